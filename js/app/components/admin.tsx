@@ -23,6 +23,8 @@ export default function AdminPage() {
   const [loading, setLoading] = useState(false);
   const toast = useToastController();
   const [streamKey, setStreamKey] = useState("");
+  const [srtStreamId, setSrtStreamId] = useState("");
+  const [server, setServer] = useState("");
   const disabled = loading || streamer === "" || title === "";
   return (
     <View f={1} ai="center" jc="center">
@@ -86,14 +88,20 @@ export default function AdminPage() {
           >
             {loading ? "Loading..." : "Sign message"}
           </Button>
+          <Label>
+            Server Address
+            <Input value={server} onChangeText={setServer} />
+          </Label>
           <Button
+            disabled={server === ""}
+            opacity={server === "" ? 0.5 : 1}
             onPress={async () => {
               try {
                 const message = {
                   signer: account.address,
                   time: Date.now(),
                   data: {
-                    authorized: "my-server",
+                    authorized: server,
                   },
                 };
                 const signature = await signTypedDataAsync({
@@ -108,6 +116,7 @@ export default function AdminPage() {
                   message: message,
                   signature: signature,
                 });
+                setSrtStreamId(await compactStreamKey(key));
                 key = btoa(key);
                 key = key.replaceAll("+", "-");
                 key = key.replaceAll("/", "_");
@@ -130,6 +139,12 @@ export default function AdminPage() {
             <View f={1} alignItems="stretch" maxWidth="100vw">
               <H5>Stream Key:</H5>
               <Paragraph p="$10">{streamKey}</Paragraph>
+              {srtStreamId && (
+                <>
+                  <H5>SRT Stream ID:</H5>
+                  <Paragraph p="$10">{srtStreamId}</Paragraph>
+                </>
+              )}
             </View>
           )}
         </View>
@@ -137,3 +152,18 @@ export default function AdminPage() {
     </View>
   );
 }
+
+// SRT stream ids max out at 512 bytes, so send the key raw-deflated there
+async function compactStreamKey(key: string): Promise<string> {
+  if (typeof CompressionStream === "undefined") {
+    return "";
+  }
+  const stream = new Blob([key])
+    .stream()
+    .pipeThrough(new CompressionStream("deflate-raw"));
+  const bytes = new Uint8Array(await new Response(stream).arrayBuffer());
+  let compact = btoa(String.fromCharCode(...bytes));
+  compact = compact.replaceAll("+", "-");
+  compact = compact.replaceAll("/", "_");
+  return `#!::r=${compact},m=publish`;
+}
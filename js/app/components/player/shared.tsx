@@ -32,7 +32,7 @@ export function srcToUrl(props: PlayerProps): {
     }
     let outUrl;
     if (props.protocol === PROTOCOL_HLS) {
-      outUrl = `${url}/api/playback/${props.src}/hls/stream.m3u8`;
+      outUrl = `${url}/api/playback/${props.src}/hls/index.m3u8`;
     } else if (props.protocol === PROTOCOL_PROGRESSIVE_MP4) {
       outUrl = `${url}/api/playback/${props.src}/stream.mp4`;
     } else if (props.protocol === PROTOCOL_PROGRESSIVE_WEBM) {
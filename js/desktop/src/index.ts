@@ -123,7 +123,7 @@ if (require("electron-squirrel-startup")) {
       const definitions = [
         {
           name: "hls",
-          src: "/hls/stream.m3u8",
+          src: "/hls/index.m3u8",
         },
         {
           name: "progressive-mp4",
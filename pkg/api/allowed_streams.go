@@ -0,0 +1,108 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"aquareum.tv/aquareum/pkg/crypto/aqpub"
+	apierrors "aquareum.tv/aquareum/pkg/errors"
+	"aquareum.tv/aquareum/pkg/log"
+	"aquareum.tv/aquareum/pkg/model"
+	v0 "aquareum.tv/aquareum/pkg/schema/v0"
+)
+
+// how old an admin's signed update can be when it reaches us
+const ADMIN_UPDATE_MAX_AGE = 5 * time.Minute
+
+type allowedStreamsResponse struct {
+	// from the allowed-streams flag; can't be changed over the API
+	Static []string `json:"static"`
+	// added by an admin
+	Dynamic []string `json:"dynamic"`
+}
+
+func (a *AquareumAPI) HandleAllowedStreams(ctx context.Context) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		streams, err := a.Model.ListAllowedStreams()
+		if err != nil {
+			apierrors.WriteHTTPInternalServerError(w, "unable to list allowed streams", err)
+			return
+		}
+		res := allowedStreamsResponse{Static: []string{}, Dynamic: []string{}}
+		for _, pub := range a.CLI.AllowedStreams {
+			res.Static = append(res.Static, pub.String())
+		}
+		for _, stream := range streams {
+			res.Dynamic = append(res.Dynamic, stream.Address)
+		}
+		bs, err := json.Marshal(res)
+		if err != nil {
+			apierrors.WriteHTTPInternalServerError(w, "unable to marshal json", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(bs)
+	}
+}
+
+// add or remove a streamer, given a v0.AllowedStreamUpdate signed by the admin
+// whose action matches this endpoint
+func (a *AquareumAPI) HandleAllowedStreamUpdate(ctx context.Context, action string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		payload, err := io.ReadAll(req.Body)
+		if err != nil {
+			apierrors.WriteHTTPBadRequest(w, "error reading body", err)
+			return
+		}
+		signed, err := a.Signer.Verify(payload)
+		if err != nil {
+			apierrors.WriteHTTPBadRequest(w, "could not verify signature on payload", err)
+			return
+		}
+		update, ok := signed.Data().(*v0.AllowedStreamUpdate)
+		if !ok {
+			apierrors.WriteHTTPBadRequest(w, "not an allowed stream update", nil)
+			return
+		}
+		if !strings.EqualFold(signed.Signer(), a.CLI.AdminAccount) {
+			log.Log(ctx, "wrong user tried to update allowed streams", "signer", signed.Signer(), "admin", a.CLI.AdminAccount)
+			apierrors.WriteHTTPForbidden(w, "admins only", nil)
+			return
+		}
+		if update.Action != action {
+			apierrors.WriteHTTPBadRequest(w, fmt.Sprintf("expected action=%s, got action=%s", action, update.Action), nil)
+			return
+		}
+		age := time.Since(time.UnixMilli(signed.Time()))
+		if age > ADMIN_UPDATE_MAX_AGE || age < -ADMIN_UPDATE_MAX_AGE {
+			apierrors.WriteHTTPBadRequest(w, "signed update is too old or too far in the future", fmt.Errorf("age=%s", age))
+			return
+		}
+		pub, err := aqpub.FromHexString(update.Address)
+		if err != nil {
+			apierrors.WriteHTTPBadRequest(w, "invalid address", err)
+			return
+		}
+		applied, err := a.Model.UpdateAllowedStream(&model.AllowedStream{
+			Address:    pub.String(),
+			Allowed:    action == v0.ALLOWED_STREAM_ADD,
+			SignedTime: signed.Time(),
+			UpdatedBy:  strings.ToLower(signed.Signer()),
+		})
+		if err != nil {
+			apierrors.WriteHTTPInternalServerError(w, "unable to update allowed streams", err)
+			return
+		}
+		if !applied {
+			apierrors.WriteHTTPConflict(w, "a newer update for this address has already been applied", nil)
+			return
+		}
+		log.Log(ctx, "updated allowed streams", "address", pub.String(), "action", action)
+		w.WriteHeader(204)
+	}
+}
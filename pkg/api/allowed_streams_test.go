@@ -0,0 +1,123 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"aquareum.tv/aquareum/pkg/config"
+	"aquareum.tv/aquareum/pkg/crypto/signers/eip712"
+	"aquareum.tv/aquareum/pkg/crypto/signers/eip712/eip712test"
+	"aquareum.tv/aquareum/pkg/model"
+	v0 "aquareum.tv/aquareum/pkg/schema/v0"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAllowedStreamsHandler(t *testing.T) {
+	eip712test.WithTestSigner(func(signer *eip712.EIP712Signer) {
+		streamer := "0x156118110dcd4b7c91fc1f4200691d4b6e3bcaf7"
+		tests := []struct {
+			name         string
+			adminAccount string
+			method       string
+			update       v0.AllowedStreamUpdate
+			responseCode int
+			allowed      bool
+		}{
+			{
+				name:         "add",
+				adminAccount: signer.Opts.EthAccountAddr,
+				method:       "POST",
+				update:       v0.AllowedStreamUpdate{Address: streamer, Action: v0.ALLOWED_STREAM_ADD},
+				responseCode: 204,
+				allowed:      true,
+			},
+			{
+				name:         "not the admin",
+				adminAccount: "0x156118110DcD4b7c91fC1F4200691d4b6e3BcaF7",
+				method:       "POST",
+				update:       v0.AllowedStreamUpdate{Address: streamer, Action: v0.ALLOWED_STREAM_ADD},
+				responseCode: 403,
+			},
+			{
+				name:         "action doesn't match method",
+				adminAccount: signer.Opts.EthAccountAddr,
+				method:       "DELETE",
+				update:       v0.AllowedStreamUpdate{Address: streamer, Action: v0.ALLOWED_STREAM_ADD},
+				responseCode: 400,
+			},
+			{
+				name:         "bad address",
+				adminAccount: signer.Opts.EthAccountAddr,
+				method:       "POST",
+				update:       v0.AllowedStreamUpdate{Address: "@aquareum.tv", Action: v0.ALLOWED_STREAM_ADD},
+				responseCode: 400,
+			},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				mod, err := model.MakeDB(":memory:")
+				require.NoError(t, err)
+				cli := &config.CLI{AdminAccount: tt.adminAccount}
+				a := AquareumAPI{CLI: cli, Model: mod, Signer: signer}
+				action := v0.ALLOWED_STREAM_ADD
+				if tt.method == "DELETE" {
+					action = v0.ALLOWED_STREAM_REMOVE
+				}
+				signed, err := signer.SignMessage(tt.update)
+				require.NoError(t, err)
+				req := httptest.NewRequest(tt.method, "https://aquareum.tv/api/allowed-streams", bytes.NewReader(signed))
+				rr := httptest.NewRecorder()
+				a.HandleAllowedStreamUpdate(context.Background(), action).ServeHTTP(rr, req)
+				require.Equal(t, tt.responseCode, rr.Code)
+				allowed, err := mod.IsAllowedStream(streamer)
+				require.NoError(t, err)
+				require.Equal(t, tt.allowed, allowed)
+			})
+		}
+
+		t.Run("replay", func(t *testing.T) {
+			mod, err := model.MakeDB(":memory:")
+			require.NoError(t, err)
+			cli := &config.CLI{AdminAccount: signer.Opts.EthAccountAddr}
+			a := AquareumAPI{CLI: cli, Model: mod, Signer: signer}
+			add, err := signer.SignMessage(v0.AllowedStreamUpdate{Address: streamer, Action: v0.ALLOWED_STREAM_ADD})
+			require.NoError(t, err)
+			// signed times are in milliseconds, make sure the remove is newer
+			time.Sleep(2 * time.Millisecond)
+			remove, err := signer.SignMessage(v0.AllowedStreamUpdate{Address: streamer, Action: v0.ALLOWED_STREAM_REMOVE})
+			require.NoError(t, err)
+			steps := []struct {
+				method  string
+				action  string
+				body    []byte
+				code    int
+				allowed bool
+			}{
+				{"POST", v0.ALLOWED_STREAM_ADD, add, 204, true},
+				{"DELETE", v0.ALLOWED_STREAM_REMOVE, remove, 204, false},
+				// replaying the older add must not undo the remove
+				{"POST", v0.ALLOWED_STREAM_ADD, add, 409, false},
+			}
+			for _, step := range steps {
+				req := httptest.NewRequest(step.method, "https://aquareum.tv/api/allowed-streams", bytes.NewReader(step.body))
+				rr := httptest.NewRecorder()
+				a.HandleAllowedStreamUpdate(context.Background(), step.action).ServeHTTP(rr, req)
+				require.Equal(t, step.code, rr.Code)
+				allowed, err := mod.IsAllowedStream(streamer)
+				require.NoError(t, err)
+				require.Equal(t, step.allowed, allowed)
+			}
+
+			rr := httptest.NewRecorder()
+			a.HandleAllowedStreams(context.Background()).ServeHTTP(rr, httptest.NewRequest("GET", "https://aquareum.tv/api/allowed-streams", nil))
+			require.Equal(t, 200, rr.Code)
+			var res allowedStreamsResponse
+			require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &res))
+			require.Empty(t, res.Dynamic)
+		})
+	})
+}
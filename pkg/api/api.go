@@ -1,6 +1,7 @@
 package api
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -11,13 +12,16 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/NYTimes/gziphandler"
 	"github.com/julienschmidt/httprouter"
 	"github.com/rs/cors"
 	sloghttp "github.com/samber/slog-http"
+	"golang.org/x/time/rate"
 
 	"aquareum.tv/aquareum/js/app"
 	"aquareum.tv/aquareum/pkg/config"
@@ -28,7 +32,9 @@ import (
 	"aquareum.tv/aquareum/pkg/mist/mistconfig"
 	"aquareum.tv/aquareum/pkg/model"
 	"aquareum.tv/aquareum/pkg/notifications"
+	"aquareum.tv/aquareum/pkg/replication"
 	v0 "aquareum.tv/aquareum/pkg/schema/v0"
+	"aquareum.tv/aquareum/pkg/storage"
 )
 
 type AquareumAPI struct {
@@ -40,11 +46,20 @@ type AquareumAPI struct {
 	FirebaseNotifier notifications.FirebaseNotifier
 	MediaManager     *media.MediaManager
 	MediaSigner      *media.MediaSigner
+	SegmentStore     storage.SegmentStore
+	Replicator       replication.Replicator
 	// not thread-safe yet
 	Aliases map[string]string
+
+	peerLimiters    map[string]*rate.Limiter
+	peerLimitersMut sync.Mutex
+	whipSessions    map[string]*whipSession
+	whipSessionsMut sync.Mutex
+	whepSessions    map[string]*whepSession
+	whepSessionsMut sync.Mutex
 }
 
-func MakeAquareumAPI(cli *config.CLI, mod model.Model, signer *eip712.EIP712Signer, noter notifications.FirebaseNotifier, mm *media.MediaManager, ms *media.MediaSigner) (*AquareumAPI, error) {
+func MakeAquareumAPI(cli *config.CLI, mod model.Model, signer *eip712.EIP712Signer, noter notifications.FirebaseNotifier, mm *media.MediaManager, ms *media.MediaSigner, store storage.SegmentStore, rep replication.Replicator) (*AquareumAPI, error) {
 	updater, err := PrepareUpdater(cli)
 	if err != nil {
 		return nil, err
@@ -56,6 +71,8 @@ func MakeAquareumAPI(cli *config.CLI, mod model.Model, signer *eip712.EIP712Sign
 		FirebaseNotifier: noter,
 		MediaManager:     mm,
 		MediaSigner:      ms,
+		SegmentStore:     store,
+		Replicator:       rep,
 		Aliases:          map[string]string{},
 	}
 	a.Mimes, err = updater.GetMimes()
@@ -102,22 +119,38 @@ func (a *AquareumAPI) Handler(ctx context.Context) (http.Handler, error) {
 	// new ones
 	apiRouter.HandlerFunc("GET", "/api/manifest", a.HandleAppUpdates(ctx))
 	apiRouter.GET("/api/desktop-updates/:platform/:architecture/:version/:buildTime/:file", a.HandleDesktopUpdates(ctx))
-	apiRouter.POST("/api/webrtc/:stream", a.MistProxyHandler(ctx, "/webrtc/%s"))
-	apiRouter.OPTIONS("/api/webrtc/:stream", a.MistProxyHandler(ctx, "/webrtc/%s"))
-	apiRouter.DELETE("/api/webrtc/:stream", a.MistProxyHandler(ctx, "/webrtc/%s"))
+	apiRouter.POST("/api/webrtc/:stream", a.HandleWebRTCPlayback(ctx))
+	apiRouter.OPTIONS("/api/webrtc/:stream", a.HandleWebRTCPlayback(ctx))
+	apiRouter.DELETE("/api/webrtc/:stream", a.HandleWebRTCPlayback(ctx))
+	apiRouter.POST("/api/whip/:key", a.HandleWHIP(ctx))
+	apiRouter.DELETE("/api/whip/:key/:session", a.HandleWHIPDelete(ctx))
+	apiRouter.POST("/api/whep/:user", a.HandleWHEP(ctx))
+	apiRouter.OPTIONS("/api/whep/:user", a.HandleWHEPOptions(ctx))
+	apiRouter.DELETE("/api/whep/:user/:session", a.HandleWHEPDelete(ctx))
 	apiRouter.GET("/api/hls/:stream/*resource", a.MistProxyHandler(ctx, "/hls/%s"))
 	apiRouter.Handler("POST", "/api/segment", a.HandleSegment(ctx))
+	apiRouter.GET("/api/segment/:id", a.HandleSegmentDownload(ctx))
+	apiRouter.GET("/api/segments/:user", a.HandleSegmentInventory(ctx))
+	apiRouter.HandlerFunc("GET", "/api/allowed-streams", a.HandleAllowedStreams(ctx))
+	apiRouter.HandlerFunc("POST", "/api/allowed-streams", a.HandleAllowedStreamUpdate(ctx, v0.ALLOWED_STREAM_ADD))
+	apiRouter.HandlerFunc("DELETE", "/api/allowed-streams", a.HandleAllowedStreamUpdate(ctx, v0.ALLOWED_STREAM_REMOVE))
 	apiRouter.HandlerFunc("GET", "/api/healthz", a.HandleHealthz(ctx))
 	apiRouter.GET("/api/playback/:user/stream.mp4", a.HandleMP4Playback(ctx))
 	apiRouter.GET("/api/playback/:user/stream.webm", a.HandleMKVPlayback(ctx))
 	apiRouter.GET("/api/playback/:user/hls/:file", a.HandleHLSPlayback(ctx))
+	apiRouter.GET("/api/playback/:user/vod.mp4", a.HandleVODMP4Playback(ctx))
+	apiRouter.GET("/api/playback/:user/vod.m3u8", a.HandleVODHLSPlaylist(ctx))
+	apiRouter.GET("/api/playback/:user/vod/:file", a.HandleVODHLSSegment(ctx))
 	apiRouter.POST("/api/player-event", a.HandlePlayerEvent(ctx))
+	apiRouter.HandlerFunc("GET", "/api/live", a.HandleLiveStreams(ctx))
+	apiRouter.GET("/api/live/:user", a.HandleLiveStatus(ctx))
 	apiRouter.NotFound = a.HandleAPI404(ctx)
 	router.Handler("GET", "/api/*resource", apiRouter)
 	router.Handler("POST", "/api/*resource", apiRouter)
 	router.Handler("PUT", "/api/*resource", apiRouter)
 	router.Handler("PATCH", "/api/*resource", apiRouter)
 	router.Handler("DELETE", "/api/*resource", apiRouter)
+	router.Handler("OPTIONS", "/api/*resource", apiRouter)
 	router.GET("/dl/*params", a.HandleAppDownload(ctx))
 	router.NotFound = a.FileHandler(ctx, http.FileServer(AppHostingFS{http.FS(files)}))
 	handler := sloghttp.Recovery(router)
@@ -297,15 +330,116 @@ func (a *AquareumAPI) HandleNotification(ctx context.Context) http.HandlerFunc {
 
 func (a *AquareumAPI) HandleSegment(ctx context.Context) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
-		err := a.MediaManager.ValidateMP4(ctx, req.Body)
+		peer, hash, ok := a.authenticatePeer(w, req)
+		if !ok {
+			return
+		}
+		bs, err := io.ReadAll(req.Body)
+		if err != nil {
+			apierrors.WriteHTTPBadRequest(w, "error reading segment", err)
+			return
+		}
+		if replication.SegmentHash(bs) != hash {
+			apierrors.WriteHTTPUnauthorized(w, "peer auth is for a different segment", nil)
+			return
+		}
+		ctx := log.WithLogValues(ctx, "peer", peer)
+		err = a.MediaManager.ValidateMP4(ctx, bytes.NewReader(bs), model.SegmentSourceReplicated)
 		if err != nil {
-			apierrors.WriteHTTPBadRequest(w, "could not ingest segment", err)
+			writeSegmentError(w, err)
 			return
 		}
 		w.WriteHeader(200)
 	}
 }
 
+// map ValidateMP4's errors onto status codes, so peers can tell which are worth retrying
+func writeSegmentError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, media.ErrStreamerNotAllowed):
+		apierrors.WriteHTTPForbidden(w, "streamer not allowed", err)
+	case errors.Is(err, media.ErrSegmentDuplicate):
+		apierrors.WriteHTTPConflict(w, "duplicate segment", err)
+	case errors.Is(err, media.ErrSegmentOverlap), errors.Is(err, media.ErrSegmentOutOfOrder):
+		apierrors.WriteHTTPConflict(w, "segment conflicts with an existing segment", err)
+	case errors.Is(err, media.ErrSegmentClockSkew), errors.Is(err, media.ErrSegmentInvalidRange):
+		apierrors.WriteHTTPUnprocessableEntity(w, "segment has unacceptable timestamps", err)
+	case errors.Is(err, media.ErrSegmentTooLong):
+		apierrors.WriteHTTPUnprocessableEntity(w, "segment is too long", err)
+	case errors.Is(err, media.ErrSegmentInvalid):
+		apierrors.WriteHTTPBadRequest(w, "invalid segment", err)
+	default:
+		apierrors.WriteHTTPInternalServerError(w, "could not ingest segment", err)
+	}
+}
+
+// list the segments we have for a user in a time range, for pull replication
+func (a *AquareumAPI) HandleSegmentInventory(ctx context.Context) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		user := p.ByName("user")
+		if user == "" {
+			apierrors.WriteHTTPBadRequest(w, "user required", nil)
+			return
+		}
+		user = a.NormalizeUser(user)
+		start, end, err := parseTimeRange(r)
+		if err != nil {
+			apierrors.WriteHTTPBadRequest(w, "invalid time range", err)
+			return
+		}
+		segs, err := a.Model.ListSegments(user, start, end)
+		if err != nil {
+			apierrors.WriteHTTPInternalServerError(w, "unable to list segments", err)
+			return
+		}
+		items := []replication.InventoryItem{}
+		for _, seg := range segs {
+			items = append(items, replication.InventoryItem{
+				ID:        seg.ID,
+				User:      seg.User,
+				StartTime: seg.StartTime,
+				EndTime:   seg.EndTime,
+				Hash:      seg.Hash,
+				Size:      seg.Size,
+			})
+		}
+		bs, err := json.Marshal(items)
+		if err != nil {
+			apierrors.WriteHTTPInternalServerError(w, "unable to marshal json", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(bs)
+	}
+}
+
+// raw signed segment by ID, for pull replication
+func (a *AquareumAPI) HandleSegmentDownload(ctx context.Context) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		id := p.ByName("id")
+		seg, err := a.Model.GetSegment(id)
+		if err != nil {
+			apierrors.WriteHTTPInternalServerError(w, "unable to get segment", err)
+			return
+		}
+		if seg == nil {
+			apierrors.WriteHTTPNotFound(w, "segment not found", nil)
+			return
+		}
+		f, err := a.SegmentStore.Get(ctx, seg.Path)
+		if errors.Is(err, storage.ErrNotFound) {
+			apierrors.WriteHTTPNotFound(w, "segment not found", err)
+			return
+		}
+		if err != nil {
+			apierrors.WriteHTTPInternalServerError(w, "error fetching segment", err)
+			return
+		}
+		defer f.Close()
+		http.ServeContent(w, r, path.Base(seg.Path), seg.CreatedAt, f)
+	}
+}
+
 func (a *AquareumAPI) HandlePlayerEvent(ctx context.Context) httprouter.Handle {
 	return func(w http.ResponseWriter, req *http.Request, p httprouter.Params) {
 		var event model.PlayerEventAPI
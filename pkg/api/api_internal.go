@@ -1,10 +1,12 @@
 package api
 
 import (
-	"bufio"
+	"bytes"
+	"compress/flate"
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	goerrors "errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -18,12 +20,14 @@ import (
 
 	"aquareum.tv/aquareum/pkg/errors"
 	"aquareum.tv/aquareum/pkg/log"
+	"aquareum.tv/aquareum/pkg/media"
 	"aquareum.tv/aquareum/pkg/mist/mistconfig"
 	"aquareum.tv/aquareum/pkg/mist/misttriggers"
 	v0 "aquareum.tv/aquareum/pkg/schema/v0"
+	"aquareum.tv/aquareum/pkg/storage"
+	"github.com/google/uuid"
 	"github.com/julienschmidt/httprouter"
 	sloghttp "github.com/samber/slog-http"
-	"golang.org/x/sync/errgroup"
 )
 
 func (a *AquareumAPI) ServeInternalHTTP(ctx context.Context) error {
@@ -70,11 +74,46 @@ func (a *AquareumAPI) InternalHandler(ctx context.Context) (http.Handler, error)
 			return
 		}
 		user = a.NormalizeUser(user)
+		// ffmpeg fetches the playlist once and then loops over it, so each
+		// latest.mp4 says who's asking and picks up where they left off
+		reader, err := uuid.NewV7()
+		if err != nil {
+			errors.WriteHTTPInternalServerError(w, "error generating reader id", err)
+			return
+		}
 		w.Header().Set("content-type", "text/plain")
 		fmt.Fprintf(w, "ffconcat version 1.0\n")
 		// intermittent reports that you need two here to make things work properly? shouldn't matter.
 		for i := 0; i < 2; i += 1 {
-			fmt.Fprintf(w, "file '%s/playback/%s/latest.mp4'\n", a.CLI.OwnInternalURL(), user)
+			fmt.Fprintf(w, "file '%s/playback/%s/latest.mp4?reader=%s'\n", a.CLI.OwnInternalURL(), user, reader.String())
+		}
+	})
+
+	router.GET("/playback/:user/vod/concat", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		user := p.ByName("user")
+		if user == "" {
+			errors.WriteHTTPBadRequest(w, "user required", nil)
+			return
+		}
+		user = a.NormalizeUser(user)
+		start, end, err := parseTimeRange(r)
+		if err != nil {
+			errors.WriteHTTPBadRequest(w, "invalid time range", err)
+			return
+		}
+		segs, err := a.Model.ListSegments(user, start, end)
+		if err != nil {
+			errors.WriteHTTPInternalServerError(w, "unable to list segments", err)
+			return
+		}
+		if len(segs) == 0 {
+			errors.WriteHTTPNotFound(w, "no segments found in time range", nil)
+			return
+		}
+		w.Header().Set("content-type", "text/plain")
+		fmt.Fprintf(w, "ffconcat version 1.0\n")
+		for _, seg := range segs {
+			fmt.Fprintf(w, "file '%s/playback/%s/segment/%s.mp4'\n", a.CLI.OwnInternalURL(), user, seg.StartTime.FileSafeString())
 		}
 	})
 
@@ -85,7 +124,11 @@ func (a *AquareumAPI) InternalHandler(ctx context.Context) (http.Handler, error)
 			return
 		}
 		user = a.NormalizeUser(user)
-		file := <-a.MediaManager.SubscribeSegment(ctx, user)
+		file, err := a.MediaManager.NextSegment(r.Context(), user, r.URL.Query().Get("reader"), r.URL.Query().Get("after"))
+		if err != nil {
+			// client went away
+			return
+		}
 		w.Header().Set("Location", fmt.Sprintf("%s/playback/%s/segment/%s\n", a.CLI.OwnInternalURL(), user, file))
 		w.WriteHeader(301)
 	})
@@ -102,12 +145,84 @@ func (a *AquareumAPI) InternalHandler(ctx context.Context) (http.Handler, error)
 			errors.WriteHTTPBadRequest(w, "file required", nil)
 			return
 		}
-		fullpath, err := a.CLI.SegmentFilePath(user, file)
+		key, aqt, err := storage.SegmentFileKey(user, file)
 		if err != nil {
 			errors.WriteHTTPBadRequest(w, "badly formatted request", err)
 			return
 		}
-		http.ServeFile(w, r, fullpath)
+		seg, err := a.SegmentStore.Get(ctx, key)
+		if goerrors.Is(err, storage.ErrNotFound) {
+			errors.WriteHTTPNotFound(w, "segment not found", err)
+			return
+		}
+		if err != nil {
+			errors.WriteHTTPInternalServerError(w, "error fetching segment", err)
+			return
+		}
+		defer seg.Close()
+		err = a.Model.TouchSegment(user, aqt)
+		if err != nil {
+			log.Error(ctx, "error marking segment as accessed", "file", file, "error", err)
+		}
+		http.ServeContent(w, r, file, time.Time{}, seg)
+	})
+
+	router.GET("/playback/:user/rendition/:rendition/concat", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		user := p.ByName("user")
+		if user == "" {
+			errors.WriteHTTPBadRequest(w, "user required", nil)
+			return
+		}
+		user = a.NormalizeUser(user)
+		rendition := p.ByName("rendition")
+		reader, err := uuid.NewV7()
+		if err != nil {
+			errors.WriteHTTPInternalServerError(w, "error generating reader id", err)
+			return
+		}
+		w.Header().Set("content-type", "text/plain")
+		fmt.Fprintf(w, "ffconcat version 1.0\n")
+		for i := 0; i < 2; i += 1 {
+			fmt.Fprintf(w, "file '%s/playback/%s/rendition/%s/latest.mp4?reader=%s'\n", a.CLI.OwnInternalURL(), user, rendition, reader.String())
+		}
+	})
+
+	router.GET("/playback/:user/rendition/:rendition/latest.mp4", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		user := p.ByName("user")
+		if user == "" {
+			errors.WriteHTTPBadRequest(w, "user required", nil)
+			return
+		}
+		user = a.NormalizeUser(user)
+		rendition := p.ByName("rendition")
+		file, err := a.MediaManager.NextRenditionSegment(r.Context(), user, rendition, r.URL.Query().Get("reader"), r.URL.Query().Get("after"))
+		if err != nil {
+			return
+		}
+		w.Header().Set("Location", fmt.Sprintf("%s/playback/%s/rendition/%s/segment/%s\n", a.CLI.OwnInternalURL(), user, rendition, file))
+		w.WriteHeader(301)
+	})
+
+	router.GET("/playback/:user/rendition/:rendition/segment/:file", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		user := p.ByName("user")
+		if user == "" {
+			errors.WriteHTTPBadRequest(w, "user required", nil)
+			return
+		}
+		user = a.NormalizeUser(user)
+		rendition := p.ByName("rendition")
+		file := p.ByName("file")
+		if file == "" {
+			errors.WriteHTTPBadRequest(w, "file required", nil)
+			return
+		}
+		// we only keep the latest few signed segments of each rendition around
+		bs := a.MediaManager.RenditionSegment(user, rendition, file)
+		if bs == nil {
+			errors.WriteHTTPNotFound(w, "rendition segment not found", nil)
+			return
+		}
+		http.ServeContent(w, r, file, time.Time{}, bytes.NewReader(bs))
 	})
 
 	router.GET("/playback/:user/stream.mkv", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
@@ -119,7 +234,7 @@ func (a *AquareumAPI) InternalHandler(ctx context.Context) (http.Handler, error)
 		user = a.NormalizeUser(user)
 		w.Header().Set("Content-Type", "video/x-matroska")
 		w.WriteHeader(200)
-		err := a.MediaManager.SegmentToMKVPlusOpus(ctx, user, w)
+		err := a.MediaManager.SharedMKV(r.Context(), user, w)
 		if err != nil {
 			log.Log(ctx, "stream.mkv error", "error", err)
 		}
@@ -148,18 +263,11 @@ func (a *AquareumAPI) InternalHandler(ctx context.Context) (http.Handler, error)
 		}
 		w.Header().Set("Content-Type", "video/mp4")
 		w.WriteHeader(200)
-		g, ctx := errgroup.WithContext(ctx)
-		pr, pw := io.Pipe()
-		bufw := bufio.NewWriter(pw)
-		g.Go(func() error {
-			return a.MediaManager.SegmentToMP4(ctx, user, bufw)
-		})
-		g.Go(func() error {
-			time.Sleep(time.Duration(delayMS) * time.Millisecond)
-			_, err := io.Copy(w, pr)
-			return err
-		})
-		g.Wait()
+		time.Sleep(time.Duration(delayMS) * time.Millisecond)
+		err := a.MediaManager.SharedMP4(r.Context(), user, w)
+		if err != nil {
+			log.Debug(ctx, "stream.mp4 ended", "error", err)
+		}
 	})
 
 	router.HEAD("/playback/:user/stream.mkv", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
@@ -195,9 +303,20 @@ func (a *AquareumAPI) InternalHandler(ctx context.Context) (http.Handler, error)
 	})
 
 	handleIncomingStream := func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		ms, err := a.streamKeySigner(ctx, p.ByName("key"))
+		if err != nil {
+			errors.WriteHTTPUnauthorized(w, "invalid stream key", err)
+			return
+		}
+		ctx := log.WithLogValues(ctx, "user", ms.UserAddress())
 		log.Log(ctx, "stream start")
-		err := a.MediaManager.IngestStream(ctx, r.Body, a.MediaSigner)
+		err = a.MediaManager.IngestStream(ctx, r.Body, ms)
 
+		if goerrors.Is(err, media.ErrUnsupportedInput) {
+			log.Log(ctx, "stream rejected", "error", err)
+			errors.WriteHTTPUnsupportedMediaType(w, err.Error(), err)
+			return
+		}
 		if err != nil {
 			log.Log(ctx, "stream error", "error", err)
 			errors.WriteHTTPInternalServerError(w, "stream error", err)
@@ -206,7 +325,7 @@ func (a *AquareumAPI) InternalHandler(ctx context.Context) (http.Handler, error)
 		log.Log(ctx, "stream success", "url", r.URL.String())
 	}
 
-	// route to accept an incoming mkv stream from OBS, segment it, and push the segments back to this HTTP handler
+	// route to accept an incoming mkv, MPEG-TS or fMP4 stream from OBS, segment it, and push the segments back to this HTTP handler
 	router.POST("/stream/:key", handleIncomingStream)
 	router.PUT("/stream/:key", handleIncomingStream)
 
@@ -229,6 +348,38 @@ func (a *AquareumAPI) InternalHandler(ctx context.Context) (http.Handler, error)
 		w.Write(bs)
 	})
 
+	router.GET("/replication", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		stats, err := a.Replicator.Stats()
+		if err != nil {
+			errors.WriteHTTPInternalServerError(w, "unable to get replication stats", err)
+			return
+		}
+		bs, err := json.Marshal(stats)
+		if err != nil {
+			errors.WriteHTTPInternalServerError(w, "unable to marhsal json", err)
+			return
+		}
+		w.Write(bs)
+	})
+
+	router.GET("/segment-hub", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		bs, err := json.Marshal(a.MediaManager.SegmentHubStats())
+		if err != nil {
+			errors.WriteHTTPInternalServerError(w, "unable to marshal json", err)
+			return
+		}
+		w.Write(bs)
+	})
+
+	router.GET("/hls", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		bs, err := json.Marshal(a.MediaManager.HLSSessions())
+		if err != nil {
+			errors.WriteHTTPInternalServerError(w, "unable to marshal json", err)
+			return
+		}
+		w.Write(bs)
+	})
+
 	router.DELETE("/player-events", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		err := a.Model.ClearPlayerEvents()
 		if err != nil {
@@ -243,18 +394,49 @@ func (a *AquareumAPI) InternalHandler(ctx context.Context) (http.Handler, error)
 	return handler, nil
 }
 
-func (a *AquareumAPI) keyToUser(ctx context.Context, key string) (string, error) {
-	payload, err := base64.URLEncoding.DecodeString(key)
+// the user that signed the provided v0.StreamKey, and the raw signed payload
+func (a *AquareumAPI) keyToUser(ctx context.Context, key string) (string, *v0.StreamKey, []byte, error) {
+	payload, err := decodeStreamKey(key)
 	if err != nil {
-		return "", err
+		return "", nil, nil, err
 	}
 	signed, err := a.Signer.Verify(payload)
 	if err != nil {
-		return "", err
+		return "", nil, nil, err
 	}
-	_, ok := signed.Data().(*v0.StreamKey)
+	sk, ok := signed.Data().(*v0.StreamKey)
 	if !ok {
-		return "", fmt.Errorf("got signed data but it wasn't a stream key")
+		return "", nil, nil, fmt.Errorf("got signed data but it wasn't a stream key")
+	}
+	return strings.ToLower(signed.Signer()), sk, payload, nil
+}
+
+// stream keys are base64url signed JSON. protocols with a short stream id (SRT
+// caps it at 512 bytes) can instead send the JSON raw-deflated first.
+func decodeStreamKey(key string) ([]byte, error) {
+	bs, err := base64.URLEncoding.DecodeString(key)
+	if err != nil {
+		return nil, err
+	}
+	if json.Valid(bs) {
+		return bs, nil
+	}
+	return io.ReadAll(flate.NewReader(bytes.NewReader(bs)))
+}
+
+// media signer for an incoming stream. a stream key from our own account gets
+// our signer as-is; anyone else's has to authorize our media signing address,
+// and we sign on their behalf with the key embedded in each segment.
+func (a *AquareumAPI) streamKeySigner(ctx context.Context, key string) (*media.MediaSigner, error) {
+	user, sk, payload, err := a.keyToUser(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if user == a.MediaSigner.Pub.String() {
+		return a.MediaSigner, nil
+	}
+	if !strings.EqualFold(sk.Authorized, a.MediaSigner.Pub.String()) {
+		return nil, fmt.Errorf("stream key from %s authorizes %s, not this node (%s)", user, sk.Authorized, a.MediaSigner.Pub.String())
 	}
-	return strings.ToLower(signed.Signer()), nil
+	return a.MediaSigner.Delegate(user, payload), nil
 }
@@ -0,0 +1,80 @@
+package api
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/base64"
+	"testing"
+
+	"aquareum.tv/aquareum/pkg/crypto/aqpub"
+	"aquareum.tv/aquareum/pkg/crypto/signers/eip712"
+	"aquareum.tv/aquareum/pkg/crypto/signers/eip712/eip712test"
+	"aquareum.tv/aquareum/pkg/media"
+	v0 "aquareum.tv/aquareum/pkg/schema/v0"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamKeySigner(t *testing.T) {
+	eip712test.WithTestSigner(func(signer *eip712.EIP712Signer) {
+		user, err := aqpub.FromHexString(signer.Hex())
+		require.NoError(t, err)
+		node, err := aqpub.FromHexString("0x156118110dcd4b7c91fc1f4200691d4b6e3bcaf7")
+		require.NoError(t, err)
+		streamKey := func(authorized string) string {
+			bs, err := signer.SignMessage(v0.StreamKey{Authorized: authorized})
+			require.NoError(t, err)
+			return base64.URLEncoding.EncodeToString(bs)
+		}
+
+		t.Run("our own account", func(t *testing.T) {
+			ms := &media.MediaSigner{Pub: user}
+			a := AquareumAPI{Signer: signer, MediaSigner: ms}
+			got, err := a.streamKeySigner(context.Background(), streamKey("anything"))
+			require.NoError(t, err)
+			require.Same(t, ms, got)
+		})
+
+		t.Run("delegated to this node", func(t *testing.T) {
+			ms := &media.MediaSigner{Pub: node}
+			a := AquareumAPI{Signer: signer, MediaSigner: ms}
+			got, err := a.streamKeySigner(context.Background(), streamKey("0x156118110DcD4b7c91fC1F4200691d4b6e3BcaF7"))
+			require.NoError(t, err)
+			require.Equal(t, user.String(), got.UserAddress())
+			require.Equal(t, node, got.Pub)
+			require.NotEmpty(t, got.StreamKey)
+			require.Empty(t, ms.User, "node signer should be left alone")
+		})
+
+		t.Run("delegated to another node", func(t *testing.T) {
+			a := AquareumAPI{Signer: signer, MediaSigner: &media.MediaSigner{Pub: node}}
+			_, err := a.streamKeySigner(context.Background(), streamKey("my-server"))
+			require.Error(t, err)
+		})
+
+		t.Run("compressed key", func(t *testing.T) {
+			bs, err := signer.SignMessage(v0.StreamKey{Authorized: node.String()})
+			require.NoError(t, err)
+			var buf bytes.Buffer
+			fw, err := flate.NewWriter(&buf, flate.BestCompression)
+			require.NoError(t, err)
+			_, err = fw.Write(bs)
+			require.NoError(t, err)
+			require.NoError(t, fw.Close())
+			key := base64.URLEncoding.EncodeToString(buf.Bytes())
+			require.Less(t, len(key), 512, "should fit in an SRT streamid")
+
+			a := AquareumAPI{Signer: signer, MediaSigner: &media.MediaSigner{Pub: node}}
+			got, err := a.streamKeySigner(context.Background(), key)
+			require.NoError(t, err)
+			require.Equal(t, user.String(), got.UserAddress())
+			require.Equal(t, bs, got.StreamKey)
+		})
+
+		t.Run("garbage", func(t *testing.T) {
+			a := AquareumAPI{Signer: signer, MediaSigner: &media.MediaSigner{Pub: node}}
+			_, err := a.streamKeySigner(context.Background(), "not-a-stream-key")
+			require.Error(t, err)
+		})
+	})
+}
@@ -0,0 +1,47 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	apierrors "aquareum.tv/aquareum/pkg/errors"
+	"github.com/julienschmidt/httprouter"
+)
+
+// everyone who's streaming right now
+func (a *AquareumAPI) HandleLiveStreams(ctx context.Context) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		bs, err := json.Marshal(a.MediaManager.LiveStreams())
+		if err != nil {
+			apierrors.WriteHTTPInternalServerError(w, "unable to marshal json", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(bs)
+	}
+}
+
+// whether a user is live, so the app knows to show a player or an offline screen
+func (a *AquareumAPI) HandleLiveStatus(ctx context.Context) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		user := p.ByName("user")
+		if user == "" {
+			apierrors.WriteHTTPBadRequest(w, "user required", nil)
+			return
+		}
+		user = a.NormalizeUser(user)
+		status, err := a.MediaManager.StreamStatus(user)
+		if err != nil {
+			apierrors.WriteHTTPInternalServerError(w, "unable to get stream status", err)
+			return
+		}
+		bs, err := json.Marshal(status)
+		if err != nil {
+			apierrors.WriteHTTPInternalServerError(w, "unable to marshal json", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(bs)
+	}
+}
@@ -0,0 +1,88 @@
+package api
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	apierrors "aquareum.tv/aquareum/pkg/errors"
+	"aquareum.tv/aquareum/pkg/replication"
+	v0 "aquareum.tv/aquareum/pkg/schema/v0"
+	"golang.org/x/time/rate"
+)
+
+// how far the time on a peer's signed header can be from ours
+const PEER_AUTH_MAX_SKEW = 5 * time.Minute
+
+// check the signed header on a segment pushed by a peer, returning the peer and
+// the hash of the segment they're vouching for. writes an error response and
+// returns false if the peer shouldn't be trusted.
+func (a *AquareumAPI) authenticatePeer(w http.ResponseWriter, r *http.Request) (string, string, bool) {
+	header := r.Header.Get(replication.PEER_AUTH_HEADER)
+	if header == "" {
+		apierrors.WriteHTTPUnauthorized(w, fmt.Sprintf("%s header required", replication.PEER_AUTH_HEADER), nil)
+		return "", "", false
+	}
+	payload, err := base64.URLEncoding.DecodeString(header)
+	if err != nil {
+		apierrors.WriteHTTPUnauthorized(w, "badly formatted peer auth", err)
+		return "", "", false
+	}
+	signed, err := a.Signer.Verify(payload)
+	if err != nil {
+		apierrors.WriteHTTPUnauthorized(w, "invalid peer auth signature", err)
+		return "", "", false
+	}
+	if len(a.CLI.PeerAllowlist) == 0 {
+		apierrors.WriteHTTPUnauthorized(w, "this node isn't accepting segments from peers, see --peer-allowlist", nil)
+		return "", "", false
+	}
+	upload, ok := signed.Data().(*v0.SegmentUpload)
+	if !ok {
+		apierrors.WriteHTTPUnauthorized(w, "got signed data but it wasn't a segment upload", nil)
+		return "", "", false
+	}
+	if upload.Method != r.Method || upload.Path != r.URL.Path {
+		apierrors.WriteHTTPUnauthorized(w, "peer auth was signed for a different request", fmt.Errorf("signed for %s %s", upload.Method, upload.Path))
+		return "", "", false
+	}
+	peer := strings.ToLower(signed.Signer())
+	allowed := false
+	for _, pub := range a.CLI.PeerAllowlist {
+		if pub.String() == peer {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		// an unknown peer is as unauthenticated as a bad signature
+		apierrors.WriteHTTPUnauthorized(w, fmt.Sprintf("peer %s is not in peer-allowlist", peer), nil)
+		return "", "", false
+	}
+	skew := time.Since(time.UnixMilli(signed.Time()))
+	if skew > PEER_AUTH_MAX_SKEW || skew < -PEER_AUTH_MAX_SKEW {
+		apierrors.WriteHTTPUnauthorized(w, "peer auth is too old or too far in the future", fmt.Errorf("skew=%s", skew))
+		return "", "", false
+	}
+	if !a.peerLimiter(peer).Allow() {
+		apierrors.WriteHTTPTooManyRequests(w, fmt.Sprintf("peer %s is pushing segments too quickly", peer), nil)
+		return "", "", false
+	}
+	return peer, upload.Hash, true
+}
+
+func (a *AquareumAPI) peerLimiter(peer string) *rate.Limiter {
+	a.peerLimitersMut.Lock()
+	defer a.peerLimitersMut.Unlock()
+	if a.peerLimiters == nil {
+		a.peerLimiters = map[string]*rate.Limiter{}
+	}
+	limiter, ok := a.peerLimiters[peer]
+	if !ok {
+		limiter = rate.NewLimiter(rate.Limit(a.CLI.PeerRateLimit), a.CLI.PeerRateBurst)
+		a.peerLimiters[peer] = limiter
+	}
+	return limiter
+}
@@ -0,0 +1,76 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"aquareum.tv/aquareum/pkg/config"
+	"aquareum.tv/aquareum/pkg/crypto/aqpub"
+	"aquareum.tv/aquareum/pkg/crypto/signers/eip712"
+	"aquareum.tv/aquareum/pkg/crypto/signers/eip712/eip712test"
+	"aquareum.tv/aquareum/pkg/replication"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSegmentPeerAuth(t *testing.T) {
+	eip712test.WithTestSigner(func(signer *eip712.EIP712Signer) {
+		me, err := aqpub.FromHexString(signer.Hex())
+		require.NoError(t, err)
+		stranger, err := aqpub.FromHexString("0x156118110dcd4b7c91fc1f4200691d4b6e3bcaf7")
+		require.NoError(t, err)
+		segment := []byte("pretend this is a signed mp4")
+		hash := replication.SegmentHash(segment)
+		auth, err := replication.PeerAuthHeader(signer, "POST", "/api/segment", hash)
+		require.NoError(t, err)
+		wrongAuth, err := replication.PeerAuthHeader(signer, "POST", "/api/segment", replication.SegmentHash([]byte("something else")))
+		require.NoError(t, err)
+		wrongPath, err := replication.PeerAuthHeader(signer, "POST", "/api/somewhere-else", hash)
+		require.NoError(t, err)
+
+		tests := []struct {
+			name         string
+			allowlist    []aqpub.Pub
+			header       string
+			responseCode int
+		}{
+			{name: "no header", allowlist: []aqpub.Pub{me}, header: "", responseCode: 401},
+			{name: "garbage header", allowlist: []aqpub.Pub{me}, header: "not-a-signature", responseCode: 401},
+			{name: "not allowlisted", allowlist: []aqpub.Pub{stranger}, header: auth, responseCode: 401},
+			{name: "wrong segment", allowlist: []aqpub.Pub{me}, header: wrongAuth, responseCode: 401},
+			{name: "wrong path", allowlist: []aqpub.Pub{me}, header: wrongPath, responseCode: 401},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				cli := &config.CLI{PeerAllowlist: tt.allowlist, PeerRateLimit: 1, PeerRateBurst: 1}
+				a := AquareumAPI{CLI: cli, Signer: signer}
+				req := httptest.NewRequest("POST", "https://aquareum.tv/api/segment", bytes.NewReader(segment))
+				if tt.header != "" {
+					req.Header.Set(replication.PEER_AUTH_HEADER, tt.header)
+				}
+				rr := httptest.NewRecorder()
+				a.HandleSegment(context.Background()).ServeHTTP(rr, req)
+				require.Equal(t, tt.responseCode, rr.Code)
+			})
+		}
+
+		t.Run("rate limit", func(t *testing.T) {
+			cli := &config.CLI{PeerAllowlist: []aqpub.Pub{me}, PeerRateLimit: 0.001, PeerRateBurst: 1}
+			a := AquareumAPI{CLI: cli, Signer: signer}
+			for i, code := range []int{200, 429} {
+				req := httptest.NewRequest("POST", "https://aquareum.tv/api/segment", bytes.NewReader(segment))
+				req.Header.Set(replication.PEER_AUTH_HEADER, auth)
+				rr := httptest.NewRecorder()
+				peer, gotHash, ok := a.authenticatePeer(rr, req)
+				require.Equal(t, i == 0, ok)
+				if ok {
+					require.Equal(t, me.String(), peer)
+					require.Equal(t, hash, gotHash)
+					continue
+				}
+				require.Equal(t, code, rr.Code)
+			}
+		})
+	})
+}
@@ -1,18 +1,22 @@
 package api
 
 import (
-	"bufio"
 	"context"
-	"io"
+	goerrors "errors"
+	"fmt"
+	"math"
 	"net/http"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
+	"aquareum.tv/aquareum/pkg/aqtime"
 	"aquareum.tv/aquareum/pkg/errors"
+	"aquareum.tv/aquareum/pkg/log"
+	"aquareum.tv/aquareum/pkg/media"
+	"aquareum.tv/aquareum/pkg/storage"
 	"github.com/julienschmidt/httprouter"
-	"golang.org/x/sync/errgroup"
 )
 
 func (a *AquareumAPI) NormalizeUser(user string) string {
@@ -48,18 +52,11 @@ func (a *AquareumAPI) HandleMP4Playback(ctx context.Context) httprouter.Handle {
 		}
 		w.Header().Set("Content-Type", "video/mp4")
 		w.WriteHeader(200)
-		g, ctx := errgroup.WithContext(ctx)
-		pr, pw := io.Pipe()
-		bufw := bufio.NewWriter(pw)
-		g.Go(func() error {
-			return a.MediaManager.SegmentToMP4(ctx, user, bufw)
-		})
-		g.Go(func() error {
-			time.Sleep(time.Duration(delayMS) * time.Millisecond)
-			_, err := io.Copy(w, pr)
-			return err
-		})
-		g.Wait()
+		time.Sleep(time.Duration(delayMS) * time.Millisecond)
+		err := a.MediaManager.SharedMP4(r.Context(), user, w)
+		if err != nil {
+			log.Debug(ctx, "mp4 playback ended", "user", user, "error", err)
+		}
 	}
 }
 
@@ -87,18 +84,11 @@ func (a *AquareumAPI) HandleMKVPlayback(ctx context.Context) httprouter.Handle {
 		}
 		w.Header().Set("Content-Type", "video/mp4")
 		w.WriteHeader(200)
-		g, ctx := errgroup.WithContext(ctx)
-		pr, pw := io.Pipe()
-		bufw := bufio.NewWriter(pw)
-		g.Go(func() error {
-			return a.MediaManager.SegmentToMKVPlusOpus(ctx, user, bufw)
-		})
-		g.Go(func() error {
-			time.Sleep(time.Duration(delayMS) * time.Millisecond)
-			_, err := io.Copy(w, pr)
-			return err
-		})
-		g.Wait()
+		time.Sleep(time.Duration(delayMS) * time.Millisecond)
+		err := a.MediaManager.SharedMKV(r.Context(), user, w)
+		if err != nil {
+			log.Debug(ctx, "mkv playback ended", "user", user, "error", err)
+		}
 	}
 }
 
@@ -121,7 +111,244 @@ func (a *AquareumAPI) HandleHLSPlayback(ctx context.Context) httprouter.Handle {
 			return
 		}
 		dir := getDir()
+		if a.CLI.HLSLowLatency && file != media.HLS_MASTER_PLAYLIST {
+			a.serveLLHLS(w, r, user, file)
+			return
+		}
+		// media playlists get renumbered across source restarts
+		if file != media.HLS_MASTER_PLAYLIST && strings.HasSuffix(file, ".m3u8") {
+			bs, err := a.MediaManager.HLSPlaylist(user, file)
+			if goerrors.Is(err, media.ErrHLSNotFound) {
+				errors.WriteHTTPNotFound(w, "playlist not found", err)
+				return
+			}
+			if err != nil {
+				errors.WriteHTTPInternalServerError(w, "error reading playlist", err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Write(bs)
+			return
+		}
 		fullpath := filepath.Join(dir, file)
 		http.ServeFile(w, r, fullpath)
 	}
 }
+
+// serve an LL-HLS media playlist, init segment, segment or part, holding
+// playlist requests with _HLS_msn and _HLS_part until they're ready
+func (a *AquareumAPI) serveLLHLS(w http.ResponseWriter, r *http.Request, user, file string) {
+	playlist, kind, msn, part, err := media.ParseLLHLSFile(file)
+	if err != nil {
+		errors.WriteHTTPNotFound(w, "file not found", err)
+		return
+	}
+	pl, err := a.MediaManager.LLHLSPlaylist(user, playlist)
+	if err != nil {
+		errors.WriteHTTPNotFound(w, "playlist not found", err)
+		return
+	}
+	// blocking requests get three target durations to be ready
+	ctx, cancel := context.WithTimeout(r.Context(), 3*a.CLI.SegmentDuration)
+	defer cancel()
+	var bs []byte
+	switch kind {
+	case media.LLHLSFilePlaylist:
+		msn, part, err = parseBlockingReload(r)
+		if err != nil {
+			errors.WriteHTTPBadRequest(w, "invalid blocking playlist reload", err)
+			return
+		}
+		var m3u8 string
+		m3u8, err = pl.Render(ctx, msn, part)
+		bs = []byte(m3u8)
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	case media.LLHLSFileInit:
+		bs, err = pl.Init(ctx, msn)
+		w.Header().Set("Content-Type", "video/mp4")
+	case media.LLHLSFileSegment:
+		bs, err = pl.Segment(ctx, msn)
+		w.Header().Set("Content-Type", "video/mp4")
+	case media.LLHLSFilePart:
+		bs, err = pl.Part(ctx, msn, part)
+		w.Header().Set("Content-Type", "video/mp4")
+	}
+	if err != nil {
+		w.Header().Del("Content-Type")
+		writeLLHLSError(w, err)
+		return
+	}
+	if kind == media.LLHLSFilePlaylist {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	w.Write(bs)
+}
+
+// _HLS_msn and _HLS_part from a playlist request, or -1 if they're not there
+func parseBlockingReload(r *http.Request) (int, int, error) {
+	q := r.URL.Query()
+	msn, part := -1, -1
+	var err error
+	if str := q.Get("_HLS_msn"); str != "" {
+		msn, err = strconv.Atoi(str)
+		if err != nil || msn < 0 {
+			return 0, 0, fmt.Errorf("bad _HLS_msn %q", str)
+		}
+	}
+	if str := q.Get("_HLS_part"); str != "" {
+		if msn < 0 {
+			return 0, 0, fmt.Errorf("_HLS_part without _HLS_msn")
+		}
+		part, err = strconv.Atoi(str)
+		if err != nil || part < 0 {
+			return 0, 0, fmt.Errorf("bad _HLS_part %q", str)
+		}
+	}
+	return msn, part, nil
+}
+
+func writeLLHLSError(w http.ResponseWriter, err error) {
+	switch {
+	case goerrors.Is(err, media.ErrLLHLSTooFarAhead):
+		errors.WriteHTTPBadRequest(w, "too far ahead of the live edge", err)
+	case goerrors.Is(err, media.ErrLLHLSNotFound), goerrors.Is(err, media.ErrLLHLSEnded):
+		errors.WriteHTTPNotFound(w, "not found", err)
+	case goerrors.Is(err, context.DeadlineExceeded):
+		errors.WriteHTTPServiceUnavailable(w, "timed out waiting for the live edge", err)
+	default:
+		errors.WriteHTTPInternalServerError(w, "error serving LL-HLS", err)
+	}
+}
+
+// parse ?start= and ?end= query parameters for VOD requests. they're RFC 3339
+// timestamps, which comes back out in the canonical AQTime form the database
+// compares against.
+func parseTimeRange(r *http.Request) (aqtime.AQTime, aqtime.AQTime, error) {
+	start, err := time.Parse(time.RFC3339Nano, r.URL.Query().Get("start"))
+	if err != nil {
+		return "", "", fmt.Errorf("error parsing start: %w", err)
+	}
+	end, err := time.Parse(time.RFC3339Nano, r.URL.Query().Get("end"))
+	if err != nil {
+		return "", "", fmt.Errorf("error parsing end: %w", err)
+	}
+	if !end.After(start) {
+		return "", "", fmt.Errorf("end must be after start")
+	}
+	return aqtime.FromMillis(start.UnixMilli()), aqtime.FromMillis(end.UnixMilli()), nil
+}
+
+func (a *AquareumAPI) HandleVODMP4Playback(ctx context.Context) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		user := p.ByName("user")
+		if user == "" {
+			errors.WriteHTTPBadRequest(w, "user required", nil)
+			return
+		}
+		user = a.NormalizeUser(user)
+		start, end, err := parseTimeRange(r)
+		if err != nil {
+			errors.WriteHTTPBadRequest(w, "invalid time range", err)
+			return
+		}
+		segs, err := a.Model.ListSegments(user, start, end)
+		if err != nil {
+			errors.WriteHTTPInternalServerError(w, "unable to list segments", err)
+			return
+		}
+		if len(segs) == 0 {
+			errors.WriteHTTPNotFound(w, "no segments found in time range", nil)
+			return
+		}
+		w.Header().Set("Content-Type", "video/mp4")
+		w.WriteHeader(200)
+		// stop transmuxing once the viewer's gone
+		err = a.MediaManager.SegmentsToVODMP4(r.Context(), user, start, end, w)
+		if err != nil {
+			log.Log(ctx, "vod.mp4 error", "error", err)
+		}
+	}
+}
+
+func (a *AquareumAPI) HandleVODHLSPlaylist(ctx context.Context) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		user := p.ByName("user")
+		if user == "" {
+			errors.WriteHTTPBadRequest(w, "user required", nil)
+			return
+		}
+		user = a.NormalizeUser(user)
+		start, end, err := parseTimeRange(r)
+		if err != nil {
+			errors.WriteHTTPBadRequest(w, "invalid time range", err)
+			return
+		}
+		segs, err := a.Model.ListSegments(user, start, end)
+		if err != nil {
+			errors.WriteHTTPInternalServerError(w, "unable to list segments", err)
+			return
+		}
+		if len(segs) == 0 {
+			errors.WriteHTTPNotFound(w, "no segments found in time range", nil)
+			return
+		}
+		target := 1.0
+		for _, seg := range segs {
+			target = math.Max(target, seg.EndTime.Time().Sub(seg.StartTime.Time()).Seconds())
+		}
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		fmt.Fprintf(w, "#EXTM3U\n")
+		fmt.Fprintf(w, "#EXT-X-VERSION:3\n")
+		fmt.Fprintf(w, "#EXT-X-PLAYLIST-TYPE:VOD\n")
+		fmt.Fprintf(w, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(target)))
+		fmt.Fprintf(w, "#EXT-X-MEDIA-SEQUENCE:0\n")
+		for i, seg := range segs {
+			// every segment is remuxed on its own, so timestamps restart each time
+			if i > 0 {
+				fmt.Fprintf(w, "#EXT-X-DISCONTINUITY\n")
+			}
+			dur := seg.EndTime.Time().Sub(seg.StartTime.Time()).Seconds()
+			fmt.Fprintf(w, "#EXTINF:%.3f,\n", dur)
+			fmt.Fprintf(w, "vod/%s.ts\n", seg.StartTime.FileSafeString())
+		}
+		fmt.Fprintf(w, "#EXT-X-ENDLIST\n")
+	}
+}
+
+func (a *AquareumAPI) HandleVODHLSSegment(ctx context.Context) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		user := p.ByName("user")
+		if user == "" {
+			errors.WriteHTTPBadRequest(w, "user required", nil)
+			return
+		}
+		user = a.NormalizeUser(user)
+		file := p.ByName("file")
+		if filepath.Ext(file) != ".ts" {
+			errors.WriteHTTPBadRequest(w, "expected a .ts file", nil)
+			return
+		}
+		mp4File := fmt.Sprintf("%s.mp4", strings.TrimSuffix(file, ".ts"))
+		key, _, err := storage.SegmentFileKey(user, mp4File)
+		if err != nil {
+			errors.WriteHTTPBadRequest(w, "badly formatted request", err)
+			return
+		}
+		_, err = a.SegmentStore.Stat(r.Context(), key)
+		if goerrors.Is(err, storage.ErrNotFound) {
+			errors.WriteHTTPNotFound(w, "segment not found", err)
+			return
+		}
+		if err != nil {
+			errors.WriteHTTPInternalServerError(w, "error fetching segment", err)
+			return
+		}
+		w.Header().Set("Content-Type", "video/mp2t")
+		w.WriteHeader(200)
+		err = a.MediaManager.SegmentToTS(r.Context(), user, mp4File, w)
+		if err != nil {
+			log.Log(ctx, "vod segment error", "error", err)
+		}
+	}
+}
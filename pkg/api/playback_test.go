@@ -0,0 +1,85 @@
+package api
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"aquareum.tv/aquareum/pkg/aqtime"
+	"aquareum.tv/aquareum/pkg/config"
+	"aquareum.tv/aquareum/pkg/model"
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVODHLSPlaylist(t *testing.T) {
+	mod, err := model.MakeDB("sqlite://:memory:")
+	require.NoError(t, err)
+	var base int64 = 1726251017090
+	for i := 0; i < 3; i++ {
+		start := base + int64(i)*2000
+		err := mod.CreateSegment(&model.Segment{
+			ID:        aqtime.FromMillis(start).String(),
+			User:      "0xalice",
+			StartTime: aqtime.FromMillis(start),
+			EndTime:   aqtime.FromMillis(start + 2000),
+		})
+		require.NoError(t, err)
+	}
+	a := AquareumAPI{CLI: &config.CLI{}, Model: mod, Aliases: map[string]string{}}
+	handler := a.HandleVODHLSPlaylist(context.Background())
+	params := httprouter.Params{{Key: "user", Value: "0xAlice"}}
+
+	req := httptest.NewRequest("GET", "/api/playback/0xAlice/vod.m3u8?start=2024-09-13T18:10:17.090Z&end=2024-09-13T18:10:21.090Z", nil)
+	rr := httptest.NewRecorder()
+	handler(rr, req, params)
+	require.Equal(t, 200, rr.Code)
+	body := rr.Body.String()
+	require.Equal(t, 2, strings.Count(body, "#EXTINF:2.000,"))
+	require.Contains(t, body, "vod/2024-09-13T18-10-17-090Z.ts")
+	require.Contains(t, body, "#EXT-X-ENDLIST")
+
+	req = httptest.NewRequest("GET", "/api/playback/0xAlice/vod.m3u8?start=2024-09-13T18:10:21.090Z&end=2024-09-13T18:10:17.090Z", nil)
+	rr = httptest.NewRecorder()
+	handler(rr, req, params)
+	require.Equal(t, 400, rr.Code)
+
+	// the file-safe form isn't a timestamp we take
+	req = httptest.NewRequest("GET", "/api/playback/0xAlice/vod.m3u8?start=2024-09-13T18-10-17-090Z&end=2024-09-13T18:10:21.090Z", nil)
+	rr = httptest.NewRecorder()
+	handler(rr, req, params)
+	require.Equal(t, 400, rr.Code)
+
+	req = httptest.NewRequest("GET", "/api/playback/0xAlice/vod.m3u8?start=2025-09-13T18:10:17.090Z&end=2025-09-13T18:10:21.090Z", nil)
+	rr = httptest.NewRecorder()
+	handler(rr, req, params)
+	require.Equal(t, 404, rr.Code)
+}
+
+func TestParseBlockingReload(t *testing.T) {
+	tests := []struct {
+		query string
+		msn   int
+		part  int
+		err   bool
+	}{
+		{query: "", msn: -1, part: -1},
+		{query: "_HLS_msn=12", msn: 12, part: -1},
+		{query: "_HLS_msn=12&_HLS_part=3", msn: 12, part: 3},
+		{query: "_HLS_part=3", err: true},
+		{query: "_HLS_msn=-1", err: true},
+		{query: "_HLS_msn=12&_HLS_part=x", err: true},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/api/playback/0xalice/hls/stream.m3u8?"+tt.query, nil)
+		msn, part, err := parseBlockingReload(req)
+		if tt.err {
+			require.Error(t, err, tt.query)
+			continue
+		}
+		require.NoError(t, err, tt.query)
+		require.Equal(t, tt.msn, msn, tt.query)
+		require.Equal(t, tt.part, part, tt.query)
+	}
+}
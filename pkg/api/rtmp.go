@@ -0,0 +1,31 @@
+package api
+
+import (
+	"context"
+	"io"
+
+	"aquareum.tv/aquareum/pkg/log"
+	"aquareum.tv/aquareum/pkg/rtmp"
+)
+
+// accept streams from OBS's default RTMP output, authenticated by the stream key
+func (a *AquareumAPI) ServeRTMP(ctx context.Context) error {
+	if a.CLI.RTMPAddr == "" {
+		<-ctx.Done()
+		return nil
+	}
+	s := &rtmp.Server{
+		Addr: a.CLI.RTMPAddr,
+		OnPublish: func(ctx context.Context, key string) (rtmp.IngestFunc, error) {
+			ms, err := a.streamKeySigner(ctx, key)
+			if err != nil {
+				return nil, err
+			}
+			return func(ctx context.Context, flv io.Reader) error {
+				ctx = log.WithLogValues(ctx, "user", ms.UserAddress())
+				return a.MediaManager.IngestFLV(ctx, flv, ms)
+			}, nil
+		},
+	}
+	return s.ListenAndServe(ctx)
+}
@@ -0,0 +1,32 @@
+package api
+
+import (
+	"context"
+	"io"
+
+	"aquareum.tv/aquareum/pkg/log"
+	"aquareum.tv/aquareum/pkg/srt"
+)
+
+// accept MPEG-TS over SRT for publishers on lossy links, authenticated by the
+// stream key in the streamid
+func (a *AquareumAPI) ServeSRT(ctx context.Context) error {
+	if a.CLI.SRTAddr == "" {
+		<-ctx.Done()
+		return nil
+	}
+	s := &srt.Server{
+		Addr: a.CLI.SRTAddr,
+		OnPublish: func(ctx context.Context, key string) (srt.IngestFunc, error) {
+			ms, err := a.streamKeySigner(ctx, key)
+			if err != nil {
+				return nil, err
+			}
+			return func(ctx context.Context, ts io.Reader) error {
+				ctx = log.WithLogValues(ctx, "user", ms.UserAddress())
+				return a.MediaManager.IngestMPEGTS(ctx, ts, ms)
+			}, nil
+		},
+	}
+	return s.ListenAndServe(ctx)
+}
@@ -0,0 +1,227 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+
+	apierrors "aquareum.tv/aquareum/pkg/errors"
+	"aquareum.tv/aquareum/pkg/log"
+	"aquareum.tv/aquareum/pkg/media"
+	"github.com/google/uuid"
+	"github.com/julienschmidt/httprouter"
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v4"
+)
+
+// how long a WHEP viewer has to finish connecting
+const WHEP_CONNECT_TIMEOUT = 10 * time.Second
+
+type whepSession struct {
+	user   string
+	pc     *webrtc.PeerConnection
+	cancel context.CancelFunc
+}
+
+// WebRTC playback straight from the segment stream, no Mist required. the body
+// is an SDP offer; we answer with a resource URL the viewer can DELETE to stop.
+func (a *AquareumAPI) HandleWHEP(ctx context.Context) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		user := params.ByName("user")
+		if user == "" {
+			apierrors.WriteHTTPBadRequest(w, "user required", nil)
+			return
+		}
+		user = a.NormalizeUser(user)
+		mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		if mediaType != "application/sdp" {
+			apierrors.WriteHTTPUnsupportedMediaType(w, "expected application/sdp", nil)
+			return
+		}
+		offer, ok := readSDPOffer(w, req)
+		if !ok {
+			return
+		}
+		id, err := uuid.NewV7()
+		if err != nil {
+			apierrors.WriteHTTPInternalServerError(w, "error generating session id", err)
+			return
+		}
+		// the session outlives this request, so hang it off the server's context
+		ctx := log.WithLogValues(ctx, "whep", id.String(), "user", user)
+		playback, err := a.MediaManager.JoinWebRTCPlayback(ctx, user)
+		if errors.Is(err, media.ErrWebRTCCodecUnsupported) {
+			apierrors.WriteHTTPUnprocessableEntity(w, "stream can't be played over webrtc", err)
+			return
+		}
+		if errors.Is(err, media.ErrWebRTCPlaybackFull) {
+			apierrors.WriteHTTPServiceUnavailable(w, "too many webrtc viewers, try again later", err)
+			return
+		}
+		if err != nil {
+			apierrors.WriteHTTPInternalServerError(w, "error starting playback", err)
+			return
+		}
+		ctx, cancel := context.WithCancel(ctx)
+		pc, err := a.whepPeerConnection(ctx, cancel, playback)
+		if err != nil {
+			cancel()
+			a.MediaManager.LeaveWebRTCPlayback(playback)
+			apierrors.WriteHTTPInternalServerError(w, "error creating peer connection", err)
+			return
+		}
+		answer, err := sdpAnswer(pc, offer)
+		if err != nil {
+			cancel()
+			pc.Close()
+			a.MediaManager.LeaveWebRTCPlayback(playback)
+			apierrors.WriteHTTPBadRequest(w, "error negotiating session", err)
+			return
+		}
+		a.addWHEPSession(id.String(), &whepSession{user: user, pc: pc, cancel: cancel})
+		go func() {
+			select {
+			case <-ctx.Done():
+			case <-playback.Done():
+				cancel()
+			}
+			a.removeWHEPSession(id.String())
+			pc.Close()
+			a.MediaManager.LeaveWebRTCPlayback(playback)
+			log.Log(ctx, "whep session ended")
+		}()
+		log.Log(ctx, "whep session started")
+		w.Header().Set("Content-Type", "application/sdp")
+		w.Header().Set("Location", fmt.Sprintf("/api/whep/%s/%s", params.ByName("user"), id.String()))
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(answer))
+	}
+}
+
+// end a WHEP session, per the Location we handed out
+func (a *AquareumAPI) HandleWHEPDelete(ctx context.Context) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		a.whepSessionsMut.Lock()
+		sess, ok := a.whepSessions[params.ByName("session")]
+		a.whepSessionsMut.Unlock()
+		if !ok || sess.user != a.NormalizeUser(params.ByName("user")) {
+			apierrors.WriteHTTPNotFound(w, "whep session not found", nil)
+			return
+		}
+		sess.cancel()
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// what a WHEP endpoint accepts, for viewers that ask first
+func (a *AquareumAPI) HandleWHEPOptions(ctx context.Context) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		w.Header().Set("Allow", "OPTIONS, POST")
+		w.Header().Set("Accept-Post", "application/sdp")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// the player's WebRTC endpoint, proxied to Mist when we have it and served by
+// our own WHEP otherwise. sessions we start are ended at the Location we hand
+// out, so there's nothing to DELETE here.
+func (a *AquareumAPI) HandleWebRTCPlayback(ctx context.Context) httprouter.Handle {
+	mist := a.MistProxyHandler(ctx, "/webrtc/%s")
+	whep := a.HandleWHEP(ctx)
+	options := a.HandleWHEPOptions(ctx)
+	return func(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		if a.CLI.HasMist() {
+			mist(w, req, params)
+			return
+		}
+		switch req.Method {
+		case http.MethodPost:
+			whep(w, req, httprouter.Params{{Key: "user", Value: params.ByName("stream")}})
+		case http.MethodOptions:
+			options(w, req, params)
+		default:
+			apierrors.WriteHTTPNotFound(w, "whep session not found, DELETE the Location the session was created at", nil)
+		}
+	}
+}
+
+func (a *AquareumAPI) addWHEPSession(id string, sess *whepSession) {
+	a.whepSessionsMut.Lock()
+	defer a.whepSessionsMut.Unlock()
+	if a.whepSessions == nil {
+		a.whepSessions = map[string]*whepSession{}
+	}
+	a.whepSessions[id] = sess
+}
+
+func (a *AquareumAPI) removeWHEPSession(id string) {
+	a.whepSessionsMut.Lock()
+	defer a.whepSessionsMut.Unlock()
+	delete(a.whepSessions, id)
+}
+
+// send-only peer connection for one viewer of a shared playout, which starts
+// once they've connected. cancel is called when the viewer goes away.
+func (a *AquareumAPI) whepPeerConnection(ctx context.Context, cancel context.CancelFunc, playback *media.WebRTCPlayback) (*webrtc.PeerConnection, error) {
+	m := &webrtc.MediaEngine{}
+	err := registerWebRTCCodecs(m, playback.ProfileLevelID)
+	if err != nil {
+		return nil, err
+	}
+	i := &interceptor.Registry{}
+	err = webrtc.RegisterDefaultInterceptors(m, i)
+	if err != nil {
+		return nil, err
+	}
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i))
+	pc, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, err
+	}
+	for _, track := range []*webrtc.TrackLocalStaticSample{playback.Video, playback.Audio} {
+		sender, err := pc.AddTrack(track)
+		if err != nil {
+			pc.Close()
+			return nil, err
+		}
+		// the interceptors need RTCP read off the sender to do their thing
+		go func() {
+			buf := make([]byte, 1500)
+			for {
+				_, _, err := sender.Read(buf)
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	connected := make(chan struct{})
+	var once sync.Once
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		log.Debug(ctx, "whep connection state changed", "state", state.String())
+		switch state {
+		case webrtc.PeerConnectionStateConnected:
+			once.Do(func() {
+				close(connected)
+				a.MediaManager.PlayWebRTC(playback)
+			})
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			cancel()
+		}
+	})
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-connected:
+		case <-time.After(WHEP_CONNECT_TIMEOUT):
+			log.Log(ctx, "whep viewer never connected, giving up")
+			cancel()
+		}
+	}()
+	return pc, nil
+}
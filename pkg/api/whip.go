@@ -0,0 +1,258 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	apierrors "aquareum.tv/aquareum/pkg/errors"
+	"aquareum.tv/aquareum/pkg/log"
+	"aquareum.tv/aquareum/pkg/media"
+	"github.com/google/uuid"
+	"github.com/julienschmidt/httprouter"
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/intervalpli"
+	"github.com/pion/webrtc/v4"
+)
+
+// how long a WHIP publisher has to start sending both audio and video
+const WHIP_TRACK_TIMEOUT = 10 * time.Second
+
+// real SDP offers are a few KiB, anything past this isn't one
+const SDP_OFFER_LIMIT = 64 * 1024
+
+type whipSession struct {
+	key    string
+	pc     *webrtc.PeerConnection
+	cancel context.CancelFunc
+}
+
+// WebRTC publishing from browsers and OBS. the body is an SDP offer; we answer
+// with a resource URL the publisher can DELETE to stop.
+func (a *AquareumAPI) HandleWHIP(ctx context.Context) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		key := params.ByName("key")
+		ms, err := a.streamKeySigner(ctx, key)
+		if err != nil {
+			apierrors.WriteHTTPUnauthorized(w, "invalid stream key", err)
+			return
+		}
+		mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		if mediaType != "application/sdp" {
+			apierrors.WriteHTTPUnsupportedMediaType(w, "expected application/sdp", nil)
+			return
+		}
+		offer, ok := readSDPOffer(w, req)
+		if !ok {
+			return
+		}
+		id, err := uuid.NewV7()
+		if err != nil {
+			apierrors.WriteHTTPInternalServerError(w, "error generating session id", err)
+			return
+		}
+		// the session outlives this request, so hang it off the server's context
+		ctx := log.WithLogValues(ctx, "whip", id.String(), "user", ms.UserAddress())
+		ctx, cancel := context.WithCancel(ctx)
+		pc, err := a.whipPeerConnection(ctx, cancel, ms)
+		if err != nil {
+			cancel()
+			apierrors.WriteHTTPInternalServerError(w, "error creating peer connection", err)
+			return
+		}
+		answer, err := sdpAnswer(pc, offer)
+		if err != nil {
+			cancel()
+			pc.Close()
+			apierrors.WriteHTTPBadRequest(w, "error negotiating session", err)
+			return
+		}
+		a.addWHIPSession(id.String(), &whipSession{key: key, pc: pc, cancel: cancel})
+		go func() {
+			<-ctx.Done()
+			a.removeWHIPSession(id.String())
+			pc.Close()
+		}()
+		log.Log(ctx, "whip session started")
+		w.Header().Set("Content-Type", "application/sdp")
+		w.Header().Set("Location", fmt.Sprintf("/api/whip/%s/%s", key, id.String()))
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(answer))
+	}
+}
+
+// end a WHIP session, per the Location we handed out
+func (a *AquareumAPI) HandleWHIPDelete(ctx context.Context) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		a.whipSessionsMut.Lock()
+		sess, ok := a.whipSessions[params.ByName("session")]
+		a.whipSessionsMut.Unlock()
+		if !ok || sess.key != params.ByName("key") {
+			apierrors.WriteHTTPNotFound(w, "whip session not found", nil)
+			return
+		}
+		sess.cancel()
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func (a *AquareumAPI) addWHIPSession(id string, sess *whipSession) {
+	a.whipSessionsMut.Lock()
+	defer a.whipSessionsMut.Unlock()
+	if a.whipSessions == nil {
+		a.whipSessions = map[string]*whipSession{}
+	}
+	a.whipSessions[id] = sess
+}
+
+func (a *AquareumAPI) removeWHIPSession(id string) {
+	a.whipSessionsMut.Lock()
+	defer a.whipSessionsMut.Unlock()
+	delete(a.whipSessions, id)
+}
+
+// receive-only peer connection that starts ingesting once both tracks show up.
+// cancel is called when the publisher goes away or ingest ends.
+func (a *AquareumAPI) whipPeerConnection(ctx context.Context, cancel context.CancelFunc, ms *media.MediaSigner) (*webrtc.PeerConnection, error) {
+	m := &webrtc.MediaEngine{}
+	err := registerWebRTCCodecs(m, media.WEBRTC_H264_PROFILE_LEVEL_DEFAULT)
+	if err != nil {
+		return nil, err
+	}
+	i := &interceptor.Registry{}
+	// regular keyframes so segments can start cleanly
+	pli, err := intervalpli.NewReceiverInterceptor()
+	if err != nil {
+		return nil, err
+	}
+	i.Add(pli)
+	err = webrtc.RegisterDefaultInterceptors(m, i)
+	if err != nil {
+		return nil, err
+	}
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i))
+	pc, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, err
+	}
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		_, err = pc.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly})
+		if err != nil {
+			pc.Close()
+			return nil, err
+		}
+	}
+
+	var tracksMut sync.Mutex
+	var video, audio *webrtc.TrackRemote
+	started := false
+	pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		tracksMut.Lock()
+		defer tracksMut.Unlock()
+		switch {
+		case strings.EqualFold(track.Codec().MimeType, webrtc.MimeTypeH264):
+			video = track
+		case strings.EqualFold(track.Codec().MimeType, webrtc.MimeTypeOpus):
+			audio = track
+		default:
+			log.Log(ctx, "ignoring unsupported whip track", "mime", track.Codec().MimeType)
+			return
+		}
+		if video == nil || audio == nil || started {
+			return
+		}
+		started = true
+		go func() {
+			defer cancel()
+			err := a.MediaManager.IngestWebRTC(ctx, video, audio, ms)
+			if err != nil {
+				log.Log(ctx, "whip ingest error", "error", err)
+			}
+			log.Log(ctx, "whip session ended")
+		}()
+	})
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		log.Debug(ctx, "whip connection state changed", "state", state.String())
+		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+			cancel()
+		}
+	})
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-time.After(WHIP_TRACK_TIMEOUT):
+			tracksMut.Lock()
+			defer tracksMut.Unlock()
+			if !started {
+				log.Log(ctx, "whip publisher never sent both audio and video, giving up")
+				cancel()
+			}
+		}
+	}()
+	return pc, nil
+}
+
+// the H.264 and Opus our WebRTC ingest and playback deal in
+func registerWebRTCCodecs(m *webrtc.MediaEngine, profileLevelID string) error {
+	err := m.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:    webrtc.MimeTypeH264,
+			ClockRate:   90000,
+			SDPFmtpLine: media.WebRTCH264Fmtp(profileLevelID),
+		},
+		PayloadType: media.WEBRTC_H264_PAYLOAD_TYPE,
+	}, webrtc.RTPCodecTypeVideo)
+	if err != nil {
+		return err
+	}
+	return m.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:  webrtc.MimeTypeOpus,
+			ClockRate: 48000,
+			Channels:  2,
+		},
+		PayloadType: media.WEBRTC_OPUS_PAYLOAD_TYPE,
+	}, webrtc.RTPCodecTypeAudio)
+}
+
+// read the SDP offer off a WHIP or WHEP request, writing the error response
+// if we can't
+func readSDPOffer(w http.ResponseWriter, req *http.Request) (string, bool) {
+	offer, err := io.ReadAll(http.MaxBytesReader(w, req.Body, SDP_OFFER_LIMIT))
+	var tooBig *http.MaxBytesError
+	if errors.As(err, &tooBig) {
+		apierrors.WriteHTTPRequestEntityTooLarge(w, "sdp offer too large", err)
+		return "", false
+	}
+	if err != nil {
+		apierrors.WriteHTTPBadRequest(w, "error reading body", err)
+		return "", false
+	}
+	return string(offer), true
+}
+
+// apply the offer and build an answer with all our ICE candidates, since WHIP
+// and WHEP give us no way to trickle them
+func sdpAnswer(pc *webrtc.PeerConnection, offer string) (string, error) {
+	err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer})
+	if err != nil {
+		return "", err
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return "", err
+	}
+	err = pc.SetLocalDescription(answer)
+	if err != nil {
+		return "", err
+	}
+	<-gathered
+	return pc.LocalDescription().SDP, nil
+}
@@ -0,0 +1,104 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"aquareum.tv/aquareum/pkg/config"
+	"aquareum.tv/aquareum/pkg/crypto/aqpub"
+	"aquareum.tv/aquareum/pkg/crypto/signers/eip712"
+	"aquareum.tv/aquareum/pkg/crypto/signers/eip712/eip712test"
+	"aquareum.tv/aquareum/pkg/media"
+	v0 "aquareum.tv/aquareum/pkg/schema/v0"
+	"github.com/julienschmidt/httprouter"
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/require"
+)
+
+// an SDP offer like a WHIP client would send, with H.264 video and Opus audio
+func whipOffer(t *testing.T) string {
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	require.NoError(t, err)
+	t.Cleanup(func() { pc.Close() })
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		_, err = pc.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly})
+		require.NoError(t, err)
+	}
+	offer, err := pc.CreateOffer(nil)
+	require.NoError(t, err)
+	gathered := webrtc.GatheringCompletePromise(pc)
+	require.NoError(t, pc.SetLocalDescription(offer))
+	<-gathered
+	return pc.LocalDescription().SDP
+}
+
+func TestWHIP(t *testing.T) {
+	eip712test.WithTestSigner(func(signer *eip712.EIP712Signer) {
+		pub, err := aqpub.FromHexString(signer.Hex())
+		require.NoError(t, err)
+		bs, err := signer.SignMessage(v0.StreamKey{Authorized: pub.String()})
+		require.NoError(t, err)
+		key := base64.URLEncoding.EncodeToString(bs)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		a := &AquareumAPI{CLI: &config.CLI{}, Signer: signer, MediaSigner: &media.MediaSigner{Pub: pub}}
+		router := httprouter.New()
+		router.POST("/api/whip/:key", a.HandleWHIP(ctx))
+		router.DELETE("/api/whip/:key/:session", a.HandleWHIPDelete(ctx))
+		router.POST("/api/whep/:user", a.HandleWHEP(ctx))
+		offer := whipOffer(t)
+		tooBig := offer + strings.Repeat("a=x\r\n", SDP_OFFER_LIMIT)
+
+		tests := []struct {
+			name         string
+			path         string
+			contentType  string
+			body         string
+			responseCode int
+		}{
+			{name: "bad key", path: "/api/whip/not-a-key", contentType: "application/sdp", body: offer, responseCode: 401},
+			{name: "not sdp", path: "/api/whip/" + key, contentType: "application/json", body: offer, responseCode: 415},
+			{name: "whip offer too large", path: "/api/whip/" + key, contentType: "application/sdp", body: tooBig, responseCode: 413},
+			{name: "whep offer too large", path: "/api/whep/" + pub.String(), contentType: "application/sdp", body: tooBig, responseCode: 413},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				req := httptest.NewRequest("POST", tt.path, strings.NewReader(tt.body))
+				req.Header.Set("Content-Type", tt.contentType)
+				rr := httptest.NewRecorder()
+				router.ServeHTTP(rr, req)
+				require.Equal(t, tt.responseCode, rr.Code)
+			})
+		}
+
+		t.Run("session lifecycle", func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/api/whip/"+key, strings.NewReader(offer))
+			req.Header.Set("Content-Type", "application/sdp")
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			require.Equal(t, 201, rr.Code)
+			require.Equal(t, "application/sdp", rr.Header().Get("Content-Type"))
+			require.True(t, strings.HasPrefix(rr.Body.String(), "v=0"), "should be an sdp answer")
+			location := rr.Header().Get("Location")
+			require.True(t, strings.HasPrefix(location, "/api/whip/"+key+"/"))
+
+			for _, code := range []int{200, 404} {
+				req = httptest.NewRequest("DELETE", location, bytes.NewReader(nil))
+				rr = httptest.NewRecorder()
+				router.ServeHTTP(rr, req)
+				require.Equal(t, code, rr.Code)
+				// deletion happens asynchronously once the session's context ends
+				require.Eventually(t, func() bool {
+					a.whipSessionsMut.Lock()
+					defer a.whipSessionsMut.Unlock()
+					return len(a.whipSessions) == 0
+				}, 5*time.Second, 10*time.Millisecond)
+			}
+		})
+	})
+}
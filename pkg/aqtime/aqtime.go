@@ -55,9 +55,15 @@ func (aqt AQTime) FileSafeString() string {
 }
 
 func (aqt AQTime) Time() time.Time {
-	t, err := time.Parse(fstr, aqt.String())
+	t, err := aqt.Parse()
 	if err != nil {
 		panic(err)
 	}
 	return t
 }
+
+// like Time, but returns an error rather than panicking for anything that's not
+// in the canonical format, eg the file-safe form FromString accepts
+func (aqt AQTime) Parse() (time.Time, error) {
+	return time.Parse(fstr, aqt.String())
+}
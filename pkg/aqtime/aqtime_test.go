@@ -35,6 +35,14 @@ func TestTimeParse(t *testing.T) {
 	}
 }
 
+func TestTimeParseCanonical(t *testing.T) {
+	got, err := AQTime("2024-09-13T18:10:17.090Z").Parse()
+	require.NoError(t, err)
+	require.Equal(t, int64(1726251017090), got.UnixMilli())
+	_, err = AQTime("2024-09-13T18-10-17-090Z").Parse()
+	require.Error(t, err)
+}
+
 func TestBadCases(t *testing.T) {
 	for _, str := range []string{
 		"prefix2024-09-13T18:10:17.090Z",
@@ -12,6 +12,7 @@ import (
 	"runtime/pprof"
 	"strconv"
 	"syscall"
+	"time"
 
 	"aquareum.tv/aquareum/pkg/aqhttp"
 	"aquareum.tv/aquareum/pkg/crypto/signers"
@@ -19,9 +20,11 @@ import (
 	"aquareum.tv/aquareum/pkg/log"
 	"aquareum.tv/aquareum/pkg/media"
 	"aquareum.tv/aquareum/pkg/notifications"
-	"aquareum.tv/aquareum/pkg/replication"
 	"aquareum.tv/aquareum/pkg/replication/boring"
+	"aquareum.tv/aquareum/pkg/replication/pull"
+	"aquareum.tv/aquareum/pkg/retention"
 	v0 "aquareum.tv/aquareum/pkg/schema/v0"
+	"aquareum.tv/aquareum/pkg/storage"
 	"golang.org/x/term"
 
 	"aquareum.tv/aquareum/pkg/api"
@@ -62,6 +65,8 @@ func start(build *config.BuildFlags, platformJobs []jobFunc) error {
 	fs.StringVar(&cli.HttpAddr, "http-addr", ":38080", "Public HTTP address")
 	fs.StringVar(&cli.HttpInternalAddr, "http-internal-addr", "127.0.0.1:39090", "Private, admin-only HTTP address")
 	fs.StringVar(&cli.HttpsAddr, "https-addr", ":38443", "Public HTTPS address")
+	fs.StringVar(&cli.RTMPAddr, "rtmp-addr", "", "Public RTMP address for stream ingest, eg :1935 (disabled if empty)")
+	fs.StringVar(&cli.SRTAddr, "srt-addr", "", "Public SRT address for MPEG-TS stream ingest, eg :8890 (disabled if empty)")
 	fs.BoolVar(&cli.Secure, "secure", false, "Run with HTTPS. Required for WebRTC output")
 	cli.DataDirFlag(fs, &cli.TLSCertPath, "tls-cert", filepath.Join("tls", "tls.crt"), "Path to TLS certificate")
 	cli.DataDirFlag(fs, &cli.TLSKeyPath, "tls-key", filepath.Join("tls", "tls.key"), "Path to TLS key")
@@ -85,6 +90,31 @@ func start(build *config.BuildFlags, platformJobs []jobFunc) error {
 	cli.AddressSliceFlag(fs, &cli.AllowedStreams, "allowed-streams", "", "comma-separated list of addresses that this node will replicate")
 	cli.StringSliceFlag(fs, &cli.Peers, "peers", "", "other aquareum nodes to replicate to")
 	fs.BoolVar(&cli.TestStream, "test-stream", false, "run a built-in test stream on boot")
+	fs.StringVar(&cli.TestStreamCodec, "test-stream-codec", "h264", "video codec for the built-in test stream (h264, h265 or av1)")
+	cli.StringSliceFlag(fs, &cli.HLSRenditions, "hls-renditions", "", "comma-separated list of renditions to transcode HLS playback to, eg 720p,480p,240p (empty for source only)")
+	fs.BoolVar(&cli.HLSLowLatency, "hls-low-latency", false, "serve HLS playback as LL-HLS with CMAF partial segments and blocking playlist reload (pair with a short segment-duration, eg 1s)")
+	fs.DurationVar(&cli.SegmentMaxAge, "segment-max-age", 0, "delete stored segments older than this (0 keeps them forever)")
+	cli.AddressDurationMapFlag(fs, &cli.SegmentMaxAgeByUser, "segment-max-age-by-user", "", "comma-separated list of address=duration pairs overriding segment-max-age for specific users")
+	fs.Int64Var(&cli.SegmentMaxBytes, "segment-max-bytes", 0, "maximum total size of stored segments in bytes, least recently used are deleted first (0 for no limit)")
+	fs.DurationVar(&cli.RetentionInterval, "retention-interval", time.Minute, "how often to enforce segment retention")
+	fs.DurationVar(&cli.SegmentClockSkew, "segment-clock-skew", time.Minute, "how far a segment's start time may be from our clock")
+	fs.DurationVar(&cli.SegmentDuration, "segment-duration", 2*time.Second, "target length of signed segments, cut at the first keyframe after it")
+	fs.DurationVar(&cli.SegmentMaxDuration, "segment-max-duration", 10*time.Second, "ask upstream for a keyframe when a segment runs longer than this, and reject peers' segments longer than it (0 for no limit)")
+	fs.StringVar(&cli.SegmentStore, "segment-store", "local", "where to keep segment files, one of [local, s3]")
+	fs.StringVar(&cli.S3Endpoint, "s3-endpoint", "", "S3-compatible endpoint for segment storage, as host:port or a full URL")
+	fs.StringVar(&cli.S3Bucket, "s3-bucket", "", "S3 bucket for segment storage")
+	fs.StringVar(&cli.S3Prefix, "s3-prefix", "", "key prefix for segments within the S3 bucket")
+	fs.StringVar(&cli.S3Region, "s3-region", "", "S3 region for segment storage")
+	fs.StringVar(&cli.S3AccessKeyID, "s3-access-key-id", "", "S3 access key ID for segment storage")
+	fs.StringVar(&cli.S3SecretAccessKey, "s3-secret-access-key", "", "S3 secret access key for segment storage")
+	fs.BoolVar(&cli.S3Insecure, "s3-insecure", false, "use plain http for the S3 endpoint when given as host:port")
+	fs.IntVar(&cli.ReplicationMaxInFlight, "replication-max-in-flight", 4, "maximum number of segments being sent to peers at once")
+	cli.StringSliceFlag(fs, &cli.PullPeers, "pull-peers", "", "other aquareum nodes to fetch missing segments from")
+	fs.DurationVar(&cli.PullInterval, "pull-interval", 30*time.Second, "how often to check pull-peers for segments we're missing")
+	fs.DurationVar(&cli.PullWindow, "pull-window", 24*time.Hour, "how far back to look for missing segments on pull-peers (0 for all history)")
+	cli.AddressSliceFlag(fs, &cli.PeerAllowlist, "peer-allowlist", "", "comma-separated list of node addresses allowed to push segments to us. if empty, pushed segments are rejected")
+	fs.Float64Var(&cli.PeerRateLimit, "peer-rate-limit", 5, "segments per second each peer may push to us")
+	fs.IntVar(&cli.PeerRateBurst, "peer-rate-burst", 60, "how many segments a peer may push at once before peer-rate-limit kicks in, eg when catching up")
 	verbosity := fs.String("v", "3", "log verbosity level")
 
 	fs.Bool("insecure", false, "DEPRECATED, does nothing.")
@@ -122,6 +152,12 @@ func start(build *config.BuildFlags, platformJobs []jobFunc) error {
 
 	aqhttp.UserAgent = fmt.Sprintf("aquareum/%s", build.Version)
 
+	// peers are who we push to and the allowlist is who we take pushes from,
+	// so this is fine for push-only nodes, but it's easy to forget one
+	if len(cli.Peers) > 0 && len(cli.PeerAllowlist) == 0 {
+		log.Warn(ctx, "peers is set but peer-allowlist is empty, so segments pushed to us will be rejected; set --peer-allowlist to accept them")
+	}
+
 	err = os.MkdirAll(cli.DataDir, os.ModePerm)
 	if err != nil {
 		return fmt.Errorf("error creating aquareum dir at %s:%w", cli.DataDir, err)
@@ -210,12 +246,22 @@ func start(build *config.BuildFlags, platformJobs []jobFunc) error {
 		log.Log(ctx, "successfully initialized hardware signer", "address", addr)
 		signer = hwsigner
 	}
-	var rep replication.Replicator = &boring.BoringReplicator{Peers: cli.Peers}
-	mm, err := media.MakeMediaManager(ctx, &cli, signer, rep)
+	mod, err := model.MakeDB(cli.DBPath)
 	if err != nil {
 		return err
 	}
-	mod, err := model.MakeDB(cli.DBPath)
+	store, err := storage.MakeSegmentStore(ctx, &cli)
+	if err != nil {
+		return err
+	}
+	rep := &boring.BoringReplicator{
+		Peers:       cli.Peers,
+		Model:       mod,
+		Store:       store,
+		MaxInFlight: cli.ReplicationMaxInFlight,
+		Signer:      eip712signer,
+	}
+	mm, err := media.MakeMediaManager(ctx, &cli, signer, eip712signer, rep, mod, store)
 	if err != nil {
 		return err
 	}
@@ -230,11 +276,29 @@ func start(build *config.BuildFlags, platformJobs []jobFunc) error {
 	if err != nil {
 		return err
 	}
-	a, err := api.MakeAquareumAPI(&cli, mod, eip712signer, noter, mm, ms)
+	a, err := api.MakeAquareumAPI(&cli, mod, eip712signer, noter, mm, ms, store, rep)
 	if err != nil {
 		return err
 	}
 
+	// set up before anything is running, so nobody reads AllowedStreams or Aliases mid-update
+	var testMediaSigner *media.MediaSigner
+	if cli.TestStream {
+		testSigner, err := eip712.MakeEIP712Signer(ctx, &eip712.EIP712SignerOptions{
+			Schema:          schema,
+			EthKeystorePath: filepath.Join(cli.DataDir, "test-signer"),
+		})
+		if err != nil {
+			return err
+		}
+		testMediaSigner, err = media.MakeMediaSigner(ctx, &cli, "self-test-signer", testSigner)
+		if err != nil {
+			return err
+		}
+		cli.AllowedStreams = append(cli.AllowedStreams, testMediaSigner.Pub)
+		a.Aliases["self-test"] = testMediaSigner.Pub.String()
+	}
+
 	group, ctx := TimeoutGroupWithContext(ctx)
 	ctx = log.WithLogValues(ctx, "version", build.Version)
 
@@ -259,20 +323,33 @@ func start(build *config.BuildFlags, platformJobs []jobFunc) error {
 		return a.ServeInternalHTTP(ctx)
 	})
 
+	group.Go(func() error {
+		return a.ServeRTMP(ctx)
+	})
+
+	group.Go(func() error {
+		return a.ServeSRT(ctx)
+	})
+
+	group.Go(func() error {
+		return rep.Run(ctx)
+	})
+
+	puller := &pull.PullReplicator{CLI: &cli, Model: mod, Ingester: mm}
+	group.Go(func() error {
+		return puller.Run(ctx)
+	})
+
+	group.Go(func() error {
+		return mm.RunStreamStates(ctx)
+	})
+
+	ret := &retention.Retention{CLI: &cli, Model: mod, Store: store, Cleaner: mm}
+	group.Go(func() error {
+		return ret.Run(ctx)
+	})
+
 	if cli.TestStream {
-		testSigner, err := eip712.MakeEIP712Signer(ctx, &eip712.EIP712SignerOptions{
-			Schema:          schema,
-			EthKeystorePath: filepath.Join(cli.DataDir, "test-signer"),
-		})
-		if err != nil {
-			return err
-		}
-		testMediaSigner, err := media.MakeMediaSigner(ctx, &cli, "self-test-signer", testSigner)
-		if err != nil {
-			return err
-		}
-		cli.AllowedStreams = append(cli.AllowedStreams, testMediaSigner.Pub)
-		a.Aliases["self-test"] = testMediaSigner.Pub.String()
 		group.Go(func() error {
 			return mm.TestSource(ctx, testMediaSigner)
 		})
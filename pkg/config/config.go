@@ -15,7 +15,6 @@ import (
 	"strings"
 	"time"
 
-	"aquareum.tv/aquareum/pkg/aqtime"
 	"aquareum.tv/aquareum/pkg/crypto/aqpub"
 	"github.com/peterbourgon/ff/v3"
 	"golang.org/x/exp/rand"
@@ -53,6 +52,8 @@ type CLI struct {
 	HttpAddr               string
 	HttpInternalAddr       string
 	HttpsAddr              string
+	RTMPAddr               string
+	SRTAddr                string
 	Secure                 bool
 	NoMist                 bool
 	MistAdminPort          int
@@ -73,6 +74,31 @@ type CLI struct {
 	AllowedStreams         []aqpub.Pub
 	Peers                  []string
 	TestStream             bool
+	TestStreamCodec        string
+	HLSRenditions          []string
+	HLSLowLatency          bool
+	SegmentMaxAge          time.Duration
+	SegmentMaxAgeByUser    map[string]time.Duration
+	SegmentMaxBytes        int64
+	RetentionInterval      time.Duration
+	SegmentStore           string
+	S3Endpoint             string
+	S3Bucket               string
+	S3Prefix               string
+	S3Region               string
+	S3AccessKeyID          string
+	S3SecretAccessKey      string
+	S3Insecure             bool
+	ReplicationMaxInFlight int
+	PullPeers              []string
+	PullInterval           time.Duration
+	PullWindow             time.Duration
+	PeerAllowlist          []aqpub.Pub
+	PeerRateLimit          float64
+	PeerRateBurst          int
+	SegmentClockSkew       time.Duration
+	SegmentDuration        time.Duration
+	SegmentMaxDuration     time.Duration
 
 	dataDirFlags []*string
 }
@@ -139,6 +165,9 @@ func (cli *CLI) Parse(fs *flag.FlagSet, args []string) error {
 	for _, dest := range cli.dataDirFlags {
 		*dest = strings.Replace(*dest, AQ_DATA_DIR, cli.DataDir, 1)
 	}
+	if cli.RetentionInterval <= 0 {
+		return fmt.Errorf("retention-interval must be positive, got %s", cli.RetentionInterval)
+	}
 	return nil
 }
 
@@ -201,37 +230,6 @@ func (cli *CLI) DataFileCreate(fpath []string, overwrite bool) (*os.File, error)
 	return os.Create(ddpath)
 }
 
-// get a path to a segment file in our database
-func (cli *CLI) SegmentFilePath(user string, file string) (string, error) {
-	ext := filepath.Ext(file)
-	if ext != ".mp4" {
-		return "", fmt.Errorf("expected mp4 ext, got %s", ext)
-	}
-	base := strings.TrimSuffix(file, ext)
-	aqt, err := aqtime.FromString(base)
-	if err != nil {
-		return "", err
-	}
-	fname := fmt.Sprintf("%s%s", aqt.FileSafeString(), ext)
-	yr, mon, day, hr, min, _, _ := aqt.Parts()
-	return cli.dataFilePath([]string{SEGMENTS_DIR, user, yr, mon, day, hr, min, fname}), nil
-}
-
-// get a path to a segment file in our database
-func (cli *CLI) HLSDir(user string) (string, error) {
-	return cli.dataFilePath([]string{SEGMENTS_DIR, "hls", user}), nil
-}
-
-// create a segment file in our database
-func (cli *CLI) SegmentFileCreate(user string, aqt aqtime.AQTime, ext string) (*os.File, error) {
-	if ext != "mp4" {
-		return nil, fmt.Errorf("expected mp4 ext, got %s", ext)
-	}
-	fname := fmt.Sprintf("%s.%s", aqt.FileSafeString(), ext)
-	yr, mon, day, hr, min, _, _ := aqt.Parts()
-	return cli.DataFileCreate([]string{SEGMENTS_DIR, user, yr, mon, day, hr, min, fname}, false)
-}
-
 // read a file from our data dir
 func (cli *CLI) DataFileRead(fpath []string, w io.Writer) error {
 	ddpath := cli.dataFilePath(fpath)
@@ -294,3 +292,31 @@ func (cli *CLI) StringSliceFlag(fs *flag.FlagSet, dest *[]string, name, defaultV
 		return nil
 	})
 }
+
+// type for comma-separated address=duration pairs, eg 0xabc...=24h,0xdef...=168h
+func (cli *CLI) AddressDurationMapFlag(fs *flag.FlagSet, dest *map[string]time.Duration, name, defaultValue, usage string) {
+	*dest = map[string]time.Duration{}
+	usage = fmt.Sprintf(`%s (default: "%s")`, usage, defaultValue)
+	fs.Func(name, usage, func(s string) error {
+		if s == "" {
+			return nil
+		}
+		pairs := strings.Split(s, ",")
+		for _, pair := range pairs {
+			addr, durStr, ok := strings.Cut(pair, "=")
+			if !ok {
+				return fmt.Errorf("expected address=duration, got %s", pair)
+			}
+			pub, err := aqpub.FromHexString(addr)
+			if err != nil {
+				return err
+			}
+			dur, err := time.ParseDuration(durStr)
+			if err != nil {
+				return err
+			}
+			(*dest)[pub.String()] = dur
+		}
+		return nil
+	})
+}
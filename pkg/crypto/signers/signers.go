@@ -6,9 +6,11 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/asn1"
+	"encoding/hex"
 	"encoding/pem"
 	"fmt"
 	"math/big"
@@ -158,6 +160,16 @@ func ParseES256KCert(pembs []byte) (aqpub.Pub, error) {
 	return pub, nil
 }
 
+// sha256 fingerprint of the leaf certificate in a PEM chain
+func CertFingerprint(pembs []byte) (string, error) {
+	block, _ := pem.Decode(pembs)
+	if block == nil {
+		return "", fmt.Errorf("failed to parse PEM block containing the cert")
+	}
+	sum := sha256.Sum256(block.Bytes)
+	return hex.EncodeToString(sum[:]), nil
+}
+
 func HexAddr(pub *ecdsa.PublicKey) string {
 	addr := crypto.PubkeyToAddress(*pub)
 	hex := hexutil.Encode(addr.Bytes())
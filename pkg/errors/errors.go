@@ -50,14 +50,34 @@ func WriteHTTPUnsupportedMediaType(w http.ResponseWriter, msg string, err error)
 	return writeHttpError(w, msg, http.StatusUnsupportedMediaType, err)
 }
 
+func WriteHTTPRequestEntityTooLarge(w http.ResponseWriter, msg string, err error) APIError {
+	return writeHttpError(w, msg, http.StatusRequestEntityTooLarge, err)
+}
+
 func WriteHTTPNotFound(w http.ResponseWriter, msg string, err error) APIError {
 	return writeHttpError(w, msg, http.StatusNotFound, err)
 }
 
+func WriteHTTPConflict(w http.ResponseWriter, msg string, err error) APIError {
+	return writeHttpError(w, msg, http.StatusConflict, err)
+}
+
+func WriteHTTPUnprocessableEntity(w http.ResponseWriter, msg string, err error) APIError {
+	return writeHttpError(w, msg, http.StatusUnprocessableEntity, err)
+}
+
+func WriteHTTPTooManyRequests(w http.ResponseWriter, msg string, err error) APIError {
+	return writeHttpError(w, msg, http.StatusTooManyRequests, err)
+}
+
 func WriteHTTPInternalServerError(w http.ResponseWriter, msg string, err error) APIError {
 	return writeHttpError(w, msg, http.StatusInternalServerError, err)
 }
 
+func WriteHTTPServiceUnavailable(w http.ResponseWriter, msg string, err error) APIError {
+	return writeHttpError(w, msg, http.StatusServiceUnavailable, err)
+}
+
 func WriteHTTPNotImplemented(w http.ResponseWriter, msg string, err error) APIError {
 	return writeHttpError(w, msg, http.StatusNotImplemented, err)
 }
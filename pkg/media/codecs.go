@@ -0,0 +1,411 @@
+package media
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-gst/go-gst/gst"
+)
+
+// a video codec we can carry from ingest through signed mp4 segments to playback
+type videoCodec struct {
+	// caps name demuxers give it, eg video/x-h265
+	caps string
+	// turns whatever the demuxer gives us into something mp4mux and mpegtsmux take
+	parser string
+	// for the test source
+	encoder string
+}
+
+// keyed by the names used in --test-stream-codec
+var videoCodecs = map[string]videoCodec{
+	"h264": {caps: "video/x-h264", parser: "h264parse", encoder: "x264enc speed-preset=ultrafast key-int-max=30"},
+	"h265": {caps: "video/x-h265", parser: "h265parse", encoder: "x265enc speed-preset=ultrafast key-int-max=30"},
+	"av1":  {caps: "video/x-av1", parser: "av1parse", encoder: "svtav1enc preset=12 intra-period-length=30"},
+}
+
+// this build of gstreamer is missing an element a codec needs, eg a static build
+// without x265. wrapped with details, so check for it with errors.Is.
+var ErrCodecUnavailable = errors.New("codec not available")
+
+// make sure we have every element the codec needs for ingest, and for the test
+// source if encode is set
+func (codec videoCodec) available(encode bool) error {
+	elements := []string{codec.parser}
+	if encode {
+		elements = append(elements, strings.Fields(codec.encoder)[0])
+	}
+	for _, name := range elements {
+		if gst.Find(name) == nil {
+			return fmt.Errorf("%w: %s needs %s, which isn't in this build of gstreamer", ErrCodecUnavailable, codec.caps, name)
+		}
+	}
+	return nil
+}
+
+func videoCodecForCaps(name string) (videoCodec, bool) {
+	for _, codec := range videoCodecs {
+		if codec.caps == name {
+			return codec, true
+		}
+	}
+	return videoCodec{}, false
+}
+
+// plug a queue and the parser for a demuxed video pad's codec in between the
+// pad and downstream
+func linkVideoPad(pipeline *gst.Pipeline, pad *gst.Pad, downstream *gst.Element) error {
+	caps := pad.GetCurrentCaps()
+	if caps == nil || caps.GetSize() == 0 {
+		return fmt.Errorf("video pad %s has no caps", pad.GetName())
+	}
+	name := caps.GetStructureAt(0).Name()
+	codec, ok := videoCodecForCaps(name)
+	if !ok {
+		return fmt.Errorf("%w: unsupported video codec %s", ErrUnsupportedInput, name)
+	}
+	err := codec.available(false)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrUnsupportedInput, err)
+	}
+	queue, err := gst.NewElement("queue")
+	if err != nil {
+		return err
+	}
+	parser, err := gst.NewElement(codec.parser)
+	if err != nil {
+		return err
+	}
+	err = pipeline.AddMany(queue, parser)
+	if err != nil {
+		return err
+	}
+	err = queue.Link(parser)
+	if err != nil {
+		return err
+	}
+	err = parser.Link(downstream)
+	if err != nil {
+		return err
+	}
+	if !queue.SyncStateWithParent() || !parser.SyncStateWithParent() {
+		return fmt.Errorf("couldn't start %s", codec.parser)
+	}
+	ret := pad.Link(queue.GetStaticPad("sink"))
+	if ret != gst.PadLinkOK {
+		return fmt.Errorf("error linking %s pad: %v", name, ret)
+	}
+	return nil
+}
+
+// the sample entry types of an mp4's tracks, eg avc1, hvc1 or av01 and mp4a,
+// in track order
+func mp4Codecs(bs []byte) ([]string, error) {
+	moov, ok := mp4Box(bs, "moov")
+	if !ok {
+		return nil, fmt.Errorf("mp4 has no moov box")
+	}
+	codecs := []string{}
+	for rest := moov; len(rest) > 0; {
+		typ, body, next, err := mp4NextBox(rest)
+		if err != nil {
+			return nil, err
+		}
+		rest = next
+		if typ != "trak" {
+			continue
+		}
+		stsd, ok := mp4Path(body, "mdia", "minf", "stbl", "stsd")
+		// version, flags and entry count come before the sample entries
+		if !ok || len(stsd) < 8 {
+			return nil, fmt.Errorf("mp4 track has no sample description")
+		}
+		entry, _, _, err := mp4NextBox(stsd[8:])
+		if err != nil {
+			return nil, err
+		}
+		codecs = append(codecs, entry)
+	}
+	if len(codecs) == 0 {
+		return nil, fmt.Errorf("mp4 has no tracks")
+	}
+	return codecs, nil
+}
+
+// what HLS wants to know about an mp4's tracks for the master playlist
+type mp4Info struct {
+	// RFC 6381 codec strings, eg avc1.64001f and mp4a.40.2, empty if we
+	// couldn't work them out
+	video string
+	audio string
+	// coded size of the video track
+	width  int
+	height int
+}
+
+// the RFC 6381 codecs and video size of an mp4, as best we can tell
+func mp4TrackInfo(bs []byte) (mp4Info, error) {
+	info := mp4Info{}
+	moov, ok := mp4Box(bs, "moov")
+	if !ok {
+		return info, fmt.Errorf("mp4 has no moov box")
+	}
+	for rest := moov; len(rest) > 0; {
+		typ, body, next, err := mp4NextBox(rest)
+		if err != nil {
+			return info, err
+		}
+		rest = next
+		if typ != "trak" {
+			continue
+		}
+		hdlr, ok := mp4Path(body, "mdia", "hdlr")
+		// version, flags and pre_defined come before the handler type
+		if !ok || len(hdlr) < 12 {
+			return info, fmt.Errorf("mp4 track has no handler")
+		}
+		stsd, ok := mp4Path(body, "mdia", "minf", "stbl", "stsd")
+		if !ok || len(stsd) < 8 {
+			return info, fmt.Errorf("mp4 track has no sample description")
+		}
+		entryType, entry, _, err := mp4NextBox(stsd[8:])
+		if err != nil {
+			return info, err
+		}
+		switch string(hdlr[8:12]) {
+		case "vide":
+			// reserved, data reference index and pre_defined come first, then
+			// the size. boxes like avcC follow the rest of the fixed fields.
+			if len(entry) < 78 {
+				return info, fmt.Errorf("truncated mp4 visual sample entry")
+			}
+			info.width = int(binary.BigEndian.Uint16(entry[24:26]))
+			info.height = int(binary.BigEndian.Uint16(entry[26:28]))
+			info.video = mp4VideoCodecString(entryType, entry[78:])
+		case "soun":
+			// boxes like esds follow the fixed fields
+			if len(entry) < 28 {
+				return info, fmt.Errorf("truncated mp4 audio sample entry")
+			}
+			info.audio = mp4AudioCodecString(entryType, entry[28:])
+		}
+	}
+	return info, nil
+}
+
+// RFC 6381 codec string for a video sample entry, from its decoder
+// configuration box
+func mp4VideoCodecString(entryType string, children []byte) string {
+	switch entryType {
+	case "avc1", "avc3":
+		avcC, ok := mp4Box(children, "avcC")
+		if !ok || len(avcC) < 4 {
+			return ""
+		}
+		// profile, constraint flags, level
+		return fmt.Sprintf("%s.%02x%02x%02x", entryType, avcC[1], avcC[2], avcC[3])
+	case "hvc1", "hev1":
+		hvcC, ok := mp4Box(children, "hvcC")
+		if !ok || len(hvcC) < 13 {
+			return ""
+		}
+		space := []string{"", "A", "B", "C"}[hvcC[1]>>6]
+		tier := "L"
+		if hvcC[1]&0x20 != 0 {
+			tier = "H"
+		}
+		// compatibility flags go in reverse bit order
+		compat := uint32(0)
+		flags := binary.BigEndian.Uint32(hvcC[2:6])
+		for i := 0; i < 32; i++ {
+			if flags&(1<<i) != 0 {
+				compat |= 1 << (31 - i)
+			}
+		}
+		str := fmt.Sprintf("%s.%s%d.%x.%s%d", entryType, space, hvcC[1]&0x1f, compat, tier, hvcC[12])
+		// constraint bytes, leaving off trailing zeroes
+		constraints := hvcC[6:12]
+		for len(constraints) > 0 && constraints[len(constraints)-1] == 0 {
+			constraints = constraints[:len(constraints)-1]
+		}
+		for _, b := range constraints {
+			str += fmt.Sprintf(".%X", b)
+		}
+		return str
+	case "av01":
+		av1C, ok := mp4Box(children, "av1C")
+		if !ok || len(av1C) < 3 {
+			return ""
+		}
+		tier := "M"
+		if av1C[2]&0x80 != 0 {
+			tier = "H"
+		}
+		depth := 8
+		if av1C[2]&0x40 != 0 {
+			depth = 10
+			if av1C[2]&0x20 != 0 {
+				depth = 12
+			}
+		}
+		return fmt.Sprintf("av01.%d.%02d%s.%02d", av1C[1]>>5, av1C[1]&0x1f, tier, depth)
+	}
+	return ""
+}
+
+// RFC 6381 codec string for an audio sample entry, eg mp4a.40.2 for AAC-LC
+func mp4AudioCodecString(entryType string, children []byte) string {
+	if entryType != "mp4a" {
+		return ""
+	}
+	esds, ok := mp4Box(children, "esds")
+	if !ok || len(esds) < 4 {
+		return ""
+	}
+	// version and flags, then the ES descriptor
+	tag, es, _, ok := mp4Descriptor(esds[4:])
+	if !ok || tag != 0x03 || len(es) < 3 {
+		return ""
+	}
+	// ES_ID, then flags saying which optional fields follow
+	flags := es[2]
+	es = es[3:]
+	if flags&0x80 != 0 {
+		es = es[min(2, len(es)):]
+	}
+	if flags&0x40 != 0 && len(es) > 0 {
+		es = es[min(1+int(es[0]), len(es)):]
+	}
+	if flags&0x20 != 0 {
+		es = es[min(2, len(es)):]
+	}
+	tag, config, _, ok := mp4Descriptor(es)
+	if !ok || tag != 0x04 || len(config) < 13 {
+		return ""
+	}
+	objectType := config[0]
+	str := fmt.Sprintf("mp4a.%x", objectType)
+	// for AAC, the audio object type from the decoder specific info
+	tag, specific, _, ok := mp4Descriptor(config[13:])
+	if objectType == 0x40 && ok && tag == 0x05 && len(specific) > 0 {
+		str += fmt.Sprintf(".%d", specific[0]>>3)
+	}
+	return str
+}
+
+// one MPEG-4 descriptor: its tag, body and whatever's after it
+func mp4Descriptor(bs []byte) (byte, []byte, []byte, bool) {
+	if len(bs) < 2 {
+		return 0, nil, nil, false
+	}
+	tag := bs[0]
+	size := 0
+	i := 1
+	// seven bits at a time, with the top bit set if there's more
+	for ; i < len(bs) && i <= 4; i++ {
+		size = size<<7 | int(bs[i]&0x7f)
+		if bs[i]&0x80 == 0 {
+			break
+		}
+	}
+	i++
+	if i+size > len(bs) {
+		return 0, nil, nil, false
+	}
+	return tag, bs[i : i+size], bs[i+size:], true
+}
+
+// the mime type we record for a segment, eg video/mp4; codecs="hvc1,mp4a"
+func mp4EncodingFormat(codecs []string) string {
+	return fmt.Sprintf(`video/mp4; codecs="%s"`, strings.Join(codecs, ","))
+}
+
+// how long an mp4 plays for, from its movie header
+func mp4Duration(bs []byte) (time.Duration, error) {
+	mvhd, ok := mp4Path(bs, "moov", "mvhd")
+	if !ok || len(mvhd) < 4 {
+		return 0, fmt.Errorf("mp4 has no movie header")
+	}
+	var timescale, duration uint64
+	switch mvhd[0] {
+	case 0:
+		// version, flags, 32-bit creation and modification times
+		if len(mvhd) < 20 {
+			return 0, fmt.Errorf("truncated mp4 movie header")
+		}
+		timescale = uint64(binary.BigEndian.Uint32(mvhd[12:16]))
+		duration = uint64(binary.BigEndian.Uint32(mvhd[16:20]))
+	case 1:
+		// same again with 64-bit times and duration
+		if len(mvhd) < 32 {
+			return 0, fmt.Errorf("truncated mp4 movie header")
+		}
+		timescale = uint64(binary.BigEndian.Uint32(mvhd[20:24]))
+		duration = binary.BigEndian.Uint64(mvhd[24:32])
+	default:
+		return 0, fmt.Errorf("unknown mp4 movie header version %d", mvhd[0])
+	}
+	if timescale == 0 {
+		return 0, fmt.Errorf("mp4 movie header has no timescale")
+	}
+	return mp4Ticks(duration, timescale), nil
+}
+
+// convert a count of timescale ticks without overflowing on long streams
+func mp4Ticks(ticks, timescale uint64) time.Duration {
+	whole := time.Duration(ticks/timescale) * time.Second
+	return whole + time.Duration(ticks%timescale*uint64(time.Second)/timescale)
+}
+
+func mp4Path(bs []byte, path ...string) ([]byte, bool) {
+	for _, typ := range path {
+		var ok bool
+		bs, ok = mp4Box(bs, typ)
+		if !ok {
+			return nil, false
+		}
+	}
+	return bs, true
+}
+
+// body of the first box of the given type
+func mp4Box(bs []byte, want string) ([]byte, bool) {
+	for len(bs) > 0 {
+		typ, body, next, err := mp4NextBox(bs)
+		if err != nil {
+			return nil, false
+		}
+		if typ == want {
+			return body, true
+		}
+		bs = next
+	}
+	return nil, false
+}
+
+func mp4NextBox(bs []byte) (string, []byte, []byte, error) {
+	if len(bs) < 8 {
+		return "", nil, nil, fmt.Errorf("truncated mp4 box header")
+	}
+	size := uint64(binary.BigEndian.Uint32(bs[0:4]))
+	typ := string(bs[4:8])
+	header := uint64(8)
+	switch size {
+	case 0:
+		// runs to the end
+		size = uint64(len(bs))
+	case 1:
+		if len(bs) < 16 {
+			return "", nil, nil, fmt.Errorf("truncated mp4 box header")
+		}
+		size = binary.BigEndian.Uint64(bs[8:16])
+		header = 16
+	}
+	if size < header || size > uint64(len(bs)) {
+		return "", nil, nil, fmt.Errorf("mp4 box %s has bad size %d", typ, size)
+	}
+	return typ, bs[header:size], bs[size:], nil
+}
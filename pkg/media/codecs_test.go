@@ -0,0 +1,127 @@
+package media
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-gst/go-gst/gst"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMP4Codecs(t *testing.T) {
+	bs, err := os.ReadFile(getFixture("sample-segment.mp4"))
+	require.NoError(t, err)
+	codecs, err := mp4Codecs(bs)
+	require.NoError(t, err)
+	require.Equal(t, []string{"avc1", "mp4a"}, codecs)
+	require.Equal(t, `video/mp4; codecs="avc1,mp4a"`, mp4EncodingFormat(codecs))
+}
+
+func TestMP4TrackInfo(t *testing.T) {
+	bs, err := os.ReadFile(getFixture("sample-segment.mp4"))
+	require.NoError(t, err)
+	info, err := mp4TrackInfo(bs)
+	require.NoError(t, err)
+	require.Equal(t, mp4Info{video: "avc1.42c01f", audio: "mp4a.40.2", width: 1280, height: 720}, info)
+
+	_, err = mp4TrackInfo([]byte("definitely not an mp4 file"))
+	require.Error(t, err)
+}
+
+func TestMP4VideoCodecString(t *testing.T) {
+	box := func(typ string, body []byte) []byte {
+		bs := []byte{0, 0, 0, byte(8 + len(body))}
+		return append(append(bs, typ...), body...)
+	}
+	// main profile, level 3.1 (93), constraint byte 0xb0
+	hvcC := []byte{1, 0x01, 0x60, 0, 0, 0, 0xb0, 0, 0, 0, 0, 0, 93}
+	require.Equal(t, "hvc1.1.6.L93.B0", mp4VideoCodecString("hvc1", box("hvcC", hvcC)))
+	// main profile, level 4.0 (8), main tier, 8 bit
+	av1C := []byte{0x81, 0x08, 0x0c}
+	require.Equal(t, "av01.0.08M.08", mp4VideoCodecString("av01", box("av1C", av1C)))
+	require.Equal(t, "", mp4VideoCodecString("vp09", nil))
+}
+
+func TestMP4CodecsInvalid(t *testing.T) {
+	bs, err := os.ReadFile(getFixture("sample-segment.mp4"))
+	require.NoError(t, err)
+	for name, input := range map[string][]byte{
+		"empty":   {},
+		"garbage": []byte("definitely not an mp4 file"),
+		// cuts off partway through the moov box
+		"truncated": bs[:13000],
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := mp4Codecs(input)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestMP4Duration(t *testing.T) {
+	bs, err := os.ReadFile(getFixture("sample-segment.mp4"))
+	require.NoError(t, err)
+	dur, err := mp4Duration(bs)
+	require.NoError(t, err)
+	require.Equal(t, 4010*time.Millisecond, dur)
+
+	_, err = mp4Duration([]byte("definitely not an mp4 file"))
+	require.Error(t, err)
+}
+
+func TestISODuration(t *testing.T) {
+	require.Equal(t, "PT4.01S", formatISODuration(4010*time.Millisecond))
+	require.Equal(t, "PT2S", formatISODuration(2*time.Second))
+	for str, expected := range map[string]time.Duration{
+		"PT4.01S":  4010 * time.Millisecond,
+		"PT2S":     2 * time.Second,
+		"PT1M30S":  90 * time.Second,
+		"PT1H":     time.Hour,
+		"PT0.033S": 33 * time.Millisecond,
+	} {
+		dur, err := parseISODuration(str)
+		require.NoError(t, err, str)
+		require.Equal(t, expected, dur, str)
+	}
+	for _, str := range []string{"", "PT", "P1D", "2s", "PT-1S"} {
+		_, err := parseISODuration(str)
+		require.Error(t, err, str)
+	}
+}
+
+func TestVideoCodecForCaps(t *testing.T) {
+	for _, name := range []string{"h264", "h265", "av1"} {
+		codec, ok := videoCodecForCaps(videoCodecs[name].caps)
+		require.True(t, ok)
+		require.Equal(t, videoCodecs[name], codec)
+	}
+	_, ok := videoCodecForCaps("video/x-vp8")
+	require.False(t, ok)
+}
+
+// encode, parse and mux each codec the way the test source and segmenter do,
+// for whichever of them this build of gstreamer has
+func TestVideoCodecPipelines(t *testing.T) {
+	gst.Init(nil)
+	for _, name := range []string{"h264", "h265", "av1"} {
+		t.Run(name, func(t *testing.T) {
+			codec := videoCodecs[name]
+			err := codec.available(true)
+			if err != nil {
+				t.Skip(err.Error())
+			}
+			runTestPipeline(t, fmt.Sprintf(
+				"videotestsrc num-buffers=30 ! video/x-raw,width=320,height=240,framerate=30/1 ! videoconvert ! video/x-raw,format=I420 ! %s ! %s ! mp4mux ! fakesink",
+				codec.encoder, codec.parser,
+			))
+		})
+	}
+}
+
+func TestVideoCodecUnavailable(t *testing.T) {
+	gst.Init(nil)
+	codec := videoCodec{caps: "video/x-nope", parser: "nopeparse", encoder: "nopeenc bitrate=1"}
+	require.ErrorIs(t, codec.available(true), ErrCodecUnavailable)
+}
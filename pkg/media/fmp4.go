@@ -0,0 +1,288 @@
+package media
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// the track in a fragmented mp4 we time its fragments by, and the defaults its
+// fragments fall back on
+type fmp4Track struct {
+	id              uint32
+	timescale       uint32
+	defaultDuration uint32
+	defaultFlags    uint32
+}
+
+// sample flag saying a sample can't be decoded on its own
+const fmp4SampleNonSync = 0x00010000
+
+// read the next whole box, header and all, off a stream
+func readMP4Box(r io.Reader) (string, []byte, error) {
+	header := make([]byte, 8)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return "", nil, err
+	}
+	size := uint64(binary.BigEndian.Uint32(header[0:4]))
+	typ := string(header[4:8])
+	if size == 1 {
+		large := make([]byte, 8)
+		_, err := io.ReadFull(r, large)
+		if err != nil {
+			return "", nil, err
+		}
+		header = append(header, large...)
+		size = binary.BigEndian.Uint64(large)
+	}
+	// a box running to the end of the stream is no use to us live
+	if size < uint64(len(header)) {
+		return "", nil, fmt.Errorf("mp4 box %s has bad size %d", typ, size)
+	}
+	box := make([]byte, size)
+	copy(box, header)
+	_, err = io.ReadFull(r, box[len(header):])
+	if err != nil {
+		return "", nil, err
+	}
+	return typ, box, nil
+}
+
+// find the video track in a fragmented mp4's moov box
+func fmp4VideoTrack(moov []byte) (fmp4Track, error) {
+	var track fmp4Track
+	found := false
+	for rest := moov; len(rest) > 0; {
+		typ, body, next, err := mp4NextBox(rest)
+		if err != nil {
+			return track, err
+		}
+		rest = next
+		if typ != "trak" {
+			continue
+		}
+		hdlr, ok := mp4Path(body, "mdia", "hdlr")
+		// version and flags, then pre_defined, then the handler type
+		if !ok || len(hdlr) < 12 || string(hdlr[8:12]) != "vide" {
+			continue
+		}
+		tkhd, ok := mp4Box(body, "tkhd")
+		if !ok {
+			return track, fmt.Errorf("mp4 video track has no header")
+		}
+		id, err := fullBoxField(tkhd, 12, 20)
+		if err != nil {
+			return track, err
+		}
+		mdhd, ok := mp4Path(body, "mdia", "mdhd")
+		if !ok {
+			return track, fmt.Errorf("mp4 video track has no media header")
+		}
+		timescale, err := fullBoxField(mdhd, 12, 20)
+		if err != nil {
+			return track, err
+		}
+		if timescale == 0 {
+			return track, fmt.Errorf("mp4 video track has no timescale")
+		}
+		track.id = id
+		track.timescale = timescale
+		found = true
+		break
+	}
+	if !found {
+		return track, fmt.Errorf("mp4 has no video track")
+	}
+	mvex, ok := mp4Box(moov, "mvex")
+	if !ok {
+		return track, fmt.Errorf("mp4 isn't fragmented")
+	}
+	for rest := mvex; len(rest) > 0; {
+		typ, body, next, err := mp4NextBox(rest)
+		if err != nil {
+			return track, err
+		}
+		rest = next
+		// version and flags, track_ID, default_sample_description_index,
+		// default_sample_duration, default_sample_size, default_sample_flags
+		if typ != "trex" || len(body) < 24 || binary.BigEndian.Uint32(body[4:8]) != track.id {
+			continue
+		}
+		track.defaultDuration = binary.BigEndian.Uint32(body[12:16])
+		track.defaultFlags = binary.BigEndian.Uint32(body[20:24])
+	}
+	return track, nil
+}
+
+// a 32-bit field of a full box that moves depending on whether it's version 0
+// or 1, eg the track ID in tkhd or the timescale in mdhd
+func fullBoxField(body []byte, v0, v1 int) (uint32, error) {
+	if len(body) < 4 {
+		return 0, fmt.Errorf("truncated mp4 box")
+	}
+	offset := v0
+	if body[0] == 1 {
+		offset = v1
+	}
+	if len(body) < offset+4 {
+		return 0, fmt.Errorf("truncated mp4 box")
+	}
+	return binary.BigEndian.Uint32(body[offset : offset+4]), nil
+}
+
+// how long the track plays for in a moof box, and whether it starts with a
+// sample that can be decoded on its own
+func fmp4Fragment(moof []byte, track fmp4Track) (time.Duration, bool, error) {
+	for rest := moof; len(rest) > 0; {
+		typ, traf, next, err := mp4NextBox(rest)
+		if err != nil {
+			return 0, false, err
+		}
+		rest = next
+		if typ != "traf" {
+			continue
+		}
+		tfhd, ok := mp4Box(traf, "tfhd")
+		if !ok || len(tfhd) < 8 {
+			return 0, false, fmt.Errorf("mp4 fragment has no track header")
+		}
+		if binary.BigEndian.Uint32(tfhd[4:8]) != track.id {
+			continue
+		}
+		defaultDuration, defaultFlags, err := tfhdDefaults(tfhd, track)
+		if err != nil {
+			return 0, false, err
+		}
+		trun, ok := mp4Box(traf, "trun")
+		if !ok {
+			return 0, false, fmt.Errorf("mp4 fragment has no track run")
+		}
+		ticks, firstFlags, err := trunSamples(trun, defaultDuration, defaultFlags)
+		if err != nil {
+			return 0, false, err
+		}
+		return mp4Ticks(ticks, uint64(track.timescale)), firstFlags&fmp4SampleNonSync == 0, nil
+	}
+	return 0, false, fmt.Errorf("mp4 fragment has no video")
+}
+
+// default sample duration and flags for a track fragment, falling back on the
+// track's
+func tfhdDefaults(tfhd []byte, track fmp4Track) (uint32, uint32, error) {
+	flags := binary.BigEndian.Uint32(tfhd[0:4]) & 0xffffff
+	duration := track.defaultDuration
+	sampleFlags := track.defaultFlags
+	offset := 8
+	// base_data_offset and sample_description_index come first
+	if flags&0x01 != 0 {
+		offset += 8
+	}
+	if flags&0x02 != 0 {
+		offset += 4
+	}
+	if flags&0x08 != 0 {
+		if len(tfhd) < offset+4 {
+			return 0, 0, fmt.Errorf("truncated mp4 track fragment header")
+		}
+		duration = binary.BigEndian.Uint32(tfhd[offset : offset+4])
+		offset += 4
+	}
+	if flags&0x10 != 0 {
+		offset += 4
+	}
+	if flags&0x20 != 0 {
+		if len(tfhd) < offset+4 {
+			return 0, 0, fmt.Errorf("truncated mp4 track fragment header")
+		}
+		sampleFlags = binary.BigEndian.Uint32(tfhd[offset : offset+4])
+	}
+	return duration, sampleFlags, nil
+}
+
+// total duration in ticks of the samples in a track run, and the flags of the
+// first one
+func trunSamples(trun []byte, defaultDuration, defaultFlags uint32) (uint64, uint32, error) {
+	if len(trun) < 8 {
+		return 0, 0, fmt.Errorf("truncated mp4 track run")
+	}
+	flags := binary.BigEndian.Uint32(trun[0:4]) & 0xffffff
+	count := binary.BigEndian.Uint32(trun[4:8])
+	offset := 8
+	if flags&0x01 != 0 {
+		// data_offset
+		offset += 4
+	}
+	firstFlags := defaultFlags
+	hasFirstFlags := flags&0x04 != 0
+	if hasFirstFlags {
+		if len(trun) < offset+4 {
+			return 0, 0, fmt.Errorf("truncated mp4 track run")
+		}
+		firstFlags = binary.BigEndian.Uint32(trun[offset : offset+4])
+		offset += 4
+	}
+	fields := []uint32{0x100, 0x200, 0x400, 0x800}
+	var ticks uint64
+	for i := uint32(0); i < count; i++ {
+		duration := defaultDuration
+		for _, field := range fields {
+			if flags&field == 0 {
+				continue
+			}
+			if len(trun) < offset+4 {
+				return 0, 0, fmt.Errorf("truncated mp4 track run")
+			}
+			val := binary.BigEndian.Uint32(trun[offset : offset+4])
+			offset += 4
+			switch field {
+			case 0x100:
+				duration = val
+			case 0x400:
+				if i == 0 && !hasFirstFlags {
+					firstFlags = val
+				}
+			}
+		}
+		ticks += uint64(duration)
+	}
+	return ticks, firstFlags, nil
+}
+
+// cut a fragmented mp4 stream into its init segment and then the boxes after
+// it, noting which fragments start on a keyframe
+func splitFMP4(r io.Reader, header func([]byte), piece func([]byte, bool)) error {
+	var init []byte
+	var track fmp4Track
+	started := false
+	for {
+		typ, box, err := readMP4Box(r)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !started {
+			init = append(init, box...)
+			if typ == "moov" {
+				track, err = fmp4VideoTrack(box[8:])
+				if err != nil {
+					return err
+				}
+				header(init)
+				started = true
+			}
+			continue
+		}
+		keyframe := false
+		if typ == "moof" {
+			// fragments without any video aren't somewhere to start from
+			_, independent, err := fmp4Fragment(box[8:], track)
+			keyframe = err == nil && independent
+		}
+		piece(box, keyframe)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -14,6 +15,7 @@ import (
 	"time"
 
 	"aquareum.tv/aquareum/pkg/log"
+	"aquareum.tv/aquareum/pkg/model"
 	"aquareum.tv/aquareum/test"
 	"github.com/go-gst/go-glib/glib"
 	"github.com/go-gst/go-gst/gst"
@@ -251,15 +253,26 @@ func SelfTest(ctx context.Context) error {
 	return nil
 }
 
-func ToHLS(ctx context.Context, input io.Reader, dir string) error {
+// hlssink2 only takes whole seconds
+func hlsTargetDuration(d time.Duration) uint {
+	secs := uint(math.Ceil(d.Seconds()))
+	if secs < 1 {
+		return 1
+	}
+	return secs
+}
+
+// write an HLS playlist and its segments to dir from an mkv stream. segments
+// are named after the playlist, eg 720p.m3u8 gets 720p-00001.ts, and cut at the
+// first keyframe after targetDuration.
+func ToHLS(ctx context.Context, input io.Reader, dir, playlistName string, targetDuration time.Duration) error {
 	mainLoop := glib.NewMainLoop(glib.MainContextDefault(), false)
 
-	seg := filepath.Join(dir, "segment%05d.ts")
-	playlist := filepath.Join(dir, HLS_PLAYLIST)
+	seg := filepath.Join(dir, strings.TrimSuffix(playlistName, ".m3u8")+"-%05d.ts")
+	playlist := filepath.Join(dir, playlistName)
 	pipelineSlice := []string{
 		"appsrc name=appsrc ! matroskademux name=demux",
-		"hlssink2 name=mux target-duration=1",
-		"demux.video_0 ! queue ! h264parse ! mux.video",
+		fmt.Sprintf("hlssink2 name=mux target-duration=%d", hlsTargetDuration(targetDuration)),
 		"demux.audio_0 ! queue ! aacparse ! mux.audio",
 	}
 
@@ -272,6 +285,23 @@ func ToHLS(ctx context.Context, input io.Reader, dir string) error {
 	if err != nil {
 		return err
 	}
+	demux, err := pipeline.GetElementByName("demux")
+	if err != nil {
+		return err
+	}
+	// the video parser depends on the codec, so we can't link it up front
+	_, err = demux.Connect("pad-added", func(self *gst.Element, pad *gst.Pad) {
+		if !strings.HasPrefix(pad.GetName(), "video") {
+			return
+		}
+		err := linkVideoPad(pipeline, pad, mux)
+		if err != nil {
+			self.ErrorMessage(gst.DomainStream, gst.StreamErrorCodecNotFound, err.Error(), "")
+		}
+	})
+	if err != nil {
+		return err
+	}
 	// these two can't be set on a string or backslashes break things on windows
 	err = mux.SetProperty("location", seg)
 	if err != nil {
@@ -328,26 +358,9 @@ func ToHLS(ctx context.Context, input io.Reader, dir string) error {
 	return nil
 }
 
-func (mm *MediaManager) IngestStream(ctx context.Context, input io.Reader, ms *MediaSigner) error {
-	pipelineSlice := []string{
-		"appsrc name=streamsrc ! matroskademux name=demux",
-		"demux. ! queue ! h264parse name=parse",
-		"demux. ! queue ! aacparse name=audioparse",
-	}
-	pipeline, err := gst.NewPipelineFromString(strings.Join(pipelineSlice, "\n"))
-	if err != nil {
-		return fmt.Errorf("error creating IngestStream pipeline: %w", err)
-	}
-	defer runtime.KeepAlive(pipeline)
-	srcele, err := pipeline.GetElementByName("streamsrc")
-	if err != nil {
-		return err
-	}
-	// defer runtime.KeepAlive(srcele)
-	src := app.SrcFromElement(srcele)
-	src.SetCallbacks(&app.SourceCallbacks{
-		NeedDataFunc: readerNeedData(ctx, input),
-	})
+// hook the pipeline's "parse" (video) and "audioparse" (aac) elements up to a
+// segmenter signing with ms, then run it until EOS, an error, or ctx is done
+func (mm *MediaManager) runSigningPipeline(ctx context.Context, pipeline *gst.Pipeline, ms *MediaSigner) error {
 	parseEle, err := pipeline.GetElementByName("parse")
 	if err != nil {
 		return err
@@ -377,6 +390,8 @@ func (mm *MediaManager) IngestStream(ctx context.Context, input io.Reader, ms *M
 
 	mainLoop := glib.NewMainLoop(glib.MainContextDefault(), false)
 
+	// the first error stops the pipeline and is what we return
+	var pipelineErr error
 	pipeline.GetPipelineBus().AddWatch(func(msg *gst.Message) bool {
 		switch msg.Type() {
 
@@ -388,6 +403,9 @@ func (mm *MediaManager) IngestStream(ctx context.Context, input io.Reader, ms *M
 			if debug := err.DebugString(); debug != "" {
 				log.Log(ctx, "gstreamer debug", "message", debug)
 			}
+			if pipelineErr == nil {
+				pipelineErr = fmt.Errorf("gstreamer error: %w", err)
+			}
 			mainLoop.Quit()
 		default:
 			log.Debug(ctx, msg.String())
@@ -399,10 +417,22 @@ func (mm *MediaManager) IngestStream(ctx context.Context, input io.Reader, ms *M
 	if err != nil {
 		return err
 	}
+	defer pipeline.BlockSetState(gst.StateNull)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// EOS rather than tearing down, so the last segment gets signed
+			pipeline.SendEvent(gst.NewEOSEvent())
+		case <-done:
+		}
+	}()
 
 	mainLoop.Run()
 
-	return nil
+	return pipelineErr
 }
 
 const TESTSRC_WIDTH = 1280
@@ -414,11 +444,19 @@ type QRData struct {
 }
 
 func (mm *MediaManager) TestSource(ctx context.Context, ms *MediaSigner) error {
+	codec, ok := videoCodecs[mm.cli.TestStreamCodec]
+	if !ok {
+		return fmt.Errorf("unknown test stream codec %q", mm.cli.TestStreamCodec)
+	}
+	err := codec.available(true)
+	if err != nil {
+		return err
+	}
 	mainLoop := glib.NewMainLoop(glib.MainContextDefault(), false)
 
 	pipelineSlice := []string{
-		"h264parse name=videoparse",
-		"compositor name=comp ! videoconvert ! video/x-raw,format=I420 ! x264enc speed-preset=ultrafast key-int-max=30 ! queue ! videoparse.",
+		fmt.Sprintf("%s name=videoparse", codec.parser),
+		fmt.Sprintf("compositor name=comp ! videoconvert ! video/x-raw,format=I420 ! %s ! queue ! videoparse.", codec.encoder),
 		fmt.Sprintf(`videotestsrc is-live=true ! video/x-raw,format=AYUV,framerate=30/1,width=%d,height=%d ! comp.`, TESTSRC_WIDTH, TESTSRC_HEIGHT),
 		fmt.Sprintf("videobox border-alpha=0 top=-%d left=-%d name=box ! comp.", (TESTSRC_HEIGHT/2)-(QR_SIZE/2), (TESTSRC_WIDTH/2)-(QR_SIZE/2)),
 		"appsrc name=pngsrc ! pngdec ! videoconvert ! videorate ! video/x-raw,format=AYUV,framerate=1/1 ! box.",
@@ -519,6 +557,35 @@ func (mm *MediaManager) TestSource(ctx context.Context, ms *MediaSigner) error {
 	return g.Wait()
 }
 
+// follows along with where splitmuxsink cuts segments, so we notice one
+// running past segment-max-duration for want of a keyframe
+type keyframeWatch struct {
+	// segment-duration and segment-max-duration
+	target time.Duration
+	max    time.Duration
+
+	started   bool
+	start     time.Duration
+	requested bool
+}
+
+// note a buffer going into the segmenter, returning true if the current
+// segment has just run past max and we should ask upstream for a keyframe
+func (kw *keyframeWatch) buffer(pts time.Duration, keyframe bool) bool {
+	// splitmuxsink cuts at the first keyframe after the target
+	if !kw.started || (keyframe && pts-kw.start >= kw.target) {
+		kw.started = true
+		kw.start = pts
+		kw.requested = false
+		return false
+	}
+	if kw.max <= 0 || kw.requested || pts-kw.start < kw.max {
+		return false
+	}
+	kw.requested = true
+	return true
+}
+
 // element that takes the input stream, muxes to mp4, and signs the result
 func (mm *MediaManager) SegmentAndSignElem(ctx context.Context, ms *MediaSigner) (*gst.Element, error) {
 	// elem, err := gst.NewElement("splitmuxsink name=splitter async-finalize=true sink-factory=appsink muxer-factory=matroskamux max-size-bytes=1")
@@ -527,7 +594,10 @@ func (mm *MediaManager) SegmentAndSignElem(ctx context.Context, ms *MediaSigner)
 		"async-finalize": true,
 		"sink-factory":   "appsink",
 		"muxer-factory":  "mp4mux",
-		"max-size-bytes": 1,
+		// cuts at the first keyframe after this, and asks upstream encoders
+		// for one when we get there
+		"max-size-time":          uint64(mm.cli.SegmentDuration.Nanoseconds()),
+		"send-keyframe-requests": true,
 	})
 	if err != nil {
 		return nil, err
@@ -537,6 +607,31 @@ func (mm *MediaManager) SegmentAndSignElem(ctx context.Context, ms *MediaSigner)
 	if p == nil {
 		return nil, fmt.Errorf("failed to get video pad")
 	}
+	// segment timestamps come from the video going in, not from when we
+	// finish muxing them
+	timeline := &segmentTimeline{}
+	watch := &keyframeWatch{target: mm.cli.SegmentDuration, max: mm.cli.SegmentMaxDuration}
+	p.AddProbe(gst.PadProbeTypeBuffer, func(pad *gst.Pad, info *gst.PadProbeInfo) gst.PadProbeReturn {
+		buf := info.GetBuffer()
+		if buf == nil {
+			return gst.PadProbeOK
+		}
+		pts := buf.PresentationTimestamp().AsDuration()
+		if pts == nil {
+			return gst.PadProbeOK
+		}
+		keyframe := !buf.HasFlags(gst.BufferFlagDeltaUnit)
+		timeline.buffer(*pts, keyframe, time.Now())
+		// splitmuxsink asked for one at the target already. asking again
+		// helps if that got lost, but with nothing upstream to encode (eg
+		// passthrough ingest) we're stuck with the source's keyframe interval.
+		if watch.buffer(*pts, keyframe) {
+			log.Warn(ctx, "segment is past segment-max-duration without a keyframe, asking upstream for one", "max", watch.max)
+			ev := gst.NewCustomEvent(gst.EventTypeCustomUpstream, gst.NewStructureFromString("GstForceKeyUnit, all-headers=(boolean)true"))
+			pad.PushEvent(ev)
+		}
+		return gst.PadProbeOK
+	})
 	p = elem.GetRequestPad("audio_%u")
 	if p == nil {
 		return nil, fmt.Errorf("failed to get audio pad")
@@ -551,12 +646,18 @@ func (mm *MediaManager) SegmentAndSignElem(ctx context.Context, ms *MediaSigner)
 		appsink.SetCallbacks(&app.SinkCallbacks{
 			NewSampleFunc: writerNewSample(ctx, buf),
 			EOSFunc: func(sink *app.Sink) {
-				bs, err := ms.SignMP4(ctx, bytes.NewReader(buf.Bytes()), time.Now().UnixMilli())
+				dur, err := mp4Duration(buf.Bytes())
+				if err != nil {
+					log.Error(ctx, "error finding segment duration", "error", err)
+					return
+				}
+				start, end := timeline.segment(dur, time.Now())
+				bs, err := ms.SignMP4(ctx, bytes.NewReader(buf.Bytes()), start.UnixMilli(), end.UnixMilli())
 				if err != nil {
 					log.Error(ctx, "error signing segment", "error", err)
 					return
 				}
-				err = mm.ValidateMP4(ctx, bytes.NewReader(bs))
+				err = mm.ValidateMP4(ctx, bytes.NewReader(bs), model.SegmentSourceLocal)
 				if err != nil {
 					log.Error(ctx, "error validating segment", "error", err)
 					return
@@ -4,6 +4,7 @@ import (
 	"context"
 	"os"
 	"testing"
+	"time"
 
 	_ "aquareum.tv/aquareum/pkg/media/mediatesting"
 	"github.com/go-gst/go-gst/gst"
@@ -24,3 +25,25 @@ func TestNormalizeAudio(t *testing.T) {
 	require.NoError(t, err)
 	require.Greater(t, info.Size(), int64(0))
 }
+
+func TestKeyframeWatch(t *testing.T) {
+	kw := &keyframeWatch{target: 2 * time.Second, max: 5 * time.Second}
+	frame := time.Second / 30
+	requests := []time.Duration{}
+	// a keyframe every second for a bit, then the encoder stops sending them
+	for pts := time.Duration(0); pts < 20*time.Second; pts += frame {
+		keyframe := pts < 4*time.Second && pts%time.Second < frame
+		if kw.buffer(pts, keyframe) {
+			requests = append(requests, pts)
+		}
+	}
+	// the segment that started at 2s runs past 7s, and we only ask once
+	require.Len(t, requests, 1)
+	require.InDelta(t, float64(7*time.Second), float64(requests[0]), float64(2*frame))
+
+	// no limit, no requests
+	kw = &keyframeWatch{target: 2 * time.Second}
+	for pts := time.Duration(0); pts < 20*time.Second; pts += frame {
+		require.False(t, kw.buffer(pts, pts == 0))
+	}
+}
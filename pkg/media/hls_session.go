@@ -0,0 +1,259 @@
+package media
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"aquareum.tv/aquareum/pkg/log"
+)
+
+// a gap this big between one segment's end and the next one's start means the
+// streamer stopped and started again
+const HLS_SOURCE_GAP = time.Second
+
+// no such HLS output or playlist, or it's not been written yet
+var ErrHLSNotFound = errors.New("not found")
+
+// where the internal API reports on running HLS output
+type HLSSessionStatus struct {
+	User        string    `json:"user"`
+	Dir         string    `json:"dir"`
+	Started     time.Time `json:"started"`
+	LastViewed  time.Time `json:"lastViewed"`
+	LastSegment time.Time `json:"lastSegment"`
+	Restarts    int       `json:"restarts"`
+	LowLatency  bool      `json:"lowLatency"`
+}
+
+// media playlists for the source and each rendition
+func (mm *MediaManager) hlsPlaylists() []string {
+	playlists := []string{HLS_PLAYLIST}
+	for _, r := range mm.renditions {
+		playlists = append(playlists, r.Playlist())
+	}
+	return playlists
+}
+
+// what a playlist is written as on disk for a run, eg stream.m3u8 is
+// stream-2.m3u8 after the source's second restart
+func hlsRunPlaylist(playlist string, run int) string {
+	if run == 0 {
+		return playlist
+	}
+	return fmt.Sprintf("%s-%d.m3u8", strings.TrimSuffix(playlist, ".m3u8"), run)
+}
+
+// run a user's HLS output until ctx is done or the stream ends, starting it
+// over whenever the source restarts, then clean up after it
+func (mm *MediaManager) runHLS(ctx context.Context, user string, hls *HLSStream) {
+	for run := 0; ; run++ {
+		restarted, err := mm.runHLSOnce(ctx, user, hls, run)
+		if err != nil {
+			log.Log(ctx, "error in async segmentToHLS code", "error", err)
+		}
+		if !restarted {
+			break
+		}
+		log.Log(ctx, "source restarted, starting HLS output over", "user", user, "run", run+1)
+		offsets := mm.hlsNextOffsets(hls, run)
+		mm.hlsRunningMut.Lock()
+		hls.offsets = append(hls.offsets, offsets)
+		hls.Restarts = run + 1
+		mm.hlsRunningMut.Unlock()
+	}
+	for _, pl := range hls.LowLatency {
+		pl.end()
+	}
+	mm.endHLS(user, hls)
+	err := os.RemoveAll(hls.Dir)
+	if err != nil {
+		log.Error(ctx, "error removing HLS dir", "dir", hls.Dir, "error", err)
+	}
+}
+
+// one run of HLS output, returning early with restarted set if the source
+// restarts partway through
+func (mm *MediaManager) runHLSOnce(ctx context.Context, user string, hls *HLSStream, run int) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	segs := mm.SubscribeSegment(ctx, user, "")
+	done := make(chan error, 1)
+	go func() {
+		if hls.LowLatency != nil {
+			if run > 0 {
+				for _, pl := range hls.LowLatency {
+					pl.restart()
+				}
+			}
+			done <- mm.SegmentToLLHLS(ctx, user, hls.LowLatency)
+		} else {
+			done <- mm.SegmentToHLS(ctx, user, hls.Dir, run)
+		}
+	}()
+	var prevEnd time.Time
+	for {
+		select {
+		case err := <-done:
+			return false, err
+		case file, ok := <-segs:
+			if !ok {
+				segs = nil
+				continue
+			}
+			start, end, ok := mm.segments.span(user, file)
+			if !ok {
+				continue
+			}
+			if sourceRestarted(prevEnd, start) {
+				cancel()
+				<-done
+				return true, nil
+			}
+			prevEnd = end
+		}
+	}
+}
+
+// whether a segment starting at start can't have followed on from one that
+// ended at prevEnd
+func sourceRestarted(prevEnd, start time.Time) bool {
+	if prevEnd.IsZero() {
+		return false
+	}
+	gap := start.Sub(prevEnd)
+	return gap > HLS_SOURCE_GAP || gap < -HLS_SOURCE_GAP
+}
+
+// where each playlist's media sequence numbers carry on from after a run,
+// which is after the last segment it listed
+func (mm *MediaManager) hlsNextOffsets(hls *HLSStream, run int) map[string]int {
+	mm.hlsRunningMut.Lock()
+	prev := hls.offsets[run]
+	mm.hlsRunningMut.Unlock()
+	offsets := map[string]int{}
+	for _, playlist := range mm.hlsPlaylists() {
+		offsets[playlist] = prev[playlist]
+		bs, err := os.ReadFile(filepath.Join(hls.Dir, hlsRunPlaylist(playlist, run)))
+		if err != nil {
+			continue
+		}
+		seq, count := hlsPlaylistSequence(string(bs))
+		offsets[playlist] += seq + count
+	}
+	return offsets
+}
+
+// the latest run's version of a playlist, or the one before if it's not been
+// written yet, along with which run it's from and its offset
+func (mm *MediaManager) hlsPlaylistFile(hls *HLSStream, playlist string) ([]byte, int, int, error) {
+	mm.hlsRunningMut.Lock()
+	latest := hls.Restarts
+	offsets := hls.offsets
+	mm.hlsRunningMut.Unlock()
+	for run := latest; run >= 0; run-- {
+		bs, err := os.ReadFile(filepath.Join(hls.Dir, hlsRunPlaylist(playlist, run)))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		return bs, run, offsets[run][playlist], nil
+	}
+	return nil, 0, 0, fmt.Errorf("%w: no playlist %s", ErrHLSNotFound, playlist)
+}
+
+// one of a user's HLS media playlists, eg stream.m3u8, numbered so players
+// see one continuous playlist across source restarts
+func (mm *MediaManager) HLSPlaylist(user, playlist string) ([]byte, error) {
+	mm.hlsRunningMut.Lock()
+	hls, ok := mm.hlsRunning[user]
+	mm.hlsRunningMut.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: no HLS output for %s", ErrHLSNotFound, user)
+	}
+	bs, run, offset, err := mm.hlsPlaylistFile(hls, playlist)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(rewriteHLSPlaylist(string(bs), run, offset)), nil
+}
+
+// the media sequence number of a playlist's first segment and how many
+// segments it lists
+func hlsPlaylistSequence(m3u8 string) (int, int) {
+	seq := 0
+	count := 0
+	for _, line := range strings.Split(m3u8, "\n") {
+		if after, ok := strings.CutPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"); ok {
+			seq, _ = strconv.Atoi(strings.TrimSpace(after))
+		}
+		if strings.HasPrefix(line, "#EXTINF:") {
+			count += 1
+		}
+	}
+	return seq, count
+}
+
+// renumber a playlist hlssink2 wrote for a run so it carries on from the runs
+// before it, with a discontinuity where each one started
+func rewriteHLSPlaylist(m3u8 string, run, offset int) string {
+	seq, _ := hlsPlaylistSequence(m3u8)
+	tags := []string{fmt.Sprintf("#EXT-X-MEDIA-SEQUENCE:%d", seq+offset)}
+	// the discontinuity before this run's first segment only counts once that
+	// segment's gone from the playlist
+	discontinuity := run > 0 && seq == 0
+	if discontinuity {
+		tags = append(tags, fmt.Sprintf("#EXT-X-DISCONTINUITY-SEQUENCE:%d", run-1))
+	} else if run > 0 {
+		tags = append(tags, fmt.Sprintf("#EXT-X-DISCONTINUITY-SEQUENCE:%d", run))
+	}
+	lines := []string{}
+	inserted := false
+	for _, line := range strings.Split(strings.TrimSuffix(m3u8, "\n"), "\n") {
+		if strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE:") {
+			continue
+		}
+		if !inserted && strings.HasPrefix(line, "#EXTINF:") {
+			lines = append(lines, tags...)
+			if discontinuity {
+				lines = append(lines, "#EXT-X-DISCONTINUITY")
+			}
+			inserted = true
+		}
+		lines = append(lines, line)
+	}
+	if !inserted {
+		lines = append(lines, tags...)
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// everyone's running HLS output, for the internal API
+func (mm *MediaManager) HLSSessions() []HLSSessionStatus {
+	mm.hlsRunningMut.Lock()
+	defer mm.hlsRunningMut.Unlock()
+	sessions := []HLSSessionStatus{}
+	for user, hls := range mm.hlsRunning {
+		sessions = append(sessions, HLSSessionStatus{
+			User:        user,
+			Dir:         hls.Dir,
+			Started:     hls.Started,
+			LastViewed:  hls.LastViewed,
+			LastSegment: mm.segments.lastPublished(user),
+			Restarts:    hls.Restarts,
+			LowLatency:  hls.LowLatency != nil,
+		})
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].User < sessions[j].User
+	})
+	return sessions
+}
@@ -0,0 +1,52 @@
+package media
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// what hlssink2 writes
+func testHLSPlaylist(seq int, segments ...string) string {
+	m3u8 := fmt.Sprintf("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-ALLOW-CACHE:NO\n#EXT-X-MEDIA-SEQUENCE:%d\n#EXT-X-TARGETDURATION:2\n\n", seq)
+	for _, seg := range segments {
+		m3u8 += "#EXTINF:2,\n" + seg + "\n"
+	}
+	return m3u8
+}
+
+func TestHLSPlaylistSequence(t *testing.T) {
+	seq, count := hlsPlaylistSequence(testHLSPlaylist(4, "stream-00004.ts", "stream-00005.ts"))
+	require.Equal(t, 4, seq)
+	require.Equal(t, 2, count)
+}
+
+func TestRewriteHLSPlaylist(t *testing.T) {
+	// the first run passes through apart from where the sequence goes
+	m3u8 := testHLSPlaylist(3, "stream-00003.ts")
+	require.Equal(t, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-ALLOW-CACHE:NO\n#EXT-X-TARGETDURATION:2\n\n#EXT-X-MEDIA-SEQUENCE:3\n#EXTINF:2,\nstream-00003.ts\n", rewriteHLSPlaylist(m3u8, 0, 0))
+
+	// a new run starts with a discontinuity and carries on numbering
+	m3u8 = testHLSPlaylist(0, "stream-2-00000.ts", "stream-2-00001.ts")
+	require.Equal(t, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-ALLOW-CACHE:NO\n#EXT-X-TARGETDURATION:2\n\n#EXT-X-MEDIA-SEQUENCE:12\n#EXT-X-DISCONTINUITY-SEQUENCE:1\n#EXT-X-DISCONTINUITY\n#EXTINF:2,\nstream-2-00000.ts\n#EXTINF:2,\nstream-2-00001.ts\n", rewriteHLSPlaylist(m3u8, 2, 12))
+
+	// which is only counted once its first segment's gone
+	m3u8 = testHLSPlaylist(1, "stream-2-00001.ts")
+	require.Equal(t, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-ALLOW-CACHE:NO\n#EXT-X-TARGETDURATION:2\n\n#EXT-X-MEDIA-SEQUENCE:13\n#EXT-X-DISCONTINUITY-SEQUENCE:2\n#EXTINF:2,\nstream-2-00001.ts\n", rewriteHLSPlaylist(m3u8, 2, 12))
+}
+
+func TestHLSRunPlaylist(t *testing.T) {
+	require.Equal(t, "stream.m3u8", hlsRunPlaylist("stream.m3u8", 0))
+	require.Equal(t, "720p-3.m3u8", hlsRunPlaylist("720p.m3u8", 3))
+}
+
+func TestSourceRestarted(t *testing.T) {
+	now := time.Now()
+	require.False(t, sourceRestarted(time.Time{}, now))
+	require.False(t, sourceRestarted(now, now.Add(100*time.Millisecond)))
+	require.False(t, sourceRestarted(now, now.Add(-100*time.Millisecond)))
+	require.True(t, sourceRestarted(now, now.Add(5*time.Second)))
+	require.True(t, sourceRestarted(now, now.Add(-5*time.Second)))
+}
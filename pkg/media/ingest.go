@@ -0,0 +1,265 @@
+package media
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+	"sync"
+
+	"aquareum.tv/aquareum/pkg/log"
+	"github.com/go-gst/go-gst/gst"
+	"github.com/go-gst/go-gst/gst/app"
+)
+
+// an incoming stream in a container or with codecs we can't segment. wrapped
+// with details, so check for it with errors.Is.
+var ErrUnsupportedInput = errors.New("unsupported input")
+
+// demuxers for the containers typefind can find in an incoming stream
+var ingestDemuxers = map[string]string{
+	"video/x-matroska": "matroskademux",
+	"video/webm":       "matroskademux",
+	"video/mpegts":     "tsdemux",
+	"video/quicktime":  "qtdemux",
+	"video/x-flv":      "flvdemux",
+}
+
+// segment and sign an incoming stream, eg from OBS over HTTP. the container
+// (mkv, MPEG-TS, fragmented mp4 or flv) is autodetected, and it needs to carry
+// H.264, H.265 or AV1 video and AAC audio.
+func (mm *MediaManager) IngestStream(ctx context.Context, input io.Reader, ms *MediaSigner) error {
+	return mm.ingest(ctx, "", input, ms)
+}
+
+// segment and sign an incoming flv stream, eg from the RTMP server
+func (mm *MediaManager) IngestFLV(ctx context.Context, input io.Reader, ms *MediaSigner) error {
+	return mm.ingest(ctx, "flvdemux", input, ms)
+}
+
+// segment and sign an incoming MPEG-TS stream, eg from the SRT listener
+func (mm *MediaManager) IngestMPEGTS(ctx context.Context, input io.Reader, ms *MediaSigner) error {
+	return mm.ingest(ctx, "tsdemux", input, ms)
+}
+
+// an empty demuxer means we typefind the input to pick one
+func (mm *MediaManager) ingest(ctx context.Context, demuxer string, input io.Reader, ms *MediaSigner) error {
+	pipelineSlice := []string{
+		"appsrc name=streamsrc",
+		// the video parser gets plugged in front of this once we know the codec
+		"identity name=parse",
+		"queue name=audioqueue ! aacparse name=audioparse",
+	}
+	pipeline, err := gst.NewPipelineFromString(strings.Join(pipelineSlice, "\n"))
+	if err != nil {
+		return fmt.Errorf("error creating IngestStream pipeline: %w", err)
+	}
+	defer runtime.KeepAlive(pipeline)
+	srcele, err := pipeline.GetElementByName("streamsrc")
+	if err != nil {
+		return err
+	}
+	src := app.SrcFromElement(srcele)
+	src.SetCallbacks(&app.SourceCallbacks{
+		NeedDataFunc: readerNeedData(ctx, input),
+	})
+	tracks := &ingestTracks{ctx: ctx, pipeline: pipeline}
+	if demuxer == "" {
+		err = tracks.typefind(srcele)
+	} else {
+		err = tracks.demux(srcele, demuxer)
+	}
+	if err != nil {
+		return err
+	}
+	err = mm.runSigningPipeline(ctx, pipeline, ms)
+	tracks.mut.Lock()
+	defer tracks.mut.Unlock()
+	if tracks.err != nil {
+		return tracks.err
+	}
+	if err != nil && tracks.container == "" {
+		return fmt.Errorf("%w: couldn't detect a container: %w", ErrUnsupportedInput, err)
+	}
+	return err
+}
+
+// plugs a demuxer for the incoming stream and links the tracks it finds to our
+// video and aac branches, turning the stream away if it can't feed both rather
+// than letting the segmenter wait forever
+type ingestTracks struct {
+	ctx      context.Context
+	pipeline *gst.Pipeline
+
+	mut       sync.Mutex
+	container string
+	found     []string
+	video     bool
+	audio     bool
+	err       error
+}
+
+func (t *ingestTracks) typefind(upstream *gst.Element) error {
+	typefind, err := gst.NewElement("typefind")
+	if err != nil {
+		return err
+	}
+	err = t.pipeline.Add(typefind)
+	if err != nil {
+		return err
+	}
+	_, err = typefind.Connect("have-type", func(self *gst.Element, probability uint, caps *gst.Caps) {
+		name := caps.GetStructureAt(0).Name()
+		demuxer, ok := ingestDemuxers[name]
+		if !ok {
+			t.reject(self, fmt.Errorf("%w: unsupported container %s", ErrUnsupportedInput, name))
+			return
+		}
+		log.Log(t.ctx, "detected ingest container", "caps", caps.String(), "demuxer", demuxer)
+		err := t.demux(self, demuxer)
+		if err != nil {
+			t.reject(self, fmt.Errorf("error adding %s: %w", demuxer, err))
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return upstream.Link(typefind)
+}
+
+func (t *ingestTracks) demux(upstream *gst.Element, demuxer string) error {
+	t.mut.Lock()
+	t.container = demuxer
+	t.mut.Unlock()
+	demux, err := gst.NewElement(demuxer)
+	if err != nil {
+		return err
+	}
+	err = t.pipeline.Add(demux)
+	if err != nil {
+		return err
+	}
+	_, err = demux.Connect("pad-added", t.padAdded)
+	if err != nil {
+		return err
+	}
+	_, err = demux.Connect("no-more-pads", t.noMorePads)
+	if err != nil {
+		return err
+	}
+	err = upstream.Link(demux)
+	if err != nil {
+		return err
+	}
+	if !demux.SyncStateWithParent() {
+		return fmt.Errorf("couldn't start %s", demuxer)
+	}
+	return nil
+}
+
+func (t *ingestTracks) padAdded(demux *gst.Element, pad *gst.Pad) {
+	caps := pad.GetCurrentCaps()
+	if caps == nil || caps.GetSize() == 0 {
+		log.Log(t.ctx, "ignoring demuxed track without caps", "pad", pad.GetName())
+		return
+	}
+	s := caps.GetStructureAt(0)
+	mpegversion, _ := s.GetValue("mpegversion")
+	version, _ := mpegversion.(int)
+	track := describeTrack(s.Name(), version)
+	t.mut.Lock()
+	t.found = append(t.found, track)
+	t.mut.Unlock()
+
+	branch := ingestBranch(s.Name(), version)
+	if branch == "" {
+		log.Log(t.ctx, "ignoring unsupported track", "track", track)
+		return
+	}
+	t.mut.Lock()
+	linked := (branch == "video" && t.video) || (branch == "audio" && t.audio)
+	t.mut.Unlock()
+	if linked {
+		log.Log(t.ctx, "ignoring extra track", "track", track)
+		return
+	}
+	err := t.link(branch, pad)
+	if err != nil {
+		t.reject(demux, fmt.Errorf("error linking %s track: %w", track, err))
+		return
+	}
+	t.mut.Lock()
+	if branch == "video" {
+		t.video = true
+	} else {
+		t.audio = true
+	}
+	t.mut.Unlock()
+	log.Debug(t.ctx, "linked ingest track", "track", track, "branch", branch)
+}
+
+func (t *ingestTracks) link(branch string, pad *gst.Pad) error {
+	if branch == "video" {
+		parse, err := t.pipeline.GetElementByName("parse")
+		if err != nil {
+			return err
+		}
+		return linkVideoPad(t.pipeline, pad, parse)
+	}
+	queue, err := t.pipeline.GetElementByName("audioqueue")
+	if err != nil {
+		return err
+	}
+	ret := pad.Link(queue.GetStaticPad("sink"))
+	if ret != gst.PadLinkOK {
+		return fmt.Errorf("%v", ret)
+	}
+	return nil
+}
+
+func (t *ingestTracks) noMorePads(demux *gst.Element) {
+	t.mut.Lock()
+	complete := t.video && t.audio
+	found := strings.Join(t.found, ", ")
+	t.mut.Unlock()
+	if complete {
+		return
+	}
+	if found == "" {
+		found = "no tracks"
+	}
+	t.reject(demux, fmt.Errorf("%w: need H.264, H.265 or AV1 video and AAC audio, got %s", ErrUnsupportedInput, found))
+}
+
+// keep the first reason we turned the stream away and post it to the bus, which
+// stops the pipeline
+func (t *ingestTracks) reject(elem *gst.Element, err error) {
+	log.Log(t.ctx, "rejecting ingest stream", "error", err)
+	t.mut.Lock()
+	if t.err == nil {
+		t.err = err
+	}
+	t.mut.Unlock()
+	elem.ErrorMessage(gst.DomainStream, gst.StreamErrorCodecNotFound, err.Error(), "")
+}
+
+// which of our branches a demuxed track can feed, or "" if none
+func ingestBranch(name string, mpegversion int) string {
+	if _, ok := videoCodecForCaps(name); ok {
+		return "video"
+	}
+	if name == "audio/mpeg" && (mpegversion == 2 || mpegversion == 4) {
+		return "audio"
+	}
+	return ""
+}
+
+// audio/mpeg covers both mp3 and aac, so say which
+func describeTrack(name string, mpegversion int) string {
+	if name == "audio/mpeg" {
+		return fmt.Sprintf("%s (mpegversion %d)", name, mpegversion)
+	}
+	return name
+}
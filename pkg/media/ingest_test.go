@@ -0,0 +1,77 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	_ "aquareum.tv/aquareum/pkg/media/mediatesting"
+	"github.com/go-gst/go-gst/gst"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIngestBranch(t *testing.T) {
+	tests := []struct {
+		name        string
+		mpegversion int
+		branch      string
+	}{
+		{name: "video/x-h264", branch: "video"},
+		{name: "video/x-h265", branch: "video"},
+		{name: "video/x-av1", branch: "video"},
+		{name: "audio/mpeg", mpegversion: 4, branch: "audio"},
+		{name: "audio/mpeg", mpegversion: 2, branch: "audio"},
+		{name: "audio/mpeg", mpegversion: 1, branch: ""},
+		{name: "video/x-vp8", branch: ""},
+		{name: "audio/x-opus", branch: ""},
+	}
+	for _, tt := range tests {
+		t.Run(describeTrack(tt.name, tt.mpegversion), func(t *testing.T) {
+			require.Equal(t, tt.branch, ingestBranch(tt.name, tt.mpegversion))
+		})
+	}
+}
+
+func TestIngestStreamContainers(t *testing.T) {
+	gst.Init(nil)
+	fixtures := map[string]string{
+		"sample-stream.mkv": getFixture("sample-stream.mkv"),
+		"video.mpegts":      getFixture("video.mpegts"),
+		"fragmented.mp4":    makeFragmentedMP4(t),
+	}
+	for name, fixture := range fixtures {
+		t.Run(name, func(t *testing.T) {
+			f, err := os.Open(fixture)
+			require.NoError(t, err)
+			defer f.Close()
+			mm, ms := getStaticTestMediaManager(t)
+			err = mm.IngestStream(context.Background(), f, ms)
+			require.NoError(t, err)
+		})
+	}
+}
+
+// remux sample-stream.mkv into fragmented mp4, like OBS's hybrid mp4 output or
+// ffmpeg -movflags frag_keyframe+empty_moov
+func makeFragmentedMP4(t *testing.T) string {
+	out := filepath.Join(t.TempDir(), "fragmented.mp4")
+	runTestPipeline(t, fmt.Sprintf(
+		"filesrc location=%s ! matroskademux name=demux "+
+			"mp4mux name=mux fragment-duration=1000 streamable=true ! filesink location=%s "+
+			"demux.video_0 ! queue ! h264parse ! mux. "+
+			"demux.audio_0 ! queue ! aacparse ! mux.",
+		getFixture("sample-stream.mkv"), out,
+	))
+	return out
+}
+
+func TestIngestStreamUnsupported(t *testing.T) {
+	gst.Init(nil)
+	mm, ms := getStaticTestMediaManager(t)
+	garbage := bytes.Repeat([]byte("definitely not a video "), 1000)
+	err := mm.IngestStream(context.Background(), bytes.NewReader(garbage), ms)
+	require.ErrorIs(t, err, ErrUnsupportedInput)
+}
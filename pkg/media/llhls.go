@@ -0,0 +1,468 @@
+package media
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how long each CMAF partial segment plays for, at most
+const LLHLS_PART_TARGET = 333 * time.Millisecond
+
+// how many complete segments an LL-HLS playlist keeps
+const LLHLS_SEGMENTS_KEPT = 10
+
+// how many of the latest complete segments still list their parts
+const LLHLS_PART_SEGMENTS = 3
+
+// muxer options for the fragmented mp4 LL-HLS playlists are fed with. a new
+// fragment, and so a new part, starts at every keyframe and at the part target.
+var llhlsMuxerOpts = map[string]string{
+	"movflags":      MP4_STREAM_MOVFLAGS,
+	"frag_duration": strconv.FormatInt(LLHLS_PART_TARGET.Microseconds(), 10),
+}
+
+var (
+	// no such LL-HLS playlist, segment or part, or it's aged out
+	ErrLLHLSNotFound = errors.New("not found")
+	// a blocking request for a segment more than two past the latest
+	ErrLLHLSTooFarAhead = errors.New("too far ahead of the live edge")
+	// the stream behind the playlist stopped
+	ErrLLHLSEnded = errors.New("stream ended")
+)
+
+// the kinds of file an LL-HLS playlist serves
+type LLHLSFileKind int
+
+const (
+	LLHLSFilePlaylist LLHLSFileKind = iota
+	LLHLSFileInit
+	LLHLSFileSegment
+	LLHLSFilePart
+)
+
+type llhlsPart struct {
+	data        []byte
+	duration    time.Duration
+	independent bool
+}
+
+type llhlsSegment struct {
+	msn      int
+	parts    []llhlsPart
+	duration time.Duration
+	complete bool
+	// which init segment it needs
+	init int
+	// first segment after the source restarted
+	discontinuity bool
+}
+
+// a low-latency HLS media playlist, built in memory from a fragmented mp4
+// stream with each fragment as a partial segment. supports blocking playlist
+// reload and preload hints, so players can wait on the next part rather than
+// polling for it.
+type LLHLSPlaylist struct {
+	name string
+	// cut a new segment at the first keyframe after this
+	target time.Duration
+
+	mut sync.Mutex
+	// init segments by version, one per time the source started
+	inits    map[int][]byte
+	initSeq  int
+	segments []*llhlsSegment
+	ended    bool
+	// the next part starts a new segment whatever it is
+	restarted bool
+	// discontinuities that have aged out of the playlist
+	discontinuities int
+	// closed and replaced whenever anything changes
+	changed chan struct{}
+}
+
+// segments and parts get named after the playlist, eg stream.m3u8 gets
+// stream-12.3.mp4
+func NewLLHLSPlaylist(playlist string, target time.Duration) *LLHLSPlaylist {
+	return &LLHLSPlaylist{
+		name:    strings.TrimSuffix(playlist, ".m3u8"),
+		target:  target,
+		inits:   map[int][]byte{},
+		initSeq: -1,
+		changed: make(chan struct{}),
+	}
+}
+
+// the first init segment keeps the plain name, later ones get a version
+func (pl *LLHLSPlaylist) initURI(version int) string {
+	if version <= 0 {
+		return pl.name + "-init.mp4"
+	}
+	return fmt.Sprintf("%s-init-%d.mp4", pl.name, version)
+}
+
+func (pl *LLHLSPlaylist) segmentURI(msn int) string {
+	return fmt.Sprintf("%s-%d.mp4", pl.name, msn)
+}
+
+func (pl *LLHLSPlaylist) partURI(msn, part int) string {
+	return fmt.Sprintf("%s-%d.%d.mp4", pl.name, msn, part)
+}
+
+var llhlsFileRegex = regexp.MustCompile(`^([a-z0-9]+)(?:(\.m3u8)|(-init(?:-(\d+))?\.mp4)|-(\d+)\.mp4|-(\d+)\.(\d+)\.mp4)$`)
+
+// figure out which playlist a requested file belongs to and what it is, eg
+// 720p-12.3.mp4 is part 3 of segment 12 of 720p.m3u8. for init segments the
+// msn is their version.
+func ParseLLHLSFile(file string) (string, LLHLSFileKind, int, int, error) {
+	m := llhlsFileRegex.FindStringSubmatch(file)
+	if m == nil {
+		return "", 0, 0, 0, fmt.Errorf("%w: unknown file %s", ErrLLHLSNotFound, file)
+	}
+	playlist := m[1] + ".m3u8"
+	switch {
+	case m[2] != "":
+		return playlist, LLHLSFilePlaylist, 0, 0, nil
+	case m[3] != "":
+		if m[4] == "" {
+			return playlist, LLHLSFileInit, 0, 0, nil
+		}
+		version, err := strconv.Atoi(m[4])
+		return playlist, LLHLSFileInit, version, 0, err
+	case m[5] != "":
+		msn, err := strconv.Atoi(m[5])
+		return playlist, LLHLSFileSegment, msn, 0, err
+	}
+	msn, err := strconv.Atoi(m[6])
+	if err != nil {
+		return "", 0, 0, 0, err
+	}
+	part, err := strconv.Atoi(m[7])
+	return playlist, LLHLSFilePart, msn, part, err
+}
+
+// read a fragmented mp4 stream into the playlist until it ends. the playlist
+// only ends with the stream; if ctx is cancelled first it's left open, so
+// another stream can carry on where this one left off.
+func (pl *LLHLSPlaylist) Ingest(ctx context.Context, r io.Reader) error {
+	var init []byte
+	var track fmp4Track
+	var moof []byte
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		typ, box, err := readMP4Box(r)
+		if errors.Is(err, io.EOF) {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			pl.end()
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case "ftyp":
+			init = box
+		case "moov":
+			track, err = fmp4VideoTrack(box[8:])
+			if err != nil {
+				return err
+			}
+			pl.setInit(append(init, box...))
+		case "moof":
+			moof = box
+		case "mdat":
+			if moof == nil {
+				return fmt.Errorf("mp4 mdat without a moof")
+			}
+			dur, independent, err := fmp4Fragment(moof[8:], track)
+			if err != nil {
+				return err
+			}
+			pl.addPart(append(moof, box...), dur, independent)
+			moof = nil
+		}
+	}
+}
+
+func (pl *LLHLSPlaylist) setInit(init []byte) {
+	pl.mut.Lock()
+	defer pl.mut.Unlock()
+	pl.initSeq += 1
+	pl.inits[pl.initSeq] = init
+	pl.notify()
+}
+
+// the source restarted, so whatever comes next starts a new segment after a
+// discontinuity
+func (pl *LLHLSPlaylist) restart() {
+	pl.mut.Lock()
+	defer pl.mut.Unlock()
+	pl.restarted = true
+}
+
+func (pl *LLHLSPlaylist) addPart(data []byte, dur time.Duration, independent bool) {
+	pl.mut.Lock()
+	defer pl.mut.Unlock()
+	var cur *llhlsSegment
+	if len(pl.segments) > 0 {
+		cur = pl.segments[len(pl.segments)-1]
+	}
+	if cur == nil || pl.restarted || (independent && pl.due(cur)) {
+		next := &llhlsSegment{init: pl.initSeq}
+		if cur != nil {
+			cur.complete = true
+			next.msn = cur.msn + 1
+			next.discontinuity = pl.restarted
+		}
+		pl.restarted = false
+		cur = next
+		pl.segments = append(pl.segments, cur)
+		// the in-progress segment doesn't count towards what we keep
+		if len(pl.segments) > LLHLS_SEGMENTS_KEPT+1 {
+			drop := len(pl.segments) - LLHLS_SEGMENTS_KEPT - 1
+			for _, seg := range pl.segments[:drop] {
+				if seg.discontinuity {
+					pl.discontinuities += 1
+				}
+			}
+			pl.segments = pl.segments[drop:]
+			for version := range pl.inits {
+				if version < pl.segments[0].init {
+					delete(pl.inits, version)
+				}
+			}
+		}
+	}
+	cur.parts = append(cur.parts, llhlsPart{data: data, duration: dur, independent: independent})
+	cur.duration += dur
+	pl.notify()
+}
+
+// whether a segment is long enough to end at the next keyframe
+func (pl *LLHLSPlaylist) due(seg *llhlsSegment) bool {
+	return seg.duration >= pl.target-LLHLS_PART_TARGET/2
+}
+
+func (pl *LLHLSPlaylist) end() {
+	pl.mut.Lock()
+	defer pl.mut.Unlock()
+	pl.ended = true
+	pl.notify()
+}
+
+// call with mut held
+func (pl *LLHLSPlaylist) notify() {
+	close(pl.changed)
+	pl.changed = make(chan struct{})
+}
+
+// block until ready returns true or an error, with mut held while it runs
+func (pl *LLHLSPlaylist) wait(ctx context.Context, ready func() (bool, error)) error {
+	for {
+		pl.mut.Lock()
+		ok, err := ready()
+		ended := pl.ended
+		changed := pl.changed
+		pl.mut.Unlock()
+		if err != nil || ok {
+			return err
+		}
+		if ended {
+			return ErrLLHLSEnded
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// whether we have part of segment msn, or all of it if part is negative.
+// call with mut held.
+func (pl *LLHLSPlaylist) has(msn, part int) (bool, error) {
+	if len(pl.segments) == 0 {
+		return false, nil
+	}
+	first := pl.segments[0]
+	last := pl.segments[len(pl.segments)-1]
+	if msn < first.msn {
+		return false, fmt.Errorf("%w: segment %d has aged out", ErrLLHLSNotFound, msn)
+	}
+	if msn > last.msn+2 {
+		return false, fmt.Errorf("%w: segment %d, latest is %d", ErrLLHLSTooFarAhead, msn, last.msn)
+	}
+	if msn > last.msn {
+		return false, nil
+	}
+	seg := pl.segments[msn-first.msn]
+	if part < 0 {
+		return seg.complete, nil
+	}
+	if part < len(seg.parts) {
+		return true, nil
+	}
+	if seg.complete {
+		return false, fmt.Errorf("%w: segment %d only has %d parts", ErrLLHLSNotFound, msn, len(seg.parts))
+	}
+	return false, nil
+}
+
+// the media playlist, once it has part of segment msn (or all of it if part is
+// negative), for blocking playlist reloads. a negative msn doesn't wait for
+// anything past the first segment.
+func (pl *LLHLSPlaylist) Render(ctx context.Context, msn, part int) (string, error) {
+	err := pl.wait(ctx, func() (bool, error) {
+		if msn < 0 {
+			return len(pl.segments) > 0, nil
+		}
+		return pl.has(msn, part)
+	})
+	if err != nil {
+		return "", err
+	}
+	pl.mut.Lock()
+	defer pl.mut.Unlock()
+	return pl.render(), nil
+}
+
+// call with mut held
+func (pl *LLHLSPlaylist) render() string {
+	targetDuration := pl.target
+	for _, seg := range pl.segments {
+		if seg.complete && seg.duration > targetDuration {
+			targetDuration = seg.duration
+		}
+	}
+	lines := []string{
+		"#EXTM3U",
+		"#EXT-X-VERSION:9",
+		fmt.Sprintf("#EXT-X-TARGETDURATION:%d", int(math.Ceil(targetDuration.Seconds()))),
+		fmt.Sprintf("#EXT-X-PART-INF:PART-TARGET=%.3f", LLHLS_PART_TARGET.Seconds()),
+		fmt.Sprintf("#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f", (3 * LLHLS_PART_TARGET).Seconds()),
+		fmt.Sprintf("#EXT-X-MEDIA-SEQUENCE:%d", pl.segments[0].msn),
+	}
+	if pl.discontinuities > 0 {
+		lines = append(lines, fmt.Sprintf("#EXT-X-DISCONTINUITY-SEQUENCE:%d", pl.discontinuities))
+	}
+	lines = append(lines, fmt.Sprintf("#EXT-X-MAP:URI=\"%s\"", pl.initURI(pl.segments[0].init)))
+	for i, seg := range pl.segments {
+		if seg.discontinuity {
+			lines = append(lines, "#EXT-X-DISCONTINUITY")
+			if i > 0 {
+				lines = append(lines, fmt.Sprintf("#EXT-X-MAP:URI=\"%s\"", pl.initURI(seg.init)))
+			}
+		}
+		if len(pl.segments)-i <= LLHLS_PART_SEGMENTS+1 {
+			for j, part := range seg.parts {
+				line := fmt.Sprintf("#EXT-X-PART:DURATION=%.3f,URI=\"%s\"", part.duration.Seconds(), pl.partURI(seg.msn, j))
+				if part.independent {
+					line += ",INDEPENDENT=YES"
+				}
+				lines = append(lines, line)
+			}
+		}
+		if !seg.complete {
+			continue
+		}
+		lines = append(lines,
+			fmt.Sprintf("#EXTINF:%.3f,", seg.duration.Seconds()),
+			pl.segmentURI(seg.msn),
+		)
+	}
+	if !pl.ended {
+		// the next part starts a new segment if it's a keyframe, which it
+		// usually is once the segment is due to end
+		last := pl.segments[len(pl.segments)-1]
+		hint := pl.partURI(last.msn, len(last.parts))
+		if pl.restarted || pl.due(last) {
+			hint = pl.partURI(last.msn+1, 0)
+		}
+		lines = append(lines, fmt.Sprintf("#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"%s\"", hint))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// an init segment with the stream's moov box. there's a new version each time
+// the source restarts.
+func (pl *LLHLSPlaylist) Init(ctx context.Context, version int) ([]byte, error) {
+	var init []byte
+	err := pl.wait(ctx, func() (bool, error) {
+		init = pl.inits[version]
+		if init != nil {
+			return true, nil
+		}
+		if version <= pl.initSeq {
+			return false, fmt.Errorf("%w: init segment %d has aged out", ErrLLHLSNotFound, version)
+		}
+		if version > pl.initSeq+1 {
+			return false, fmt.Errorf("%w: init segment %d, latest is %d", ErrLLHLSTooFarAhead, version, pl.initSeq)
+		}
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return init, nil
+}
+
+// a whole segment, waiting for it to finish if it's in progress
+func (pl *LLHLSPlaylist) Segment(ctx context.Context, msn int) ([]byte, error) {
+	err := pl.wait(ctx, func() (bool, error) {
+		return pl.has(msn, -1)
+	})
+	if err != nil {
+		return nil, err
+	}
+	pl.mut.Lock()
+	defer pl.mut.Unlock()
+	seg, err := pl.segment(msn)
+	if err != nil {
+		return nil, err
+	}
+	data := []byte{}
+	for _, part := range seg.parts {
+		data = append(data, part.data...)
+	}
+	return data, nil
+}
+
+// a partial segment, waiting for it if it's the one in the preload hint
+func (pl *LLHLSPlaylist) Part(ctx context.Context, msn, part int) ([]byte, error) {
+	if part < 0 {
+		return nil, fmt.Errorf("%w: part %d", ErrLLHLSNotFound, part)
+	}
+	err := pl.wait(ctx, func() (bool, error) {
+		return pl.has(msn, part)
+	})
+	if err != nil {
+		return nil, err
+	}
+	pl.mut.Lock()
+	defer pl.mut.Unlock()
+	seg, err := pl.segment(msn)
+	if err != nil {
+		return nil, err
+	}
+	return seg.parts[part].data, nil
+}
+
+// call with mut held, after has says we have it
+func (pl *LLHLSPlaylist) segment(msn int) (*llhlsSegment, error) {
+	// it might have aged out since we checked
+	if len(pl.segments) == 0 || msn < pl.segments[0].msn {
+		return nil, fmt.Errorf("%w: segment %d has aged out", ErrLLHLSNotFound, msn)
+	}
+	return pl.segments[msn-pl.segments[0].msn], nil
+}
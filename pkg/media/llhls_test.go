@@ -0,0 +1,291 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testBox(typ string, body ...[]byte) []byte {
+	bs := bytes.Join(body, nil)
+	out := binary.BigEndian.AppendUint32(nil, uint32(len(bs)+8))
+	out = append(out, typ...)
+	return append(out, bs...)
+}
+
+func u32s(vals ...uint32) []byte {
+	out := []byte{}
+	for _, v := range vals {
+		out = binary.BigEndian.AppendUint32(out, v)
+	}
+	return out
+}
+
+// init segment with a 90khz video track 1 and an audio track 2
+func testFMP4Init() []byte {
+	trak := func(id uint32, handler string) []byte {
+		return testBox("trak",
+			// version/flags, creation, modification, track id
+			testBox("tkhd", u32s(0, 0, 0, id, 0)),
+			testBox("mdia",
+				testBox("mdhd", u32s(0, 0, 0, 90000, 0)),
+				testBox("hdlr", u32s(0, 0), []byte(handler)),
+			),
+		)
+	}
+	return append(testBox("ftyp", []byte("iso5")), testBox("moov",
+		trak(2, "soun"),
+		trak(1, "vide"),
+		testBox("mvex",
+			// default duration of 3000 ticks and non-sync samples
+			testBox("trex", u32s(0, 1, 1, 3000, 0, fmp4SampleNonSync)),
+		),
+	)...)
+}
+
+// a fragment with frames 30fps frames of video, starting with a keyframe or not
+func testFMP4Fragment(frames uint32, keyframe bool) []byte {
+	trun := testBox("trun", u32s(0, frames))
+	if keyframe {
+		// first-sample-flags present and saying it's a sync sample
+		trun = testBox("trun", u32s(0x04, frames, 0))
+	}
+	moof := testBox("moof",
+		testBox("traf", testBox("tfhd", u32s(0, 2)), testBox("trun", u32s(0x100, 1, 1920))),
+		testBox("traf", testBox("tfhd", u32s(0, 1)), trun),
+	)
+	return append(moof, testBox("mdat", []byte("frames"))...)
+}
+
+func TestFMP4(t *testing.T) {
+	init := testFMP4Init()
+	track, err := fmp4VideoTrack(init[len(testBox("ftyp", []byte("iso5")))+8:])
+	require.NoError(t, err)
+	require.Equal(t, fmp4Track{id: 1, timescale: 90000, defaultDuration: 3000, defaultFlags: fmp4SampleNonSync}, track)
+
+	frag := testFMP4Fragment(10, true)
+	_, moof, _, err := mp4NextBox(frag)
+	require.NoError(t, err)
+	dur, independent, err := fmp4Fragment(moof, track)
+	require.NoError(t, err)
+	require.Equal(t, time.Second/3, dur)
+	require.True(t, independent)
+
+	_, moof, _, err = mp4NextBox(testFMP4Fragment(5, false))
+	require.NoError(t, err)
+	dur, independent, err = fmp4Fragment(moof, track)
+	require.NoError(t, err)
+	require.Equal(t, time.Second/6, dur)
+	require.False(t, independent)
+}
+
+func TestParseLLHLSFile(t *testing.T) {
+	tests := []struct {
+		file     string
+		playlist string
+		kind     LLHLSFileKind
+		msn      int
+		part     int
+	}{
+		{"stream.m3u8", "stream.m3u8", LLHLSFilePlaylist, 0, 0},
+		{"720p-init.mp4", "720p.m3u8", LLHLSFileInit, 0, 0},
+		{"720p-init-2.mp4", "720p.m3u8", LLHLSFileInit, 2, 0},
+		{"stream-12.mp4", "stream.m3u8", LLHLSFileSegment, 12, 0},
+		{"720p-12.3.mp4", "720p.m3u8", LLHLSFilePart, 12, 3},
+	}
+	for _, tt := range tests {
+		playlist, kind, msn, part, err := ParseLLHLSFile(tt.file)
+		require.NoError(t, err, tt.file)
+		require.Equal(t, tt.playlist, playlist, tt.file)
+		require.Equal(t, tt.kind, kind, tt.file)
+		require.Equal(t, tt.msn, msn, tt.file)
+		require.Equal(t, tt.part, part, tt.file)
+	}
+	for _, file := range []string{"index.m3u8.bak", "../stream.m3u8", "stream-00001.ts", "stream-x.mp4"} {
+		_, _, _, _, err := ParseLLHLSFile(file)
+		require.ErrorIs(t, err, ErrLLHLSNotFound, file)
+	}
+}
+
+// a second of video as three keyframe-led parts with one more per second
+func testLLHLSStream(seconds int) []byte {
+	bs := testFMP4Init()
+	for i := 0; i < seconds; i++ {
+		bs = append(bs, testFMP4Fragment(10, true)...)
+		bs = append(bs, testFMP4Fragment(10, false)...)
+		bs = append(bs, testFMP4Fragment(10, false)...)
+	}
+	return bs
+}
+
+func TestLLHLSPlaylist(t *testing.T) {
+	ctx := context.Background()
+	pl := NewLLHLSPlaylist("stream.m3u8", time.Second)
+	err := pl.Ingest(ctx, bytes.NewReader(testLLHLSStream(3)))
+	require.NoError(t, err)
+
+	m3u8, err := pl.Render(ctx, -1, -1)
+	require.NoError(t, err)
+	expected := `#EXTM3U
+#EXT-X-VERSION:9
+#EXT-X-TARGETDURATION:1
+#EXT-X-PART-INF:PART-TARGET=0.333
+#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=0.999
+#EXT-X-MEDIA-SEQUENCE:0
+#EXT-X-MAP:URI="stream-init.mp4"
+#EXT-X-PART:DURATION=0.333,URI="stream-0.0.mp4",INDEPENDENT=YES
+#EXT-X-PART:DURATION=0.333,URI="stream-0.1.mp4"
+#EXT-X-PART:DURATION=0.333,URI="stream-0.2.mp4"
+#EXTINF:1.000,
+stream-0.mp4
+#EXT-X-PART:DURATION=0.333,URI="stream-1.0.mp4",INDEPENDENT=YES
+#EXT-X-PART:DURATION=0.333,URI="stream-1.1.mp4"
+#EXT-X-PART:DURATION=0.333,URI="stream-1.2.mp4"
+#EXTINF:1.000,
+stream-1.mp4
+#EXT-X-PART:DURATION=0.333,URI="stream-2.0.mp4",INDEPENDENT=YES
+#EXT-X-PART:DURATION=0.333,URI="stream-2.1.mp4"
+#EXT-X-PART:DURATION=0.333,URI="stream-2.2.mp4"
+`
+	require.Equal(t, expected, m3u8)
+
+	init, err := pl.Init(ctx, 0)
+	require.NoError(t, err)
+	require.Equal(t, testFMP4Init(), init)
+	part, err := pl.Part(ctx, 1, 0)
+	require.NoError(t, err)
+	require.Equal(t, testFMP4Fragment(10, true), part)
+	seg, err := pl.Segment(ctx, 1)
+	require.NoError(t, err)
+	require.Equal(t, testLLHLSStream(2)[len(testLLHLSStream(1)):], seg)
+
+	// the stream's over, so nothing more is coming
+	_, err = pl.Part(ctx, 2, 3)
+	require.ErrorIs(t, err, ErrLLHLSEnded)
+	_, err = pl.Segment(ctx, 2)
+	require.ErrorIs(t, err, ErrLLHLSEnded)
+	_, err = pl.Render(ctx, 5, 0)
+	require.ErrorIs(t, err, ErrLLHLSTooFarAhead)
+}
+
+func TestLLHLSBlockingReload(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pl := NewLLHLSPlaylist("stream.m3u8", time.Second)
+	pl.setInit(testFMP4Init())
+	pl.addPart(testFMP4Fragment(10, true), time.Second/3, true)
+
+	m3u8, err := pl.Render(ctx, -1, -1)
+	require.NoError(t, err)
+	require.True(t, strings.HasSuffix(m3u8, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"stream-0.1.mp4\"\n"))
+
+	// require can't be used off the test goroutine, so results come back here
+	type renderResult struct {
+		m3u8 string
+		err  error
+	}
+	type partResult struct {
+		part []byte
+		err  error
+	}
+	rendered := make(chan renderResult, 1)
+	go func() {
+		m3u8, err := pl.Render(ctx, 0, 1)
+		rendered <- renderResult{m3u8, err}
+	}()
+	parts := make(chan partResult, 1)
+	go func() {
+		part, err := pl.Part(ctx, 0, 1)
+		parts <- partResult{part, err}
+	}()
+	select {
+	case <-rendered:
+		t.Fatal("playlist shouldn't be ready until part 1 is")
+	case <-parts:
+		t.Fatal("part shouldn't be ready until it's added")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	frag := testFMP4Fragment(10, false)
+	pl.addPart(frag, time.Second/3, false)
+	render := <-rendered
+	require.NoError(t, render.err)
+	require.Contains(t, render.m3u8, "stream-0.1.mp4")
+	part := <-parts
+	require.NoError(t, part.err)
+	require.Equal(t, frag, part.part)
+
+	// once the segment is due to end, the hint is for the next one
+	pl.addPart(testFMP4Fragment(10, false), time.Second/3, false)
+	m3u8, err = pl.Render(ctx, 0, 2)
+	require.NoError(t, err)
+	require.True(t, strings.HasSuffix(m3u8, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"stream-1.0.mp4\"\n"))
+
+	// timing out is up to the caller
+	short, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = pl.Render(short, 1, 0)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestLLHLSWindow(t *testing.T) {
+	pl := NewLLHLSPlaylist("stream.m3u8", time.Second)
+	for i := 0; i < LLHLS_SEGMENTS_KEPT+5; i++ {
+		pl.addPart(testFMP4Fragment(30, true), time.Second, true)
+	}
+	m3u8, err := pl.Render(context.Background(), -1, -1)
+	require.NoError(t, err)
+	require.Contains(t, m3u8, "#EXT-X-MEDIA-SEQUENCE:4\n")
+	require.Equal(t, LLHLS_SEGMENTS_KEPT, strings.Count(m3u8, "#EXTINF"))
+	// parts are only listed for the latest few
+	require.Equal(t, LLHLS_PART_SEGMENTS+1, strings.Count(m3u8, "#EXT-X-PART:"))
+
+	_, err = pl.Segment(context.Background(), 1)
+	require.ErrorIs(t, err, ErrLLHLSNotFound)
+}
+
+func TestLLHLSRestart(t *testing.T) {
+	ctx := context.Background()
+	pl := NewLLHLSPlaylist("stream.m3u8", time.Second)
+	pl.setInit(testFMP4Init())
+	pl.addPart(testFMP4Fragment(30, true), time.Second, true)
+	pl.addPart(testFMP4Fragment(10, false), time.Second/3, false)
+
+	// the source comes back partway through a segment with a new init segment
+	pl.restart()
+	init := append(testFMP4Init(), 1)
+	pl.setInit(init)
+	pl.addPart(testFMP4Fragment(30, true), time.Second, true)
+
+	m3u8, err := pl.Render(ctx, -1, -1)
+	require.NoError(t, err)
+	require.Contains(t, m3u8, `#EXT-X-MAP:URI="stream-init.mp4"
+#EXT-X-PART:DURATION=1.000,URI="stream-0.0.mp4",INDEPENDENT=YES
+#EXT-X-PART:DURATION=0.333,URI="stream-0.1.mp4"
+#EXTINF:1.333,
+stream-0.mp4
+#EXT-X-DISCONTINUITY
+#EXT-X-MAP:URI="stream-init-1.mp4"
+#EXT-X-PART:DURATION=1.000,URI="stream-1.0.mp4",INDEPENDENT=YES
+`)
+	require.NotContains(t, m3u8, "#EXT-X-DISCONTINUITY-SEQUENCE")
+	bs, err := pl.Init(ctx, 1)
+	require.NoError(t, err)
+	require.Equal(t, init, bs)
+
+	// once the discontinuity ages out it's counted instead
+	for i := 0; i < LLHLS_SEGMENTS_KEPT+1; i++ {
+		pl.addPart(testFMP4Fragment(30, true), time.Second, true)
+	}
+	m3u8, err = pl.Render(ctx, -1, -1)
+	require.NoError(t, err)
+	require.Contains(t, m3u8, "#EXT-X-DISCONTINUITY-SEQUENCE:1\n#EXT-X-MAP:URI=\"stream-init-1.mp4\"\n")
+	require.NotContains(t, m3u8, "#EXT-X-DISCONTINUITY\n")
+	_, err = pl.Init(ctx, 0)
+	require.ErrorIs(t, err, ErrLLHLSNotFound)
+}
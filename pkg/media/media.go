@@ -4,20 +4,32 @@ import (
 	"bytes"
 	"context"
 	"crypto"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"aquareum.tv/aquareum/pkg/aqtime"
 	"aquareum.tv/aquareum/pkg/config"
+	"aquareum.tv/aquareum/pkg/crypto/aqpub"
 	"aquareum.tv/aquareum/pkg/crypto/signers"
+	"aquareum.tv/aquareum/pkg/crypto/signers/eip712"
 	"aquareum.tv/aquareum/pkg/log"
+	"aquareum.tv/aquareum/pkg/model"
 	"aquareum.tv/aquareum/pkg/replication"
+	v0 "aquareum.tv/aquareum/pkg/schema/v0"
+	"aquareum.tv/aquareum/pkg/storage"
 	"github.com/go-gst/go-gst/gst"
 	"github.com/google/uuid"
 	"github.com/livepeer/lpms/ffmpeg"
@@ -37,18 +49,55 @@ const SCHEMA_ORG_END_TIME = "http://schema.org/endTime"
 
 type MediaManager struct {
 	cli            *config.CLI
-	mp4subs        map[string][]chan string
-	mp4subsmut     sync.Mutex
+	segments       *segmentHub
 	replicator     replication.Replicator
-	hlsRunning     map[string]HLSStream
+	verifier       *eip712.EIP712Signer
+	model          model.Model
+	store          storage.SegmentStore
+	hlsRunning     map[string]*HLSStream
 	hlsRunningMut  sync.Mutex
+	renditions     []Rendition
+	signer         *MediaSigner
+	renditionSegs  map[string][]renditionSegment
+	renditionMut   sync.Mutex
+	shared         map[string]*sharedStream
+	sharedMut      sync.Mutex
+	webrtcShared   map[string]*WebRTCPlayback
+	webrtcViewers  int
+	streams        *streamTracker
 	httpPipes      map[string]io.Writer
 	httpPipesMutex sync.Mutex
 }
 
+// movflags for the fragmented mp4 we stream out. default_base_moof makes each
+// fragment's sample offsets relative to its own moof, so a viewer that joins
+// partway through can play it without the fragments that came before.
+const MP4_STREAM_MOVFLAGS = "frag_keyframe+empty_moov+default_base_moof"
+
+// how long a stream can go without a new segment before we tear down its HLS output
+const HLS_STREAM_END_TIMEOUT = 30 * time.Second
+
+// how long HLS output can go without anyone asking for it before we tear it down
+const HLS_VIEWER_IDLE_TIMEOUT = 30 * time.Second
+
+// how long we hold the first viewer up waiting for renditions once the source
+// is ready. they can fail without the source, so they might never show up.
+const HLS_RENDITION_READY_TIMEOUT = 10 * time.Second
+
 type HLSStream struct {
-	Dir  string
-	Wait func() string
+	Dir     string
+	Wait    func() string
+	Started time.Time
+	Cancel  context.CancelFunc
+	// in-memory media playlists by filename, with --hls-low-latency
+	LowLatency map[string]*LLHLSPlaylist
+	// when a viewer last asked for something, guarded by hlsRunningMut
+	LastViewed time.Time
+	// how many times the source has restarted, which is also the current run,
+	// guarded by hlsRunningMut
+	Restarts int
+	// media sequence number each run's playlists carry on from, by run
+	offsets []map[string]int
 }
 
 func RunSelfTest(ctx context.Context) error {
@@ -56,18 +105,49 @@ func RunSelfTest(ctx context.Context) error {
 	return SelfTest(ctx)
 }
 
-func MakeMediaManager(ctx context.Context, cli *config.CLI, signer crypto.Signer, rep replication.Replicator) (*MediaManager, error) {
+func MakeMediaManager(ctx context.Context, cli *config.CLI, signer crypto.Signer, verifier *eip712.EIP712Signer, rep replication.Replicator, mod model.Model, store storage.SegmentStore) (*MediaManager, error) {
 	gst.Init(nil)
 	err := SelfTest(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("error in gstreamer self-test: %w", err)
 	}
+	renditions, err := ParseRenditions(cli.HLSRenditions)
+	if err != nil {
+		return nil, err
+	}
+	if cli.SegmentDuration <= 0 {
+		return nil, fmt.Errorf("segment-duration must be positive, got %s", cli.SegmentDuration)
+	}
+	if cli.SegmentMaxDuration != 0 && cli.SegmentMaxDuration < cli.SegmentDuration {
+		return nil, fmt.Errorf("segment-max-duration=%s is shorter than segment-duration=%s", cli.SegmentMaxDuration, cli.SegmentDuration)
+	}
+	ms, err := MakeMediaSigner(ctx, cli, cli.StreamerName, signer)
+	if err != nil {
+		return nil, err
+	}
+	// nobody's around to end sessions that were live when we last stopped
+	ended, err := mod.EndOpenStreamSessions()
+	if err != nil {
+		return nil, err
+	}
+	if ended > 0 {
+		log.Log(ctx, "ended stream sessions left open from before", "count", ended)
+	}
 	return &MediaManager{
-		cli:        cli,
-		mp4subs:    map[string][]chan string{},
-		replicator: rep,
-		hlsRunning: map[string]HLSStream{},
-		httpPipes:  map[string]io.Writer{},
+		cli:           cli,
+		segments:      newSegmentHub(),
+		replicator:    rep,
+		verifier:      verifier,
+		model:         mod,
+		store:         store,
+		hlsRunning:    map[string]*HLSStream{},
+		httpPipes:     map[string]io.Writer{},
+		renditions:    renditions,
+		signer:        ms,
+		renditionSegs: map[string][]renditionSegment{},
+		shared:        map[string]*sharedStream{},
+		webrtcShared:  map[string]*WebRTCPlayback{},
+		streams:       newStreamTracker(mod),
 	}, nil
 }
 
@@ -96,27 +176,56 @@ func (mm *MediaManager) GetHTTPPipeWriter(uu string) io.Writer {
 	return mm.httpPipes[uu]
 }
 
-// subscribe to the latest segments from a given user for livestreaming purposes
-func (mm *MediaManager) SubscribeSegment(ctx context.Context, user string) chan string {
-	mm.mp4subsmut.Lock()
-	defer mm.mp4subsmut.Unlock()
-	_, ok := mm.mp4subs[user]
+// subscribe to a user's segments as they come in, for livestreaming purposes.
+// pass the last segment you saw as after to also get any since then that we
+// still remember. the channel closes once ctx is done.
+func (mm *MediaManager) SubscribeSegment(ctx context.Context, user, after string) <-chan string {
+	return mm.segments.subscribe(ctx, user, after)
+}
+
+// the next segment from a user after the one named after, or the next one
+// to come in if after is empty. a reader that doesn't keep track itself, like
+// ffmpeg working through a concat playlist, can name itself instead and pick
+// up after the last segment it was handed.
+func (mm *MediaManager) NextSegment(ctx context.Context, user, reader, after string) (string, error) {
+	if after == "" && reader != "" {
+		after = mm.segments.cursor(user, reader)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	file, ok := <-mm.segments.subscribe(ctx, user, after)
 	if !ok {
-		mm.mp4subs[user] = []chan string{}
+		return "", ctx.Err()
 	}
-	c := make(chan string)
-	mm.mp4subs[user] = append(mm.mp4subs[user], c)
-	return c
+	if reader != "" {
+		mm.segments.setCursor(user, reader, file)
+	}
+	return file, nil
 }
 
-// subscribe to the latest segments from a given user for livestreaming purposes
-func (mm *MediaManager) PublishSegment(ctx context.Context, user, file string) {
-	mm.mp4subsmut.Lock()
-	defer mm.mp4subsmut.Unlock()
-	for _, sub := range mm.mp4subs[user] {
-		sub <- file
+// remove a segment we stored but couldn't index, since nothing else would
+// ever find it to clean it up
+func (mm *MediaManager) deleteUnindexed(ctx context.Context, key string) {
+	err := mm.store.Delete(ctx, key)
+	if err != nil {
+		log.Error(ctx, "error removing unindexed segment", "key", key, "error", err)
 	}
-	mm.mp4subs[user] = []chan string{}
+}
+
+// whether a segment that ended at end is part of the live stream, rather than
+// catching up on one that's over
+func isLiveSegment(end, now time.Time) bool {
+	return now.Sub(end) <= STREAM_STALL_TIMEOUT
+}
+
+// let everyone watching a user know about a new segment, which plays from
+// start to end if we know. never blocks.
+func (mm *MediaManager) PublishSegment(ctx context.Context, user, file string, start, end time.Time) {
+	mm.segments.publish(user, file, start, end)
+}
+
+func (mm *MediaManager) SegmentHubStats() SegmentHubStats {
+	return mm.segments.stats()
 }
 
 func (mm *MediaManager) SegmentToMKVPlusOpus(ctx context.Context, user string, w io.Writer) error {
@@ -134,82 +243,200 @@ func (mm *MediaManager) SegmentToMKVPlusOpus(ctx context.Context, user string, w
 	return g.Wait()
 }
 
+// start HLS output for a user if it isn't running already, returning a func
+// that waits for it to be ready to serve and returns its directory
 func (mm *MediaManager) SegmentToHLSOnce(ctx context.Context, user string) (func() string, error) {
 	mm.hlsRunningMut.Lock()
 	defer mm.hlsRunningMut.Unlock()
 	hls, ok := mm.hlsRunning[user]
-	if !ok {
-		dname, err := os.MkdirTemp("", "aquareum-hls")
-		if err != nil {
-			return nil, err
+	if ok {
+		hls.LastViewed = time.Now()
+		return hls.Wait, nil
+	}
+	dname, err := os.MkdirTemp("", "aquareum-hls")
+	if err != nil {
+		return nil, err
+	}
+	master := hlsMasterPlaylist(mm.hlsSource(ctx, user), mm.renditions)
+	err = os.WriteFile(filepath.Join(dname, HLS_MASTER_PLAYLIST), []byte(master), 0644)
+	if err != nil {
+		os.RemoveAll(dname)
+		return nil, err
+	}
+	playlists := mm.hlsPlaylists()
+	var lowLatency map[string]*LLHLSPlaylist
+	if mm.cli.HLSLowLatency {
+		lowLatency = map[string]*LLHLSPlaylist{}
+		for _, playlist := range playlists {
+			lowLatency[playlist] = NewLLHLSPlaylist(playlist, mm.cli.SegmentDuration)
 		}
-		wait := sync.OnceValue[string](func() string {
-			fpath := filepath.Join(dname, HLS_PLAYLIST)
+		// these block until they have something to serve anyway
+		playlists = nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	hls = &HLSStream{
+		Dir:        dname,
+		Started:    time.Now(),
+		Cancel:     cancel,
+		LowLatency: lowLatency,
+		LastViewed: time.Now(),
+		offsets:    []map[string]int{{}},
+	}
+	// everything the master playlist points at should be there before we serve it
+	hls.Wait = sync.OnceValue[string](func() string {
+		var deadline time.Time
+		for _, playlist := range playlists {
+			// the source comes first
+			if playlist != HLS_PLAYLIST && deadline.IsZero() {
+				deadline = time.Now().Add(HLS_RENDITION_READY_TIMEOUT)
+			}
 			for {
-				_, err := os.Stat(fpath)
-				if err == nil {
+				_, _, _, err := mm.hlsPlaylistFile(hls, playlist)
+				if err == nil || ctx.Err() != nil {
+					break
+				}
+				if !deadline.IsZero() && time.Now().After(deadline) {
+					log.Log(ctx, "gave up waiting for HLS rendition", "user", user, "playlist", playlist)
 					break
 				}
-				if !errors.Is(err, os.ErrNotExist) {
+				if !errors.Is(err, ErrHLSNotFound) {
 					log.Log(ctx, "unexpected error polling for HLS playlist", "error", err)
 				}
 				time.Sleep(500 * time.Millisecond)
 			}
-			return dname
-		})
-		hls = HLSStream{
-			Wait: wait,
-			Dir:  dname,
 		}
-		mm.hlsRunning[user] = hls
-		go func() {
-			err := mm.SegmentToHLS(ctx, user, dname)
-			if err != nil {
-				log.Log(ctx, "error in async segmentToHLS code", "error", err)
-			}
-			mm.hlsRunningMut.Lock()
-			defer mm.hlsRunningMut.Unlock()
-			delete(mm.hlsRunning, user)
-		}()
-	}
+		return dname
+	})
+	mm.hlsRunning[user] = hls
+	go mm.runHLS(ctx, user, hls)
 	return hls.Wait, nil
 }
 
-func (mm *MediaManager) SegmentToHLS(ctx context.Context, user, dir string) error {
+// stop HLS output for any streams that haven't produced a segment in a while
+// or that nobody's watching any more
+func (mm *MediaManager) CleanupHLS(ctx context.Context) {
+	mm.hlsRunningMut.Lock()
+	ended := map[string]*HLSStream{}
+	for user, hls := range mm.hlsRunning {
+		last := hls.Started
+		if published := mm.segments.lastPublished(user); published.After(last) {
+			last = published
+		}
+		if time.Since(last) > HLS_STREAM_END_TIMEOUT {
+			log.Log(ctx, "stream ended, removing HLS output", "user", user, "dir", hls.Dir)
+			ended[user] = hls
+		} else if time.Since(hls.LastViewed) > HLS_VIEWER_IDLE_TIMEOUT {
+			log.Log(ctx, "no more HLS viewers, removing HLS output", "user", user, "dir", hls.Dir)
+			ended[user] = hls
+		}
+	}
+	mm.hlsRunningMut.Unlock()
+
+	for user, hls := range ended {
+		mm.endHLS(user, hls)
+	}
+}
+
+// tear down a running HLS stream. its temp dir goes once everything writing to
+// it has stopped.
+func (mm *MediaManager) endHLS(user string, hls *HLSStream) {
+	mm.hlsRunningMut.Lock()
+	defer mm.hlsRunningMut.Unlock()
+	// a new stream for the user may have started in the meantime
+	if mm.hlsRunning[user] == hls {
+		delete(mm.hlsRunning, user)
+	}
+	hls.Cancel()
+}
+
+// write HLS playlists for the source and each rendition to dir. playlists get
+// the run in their names after the first, see hlsRunPlaylist.
+func (mm *MediaManager) SegmentToHLS(ctx context.Context, user, dir string, run int) error {
 	muxer := ffmpeg.ComponentOptions{
 		Name: "matroska",
 	}
 
+	// closing both ends of each pipe means neither side can hang on the other
 	pr, pw := io.Pipe()
 	g, ctx := errgroup.WithContext(ctx)
 	g.Go(func() error {
-		return mm.SegmentToStream(ctx, user, muxer, pw)
+		err := mm.SegmentToStream(ctx, user, muxer, pw)
+		pw.Close()
+		return err
+	})
+	g.Go(func() error {
+		defer pr.Close()
+		return ToHLS(ctx, pr, dir, hlsRunPlaylist(HLS_PLAYLIST, run), mm.cli.SegmentDuration)
+	})
+	g.Go(func() error {
+		mm.runRenditions(ctx, user, muxer, func(ctx context.Context, r Rendition, pr io.Reader) error {
+			return ToHLS(ctx, pr, dir, hlsRunPlaylist(r.Playlist(), run), mm.cli.SegmentDuration)
+		})
+		return nil
+	})
+	return g.Wait()
+}
+
+// feed the in-memory LL-HLS playlists for the source and each rendition with
+// fragmented mp4
+func (mm *MediaManager) SegmentToLLHLS(ctx context.Context, user string, playlists map[string]*LLHLSPlaylist) error {
+	muxer := ffmpeg.ComponentOptions{
+		Name: "mp4",
+		Opts: llhlsMuxerOpts,
+	}
+
+	pr, pw := io.Pipe()
+	g, ctx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		err := mm.SegmentToStream(ctx, user, muxer, pw)
+		pw.Close()
+		return err
+	})
+	g.Go(func() error {
+		defer pr.Close()
+		return playlists[HLS_PLAYLIST].Ingest(ctx, pr)
 	})
 	g.Go(func() error {
-		return ToHLS(ctx, pr, dir)
+		mm.runRenditions(ctx, user, muxer, func(ctx context.Context, r Rendition, pr io.Reader) error {
+			return playlists[r.Playlist()].Ingest(ctx, pr)
+		})
+		return nil
 	})
 	return g.Wait()
 }
 
+// one of a user's running LL-HLS media playlists, eg stream.m3u8
+func (mm *MediaManager) LLHLSPlaylist(user, playlist string) (*LLHLSPlaylist, error) {
+	mm.hlsRunningMut.Lock()
+	defer mm.hlsRunningMut.Unlock()
+	hls, ok := mm.hlsRunning[user]
+	if !ok {
+		return nil, fmt.Errorf("%w: no HLS output for %s", ErrLLHLSNotFound, user)
+	}
+	pl, ok := hls.LowLatency[playlist]
+	if !ok {
+		return nil, fmt.Errorf("%w: no playlist %s", ErrLLHLSNotFound, playlist)
+	}
+	return pl, nil
+}
+
 func (mm *MediaManager) SegmentToMP4(ctx context.Context, user string, w io.Writer) error {
 	muxer := ffmpeg.ComponentOptions{
 		Name: "mp4",
 		Opts: map[string]string{
-			"movflags": "frag_keyframe+empty_moov",
+			"movflags": MP4_STREAM_MOVFLAGS,
 		},
 	}
 	return mm.SegmentToStream(ctx, user, muxer, w)
 }
 
 func (mm *MediaManager) SegmentToStream(ctx context.Context, user string, muxer ffmpeg.ComponentOptions, w io.Writer) error {
-	tc := ffmpeg.NewTranscoder()
-	defer tc.StopTranscoder()
-	ourl, or, odone, err := mm.HTTPPipe()
-	if err != nil {
-		return err
-	}
-	defer odone()
 	iname := fmt.Sprintf("%s/playback/%s/concat", mm.cli.OwnInternalURL(), user)
+	return mm.concatToStream(ctx, iname, muxer, w)
+}
+
+// transmux the endless ffconcat playlist at iname
+func (mm *MediaManager) concatToStream(ctx context.Context, iname string, muxer ffmpeg.ComponentOptions, w io.Writer) error {
 	in := &ffmpeg.TranscodeOptionsIn{
 		Fname:       iname,
 		Transmuxing: true,
@@ -223,6 +450,59 @@ func (mm *MediaManager) SegmentToStream(ctx context.Context, user string, muxer
 			},
 		},
 	}
+	return mm.Transmux(ctx, in, muxer, w)
+}
+
+// stitch together a user's archived segments between start and end into a single mp4
+func (mm *MediaManager) SegmentsToVODMP4(ctx context.Context, user string, start, end aqtime.AQTime, w io.Writer) error {
+	q := url.Values{}
+	q.Set("start", start.String())
+	q.Set("end", end.String())
+	iname := fmt.Sprintf("%s/playback/%s/vod/concat?%s", mm.cli.OwnInternalURL(), user, q.Encode())
+	in := &ffmpeg.TranscodeOptionsIn{
+		Fname:       iname,
+		Transmuxing: true,
+		Profile:     ffmpeg.VideoProfile{},
+		Demuxer: ffmpeg.ComponentOptions{
+			Name: "concat",
+			Opts: map[string]string{
+				"safe":               "0",
+				"protocol_whitelist": "file,http,https,tcp,tls",
+			},
+		},
+	}
+	muxer := ffmpeg.ComponentOptions{
+		Name: "mp4",
+		Opts: map[string]string{
+			"movflags": MP4_STREAM_MOVFLAGS,
+		},
+	}
+	return mm.Transmux(ctx, in, muxer, w)
+}
+
+// remux a single archived segment to MPEG-TS for use in an HLS VOD playlist
+func (mm *MediaManager) SegmentToTS(ctx context.Context, user, file string, w io.Writer) error {
+	iname := fmt.Sprintf("%s/playback/%s/segment/%s", mm.cli.OwnInternalURL(), user, file)
+	in := &ffmpeg.TranscodeOptionsIn{
+		Fname:       iname,
+		Transmuxing: true,
+		Profile:     ffmpeg.VideoProfile{},
+	}
+	muxer := ffmpeg.ComponentOptions{
+		Name: "mpegts",
+	}
+	return mm.Transmux(ctx, in, muxer, w)
+}
+
+// copy the audio and video of the provided input into a new container
+func (mm *MediaManager) Transmux(ctx context.Context, in *ffmpeg.TranscodeOptionsIn, muxer ffmpeg.ComponentOptions, w io.Writer) error {
+	tc := ffmpeg.NewTranscoder()
+	defer tc.StopTranscoder()
+	ourl, or, odone, err := mm.HTTPPipe()
+	if err != nil {
+		return err
+	}
+	defer odone()
 	out := []ffmpeg.TranscodeOptions{
 		{
 			Oname: ourl,
@@ -262,31 +542,51 @@ type ExpandedSchemaOrg []struct {
 		Address []StringVal `json:"http://schema.org/address"`
 		Name    []StringVal `json:"http://schema.org/name"`
 	} `json:"http://schema.org/creator"`
-	StartTime []StringVal `json:"http://schema.org/startTime"`
-	EndTime   []StringVal `json:"http://schema.org/endTime"`
+	StartTime      []StringVal `json:"http://schema.org/startTime"`
+	EndTime        []StringVal `json:"http://schema.org/endTime"`
+	EncodingFormat []StringVal `json:"http://schema.org/encodingFormat"`
+	Duration       []StringVal `json:"http://schema.org/duration"`
 }
 
 type SegmentMetadata struct {
 	StartTime aqtime.AQTime
 	EndTime   aqtime.AQTime
+	// mime type with codecs, eg video/mp4; codecs="hvc1,mp4a". empty for
+	// segments from before we recorded it.
+	EncodingFormat string
+	// how long the segment plays for. zero for segments from before we
+	// recorded it.
+	Duration time.Duration
 }
 
 var ErrInvalidMetadata = errors.New("invalid Schema.org Metadata")
 
-func ParseSegmentAssertions(mani *manifeststore.Manifest) (*SegmentMetadata, error) {
-	var ass *manifeststore.ManifestAssertion
+// the raw schema.org metadata a segment was signed with
+func segmentMetadataAssertion(mani *manifeststore.Manifest) (map[string]any, error) {
+	if mani == nil {
+		return nil, fmt.Errorf("no active manifest")
+	}
 	for _, a := range mani.Assertions {
-		if a.Label == STDS_METADATA {
-			ass = &a
-			break
+		if a.Label != STDS_METADATA {
+			continue
+		}
+		data, ok := a.Data.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s assertion is not an object", ErrInvalidMetadata, STDS_METADATA)
 		}
+		return data, nil
 	}
-	if ass == nil {
-		return nil, fmt.Errorf("couldn't find %s assertions", STDS_METADATA)
+	return nil, fmt.Errorf("couldn't find %s assertions", STDS_METADATA)
+}
+
+func ParseSegmentAssertions(mani *manifeststore.Manifest) (*SegmentMetadata, error) {
+	data, err := segmentMetadataAssertion(mani)
+	if err != nil {
+		return nil, err
 	}
 	proc := ld.NewJsonLdProcessor()
 	options := ld.NewJsonLdOptions("")
-	flat, err := proc.Expand(ass.Data, options)
+	flat, err := proc.Expand(data, options)
 	if err != nil {
 		return nil, err
 	}
@@ -327,10 +627,100 @@ func ParseSegmentAssertions(mani *manifeststore.Manifest) (*SegmentMetadata, err
 		StartTime: start,
 		EndTime:   end,
 	}
+	if len(meta.EncodingFormat) == 1 {
+		out.EncodingFormat = meta.EncodingFormat[0].Value
+	}
+	if len(meta.Duration) == 1 {
+		out.Duration, err = parseISODuration(meta.Duration[0].Value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidMetadata, err)
+		}
+	}
 	return &out, nil
 }
 
-func (mm *MediaManager) ValidateMP4(ctx context.Context, input io.Reader) error {
+// schema.org durations are ISO 8601, eg PT2.002S
+func formatISODuration(d time.Duration) string {
+	return fmt.Sprintf("PT%sS", strconv.FormatFloat(d.Seconds(), 'f', -1, 64))
+}
+
+var isoDurationRegex = regexp.MustCompile(`^PT(?:(\d+)H)?(?:(\d+)M)?(?:(\d+(?:\.\d+)?)S)?$`)
+
+func parseISODuration(str string) (time.Duration, error) {
+	m := isoDurationRegex.FindStringSubmatch(str)
+	if m == nil || str == "PT" {
+		return 0, fmt.Errorf("unsupported duration %q", str)
+	}
+	var d time.Duration
+	for i, unit := range []time.Duration{time.Hour, time.Minute, time.Second} {
+		if m[i+1] == "" {
+			continue
+		}
+		n, err := strconv.ParseFloat(m[i+1], 64)
+		if err != nil {
+			return 0, err
+		}
+		d += time.Duration(math.Round(n * float64(unit)))
+	}
+	return d, nil
+}
+
+// in the allowed-streams flag or added by an admin over the API
+func (mm *MediaManager) isAllowedStream(pub aqpub.Pub) (bool, error) {
+	for _, a := range mm.cli.AllowedStreams {
+		if a.Equals(pub) {
+			return true, nil
+		}
+	}
+	return mm.model.IsAllowedStream(pub.String())
+}
+
+// who a segment belongs to. that's whoever signed it, unless it carries a
+// v0.StreamKey in which that user authorized the signer to stream for them.
+func (mm *MediaManager) segmentUser(mani *manifeststore.Manifest, signer aqpub.Pub) (aqpub.Pub, error) {
+	var ass *manifeststore.ManifestAssertion
+	for _, a := range mani.Assertions {
+		if a.Label == STREAM_KEY_ASSERTION {
+			ass = &a
+			break
+		}
+	}
+	if ass == nil {
+		return signer, nil
+	}
+	if mm.verifier == nil {
+		return nil, fmt.Errorf("segment has a %s assertion but we can't verify stream keys", STREAM_KEY_ASSERTION)
+	}
+	bs, err := json.Marshal(ass.Data)
+	if err != nil {
+		return nil, err
+	}
+	var data struct {
+		Key string `json:"key"`
+	}
+	err = json.Unmarshal(bs, &data)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := base64.URLEncoding.DecodeString(data.Key)
+	if err != nil {
+		return nil, err
+	}
+	signed, err := mm.verifier.Verify(payload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid stream key: %w", err)
+	}
+	sk, ok := signed.Data().(*v0.StreamKey)
+	if !ok {
+		return nil, fmt.Errorf("got signed data but it wasn't a stream key")
+	}
+	if !strings.EqualFold(sk.Authorized, signer.String()) {
+		return nil, fmt.Errorf("stream key authorizes %s, but segment was signed by %s", sk.Authorized, signer.String())
+	}
+	return aqpub.FromHexString(signed.Signer())
+}
+
+func (mm *MediaManager) ValidateMP4(ctx context.Context, input io.Reader, source model.SegmentSource) error {
 	buf, err := io.ReadAll(input)
 	if err != nil {
 		return err
@@ -338,38 +728,79 @@ func (mm *MediaManager) ValidateMP4(ctx context.Context, input io.Reader) error
 	r := bytes.NewReader(buf)
 	reader, err := c2pa.FromStream(r, "video/mp4")
 	if err != nil {
-		return err
+		return fmt.Errorf("%w: %w", ErrSegmentInvalid, err)
 	}
 	mani := reader.GetActiveManifest()
 	certs := reader.GetProvenanceCertChain()
 	pub, err := signers.ParseES256KCert([]byte(certs))
 	if err != nil {
-		return err
+		return fmt.Errorf("%w: %w", ErrSegmentInvalid, err)
 	}
-	found := false
-	for _, a := range mm.cli.AllowedStreams {
-		if a.Equals(pub) {
-			found = true
-			break
-		}
+	fingerprint, err := signers.CertFingerprint([]byte(certs))
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrSegmentInvalid, err)
+	}
+	user, err := mm.segmentUser(mani, pub)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrSegmentInvalid, err)
+	}
+	found, err := mm.isAllowedStream(user)
+	if err != nil {
+		return err
 	}
 	if !found {
-		return fmt.Errorf("got valid segment, but address is not allowed: %s", pub.String())
+		return fmt.Errorf("%w: got valid segment, but address is not allowed: %s", ErrStreamerNotAllowed, user.String())
 	}
 	meta, err := ParseSegmentAssertions(mani)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrSegmentInvalid, err)
+	}
+	hash := replication.SegmentHash(buf)
+	now := time.Now()
+	err = mm.checkSegment(user.String(), meta, hash, source, now)
 	if err != nil {
 		return err
 	}
-	fd, err := mm.cli.SegmentFileCreate(pub.String(), meta.StartTime, "mp4")
+	uu, err := uuid.NewV7()
 	if err != nil {
 		return err
 	}
-	defer fd.Close()
-	go mm.replicator.NewSegment(ctx, buf)
-	r = bytes.NewReader(buf)
-	io.Copy(fd, r)
-	base := filepath.Base(fd.Name())
-	go mm.PublishSegment(ctx, pub.String(), base)
-	log.Log(ctx, "successfully ingested segment", "user", pub.String(), "timestamp", meta.StartTime)
+	key := storage.SegmentKey(user.String(), meta.StartTime)
+	err = mm.store.Put(ctx, key, bytes.NewReader(buf), int64(len(buf)))
+	if errors.Is(err, storage.ErrExists) {
+		return fmt.Errorf("%w: %w", ErrSegmentOverlap, err)
+	}
+	if err != nil {
+		return err
+	}
+	err = mm.model.CreateSegment(&model.Segment{
+		ID:                uu.String(),
+		User:              user.String(),
+		StartTime:         meta.StartTime,
+		EndTime:           meta.EndTime,
+		Size:              int64(len(buf)),
+		Hash:              hash,
+		Path:              key,
+		SignerFingerprint: fingerprint,
+		Source:            source,
+		EncodingFormat:    meta.EncodingFormat,
+		Duration:          meta.Duration,
+	})
+	if err != nil {
+		mm.deleteUnindexed(ctx, key)
+		return fmt.Errorf("error recording segment: %w", err)
+	}
+	// only queued for peers once it's indexed, so retention knows it's there
+	mm.replicator.NewSegment(ctx, key, buf)
+	// checkSegment has already made sure these parse
+	start, _ := meta.StartTime.Parse()
+	end, _ := meta.EndTime.Parse()
+	// backfill from a peer would get spliced into what viewers are watching,
+	// and would bring long-gone streams back to life
+	if isLiveSegment(end, now) {
+		mm.PublishSegment(ctx, user.String(), path.Base(key), start, end)
+		mm.streams.segment(ctx, user.String(), start, end, now)
+	}
+	log.Log(ctx, "successfully ingested segment", "user", user.String(), "signer", pub.String(), "timestamp", meta.StartTime)
 	return nil
 }
@@ -5,6 +5,7 @@ import (
 	"context"
 	"crypto"
 	"crypto/ecdsa"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -20,12 +21,19 @@ import (
 	"git.aquareum.tv/aquareum-tv/c2pa-go/pkg/c2pa"
 )
 
+// c2pa assertion carrying the signed v0.StreamKey that lets us sign on a user's behalf
+const STREAM_KEY_ASSERTION = "tv.aquareum.stream-key"
+
 type MediaSigner struct {
 	StreamerName string
 	Signer       crypto.Signer
 	Pub          aqpub.Pub
 	Cert         []byte
 	TAURL        string
+	// who the segments are attributed to, if not Pub
+	User string
+	// signed v0.StreamKey from User authorizing Pub, embedded in every segment
+	StreamKey []byte
 }
 
 func MakeMediaSigner(ctx context.Context, cli *config.CLI, streamer string, signer crypto.Signer) (*MediaSigner, error) {
@@ -62,8 +70,30 @@ func MakeMediaSigner(ctx context.Context, cli *config.CLI, streamer string, sign
 	}, nil
 }
 
-func (ms *MediaSigner) SignMP4(ctx context.Context, input io.ReadSeeker, start int64) ([]byte, error) {
-	end := time.Now().UnixMilli()
+// a copy of this signer that signs segments on behalf of user, who authorized
+// us with the provided signed v0.StreamKey
+func (ms *MediaSigner) Delegate(user string, streamKey []byte) *MediaSigner {
+	delegated := *ms
+	delegated.StreamerName = user
+	delegated.User = user
+	delegated.StreamKey = streamKey
+	return &delegated
+}
+
+// the address segments are attributed to
+func (ms *MediaSigner) UserAddress() string {
+	if ms.User != "" {
+		return ms.User
+	}
+	return ms.Pub.String()
+}
+
+// sign a segment that plays from start to end, in unix millis
+func (ms *MediaSigner) SignMP4(ctx context.Context, input io.ReadSeeker, start, end int64) ([]byte, error) {
+	codecs, dur, err := readSeekerMP4Info(input)
+	if err != nil {
+		return nil, err
+	}
 	mani := obj{
 		"title": fmt.Sprintf("Livestream Segment at %s", aqtime.FromMillis(start)),
 		"assertions": []obj{
@@ -87,15 +117,97 @@ func (ms *MediaSigner) SignMP4(ctx context.Context, input io.ReadSeeker, start i
 						{
 							"@type":     "s:Person",
 							"s:name":    ms.StreamerName,
-							"s:address": ms.Pub.String(),
+							"s:address": ms.UserAddress(),
+						},
+					},
+					"s:startTime":      aqtime.FromMillis(start).String(),
+					"s:endTime":        aqtime.FromMillis(end).String(),
+					"s:encodingFormat": mp4EncodingFormat(codecs),
+					"s:duration":       formatISODuration(dur),
+				},
+			},
+		},
+	}
+	if ms.StreamKey != nil {
+		mani["assertions"] = append(mani["assertions"].([]obj), obj{
+			"label": STREAM_KEY_ASSERTION,
+			"data": obj{
+				"key": base64.URLEncoding.EncodeToString(ms.StreamKey),
+			},
+		})
+	}
+	return ms.sign(input, mani, nil)
+}
+
+// sign a rendition transcoded from a signed source segment. the source's
+// metadata carries over with the rendition's codecs, and the source itself
+// goes in as an ingredient so viewers can follow the chain back to the
+// streamer's key.
+func (ms *MediaSigner) SignTranscodedMP4(ctx context.Context, input io.ReadSeeker, source []byte, sourceMetadata map[string]any, r Rendition) ([]byte, error) {
+	codecs, dur, err := readSeekerMP4Info(input)
+	if err != nil {
+		return nil, err
+	}
+	metadata := obj{}
+	for k, v := range sourceMetadata {
+		metadata[k] = v
+	}
+	metadata["s:encodingFormat"] = mp4EncodingFormat(codecs)
+	metadata["s:duration"] = formatISODuration(dur)
+	title := fmt.Sprintf("%s Rendition of Livestream Segment", r.Name)
+	if start, ok := metadata["s:startTime"].(string); ok {
+		title = fmt.Sprintf("%s at %s", title, start)
+	}
+	mani := obj{
+		"title": title,
+		"assertions": []obj{
+			{
+				"label": "c2pa.actions",
+				"data": obj{
+					"actions": []obj{
+						{
+							"action": "c2pa.transcoded",
+							"parameters": obj{
+								"description": fmt.Sprintf("transcoded to %s at %dx%d", r.Name, r.Width, r.Height),
+							},
 						},
+						{"action": "c2pa.published"},
 					},
-					"s:startTime": aqtime.FromMillis(start).String(),
-					"s:endTime":   aqtime.FromMillis(end).String(),
 				},
 			},
+			{
+				"label": STDS_METADATA,
+				"data":  metadata,
+			},
 		},
 	}
+	return ms.sign(input, mani, source)
+}
+
+// codecs and duration of an mp4 we're about to sign, leaving it rewound
+func readSeekerMP4Info(input io.ReadSeeker) ([]string, time.Duration, error) {
+	mp4, err := io.ReadAll(input)
+	if err != nil {
+		return nil, 0, err
+	}
+	codecs, err := mp4Codecs(mp4)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error finding segment codecs: %w", err)
+	}
+	dur, err := mp4Duration(mp4)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error finding segment duration: %w", err)
+	}
+	_, err = input.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, 0, err
+	}
+	return codecs, dur, nil
+}
+
+// sign input with the provided manifest definition, optionally with a signed
+// mp4 it was derived from as its parent ingredient
+func (ms *MediaSigner) sign(input io.ReadSeeker, mani obj, parent []byte) ([]byte, error) {
 	manifestBs, err := json.Marshal(mani)
 	if err != nil {
 		return nil, err
@@ -118,6 +230,20 @@ func (ms *MediaSigner) SignMP4(ctx context.Context, input io.ReadSeeker, start i
 	if err != nil {
 		return nil, err
 	}
+	if parent != nil {
+		ingredient, err := json.Marshal(obj{
+			"title":        "Source Livestream Segment",
+			"format":       "video/mp4",
+			"relationship": "parentOf",
+		})
+		if err != nil {
+			return nil, err
+		}
+		err = b.AddIngredient(string(ingredient), "video/mp4", bytes.NewReader(parent))
+		if err != nil {
+			return nil, fmt.Errorf("error adding ingredient: %w", err)
+		}
+	}
 
 	output := &aqio.ReadWriteSeeker{}
 	err = b.Sign(input, output, "video/mp4")
@@ -2,18 +2,23 @@ package media
 
 import (
 	"context"
+	"io"
 	"os"
 	"path/filepath"
 	"runtime"
 	"testing"
+	"time"
 
 	"aquareum.tv/aquareum/pkg/config"
 	ct "aquareum.tv/aquareum/pkg/config/configtesting"
 	"aquareum.tv/aquareum/pkg/crypto/aqpub"
 	"aquareum.tv/aquareum/pkg/crypto/signers/eip712/eip712test"
 	_ "aquareum.tv/aquareum/pkg/media/mediatesting"
+	"aquareum.tv/aquareum/pkg/model"
 	"aquareum.tv/aquareum/pkg/replication/boring"
+	"aquareum.tv/aquareum/pkg/storage"
 	"git.aquareum.tv/aquareum-tv/c2pa-go/pkg/c2pa"
+	"github.com/go-gst/go-gst/gst"
 	"github.com/stretchr/testify/require"
 )
 
@@ -23,6 +28,21 @@ func getFixture(name string) string {
 	return filepath.Join(dir, "..", "..", "test", "fixtures", name)
 }
 
+// run a gst-launch style pipeline until it finishes, failing on any error
+func runTestPipeline(t *testing.T, desc string) {
+	gst.Init(nil)
+	pipeline, err := gst.NewPipelineFromString(desc)
+	require.NoError(t, err)
+	err = pipeline.SetState(gst.StatePlaying)
+	require.NoError(t, err)
+	defer pipeline.BlockSetState(gst.StateNull)
+	msg := pipeline.GetPipelineBus().TimedPopFiltered(gst.ClockTimeNone, gst.MessageEOS|gst.MessageError)
+	require.NotNil(t, msg)
+	if msg.Type() == gst.MessageError {
+		t.Fatalf("pipeline error: %s", msg.ParseError().Error())
+	}
+}
+
 func getStaticTestMediaManager(t *testing.T) (*MediaManager, *MediaSigner) {
 	signer, err := c2pa.MakeStaticSigner(eip712test.KeyBytes)
 	require.NoError(t, err)
@@ -31,10 +51,15 @@ func getStaticTestMediaManager(t *testing.T) (*MediaManager, *MediaSigner) {
 		panic(err)
 	}
 	cli := ct.CLI(t, &config.CLI{
-		TAURL:          "http://timestamp.digicert.com",
-		AllowedStreams: []aqpub.Pub{pub},
+		TAURL:           "http://timestamp.digicert.com",
+		AllowedStreams:  []aqpub.Pub{pub},
+		SegmentDuration: 2 * time.Second,
 	})
-	mm, err := MakeMediaManager(context.Background(), cli, signer, &boring.BoringReplicator{})
+	mod, err := model.MakeDB(":memory:")
+	require.NoError(t, err)
+	store, err := storage.MakeSegmentStore(context.Background(), cli)
+	require.NoError(t, err)
+	mm, err := MakeMediaManager(context.Background(), cli, signer, nil, &boring.BoringReplicator{}, mod, store)
 	require.NoError(t, err)
 	ms, err := MakeMediaSigner(context.Background(), cli, "test-person", signer)
 	return mm, ms
@@ -119,6 +144,15 @@ func TestVerifyMP4(t *testing.T) {
 	f, err := os.Open(getFixture("sample-segment.mp4"))
 	require.NoError(t, err)
 	mm, _ := getStaticTestMediaManager(t)
-	err = mm.ValidateMP4(context.Background(), f)
+	// fixture is old, so it's only acceptable as a replicated segment
+	err = mm.ValidateMP4(context.Background(), f, model.SegmentSourceReplicated)
+	require.NoError(t, err)
+	// and too old for anyone watching live, or to mean they're streaming
+	require.Equal(t, uint64(0), mm.SegmentHubStats().Published)
+	status, err := mm.StreamStatus("0x6fbe6863cf1efc713899455e526a13239d371175")
 	require.NoError(t, err)
+	require.Equal(t, StreamStateOffline, status.State)
+	f.Seek(0, io.SeekStart)
+	err = mm.ValidateMP4(context.Background(), f, model.SegmentSourceReplicated)
+	require.ErrorIs(t, err, ErrSegmentDuplicate)
 }
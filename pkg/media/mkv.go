@@ -0,0 +1,333 @@
+package media
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// matroska element IDs, marker bits and all, like the spec writes them
+const (
+	mkvEBML           = 0x1A45DFA3
+	mkvSegment        = 0x18538067
+	mkvTracks         = 0x1654AE6B
+	mkvTrackEntry     = 0xAE
+	mkvTrackNumber    = 0xD7
+	mkvTrackType      = 0x83
+	mkvCluster        = 0x1F43B675
+	mkvSimpleBlock    = 0xA3
+	mkvBlockGroup     = 0xA0
+	mkvBlock          = 0xA1
+	mkvReferenceBlock = 0xFB
+)
+
+// track type of video tracks
+const mkvTrackTypeVideo = 1
+
+// size of an element that runs until its parent or the stream ends, which is
+// how live muxers write segments and clusters
+const mkvUnknownSize = -1
+
+// length of an EBML variable-size integer from its first byte
+func ebmlVintLen(b byte) int {
+	return bits.LeadingZeros8(b) + 1
+}
+
+// an EBML variable-size integer with and without its length marker
+func ebmlVint(raw []byte) (uint64, uint64) {
+	var marked uint64
+	for _, b := range raw {
+		marked = marked<<8 | uint64(b)
+	}
+	return marked, marked &^ (1 << (7 * len(raw)))
+}
+
+// read an EBML variable-size integer off a stream, returning it with and
+// without its length marker along with the raw bytes
+func readEBMLVint(r *bufio.Reader, max int) (uint64, uint64, []byte, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	n := ebmlVintLen(first)
+	if n > max {
+		return 0, 0, nil, fmt.Errorf("invalid ebml vint 0x%02x", first)
+	}
+	raw := make([]byte, n)
+	raw[0] = first
+	_, err = io.ReadFull(r, raw[1:])
+	if err != nil {
+		return 0, 0, nil, noEOF(err)
+	}
+	marked, value := ebmlVint(raw)
+	return marked, value, raw, nil
+}
+
+// read an element's ID and data size off a stream, along with the raw header
+func readEBMLHeader(r *bufio.Reader) (uint32, int64, []byte, error) {
+	id, _, rawID, err := readEBMLVint(r, 4)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	_, size, rawSize, err := readEBMLVint(r, 8)
+	if err != nil {
+		return 0, 0, nil, noEOF(err)
+	}
+	header := append(rawID, rawSize...)
+	// all ones means unknown
+	if size == 1<<(7*len(rawSize))-1 {
+		return uint32(id), mkvUnknownSize, header, nil
+	}
+	return uint32(id), int64(size), header, nil
+}
+
+// read a whole element of known size off a stream, header and all, along with
+// where its body starts
+func readEBMLElement(r *bufio.Reader) (uint32, []byte, int, error) {
+	id, size, header, err := readEBMLHeader(r)
+	if err != nil {
+		return 0, nil, 0, err
+	}
+	if size == mkvUnknownSize {
+		return 0, nil, 0, fmt.Errorf("mkv element 0x%x has unknown size", id)
+	}
+	el := make([]byte, int64(len(header))+size)
+	copy(el, header)
+	_, err = io.ReadFull(r, el[len(header):])
+	if err != nil {
+		return 0, nil, 0, noEOF(err)
+	}
+	return id, el, len(header), nil
+}
+
+// the next element in a buffer: its ID, body and what follows it
+func ebmlNextElement(bs []byte) (uint32, []byte, []byte, error) {
+	vint := func(max int) (uint64, uint64, error) {
+		if len(bs) == 0 {
+			return 0, 0, fmt.Errorf("truncated mkv element")
+		}
+		n := ebmlVintLen(bs[0])
+		if n > max || len(bs) < n {
+			return 0, 0, fmt.Errorf("bad mkv element")
+		}
+		marked, value := ebmlVint(bs[:n])
+		bs = bs[n:]
+		return marked, value, nil
+	}
+	id, _, err := vint(4)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	_, size, err := vint(8)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if size > uint64(len(bs)) {
+		return 0, nil, nil, fmt.Errorf("mkv element 0x%x has bad size %d", id, size)
+	}
+	return uint32(id), bs[:size], bs[size:], nil
+}
+
+// running out partway through something is an error, not the end of the stream
+func noEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// an EBML unsigned integer element's value
+func ebmlUint(body []byte) uint64 {
+	var v uint64
+	for _, b := range body {
+		v = v<<8 | uint64(b)
+	}
+	return v
+}
+
+// number of the first video track in a Tracks element, 0 if there isn't one
+func mkvVideoTrack(tracks []byte) (uint64, error) {
+	for rest := tracks; len(rest) > 0; {
+		id, entry, next, err := ebmlNextElement(rest)
+		if err != nil {
+			return 0, err
+		}
+		rest = next
+		if id != mkvTrackEntry {
+			continue
+		}
+		var number, typ uint64
+		for fields := entry; len(fields) > 0; {
+			id, body, next, err := ebmlNextElement(fields)
+			if err != nil {
+				return 0, err
+			}
+			fields = next
+			switch id {
+			case mkvTrackNumber:
+				number = ebmlUint(body)
+			case mkvTrackType:
+				typ = ebmlUint(body)
+			}
+		}
+		if typ == mkvTrackTypeVideo {
+			return number, nil
+		}
+	}
+	return 0, nil
+}
+
+// whether a cluster child is a frame of the video track, and if so whether
+// it's a keyframe. with no video track every frame counts.
+func mkvBlockKeyframe(id uint32, body []byte, videoTrack uint64) (bool, bool) {
+	var block []byte
+	keyframe := false
+	switch id {
+	case mkvSimpleBlock:
+		block = body
+		if len(block) > 0 {
+			n := ebmlVintLen(block[0])
+			// track number, 16-bit timecode, then flags
+			keyframe = len(block) > n+2 && block[n+2]&0x80 != 0
+		}
+	case mkvBlockGroup:
+		// no reference to another frame means a keyframe
+		keyframe = true
+		for rest := body; len(rest) > 0; {
+			id, child, next, err := ebmlNextElement(rest)
+			if err != nil {
+				return false, false
+			}
+			rest = next
+			switch id {
+			case mkvBlock:
+				block = child
+			case mkvReferenceBlock:
+				keyframe = false
+			}
+		}
+	default:
+		return false, false
+	}
+	if len(block) == 0 {
+		return false, false
+	}
+	n := ebmlVintLen(block[0])
+	if n > 8 || len(block) < n {
+		return false, false
+	}
+	_, track := ebmlVint(block[:n])
+	if videoTrack != 0 && track != videoTrack {
+		return false, false
+	}
+	return keyframe, true
+}
+
+// cut a live matroska stream into its header and then the elements after it,
+// noting which clusters start on a keyframe. clusters are passed on a child at
+// a time so viewers don't wait for a whole one.
+func splitMKV(r io.Reader, header func([]byte), piece func([]byte, bool)) error {
+	br := bufio.NewReader(r)
+	id, head, _, err := readEBMLElement(br)
+	if err != nil {
+		return err
+	}
+	if id != mkvEBML {
+		return fmt.Errorf("not a matroska stream")
+	}
+	id, _, segment, err := readEBMLHeader(br)
+	if err != nil {
+		return noEOF(err)
+	}
+	if id != mkvSegment {
+		return fmt.Errorf("matroska stream has no segment")
+	}
+	head = append(head, segment...)
+	var videoTrack uint64
+	started := false
+	for {
+		id, size, elHeader, err := readEBMLHeader(br)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if id == mkvCluster {
+			if !started {
+				header(head)
+				started = true
+			}
+			err = splitMKVCluster(br, elHeader, size, videoTrack, piece)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if size == mkvUnknownSize {
+			return fmt.Errorf("mkv element 0x%x has unknown size", id)
+		}
+		el := make([]byte, int64(len(elHeader))+size)
+		copy(el, elHeader)
+		_, err = io.ReadFull(br, el[len(elHeader):])
+		if err != nil {
+			return noEOF(err)
+		}
+		if started {
+			piece(el, false)
+			continue
+		}
+		head = append(head, el...)
+		if id == mkvTracks {
+			videoTrack, err = mkvVideoTrack(el[len(elHeader):])
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// pass on a cluster whose header we've read, holding back its start until its
+// first video frame says whether it's somewhere to start playing from
+func splitMKVCluster(br *bufio.Reader, header []byte, size int64, videoTrack uint64, piece func([]byte, bool)) error {
+	pending := header
+	decided := false
+	remaining := size
+	for size == mkvUnknownSize || remaining > 0 {
+		if size == mkvUnknownSize {
+			next, err := br.Peek(1)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			// cluster children have short IDs, so a long one is the next
+			// top-level element
+			if ebmlVintLen(next[0]) == 4 {
+				break
+			}
+		}
+		id, el, start, err := readEBMLElement(br)
+		if err != nil {
+			return noEOF(err)
+		}
+		remaining -= int64(len(el))
+		if decided {
+			piece(el, false)
+			continue
+		}
+		pending = append(pending, el...)
+		keyframe, ok := mkvBlockKeyframe(id, el[start:], videoTrack)
+		if ok {
+			piece(pending, keyframe)
+			decided = true
+		}
+	}
+	if !decided {
+		piece(pending, false)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// an element with an 8-byte size
+func testEBML(id uint32, body ...[]byte) []byte {
+	bs := bytes.Join(body, nil)
+	out := testEBMLID(id)
+	out = binary.BigEndian.AppendUint64(out, uint64(len(bs))|0x01<<56)
+	return append(out, bs...)
+}
+
+// an element header saying it runs until whatever's next
+func testEBMLUnknown(id uint32) []byte {
+	return binary.BigEndian.AppendUint64(testEBMLID(id), 0x01ffffffffffffff)
+}
+
+func testEBMLID(id uint32) []byte {
+	bs := binary.BigEndian.AppendUint32(nil, id)
+	for len(bs) > 1 && bs[0] == 0 {
+		bs = bs[1:]
+	}
+	return bs
+}
+
+func testSimpleBlock(track byte, keyframe bool) []byte {
+	flags := byte(0)
+	if keyframe {
+		flags = 0x80
+	}
+	return testEBML(mkvSimpleBlock, []byte{0x80 | track, 0, 0, flags}, []byte("frame"))
+}
+
+func TestSplitMKV(t *testing.T) {
+	header := bytes.Join([][]byte{
+		testEBML(mkvEBML, []byte("header")),
+		testEBMLUnknown(mkvSegment),
+		// Info
+		testEBML(0x1549A966, []byte("info")),
+		testEBML(mkvTracks,
+			testEBML(mkvTrackEntry, testEBML(mkvTrackNumber, []byte{1}), testEBML(mkvTrackType, []byte{2})),
+			testEBML(mkvTrackEntry, testEBML(mkvTrackNumber, []byte{2}), testEBML(mkvTrackType, []byte{mkvTrackTypeVideo})),
+		),
+	}, nil)
+	timestamp := testEBML(0xE7, []byte{0})
+	// audio then a video keyframe
+	first := bytes.Join([][]byte{testEBMLUnknown(mkvCluster), timestamp, testSimpleBlock(1, true), testSimpleBlock(2, true)}, nil)
+	audio := testSimpleBlock(1, true)
+	// a cluster that doesn't start with a keyframe
+	second := testEBML(mkvCluster, timestamp, testSimpleBlock(2, false))
+	// block groups are keyframes unless they reference something
+	third := bytes.Join([][]byte{testEBMLUnknown(mkvCluster), testEBML(mkvBlockGroup, testEBML(mkvBlock, []byte{0x82, 0, 0, 0}))}, nil)
+	stream := bytes.Join([][]byte{header, first, audio, second, third}, nil)
+
+	var gotHeader []byte
+	var pieces [][]byte
+	var keyframes []bool
+	err := splitMKV(bytes.NewReader(stream), func(bs []byte) {
+		gotHeader = bs
+	}, func(bs []byte, keyframe bool) {
+		pieces = append(pieces, bs)
+		keyframes = append(keyframes, keyframe)
+	})
+	require.NoError(t, err)
+	require.Equal(t, header, gotHeader)
+	require.Equal(t, [][]byte{first, audio, second, third}, pieces)
+	require.Equal(t, []bool{true, false, false, true}, keyframes)
+
+	err = splitMKV(bytes.NewReader(stream[:len(stream)-2]), func([]byte) {}, func([]byte, bool) {})
+	require.Error(t, err, "truncated streams should error")
+}
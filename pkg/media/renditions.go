@@ -0,0 +1,368 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"aquareum.tv/aquareum/pkg/aqtime"
+	"aquareum.tv/aquareum/pkg/log"
+	"aquareum.tv/aquareum/pkg/storage"
+	"git.aquareum.tv/aquareum-tv/c2pa-go/pkg/c2pa"
+	"github.com/livepeer/lpms/ffmpeg"
+	"golang.org/x/sync/errgroup"
+)
+
+// multi-variant playlist pointing at the source and every rendition
+const HLS_MASTER_PLAYLIST = "index.m3u8"
+
+// what we assume AAC audio adds on top of a rendition's video bitrate
+const HLS_AUDIO_BANDWIDTH = 128_000
+
+// advertised for the source until we have a segment to measure
+const HLS_SOURCE_BANDWIDTH_DEFAULT = 6_000_000
+
+// renditions are H.264 high profile, at a level that covers 1080p60
+const RENDITION_VIDEO_CODEC = "avc1.64002a"
+
+// a rung of the ABR ladder we transcode the source down to
+type Rendition struct {
+	Name   string
+	Width  int
+	Height int
+	// video bits per second
+	Bitrate int
+}
+
+// every rendition --hls-renditions can pick from, highest first
+var renditionLadder = []Rendition{
+	{Name: "1080p", Width: 1920, Height: 1080, Bitrate: 5_000_000},
+	{Name: "720p", Width: 1280, Height: 720, Bitrate: 3_000_000},
+	{Name: "480p", Width: 854, Height: 480, Bitrate: 1_200_000},
+	{Name: "360p", Width: 640, Height: 360, Bitrate: 800_000},
+	{Name: "240p", Width: 426, Height: 240, Bitrate: 400_000},
+}
+
+// look up renditions by name, eg from --hls-renditions, highest first
+func ParseRenditions(names []string) ([]Rendition, error) {
+	renditions := []Rendition{}
+	for _, rung := range renditionLadder {
+		if slices.Contains(names, rung.Name) {
+			renditions = append(renditions, rung)
+		}
+	}
+	for _, name := range names {
+		if !slices.ContainsFunc(renditions, func(r Rendition) bool { return r.Name == name }) {
+			known := []string{}
+			for _, rung := range renditionLadder {
+				known = append(known, rung.Name)
+			}
+			return nil, fmt.Errorf("unknown rendition %q, expected one of [%s]", name, strings.Join(known, ", "))
+		}
+	}
+	return renditions, nil
+}
+
+// HLS output name for the rendition, eg 720p.m3u8
+func (r Rendition) Playlist() string {
+	return r.Name + ".m3u8"
+}
+
+// the rendition scaled to the source's aspect ratio, without going any bigger
+// than the source. widths stay even, which x264 needs.
+func (r Rendition) fit(width, height int) Rendition {
+	if width <= 0 || height <= 0 {
+		return r
+	}
+	if r.Height > height {
+		r.Height = height
+	}
+	r.Width = (r.Height*width/height + 1) &^ 1
+	if r.Width > width {
+		r.Width = width &^ 1
+	}
+	return r
+}
+
+func (r Rendition) profile(gop time.Duration) ffmpeg.VideoProfile {
+	return ffmpeg.VideoProfile{
+		Name:       r.Name,
+		Bitrate:    fmt.Sprintf("%dk", r.Bitrate/1000),
+		Resolution: fmt.Sprintf("%dx%d", r.Width, r.Height),
+		// keyframes line up with where ToHLS wants to cut
+		GOP:    gop,
+		Format: ffmpeg.FormatNone,
+	}
+}
+
+// what the master playlist says about the source, from its latest segment
+type hlsSource struct {
+	bandwidth int
+	mp4Info
+}
+
+// master playlist letting players pick between the source and renditions.
+// RESOLUTION and CODECS are left off wherever we don't know them.
+func hlsMasterPlaylist(source hlsSource, renditions []Rendition) string {
+	sourceAttrs := fmt.Sprintf("BANDWIDTH=%d", source.bandwidth)
+	if source.width > 0 && source.height > 0 {
+		sourceAttrs += fmt.Sprintf(",RESOLUTION=%dx%d", source.width, source.height)
+	}
+	if source.video != "" && source.audio != "" {
+		sourceAttrs += fmt.Sprintf(`,CODECS="%s,%s"`, source.video, source.audio)
+	}
+	lines := []string{
+		"#EXTM3U",
+		"#EXT-X-VERSION:3",
+		"#EXT-X-STREAM-INF:" + sourceAttrs,
+		HLS_PLAYLIST,
+	}
+	for _, r := range renditions {
+		r = r.fit(source.width, source.height)
+		attrs := fmt.Sprintf("BANDWIDTH=%d,RESOLUTION=%dx%d", r.Bitrate+HLS_AUDIO_BANDWIDTH, r.Width, r.Height)
+		// audio is copied from the source
+		if source.audio != "" {
+			attrs += fmt.Sprintf(`,CODECS="%s,%s"`, RENDITION_VIDEO_CODEC, source.audio)
+		}
+		lines = append(lines, "#EXT-X-STREAM-INF:"+attrs, r.Playlist())
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// bitrate, codecs and size of the user's latest segment, so players can rank
+// the source against the renditions
+func (mm *MediaManager) hlsSource(ctx context.Context, user string) hlsSource {
+	source := hlsSource{bandwidth: HLS_SOURCE_BANDWIDTH_DEFAULT}
+	now := time.Now()
+	start := aqtime.FromMillis(now.Add(-HLS_STREAM_END_TIMEOUT).UnixMilli())
+	end := aqtime.FromMillis(now.UnixMilli())
+	segs, err := mm.model.ListSegments(user, start, end)
+	if err != nil || len(segs) == 0 {
+		return source
+	}
+	seg := segs[len(segs)-1]
+	segStart, err := seg.StartTime.Parse()
+	if err != nil {
+		return source
+	}
+	segEnd, err := seg.EndTime.Parse()
+	if err != nil {
+		return source
+	}
+	if dur := segEnd.Sub(segStart); dur > 0 {
+		source.bandwidth = int(float64(seg.Size*8) / dur.Seconds())
+	}
+	if mm.store == nil {
+		return source
+	}
+	rc, err := mm.store.Get(ctx, seg.Path)
+	if err != nil {
+		log.Debug(ctx, "couldn't read latest segment for the master playlist", "user", user, "error", err)
+		return source
+	}
+	defer rc.Close()
+	bs, err := io.ReadAll(rc)
+	if err != nil {
+		return source
+	}
+	info, err := mp4TrackInfo(bs)
+	if err != nil {
+		log.Debug(ctx, "couldn't parse latest segment for the master playlist", "user", user, "error", err)
+		return source
+	}
+	source.mp4Info = info
+	return source
+}
+
+// how many signed segments of each rendition we hold on to for live playback
+const RENDITION_SEGMENTS_KEPT = 10
+
+type renditionSegment struct {
+	file string
+	mp4  []byte
+}
+
+// pub/sub and internal URL key for a user's rendition, eg 0xabc.../720p
+func renditionStream(user string, r Rendition) string {
+	return user + "/" + r.Name
+}
+
+// transcode and package the user's renditions alongside the source, handing
+// each one's stream to output. they're in their own group so that a rendition
+// failing gets logged rather than taking the source down with it.
+func (mm *MediaManager) runRenditions(ctx context.Context, user string, muxer ffmpeg.ComponentOptions, output func(ctx context.Context, r Rendition, pr io.Reader) error) {
+	if len(mm.renditions) == 0 {
+		return
+	}
+	parent := ctx
+	g, ctx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		return mm.TranscodeLiveSegments(ctx, user)
+	})
+	for _, r := range mm.renditions {
+		pr, pw := io.Pipe()
+		g.Go(func() error {
+			err := mm.RenditionToStream(ctx, user, r, muxer, pw)
+			pw.Close()
+			return err
+		})
+		g.Go(func() error {
+			defer pr.Close()
+			return output(ctx, r, pr)
+		})
+	}
+	err := g.Wait()
+	if err != nil && parent.Err() == nil {
+		log.Error(ctx, "renditions stopped, carrying on with just the source", "user", user, "error", err)
+	}
+}
+
+// transcode the user's segments to every rendition as they come in, until
+// ctx is done
+func (mm *MediaManager) TranscodeLiveSegments(ctx context.Context, user string) error {
+	// nothing plays renditions once we stop making them
+	defer mm.dropRenditionSegments(user)
+	// if transcoding falls behind, the hub skips segments for us
+	for file := range mm.SubscribeSegment(ctx, user, "") {
+		err := mm.TranscodeSegment(ctx, user, file)
+		if err != nil {
+			log.Error(ctx, "error transcoding segment", "user", user, "file", file, "error", err)
+		}
+	}
+	return nil
+}
+
+// transcode one of the user's signed segments to every rendition in a single
+// decoding pass, sign the results with the source as their ingredient and
+// publish them for playback
+func (mm *MediaManager) TranscodeSegment(ctx context.Context, user, file string) error {
+	key, _, err := storage.SegmentFileKey(user, file)
+	if err != nil {
+		return err
+	}
+	rc, err := mm.store.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	source, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return err
+	}
+	reader, err := c2pa.FromStream(bytes.NewReader(source), "video/mp4")
+	if err != nil {
+		return fmt.Errorf("error reading source manifest: %w", err)
+	}
+	metadata, err := segmentMetadataAssertion(reader.GetActiveManifest())
+	if err != nil {
+		return err
+	}
+	// size the renditions to this segment, in case the streamer changed
+	// resolution. an unparseable one gets the ladder as it is.
+	info, err := mp4TrackInfo(source)
+	if err != nil {
+		log.Debug(ctx, "couldn't find the source size for renditions", "user", user, "file", file, "error", err)
+	}
+
+	dir, err := os.MkdirTemp("", "aquareum-renditions")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	in := &ffmpeg.TranscodeOptionsIn{
+		Fname:   fmt.Sprintf("%s/playback/%s/segment/%s", mm.cli.OwnInternalURL(), user, file),
+		Profile: ffmpeg.VideoProfile{},
+	}
+	out := []ffmpeg.TranscodeOptions{}
+	for _, r := range mm.renditions {
+		out = append(out, ffmpeg.TranscodeOptions{
+			Oname:   filepath.Join(dir, r.Name+".mp4"),
+			Profile: r.fit(info.width, info.height).profile(mm.cli.SegmentDuration),
+			Accel:   ffmpeg.Software,
+			VideoEncoder: ffmpeg.ComponentOptions{
+				Name: "libx264",
+				// what RENDITION_VIDEO_CODEC says we are
+				Opts: map[string]string{
+					"profile": "high",
+					"level":   "4.2",
+				},
+			},
+			AudioEncoder: ffmpeg.ComponentOptions{
+				Name: "copy",
+			},
+			Muxer: ffmpeg.ComponentOptions{
+				Name: "mp4",
+			},
+		})
+	}
+	tc := ffmpeg.NewTranscoder()
+	_, err = tc.Transcode(in, out)
+	tc.StopTranscoder()
+	if err != nil {
+		return err
+	}
+
+	for _, r := range mm.renditions {
+		bs, err := os.ReadFile(filepath.Join(dir, r.Name+".mp4"))
+		if err != nil {
+			return err
+		}
+		signed, err := mm.signer.SignTranscodedMP4(ctx, bytes.NewReader(bs), source, metadata, r)
+		if err != nil {
+			return fmt.Errorf("error signing %s rendition: %w", r.Name, err)
+		}
+		mm.addRenditionSegment(renditionStream(user, r), file, signed)
+		mm.PublishSegment(ctx, renditionStream(user, r), file, time.Time{}, time.Time{})
+	}
+	return nil
+}
+
+func (mm *MediaManager) addRenditionSegment(stream, file string, mp4 []byte) {
+	mm.renditionMut.Lock()
+	defer mm.renditionMut.Unlock()
+	segs := append(mm.renditionSegs[stream], renditionSegment{file: file, mp4: mp4})
+	if len(segs) > RENDITION_SEGMENTS_KEPT {
+		segs = segs[len(segs)-RENDITION_SEGMENTS_KEPT:]
+	}
+	mm.renditionSegs[stream] = segs
+}
+
+// forget every rendition segment we're holding for a user
+func (mm *MediaManager) dropRenditionSegments(user string) {
+	mm.renditionMut.Lock()
+	defer mm.renditionMut.Unlock()
+	for _, r := range mm.renditions {
+		delete(mm.renditionSegs, renditionStream(user, r))
+	}
+}
+
+// one of the recent signed segments of a user's rendition, or nil if we don't
+// have it
+func (mm *MediaManager) RenditionSegment(user, rendition, file string) []byte {
+	mm.renditionMut.Lock()
+	defer mm.renditionMut.Unlock()
+	for _, seg := range mm.renditionSegs[user+"/"+rendition] {
+		if seg.file == file {
+			return seg.mp4
+		}
+	}
+	return nil
+}
+
+// the next signed segment of a user's rendition after the one named after, or
+// the next one to be transcoded if after is empty, as with NextSegment
+func (mm *MediaManager) NextRenditionSegment(ctx context.Context, user, rendition, reader, after string) (string, error) {
+	return mm.NextSegment(ctx, user+"/"+rendition, reader, after)
+}
+
+// stream a user's rendition as matroska, from the signed rendition segments
+func (mm *MediaManager) RenditionToStream(ctx context.Context, user string, r Rendition, muxer ffmpeg.ComponentOptions, w io.Writer) error {
+	iname := fmt.Sprintf("%s/playback/%s/rendition/%s/concat", mm.cli.OwnInternalURL(), user, r.Name)
+	return mm.concatToStream(ctx, iname, muxer, w)
+}
@@ -0,0 +1,230 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"aquareum.tv/aquareum/pkg/aqtime"
+	"aquareum.tv/aquareum/pkg/crypto/signers"
+	"aquareum.tv/aquareum/pkg/model"
+	"aquareum.tv/aquareum/pkg/storage"
+	"git.aquareum.tv/aquareum-tv/c2pa-go/pkg/c2pa"
+	"git.aquareum.tv/aquareum-tv/c2pa-go/pkg/c2pa/generated/manifeststore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRenditions(t *testing.T) {
+	renditions, err := ParseRenditions([]string{"240p", "720p", "480p"})
+	require.NoError(t, err)
+	names := []string{}
+	for _, r := range renditions {
+		names = append(names, r.Name)
+	}
+	require.Equal(t, []string{"720p", "480p", "240p"}, names, "should be highest first")
+
+	renditions, err = ParseRenditions([]string{})
+	require.NoError(t, err)
+	require.Empty(t, renditions)
+
+	_, err = ParseRenditions([]string{"720p", "4k"})
+	require.ErrorContains(t, err, "4k")
+}
+
+func TestHLSMasterPlaylist(t *testing.T) {
+	renditions, err := ParseRenditions([]string{"720p", "240p"})
+	require.NoError(t, err)
+	expected := `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-STREAM-INF:BANDWIDTH=6000000
+stream.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=3128000,RESOLUTION=1280x720
+720p.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=528000,RESOLUTION=426x240
+240p.m3u8
+`
+	require.Equal(t, expected, hlsMasterPlaylist(hlsSource{bandwidth: 6_000_000}, renditions))
+
+	// no ladder still gets a master playlist, with just the source
+	require.Equal(t, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-STREAM-INF:BANDWIDTH=6000000\nstream.m3u8\n", hlsMasterPlaylist(hlsSource{bandwidth: 6_000_000}, nil))
+
+	// a 4:3 720p source gets codecs, and renditions that fit it
+	source := hlsSource{
+		bandwidth: 6_000_000,
+		mp4Info:   mp4Info{video: "avc1.64001f", audio: "mp4a.40.2", width: 960, height: 720},
+	}
+	renditions, err = ParseRenditions([]string{"1080p", "240p"})
+	require.NoError(t, err)
+	expected = `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-STREAM-INF:BANDWIDTH=6000000,RESOLUTION=960x720,CODECS="avc1.64001f,mp4a.40.2"
+stream.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=5128000,RESOLUTION=960x720,CODECS="avc1.64002a,mp4a.40.2"
+1080p.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=528000,RESOLUTION=320x240,CODECS="avc1.64002a,mp4a.40.2"
+240p.m3u8
+`
+	require.Equal(t, expected, hlsMasterPlaylist(source, renditions))
+}
+
+func TestRenditionFit(t *testing.T) {
+	r := Rendition{Name: "720p", Width: 1280, Height: 720}
+	tests := []struct {
+		name          string
+		width, height int
+		fitW, fitH    int
+	}{
+		{name: "same aspect", width: 1920, height: 1080, fitW: 1280, fitH: 720},
+		{name: "4:3", width: 1440, height: 1080, fitW: 960, fitH: 720},
+		{name: "portrait", width: 1080, height: 1920, fitW: 406, fitH: 720},
+		{name: "no upscale", width: 854, height: 480, fitW: 854, fitH: 480},
+		{name: "odd width", width: 853, height: 480, fitW: 852, fitH: 480},
+		{name: "unknown size", width: 0, height: 0, fitW: 1280, fitH: 720},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fit := r.fit(tt.width, tt.height)
+			require.Equal(t, tt.fitW, fit.Width)
+			require.Equal(t, tt.fitH, fit.Height)
+		})
+	}
+}
+
+func TestHLSSource(t *testing.T) {
+	mod, err := model.MakeDB(":memory:")
+	require.NoError(t, err)
+	store := &storage.LocalStore{Root: t.TempDir()}
+	mm := &MediaManager{model: mod, store: store}
+	ctx := context.Background()
+	require.Equal(t, hlsSource{bandwidth: HLS_SOURCE_BANDWIDTH_DEFAULT}, mm.hlsSource(ctx, "0xalice"))
+
+	bs, err := os.ReadFile(getFixture("sample-segment.mp4"))
+	require.NoError(t, err)
+	err = store.Put(ctx, "0xalice/latest.mp4", bytes.NewReader(bs), int64(len(bs)))
+	require.NoError(t, err)
+	now := time.Now()
+	err = mod.CreateSegment(&model.Segment{
+		ID:        "latest",
+		User:      "0xalice",
+		Path:      "0xalice/latest.mp4",
+		StartTime: aqtime.FromMillis(now.Add(-3 * time.Second).UnixMilli()),
+		EndTime:   aqtime.FromMillis(now.Add(-1 * time.Second).UnixMilli()),
+		// two seconds at 4mbps
+		Size: 1_000_000,
+	})
+	require.NoError(t, err)
+	source := mm.hlsSource(ctx, "0xalice")
+	require.Equal(t, 4_000_000, source.bandwidth)
+	require.Equal(t, mp4Info{video: "avc1.42c01f", audio: "mp4a.40.2", width: 1280, height: 720}, source.mp4Info)
+
+	// a bad time in the database shouldn't take anything down
+	err = mod.CreateSegment(&model.Segment{
+		ID:        "file-safe",
+		User:      "0xbob",
+		StartTime: aqtime.AQTime(aqtime.FromMillis(now.Add(-3 * time.Second).UnixMilli()).FileSafeString()),
+		EndTime:   aqtime.FromMillis(now.Add(-1 * time.Second).UnixMilli()),
+		Size:      1_000_000,
+	})
+	require.NoError(t, err)
+	require.Equal(t, HLS_SOURCE_BANDWIDTH_DEFAULT, mm.hlsSource(ctx, "0xbob").bandwidth)
+}
+
+func TestRenditionSegments(t *testing.T) {
+	r := Rendition{Name: "720p"}
+	mm := &MediaManager{renditionSegs: map[string][]renditionSegment{}, renditions: []Rendition{r}}
+	for i := 0; i < RENDITION_SEGMENTS_KEPT+2; i++ {
+		file := fmt.Sprintf("%d.mp4", i)
+		mm.addRenditionSegment(renditionStream("0xalice", r), file, []byte(file))
+	}
+	require.Nil(t, mm.RenditionSegment("0xalice", "720p", "0.mp4"), "oldest should be dropped")
+	require.Nil(t, mm.RenditionSegment("0xalice", "720p", "1.mp4"), "oldest should be dropped")
+	require.Equal(t, []byte("2.mp4"), mm.RenditionSegment("0xalice", "720p", "2.mp4"))
+	require.Equal(t, []byte("11.mp4"), mm.RenditionSegment("0xalice", "720p", "11.mp4"))
+	require.Nil(t, mm.RenditionSegment("0xalice", "480p", "11.mp4"))
+	require.Nil(t, mm.RenditionSegment("0xbob", "720p", "11.mp4"))
+
+	mm.addRenditionSegment(renditionStream("0xbob", r), "0.mp4", []byte("0.mp4"))
+	mm.dropRenditionSegments("0xalice")
+	require.NotContains(t, mm.renditionSegs, renditionStream("0xalice", r))
+	require.Equal(t, []byte("0.mp4"), mm.RenditionSegment("0xbob", "720p", "0.mp4"))
+}
+
+func TestSignTranscodedMP4(t *testing.T) {
+	_, ms := getStaticTestMediaManager(t)
+	source, err := os.ReadFile(getFixture("sample-segment.mp4"))
+	require.NoError(t, err)
+	// stands in for what ffmpeg gives us
+	out := filepath.Join(t.TempDir(), "240p.mp4")
+	runTestPipeline(t, fmt.Sprintf(
+		"videotestsrc num-buffers=30 ! video/x-raw,width=426,height=240,framerate=30/1 ! x264enc ! h264parse ! mux. "+
+			"audiotestsrc num-buffers=30 ! audioconvert ! fdkaacenc ! aacparse ! mux. "+
+			"mp4mux name=mux ! filesink location=%s",
+		out,
+	))
+	rendition, err := os.ReadFile(out)
+	require.NoError(t, err)
+
+	meta := map[string]any{"@context": "http://schema.org/", "s:startTime": "2024-01-01T00:00:00.000Z"}
+	r := Rendition{Name: "240p", Width: 426, Height: 240}
+	signed, err := ms.SignTranscodedMP4(context.Background(), bytes.NewReader(rendition), source, meta, r)
+	require.NoError(t, err)
+
+	reader, err := c2pa.FromStream(bytes.NewReader(signed), "video/mp4")
+	require.NoError(t, err)
+	pub, err := signers.ParseES256KCert([]byte(reader.GetProvenanceCertChain()))
+	require.NoError(t, err)
+	require.Equal(t, "0x6fbe6863cf1efc713899455e526a13239d371175", pub.String())
+	mani := reader.GetActiveManifest()
+	require.NotNil(t, mani)
+
+	actions := []string{}
+	for _, a := range mani.Assertions {
+		if a.Label != "c2pa.actions" {
+			continue
+		}
+		bs, err := json.Marshal(a.Data)
+		require.NoError(t, err)
+		data := struct {
+			Actions []struct {
+				Action string `json:"action"`
+			} `json:"actions"`
+		}{}
+		require.NoError(t, json.Unmarshal(bs, &data))
+		for _, action := range data.Actions {
+			actions = append(actions, action.Action)
+		}
+	}
+	require.Contains(t, actions, "c2pa.transcoded")
+
+	// the source, with its own manifest, so viewers can follow it back
+	require.Len(t, mani.Ingredients, 1)
+	require.NotNil(t, mani.Ingredients[0].ActiveManifest)
+
+	data, err := segmentMetadataAssertion(mani)
+	require.NoError(t, err)
+	require.Equal(t, "2024-01-01T00:00:00.000Z", data["s:startTime"])
+	require.Equal(t, `video/mp4; codecs="avc1,mp4a"`, data["s:encodingFormat"])
+}
+
+func TestSegmentMetadataAssertion(t *testing.T) {
+	meta := map[string]any{"@context": "http://schema.org/", "s:startTime": "2024-01-01T00:00:00.000Z"}
+	mani := &manifeststore.Manifest{
+		Assertions: []manifeststore.ManifestAssertion{
+			{Label: "c2pa.actions", Data: map[string]any{}},
+			{Label: STDS_METADATA, Data: meta},
+		},
+	}
+	data, err := segmentMetadataAssertion(mani)
+	require.NoError(t, err)
+	require.Equal(t, meta, data)
+
+	_, err = segmentMetadataAssertion(&manifeststore.Manifest{})
+	require.Error(t, err)
+	_, err = segmentMetadataAssertion(nil)
+	require.Error(t, err)
+}
@@ -0,0 +1,219 @@
+package media
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// how many of its latest segments a stream remembers, so subscribers can pick
+// up where they left off
+const SEGMENT_HUB_HISTORY = 10
+
+// how many segments a subscriber can fall behind by before it starts missing
+// them
+const SEGMENT_HUB_BUFFER = 4
+
+// how long a stream nobody's subscribed to, or a reader's place in it, is
+// remembered after it was last used
+const SEGMENT_HUB_IDLE_TIMEOUT = 30 * time.Second
+
+// fans out newly ingested segments to everyone watching a stream. publishing
+// never blocks; a subscriber that can't keep up misses segments rather than
+// holding up ingest and every other subscriber.
+type segmentHub struct {
+	mut       sync.Mutex
+	streams   map[string]*hubStream
+	published uint64
+	delivered uint64
+	dropped   uint64
+	swept     time.Time
+}
+
+type hubStream struct {
+	history []hubSegment
+	subs    map[chan string]struct{}
+	// the last segment handed to each reader, so they pick up after it
+	cursors map[string]hubCursor
+	last    time.Time
+}
+
+type hubSegment struct {
+	file string
+	// zero if whoever published it didn't say
+	start time.Time
+	end   time.Time
+}
+
+type hubCursor struct {
+	file string
+	at   time.Time
+}
+
+type SegmentHubStats struct {
+	Published uint64 `json:"published"`
+	Delivered uint64 `json:"delivered"`
+	Dropped   uint64 `json:"dropped"`
+	// current subscriber count by stream
+	Subscribers map[string]int `json:"subscribers"`
+}
+
+func newSegmentHub() *segmentHub {
+	return &segmentHub{streams: map[string]*hubStream{}}
+}
+
+func (h *segmentHub) stream(name string) *hubStream {
+	s, ok := h.streams[name]
+	if !ok {
+		s = &hubStream{subs: map[chan string]struct{}{}, cursors: map[string]hubCursor{}}
+		h.streams[name] = s
+	}
+	return s
+}
+
+// segments published to a stream from now on, starting with any we still
+// remember after the one named after. the channel closes once ctx is done.
+func (h *segmentHub) subscribe(ctx context.Context, name, after string) <-chan string {
+	c := make(chan string, SEGMENT_HUB_BUFFER)
+	h.mut.Lock()
+	s := h.stream(name)
+	if after != "" {
+		for i, seg := range s.history {
+			if seg.file != after {
+				continue
+			}
+			for _, next := range s.history[i+1:] {
+				h.send(c, next.file)
+			}
+			break
+		}
+	}
+	s.subs[c] = struct{}{}
+	h.mut.Unlock()
+	go func() {
+		<-ctx.Done()
+		h.mut.Lock()
+		defer h.mut.Unlock()
+		delete(s.subs, c)
+		close(c)
+		if len(s.subs) == 0 && time.Since(s.last) > SEGMENT_HUB_IDLE_TIMEOUT && h.streams[name] == s {
+			delete(h.streams, name)
+		}
+	}()
+	return c
+}
+
+// the last segment handed to a reader, empty if we don't remember them
+func (h *segmentHub) cursor(name, reader string) string {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	s, ok := h.streams[name]
+	if !ok {
+		return ""
+	}
+	return s.cursors[reader].file
+}
+
+// remember the last segment handed to a reader
+func (h *segmentHub) setCursor(name, reader, file string) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	h.stream(name).cursors[reader] = hubCursor{file: file, at: time.Now()}
+}
+
+// hand a segment to every subscriber with room for it, remembering when it
+// starts and ends
+func (h *segmentHub) publish(name, file string, start, end time.Time) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	now := time.Now()
+	if now.Sub(h.swept) > SEGMENT_HUB_IDLE_TIMEOUT {
+		h.sweep(now)
+	}
+	s := h.stream(name)
+	s.last = now
+	s.history = append(s.history, hubSegment{file: file, start: start, end: end})
+	if len(s.history) > SEGMENT_HUB_HISTORY {
+		s.history = s.history[len(s.history)-SEGMENT_HUB_HISTORY:]
+	}
+	h.published += 1
+	for c := range s.subs {
+		h.send(c, file)
+	}
+}
+
+// forget streams nobody's using any more, and readers that have gone away.
+// must hold mut
+func (h *segmentHub) sweep(now time.Time) {
+	h.swept = now
+	for name, s := range h.streams {
+		for reader, cursor := range s.cursors {
+			if now.Sub(cursor.at) > SEGMENT_HUB_IDLE_TIMEOUT {
+				delete(s.cursors, reader)
+			}
+		}
+		if len(s.subs) == 0 && now.Sub(s.last) > SEGMENT_HUB_IDLE_TIMEOUT {
+			delete(h.streams, name)
+		}
+	}
+}
+
+// must hold mut
+func (h *segmentHub) send(c chan string, file string) {
+	select {
+	case c <- file:
+		h.delivered += 1
+	default:
+		h.dropped += 1
+	}
+}
+
+// when a segment we still remember starts and ends, if whoever published it
+// said
+func (h *segmentHub) span(name, file string) (time.Time, time.Time, bool) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	s, ok := h.streams[name]
+	if !ok {
+		return time.Time{}, time.Time{}, false
+	}
+	for i := len(s.history) - 1; i >= 0; i-- {
+		seg := s.history[i]
+		if seg.file != file {
+			continue
+		}
+		if seg.start.IsZero() || seg.end.IsZero() {
+			return time.Time{}, time.Time{}, false
+		}
+		return seg.start, seg.end, true
+	}
+	return time.Time{}, time.Time{}, false
+}
+
+// when a stream last had a segment published, zero if never
+func (h *segmentHub) lastPublished(name string) time.Time {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	s, ok := h.streams[name]
+	if !ok {
+		return time.Time{}
+	}
+	return s.last
+}
+
+func (h *segmentHub) stats() SegmentHubStats {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	stats := SegmentHubStats{
+		Published:   h.published,
+		Delivered:   h.delivered,
+		Dropped:     h.dropped,
+		Subscribers: map[string]int{},
+	}
+	for name, s := range h.streams {
+		if len(s.subs) > 0 {
+			stats.Subscribers[name] = len(s.subs)
+		}
+	}
+	return stats
+}
@@ -0,0 +1,155 @@
+package media
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSegmentHubSlowSubscriber(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := newSegmentHub()
+	slow := h.subscribe(ctx, "user", "")
+	fast := h.subscribe(ctx, "user", "")
+
+	received := make(chan string, SEGMENT_HUB_BUFFER+2)
+	go func() {
+		for i := 0; i < SEGMENT_HUB_BUFFER+2; i++ {
+			h.publish("user", time.UnixMilli(int64(i)).Format(time.RFC3339Nano), time.Time{}, time.Time{})
+			received <- <-fast
+		}
+		close(received)
+	}()
+	for i := 0; i < SEGMENT_HUB_BUFFER+2; i++ {
+		select {
+		case file := <-received:
+			require.NotEmpty(t, file)
+		case <-time.After(5 * time.Second):
+			t.Fatal("publishing blocked on a subscriber that isn't reading")
+		}
+	}
+	require.Len(t, slow, SEGMENT_HUB_BUFFER)
+	stats := h.stats()
+	require.Equal(t, uint64(SEGMENT_HUB_BUFFER+2), stats.Published)
+	require.Equal(t, uint64(2), stats.Dropped)
+	require.Equal(t, map[string]int{"user": 2}, stats.Subscribers)
+}
+
+func TestSegmentHubUnsubscribe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	h := newSegmentHub()
+	sub := h.subscribe(ctx, "user", "")
+	cancel()
+	_, ok := <-sub
+	require.False(t, ok, "channel should close when ctx is done")
+	require.Empty(t, h.stats().Subscribers)
+	// and publishing afterwards is fine
+	h.publish("user", "a.mp4", time.Time{}, time.Time{})
+}
+
+func TestSegmentHubCursor(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := newSegmentHub()
+	for _, file := range []string{"a.mp4", "b.mp4", "c.mp4"} {
+		h.publish("user", file, time.Time{}, time.Time{})
+	}
+	sub := h.subscribe(ctx, "user", "a.mp4")
+	require.Equal(t, "b.mp4", <-sub)
+	require.Equal(t, "c.mp4", <-sub)
+	h.publish("user", "d.mp4", time.Time{}, time.Time{})
+	require.Equal(t, "d.mp4", <-sub)
+
+	// a cursor we don't know about means just the new ones
+	sub = h.subscribe(ctx, "user", "nope.mp4")
+	require.Empty(t, sub)
+	require.False(t, h.lastPublished("user").IsZero())
+	require.True(t, h.lastPublished("other").IsZero())
+}
+
+func TestSegmentHubReaderCursor(t *testing.T) {
+	ctx := context.Background()
+	mm := &MediaManager{segments: newSegmentHub()}
+	mm.PublishSegment(ctx, "user", "a.mp4", time.Time{}, time.Time{})
+	next := make(chan string)
+	go func() {
+		file, _ := mm.NextSegment(ctx, "user", "reader", "")
+		next <- file
+	}()
+	// a new reader waits for the next segment
+	require.Eventually(t, func() bool { return mm.SegmentHubStats().Subscribers["user"] == 1 }, 5*time.Second, 10*time.Millisecond)
+	mm.PublishSegment(ctx, "user", "b.mp4", time.Time{}, time.Time{})
+	require.Equal(t, "b.mp4", <-next)
+	// and doesn't miss ones that come in while it's busy with that one
+	mm.PublishSegment(ctx, "user", "c.mp4", time.Time{}, time.Time{})
+	mm.PublishSegment(ctx, "user", "d.mp4", time.Time{}, time.Time{})
+	file, err := mm.NextSegment(ctx, "user", "reader", "")
+	require.NoError(t, err)
+	require.Equal(t, "c.mp4", file)
+	file, err = mm.NextSegment(ctx, "user", "reader", "")
+	require.NoError(t, err)
+	require.Equal(t, "d.mp4", file)
+}
+
+func TestSegmentHubPrune(t *testing.T) {
+	h := newSegmentHub()
+	streams := func() int {
+		h.mut.Lock()
+		defer h.mut.Unlock()
+		return len(h.streams)
+	}
+
+	// nothing's been published, so the last subscriber leaving forgets it
+	ctx, cancel := context.WithCancel(context.Background())
+	sub := h.subscribe(ctx, "quiet", "")
+	cancel()
+	for range sub {
+	}
+	require.Eventually(t, func() bool { return streams() == 0 }, 5*time.Second, 10*time.Millisecond)
+
+	// streams still going are kept for readers to come back to
+	h.publish("live", "a.mp4", time.Time{}, time.Time{})
+	ctx, cancel = context.WithCancel(context.Background())
+	sub = h.subscribe(ctx, "live", "")
+	cancel()
+	for range sub {
+	}
+	require.Equal(t, 1, streams())
+
+	// until they've been quiet a while, along with their readers
+	h.setCursor("live", "reader", "a.mp4")
+	h.mut.Lock()
+	h.sweep(time.Now().Add(SEGMENT_HUB_IDLE_TIMEOUT + time.Second))
+	h.mut.Unlock()
+	require.Equal(t, 0, streams())
+	require.Equal(t, "", h.cursor("live", "reader"))
+}
+
+func TestSegmentHubSpan(t *testing.T) {
+	h := newSegmentHub()
+	start := time.UnixMilli(1000)
+	end := time.UnixMilli(3000)
+	h.publish("user", "a.mp4", start, end)
+	h.publish("user", "b.mp4", time.Time{}, time.Time{})
+	gotStart, gotEnd, ok := h.span("user", "a.mp4")
+	require.True(t, ok)
+	require.Equal(t, start, gotStart)
+	require.Equal(t, end, gotEnd)
+	_, _, ok = h.span("user", "b.mp4")
+	require.False(t, ok, "published without times")
+	_, _, ok = h.span("user", "c.mp4")
+	require.False(t, ok, "never published")
+	_, _, ok = h.span("nobody", "a.mp4")
+	require.False(t, ok)
+}
+
+func TestIsLiveSegment(t *testing.T) {
+	now := time.Now()
+	require.True(t, isLiveSegment(now.Add(-time.Second), now))
+	require.True(t, isLiveSegment(now.Add(time.Second), now), "a little clock skew")
+	require.False(t, isLiveSegment(now.Add(-STREAM_STALL_TIMEOUT-time.Second), now))
+	require.False(t, isLiveSegment(now.Add(-time.Hour), now))
+}
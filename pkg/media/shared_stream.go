@@ -0,0 +1,196 @@
+package media
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"aquareum.tv/aquareum/pkg/log"
+	"golang.org/x/sync/errgroup"
+)
+
+// how many pieces of the stream a viewer can fall behind by before we give up
+// on them
+const SHARED_STREAM_VIEWER_BUFFER = 512
+
+// one live transmux of a user's stream in one format, shared between everyone
+// watching it that way. torn down when the last viewer leaves.
+type sharedStream struct {
+	key    string
+	cancel context.CancelFunc
+	mut    sync.Mutex
+	header []byte
+	// viewers, and whether they've had their header and first keyframe yet
+	viewers map[*sharedStreamViewer]struct{}
+	done    bool
+}
+
+type sharedStreamViewer struct {
+	c       chan []byte
+	started bool
+	err     error
+}
+
+// makes a stream, eg SegmentToMP4
+type sharedStreamProducer func(ctx context.Context, user string, w io.Writer) error
+
+// cuts a stream into its header and the pieces after it, eg splitFMP4
+type sharedStreamSplitter func(r io.Reader, header func([]byte), piece func([]byte, bool)) error
+
+// write the user's livestream as fragmented mp4 to w until ctx is done, sharing
+// one transmux between everyone watching
+func (mm *MediaManager) SharedMP4(ctx context.Context, user string, w io.Writer) error {
+	return mm.sharedStream(ctx, user, "mp4", mm.SegmentToMP4, splitFMP4, w)
+}
+
+// write the user's livestream as matroska with opus audio to w until ctx is
+// done, sharing one transmux between everyone watching
+func (mm *MediaManager) SharedMKV(ctx context.Context, user string, w io.Writer) error {
+	return mm.sharedStream(ctx, user, "mkv", mm.SegmentToMKVPlusOpus, splitMKV, w)
+}
+
+func (mm *MediaManager) sharedStream(ctx context.Context, user, format string, produce sharedStreamProducer, split sharedStreamSplitter, w io.Writer) error {
+	s, v := mm.joinSharedStream(ctx, user, format, produce, split)
+	defer mm.leaveSharedStream(s, v)
+	flusher, _ := w.(http.Flusher)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case bs, ok := <-v.c:
+			if !ok {
+				return v.err
+			}
+			_, err := w.Write(bs)
+			if err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// join the running session for this user and format, starting one if need be
+func (mm *MediaManager) joinSharedStream(ctx context.Context, user, format string, produce sharedStreamProducer, split sharedStreamSplitter) (*sharedStream, *sharedStreamViewer) {
+	mm.sharedMut.Lock()
+	defer mm.sharedMut.Unlock()
+	key := fmt.Sprintf("%s/%s", user, format)
+	s, ok := mm.shared[key]
+	if !ok {
+		// the session outlives whichever viewer happened to start it
+		ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		ctx = log.WithLogValues(ctx, "user", user, "format", format)
+		s = &sharedStream{
+			key:     key,
+			cancel:  cancel,
+			viewers: map[*sharedStreamViewer]struct{}{},
+		}
+		mm.shared[key] = s
+		go func() {
+			err := s.run(ctx, user, produce, split)
+			if err != nil {
+				log.Log(ctx, "shared stream ended", "error", err)
+			}
+			mm.endSharedStream(s, err)
+		}()
+		log.Log(ctx, "started shared stream")
+	}
+	v := &sharedStreamViewer{c: make(chan []byte, SHARED_STREAM_VIEWER_BUFFER)}
+	s.mut.Lock()
+	s.viewers[v] = struct{}{}
+	s.mut.Unlock()
+	return s, v
+}
+
+// drop a viewer, tearing down the session if they were the last
+func (mm *MediaManager) leaveSharedStream(s *sharedStream, v *sharedStreamViewer) {
+	mm.sharedMut.Lock()
+	defer mm.sharedMut.Unlock()
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	delete(s.viewers, v)
+	if len(s.viewers) > 0 || s.done {
+		return
+	}
+	s.done = true
+	s.cancel()
+	delete(mm.shared, s.key)
+}
+
+// the session's stream is over, so let its viewers know
+func (mm *MediaManager) endSharedStream(s *sharedStream, err error) {
+	mm.sharedMut.Lock()
+	defer mm.sharedMut.Unlock()
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if mm.shared[s.key] == s {
+		delete(mm.shared, s.key)
+	}
+	s.done = true
+	s.cancel()
+	if err == nil {
+		err = io.EOF
+	}
+	for v := range s.viewers {
+		s.close(v, err)
+	}
+}
+
+// must hold mut
+func (s *sharedStream) close(v *sharedStreamViewer, err error) {
+	if v.err != nil {
+		return
+	}
+	v.err = err
+	close(v.c)
+}
+
+func (s *sharedStream) run(ctx context.Context, user string, produce sharedStreamProducer, split sharedStreamSplitter) error {
+	pr, pw := io.Pipe()
+	g, ctx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		err := produce(ctx, user, pw)
+		pw.CloseWithError(err)
+		return err
+	})
+	g.Go(func() error {
+		defer pr.Close()
+		return split(pr, s.setHeader, s.piece)
+	})
+	return g.Wait()
+}
+
+func (s *sharedStream) setHeader(header []byte) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.header = header
+}
+
+// hand a piece of the stream to every viewer that's started, and start anyone
+// waiting if it's a keyframe
+func (s *sharedStream) piece(bs []byte, keyframe bool) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	for v := range s.viewers {
+		if v.err != nil {
+			continue
+		}
+		if !v.started {
+			if !keyframe {
+				continue
+			}
+			v.started = true
+			v.c <- s.header
+		}
+		select {
+		case v.c <- bs:
+		default:
+			// dropping pieces would corrupt their stream, so they have to go
+			s.close(v, fmt.Errorf("viewer fell too far behind the shared stream"))
+		}
+	}
+}
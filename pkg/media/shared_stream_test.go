@@ -0,0 +1,213 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/livepeer/lpms/ffmpeg"
+	"github.com/stretchr/testify/require"
+)
+
+type chanWriter chan []byte
+
+func (c chanWriter) Write(bs []byte) (int, error) {
+	c <- bytes.Clone(bs)
+	return len(bs), nil
+}
+
+func TestSplitFMP4(t *testing.T) {
+	frag := testFMP4Fragment(10, true)
+	stream := bytes.Join([][]byte{testFMP4Init(), frag, testFMP4Fragment(10, false)}, nil)
+	var header []byte
+	var keyframes []bool
+	err := splitFMP4(bytes.NewReader(stream), func(bs []byte) {
+		header = bs
+	}, func(bs []byte, keyframe bool) {
+		keyframes = append(keyframes, keyframe)
+	})
+	require.NoError(t, err)
+	require.Equal(t, testFMP4Init(), header)
+	// moof and mdat, twice over
+	require.Equal(t, []bool{true, false, false, false}, keyframes)
+}
+
+func TestSharedStream(t *testing.T) {
+	mm := &MediaManager{shared: map[string]*sharedStream{}}
+	frags := make(chan []byte)
+	var produced atomic.Int32
+	stopped := make(chan struct{})
+	produce := func(ctx context.Context, user string, w io.Writer) error {
+		produced.Add(1)
+		defer close(stopped)
+		_, err := w.Write(testFMP4Init())
+		if err != nil {
+			return err
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case frag := <-frags:
+				_, err := w.Write(frag)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	viewers := func() int {
+		mm.sharedMut.Lock()
+		defer mm.sharedMut.Unlock()
+		s, ok := mm.shared["user/mp4"]
+		if !ok {
+			return 0
+		}
+		s.mut.Lock()
+		defer s.mut.Unlock()
+		return len(s.viewers)
+	}
+	watch := func(ctx context.Context, w chanWriter) {
+		go mm.sharedStream(ctx, "user", "mp4", produce, splitFMP4, w)
+	}
+	next := func(w chanWriter) []byte {
+		select {
+		case bs := <-w:
+			return bs
+		case <-time.After(5 * time.Second):
+			t.Fatal("viewer didn't get anything")
+			return nil
+		}
+	}
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	defer cancel1()
+	first := make(chanWriter, 10)
+	watch(ctx1, first)
+	require.Eventually(t, func() bool { return viewers() == 1 }, 5*time.Second, 10*time.Millisecond)
+	key := testFMP4Fragment(10, true)
+	frags <- key
+	require.Equal(t, testFMP4Init(), next(first))
+	require.Equal(t, key, append(next(first), next(first)...))
+
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	defer cancel2()
+	second := make(chanWriter, 10)
+	watch(ctx2, second)
+	require.Eventually(t, func() bool { return viewers() == 2 }, 5*time.Second, 10*time.Millisecond)
+	// the second viewer waits for a keyframe
+	delta := testFMP4Fragment(10, false)
+	frags <- delta
+	require.Equal(t, delta, append(next(first), next(first)...))
+	frags <- key
+	require.Equal(t, key, append(next(first), next(first)...))
+	require.Equal(t, testFMP4Init(), next(second))
+	require.Equal(t, key, append(next(second), next(second)...))
+	require.Equal(t, int32(1), produced.Load(), "viewers should share one transmux")
+
+	// the transmux keeps going until the last viewer leaves
+	cancel1()
+	require.Eventually(t, func() bool { return viewers() == 1 }, 5*time.Second, 10*time.Millisecond)
+	cancel2()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("transmux should stop when the last viewer leaves")
+	}
+	require.Equal(t, 0, viewers())
+}
+
+// a viewer joining a shared mp4 stream partway through gets the init segment
+// and then whole fragments from the next keyframe on, each one playable
+// without the ones before it
+func TestSharedMP4JoinMidway(t *testing.T) {
+	// mux the sample stream the way SegmentToMP4 does
+	out := filepath.Join(t.TempDir(), "stream.mp4")
+	tc := ffmpeg.NewTranscoder()
+	defer tc.StopTranscoder()
+	_, err := tc.Transcode(&ffmpeg.TranscodeOptionsIn{
+		Fname:       getFixture("sample-stream.mkv"),
+		Transmuxing: true,
+	}, []ffmpeg.TranscodeOptions{{
+		Oname:        out,
+		VideoEncoder: ffmpeg.ComponentOptions{Name: "copy"},
+		AudioEncoder: ffmpeg.ComponentOptions{Name: "copy"},
+		Profile:      ffmpeg.VideoProfile{Format: ffmpeg.FormatNone},
+		Muxer: ffmpeg.ComponentOptions{
+			Name: "mp4",
+			Opts: map[string]string{"movflags": MP4_STREAM_MOVFLAGS},
+		},
+	}})
+	require.NoError(t, err)
+	stream, err := os.ReadFile(out)
+	require.NoError(t, err)
+	var header []byte
+	var pieces [][]byte
+	var keyframes []bool
+	err = splitFMP4(bytes.NewReader(stream), func(bs []byte) {
+		header = bs
+	}, func(bs []byte, keyframe bool) {
+		pieces = append(pieces, bs)
+		keyframes = append(keyframes, keyframe)
+	})
+	require.NoError(t, err)
+	// header, then a moof and mdat for each of at least three fragments, each
+	// starting on a keyframe
+	require.NotEmpty(t, header)
+	require.GreaterOrEqual(t, len(pieces), 6)
+	require.True(t, keyframes[0])
+	require.True(t, keyframes[4])
+	first := len(header) + len(pieces[0]) + len(pieces[1]) + len(pieces[2]) + len(pieces[3])
+
+	mm := &MediaManager{shared: map[string]*sharedStream{}}
+	start := make(chan struct{})
+	rest := make(chan struct{})
+	produce := func(ctx context.Context, user string, w io.Writer) error {
+		<-start
+		_, err := w.Write(stream[:first])
+		if err != nil {
+			return err
+		}
+		<-rest
+		_, err = w.Write(stream[first:])
+		return err
+	}
+	ctx := context.Background()
+	s, early := mm.joinSharedStream(ctx, "user", "mp4", produce, splitFMP4)
+	defer mm.leaveSharedStream(s, early)
+	close(start)
+	// the first two fragments go out before anyone else turns up
+	require.Equal(t, header, <-early.c)
+	for i := 0; i < 4; i++ {
+		require.Equal(t, pieces[i], <-early.c)
+	}
+	_, late := mm.joinSharedStream(ctx, "user", "mp4", produce, splitFMP4)
+	close(rest)
+
+	got := [][]byte{}
+	for bs := range late.c {
+		got = append(got, bs)
+	}
+	require.ErrorIs(t, late.err, io.EOF)
+	require.Equal(t, header, got[0])
+	require.Equal(t, pieces[4:], got[1:])
+	for _, bs := range got[1:] {
+		typ, body, _, err := mp4NextBox(bs)
+		require.NoError(t, err)
+		if typ != "moof" {
+			continue
+		}
+		traf, ok := mp4Box(body, "traf")
+		require.True(t, ok)
+		tfhd, ok := mp4Box(traf, "tfhd")
+		require.True(t, ok)
+		flags := binary.BigEndian.Uint32(tfhd[0:4]) & 0xffffff
+		require.NotZero(t, flags&0x020000, "fragment offsets should be relative to their own moof")
+	}
+}
@@ -0,0 +1,313 @@
+package media
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"aquareum.tv/aquareum/pkg/log"
+	"aquareum.tv/aquareum/pkg/model"
+	"github.com/google/uuid"
+)
+
+// how many segments a stream has to send before it counts as live rather than
+// just starting
+const STREAM_LIVE_SEGMENTS = 2
+
+// how long a stream can go without a segment before it's stalled
+const STREAM_STALL_TIMEOUT = 10 * time.Second
+
+// how long a stream can go without a segment before it's ended
+const STREAM_END_TIMEOUT = 30 * time.Second
+
+// how often we check for streams that have stalled or ended
+const STREAM_STATE_INTERVAL = time.Second
+
+// how often a stream's session gets saved between state changes, so a crash
+// loses no more than this much of it
+const STREAM_SESSION_SAVE_INTERVAL = 30 * time.Second
+
+// how long we remember an ended stream before leaving it to the database
+const STREAM_FORGET_TIMEOUT = 5 * time.Minute
+
+// where a user's stream is at. new segments move it along from offline or
+// ended to starting to live, and going without them moves it on to stalled
+// and then ended.
+type StreamState string
+
+const (
+	StreamStateOffline  StreamState = "offline"
+	StreamStateStarting StreamState = "starting"
+	StreamStateLive     StreamState = "live"
+	StreamStateStalled  StreamState = "stalled"
+	StreamStateEnded    StreamState = "ended"
+)
+
+// what the API says about a user's stream
+type StreamStatus struct {
+	User  string      `json:"user"`
+	State StreamState `json:"state"`
+	// whether there's something to play, so the app shows a player rather
+	// than an offline screen. stalled streams still count, in case they're
+	// just catching up.
+	Live bool `json:"live"`
+	// when it got to this state
+	Since       time.Time  `json:"since"`
+	SessionID   string     `json:"sessionId,omitempty"`
+	StartTime   *time.Time `json:"startTime,omitempty"`
+	EndTime     *time.Time `json:"endTime,omitempty"`
+	LastSegment *time.Time `json:"lastSegment,omitempty"`
+	Segments    int        `json:"segments"`
+}
+
+// keeps track of every user's stream state, and the stream sessions in the
+// database that go with them
+type streamTracker struct {
+	model   model.Model
+	mut     sync.Mutex
+	streams map[string]*trackedStream
+	// sessions are saved outside mut, one at a time
+	saveMut sync.Mutex
+	saved   map[string]savedSession
+}
+
+type trackedStream struct {
+	state   StreamState
+	since   time.Time
+	session *model.StreamSession
+	// bumped every time we take a copy of the session to save
+	version  int
+	lastSave time.Time
+}
+
+// a copy of a session to save, taken under mut
+type sessionSnapshot struct {
+	session model.StreamSession
+	version int
+}
+
+// the newest copy of a session that's made it to the database
+type savedSession struct {
+	version int
+	created time.Time
+}
+
+func newStreamTracker(mod model.Model) *streamTracker {
+	return &streamTracker{model: mod, streams: map[string]*trackedStream{}, saved: map[string]savedSession{}}
+}
+
+// a user sent us a segment covering start to end, and it got to us at now
+func (t *streamTracker) segment(ctx context.Context, user string, start, end, now time.Time) {
+	snap, ok := t.recordSegment(ctx, user, start, end, now)
+	if ok {
+		t.save(ctx, snap)
+	}
+}
+
+// update a user's stream for a new segment, returning a copy of the session if
+// it's due a save
+func (t *streamTracker) recordSegment(ctx context.Context, user string, start, end, now time.Time) (sessionSnapshot, bool) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	s, ok := t.streams[user]
+	from := StreamStateOffline
+	if ok {
+		from = s.state
+	}
+	if !ok || s.state == StreamStateEnded {
+		id, err := uuid.NewV7()
+		if err != nil {
+			log.Error(ctx, "error generating stream session id", "error", err)
+			return sessionSnapshot{}, false
+		}
+		s = &trackedStream{
+			state: from,
+			session: &model.StreamSession{
+				ID:        id.String(),
+				User:      user,
+				StartTime: start,
+			},
+		}
+		t.streams[user] = s
+		t.transition(ctx, user, s, StreamStateStarting, now)
+	}
+	s.session.Segments += 1
+	s.session.LastSegment = end
+	switch s.state {
+	case StreamStateStarting:
+		if s.session.Segments >= STREAM_LIVE_SEGMENTS {
+			t.transition(ctx, user, s, StreamStateLive, now)
+		}
+	case StreamStateStalled:
+		t.transition(ctx, user, s, StreamStateLive, now)
+	}
+	if s.state == from && now.Sub(s.lastSave) < STREAM_SESSION_SAVE_INTERVAL {
+		return sessionSnapshot{}, false
+	}
+	return s.snapshot(now), true
+}
+
+// move along any streams that have gone quiet
+func (t *streamTracker) tick(ctx context.Context, now time.Time) {
+	t.save(ctx, t.quiet(ctx, now)...)
+}
+
+// move along any streams that have gone quiet and forget ones that ended a
+// while back, returning copies of the sessions that ended
+func (t *streamTracker) quiet(ctx context.Context, now time.Time) []sessionSnapshot {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	snaps := []sessionSnapshot{}
+	for user, s := range t.streams {
+		quiet := now.Sub(s.session.LastSegment)
+		switch s.state {
+		case StreamStateStarting, StreamStateLive:
+			if quiet > STREAM_STALL_TIMEOUT {
+				t.transition(ctx, user, s, StreamStateStalled, now)
+			}
+		case StreamStateStalled:
+			if quiet > STREAM_END_TIMEOUT {
+				end := s.session.LastSegment
+				s.session.EndTime = &end
+				t.transition(ctx, user, s, StreamStateEnded, now)
+				snaps = append(snaps, s.snapshot(now))
+			}
+		case StreamStateEnded:
+			// status falls back on the database for streams we don't know
+			if now.Sub(s.since) > STREAM_FORGET_TIMEOUT {
+				delete(t.streams, user)
+			}
+		}
+	}
+	return snaps
+}
+
+// must hold mut
+func (t *streamTracker) transition(ctx context.Context, user string, s *trackedStream, state StreamState, now time.Time) {
+	log.Log(ctx, "stream state changed", "user", user, "from", s.state, "to", state, "session", s.session.ID)
+	s.state = state
+	s.since = now
+}
+
+// must hold mut
+func (s *trackedStream) snapshot(now time.Time) sessionSnapshot {
+	s.version += 1
+	s.lastSave = now
+	return sessionSnapshot{session: *s.session, version: s.version}
+}
+
+// write sessions to the database, skipping any we've already saved a newer
+// copy of. must not hold mut.
+func (t *streamTracker) save(ctx context.Context, snaps ...sessionSnapshot) {
+	t.saveMut.Lock()
+	defer t.saveMut.Unlock()
+	for _, snap := range snaps {
+		sess := snap.session
+		prev, ok := t.saved[sess.ID]
+		if ok && prev.version >= snap.version {
+			continue
+		}
+		var err error
+		if !ok {
+			err = t.model.CreateStreamSession(&sess)
+		} else {
+			sess.CreatedAt = prev.created
+			err = t.model.UpdateStreamSession(&sess)
+		}
+		if err != nil {
+			log.Error(ctx, "error saving stream session", "user", sess.User, "error", err)
+			continue
+		}
+		// nothing changes once a session's ended
+		if sess.EndTime != nil {
+			delete(t.saved, sess.ID)
+			continue
+		}
+		t.saved[sess.ID] = savedSession{version: snap.version, created: sess.CreatedAt}
+	}
+}
+
+// must hold mut
+func (s *trackedStream) status(user string) StreamStatus {
+	sess := *s.session
+	return StreamStatus{
+		User:        user,
+		State:       s.state,
+		Live:        s.state == StreamStateLive || s.state == StreamStateStalled,
+		Since:       s.since,
+		SessionID:   sess.ID,
+		StartTime:   &sess.StartTime,
+		EndTime:     sess.EndTime,
+		LastSegment: &sess.LastSegment,
+		Segments:    sess.Segments,
+	}
+}
+
+// a user's stream state. if we've not seen them since we started, their last
+// session in the database says whether they've ever streamed.
+func (t *streamTracker) status(user string) (StreamStatus, error) {
+	t.mut.Lock()
+	s, ok := t.streams[user]
+	var status StreamStatus
+	if ok {
+		status = s.status(user)
+	}
+	t.mut.Unlock()
+	if ok {
+		return status, nil
+	}
+	sess, err := t.model.LatestStreamSession(user)
+	if err != nil {
+		return StreamStatus{}, err
+	}
+	if sess == nil {
+		return StreamStatus{User: user, State: StreamStateOffline}, nil
+	}
+	ended := &trackedStream{state: StreamStateEnded, session: sess}
+	if sess.EndTime != nil {
+		ended.since = *sess.EndTime
+	}
+	return ended.status(user), nil
+}
+
+// every stream that's starting, live or stalled
+func (t *streamTracker) live() []StreamStatus {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	statuses := []StreamStatus{}
+	for user, s := range t.streams {
+		if s.state == StreamStateEnded {
+			continue
+		}
+		statuses = append(statuses, s.status(user))
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].User < statuses[j].User
+	})
+	return statuses
+}
+
+// keep stream states up to date as streams go quiet, until ctx is done
+func (mm *MediaManager) RunStreamStates(ctx context.Context) error {
+	ticker := time.NewTicker(STREAM_STATE_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C:
+			mm.streams.tick(ctx, now)
+		}
+	}
+}
+
+// a user's stream state, offline if they've never streamed here
+func (mm *MediaManager) StreamStatus(user string) (StreamStatus, error) {
+	return mm.streams.status(user)
+}
+
+// everyone who's streaming right now
+func (mm *MediaManager) LiveStreams() []StreamStatus {
+	return mm.streams.live()
+}
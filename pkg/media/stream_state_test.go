@@ -0,0 +1,154 @@
+package media
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"aquareum.tv/aquareum/pkg/model"
+	"github.com/stretchr/testify/require"
+)
+
+// a two second segment that ends, and gets to us, at at
+func sendSegment(ctx context.Context, tracker *streamTracker, user string, at time.Time) {
+	tracker.segment(ctx, user, at.Add(-2*time.Second), at, at)
+}
+
+func TestStreamTracker(t *testing.T) {
+	ctx := context.Background()
+	mod, err := model.MakeDB(":memory:")
+	require.NoError(t, err)
+	tracker := newStreamTracker(mod)
+	state := func() StreamState {
+		status, err := tracker.status("0xalice")
+		require.NoError(t, err)
+		return status.State
+	}
+	require.Equal(t, StreamStateOffline, state())
+
+	now := time.Now()
+	sendSegment(ctx, tracker, "0xalice", now)
+	require.Equal(t, StreamStateStarting, state())
+	sendSegment(ctx, tracker, "0xalice", now.Add(time.Second))
+	require.Equal(t, StreamStateLive, state())
+	require.Len(t, tracker.live(), 1)
+
+	// quiet for a bit, then back
+	tracker.tick(ctx, now.Add(time.Second+STREAM_STALL_TIMEOUT/2))
+	require.Equal(t, StreamStateLive, state())
+	tracker.tick(ctx, now.Add(2*time.Second+STREAM_STALL_TIMEOUT))
+	require.Equal(t, StreamStateStalled, state())
+	status, err := tracker.status("0xalice")
+	require.NoError(t, err)
+	require.True(t, status.Live)
+	last := now.Add(15 * time.Second)
+	sendSegment(ctx, tracker, "0xalice", last)
+	require.Equal(t, StreamStateLive, state())
+
+	// quiet for good
+	tracker.tick(ctx, last.Add(STREAM_STALL_TIMEOUT+time.Second))
+	tracker.tick(ctx, last.Add(STREAM_END_TIMEOUT+time.Second))
+	require.Equal(t, StreamStateEnded, state())
+	require.Len(t, tracker.live(), 0)
+	sess, err := mod.LatestStreamSession("0xalice")
+	require.NoError(t, err)
+	require.Equal(t, 3, sess.Segments)
+	require.True(t, now.Add(-2*time.Second).Equal(sess.StartTime))
+	require.NotNil(t, sess.EndTime)
+	require.True(t, last.Equal(*sess.EndTime))
+
+	// a new segment is a new session
+	sendSegment(ctx, tracker, "0xalice", last.Add(time.Minute))
+	require.Equal(t, StreamStateStarting, state())
+	sessions, err := mod.ListStreamSessions("0xalice", 10)
+	require.NoError(t, err)
+	require.Len(t, sessions, 2)
+	require.Nil(t, sessions[0].EndTime)
+
+	// after a restart we only have the database to go on
+	status, err = newStreamTracker(mod).status("0xalice")
+	require.NoError(t, err)
+	require.Equal(t, StreamStateEnded, status.State)
+	require.False(t, status.Live)
+}
+
+// counts stream session writes
+type countingModel struct {
+	model.Model
+	creates int
+	updates int
+}
+
+func (m *countingModel) CreateStreamSession(sess *model.StreamSession) error {
+	m.creates += 1
+	return m.Model.CreateStreamSession(sess)
+}
+
+func (m *countingModel) UpdateStreamSession(sess *model.StreamSession) error {
+	m.updates += 1
+	return m.Model.UpdateStreamSession(sess)
+}
+
+func TestStreamTrackerSaves(t *testing.T) {
+	ctx := context.Background()
+	db, err := model.MakeDB(":memory:")
+	require.NoError(t, err)
+	mod := &countingModel{Model: db}
+	tracker := newStreamTracker(mod)
+
+	// starting and going live get saved, segments in between don't
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		sendSegment(ctx, tracker, "0xalice", now.Add(time.Duration(i)*time.Second))
+	}
+	require.Equal(t, 1, mod.creates)
+	require.Equal(t, 1, mod.updates)
+
+	// until it's been a while
+	// since going live a second in
+	last := now.Add(time.Second + STREAM_SESSION_SAVE_INTERVAL)
+	sendSegment(ctx, tracker, "0xalice", last)
+	require.Equal(t, 2, mod.updates)
+	sess, err := mod.LatestStreamSession("0xalice")
+	require.NoError(t, err)
+	require.Equal(t, 11, sess.Segments)
+	require.True(t, last.Equal(sess.LastSegment))
+	require.False(t, sess.CreatedAt.IsZero())
+
+	// ending is saved too, and is final
+	tracker.tick(ctx, last.Add(STREAM_STALL_TIMEOUT+time.Second))
+	require.Equal(t, 2, mod.updates)
+	tracker.tick(ctx, last.Add(STREAM_END_TIMEOUT+time.Second))
+	require.Equal(t, 3, mod.updates)
+	sess, err = mod.LatestStreamSession("0xalice")
+	require.NoError(t, err)
+	require.NotNil(t, sess.EndTime)
+	require.Empty(t, tracker.saved)
+
+	// stale copies don't overwrite newer ones
+	tracker.save(ctx, sessionSnapshot{session: model.StreamSession{ID: "sess", User: "0xbob"}, version: 2})
+	tracker.save(ctx, sessionSnapshot{session: model.StreamSession{ID: "sess", User: "0xbob", Segments: 1}, version: 1})
+	require.Equal(t, 2, mod.creates)
+	require.Equal(t, 3, mod.updates)
+}
+
+func TestStreamTrackerForgetsEnded(t *testing.T) {
+	ctx := context.Background()
+	mod, err := model.MakeDB(":memory:")
+	require.NoError(t, err)
+	tracker := newStreamTracker(mod)
+	now := time.Now()
+	sendSegment(ctx, tracker, "0xalice", now)
+	tracker.tick(ctx, now.Add(STREAM_STALL_TIMEOUT+time.Second))
+	ended := now.Add(STREAM_END_TIMEOUT + time.Second)
+	tracker.tick(ctx, ended)
+	require.Contains(t, tracker.streams, "0xalice")
+
+	tracker.tick(ctx, ended.Add(STREAM_FORGET_TIMEOUT+time.Second))
+	require.NotContains(t, tracker.streams, "0xalice")
+	// the database still knows about them
+	status, err := tracker.status("0xalice")
+	require.NoError(t, err)
+	require.Equal(t, StreamStateEnded, status.State)
+	require.Equal(t, 1, status.Segments)
+}
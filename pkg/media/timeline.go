@@ -0,0 +1,117 @@
+package media
+
+import (
+	"sync"
+	"time"
+)
+
+// gaps between segments shorter than this are timestamp jitter, not the
+// stream stalling, so we close them up
+const SEGMENT_TIMELINE_SLACK = 100 * time.Millisecond
+
+// how many keyframes we remember waiting for their segment to finish
+const SEGMENT_TIMELINE_KEYFRAMES = 256
+
+// how far the wall clock and PTS can wander apart before we anchor again, eg
+// when the source's clock runs fast or it stalls and catches up
+const SEGMENT_TIMELINE_MAX_DRIFT = 5 * time.Second
+
+// places segments on the wall clock using the PTS of the buffers going into
+// the segmenter, anchored to when the first one showed up, and again whenever
+// PTS goes backwards or drifts too far from the wall clock. consecutive
+// segments tile the timeline exactly, one's end is the next one's start,
+// except where there's a gap in the stream or we anchored again.
+type segmentTimeline struct {
+	mut     sync.Mutex
+	started bool
+	// wall clock time of PTS zero as of the latest keyframe
+	anchor time.Time
+	// goes up every time PTS goes backwards, since PTS from before and after
+	// can't be compared
+	epoch int
+	// keyframes that might start an upcoming segment
+	keyframes []timelineKeyframe
+	// where the next segment starts if it follows right on from the last
+	next timelineKeyframe
+	// PTS of the last keyframe we saw
+	lastKeyframe time.Duration
+	// wall clock end of the last segment, which the next can't start before
+	lastEnd time.Time
+}
+
+// a keyframe and the anchor that was current when we saw it. segments that
+// start on it keep to that anchor even if we've anchored again since.
+type timelineKeyframe struct {
+	pts    time.Duration
+	anchor time.Time
+	epoch  int
+}
+
+// note a buffer on its way into the segmenter
+func (tl *segmentTimeline) buffer(pts time.Duration, keyframe bool, now time.Time) {
+	tl.mut.Lock()
+	defer tl.mut.Unlock()
+	if !tl.started {
+		tl.started = true
+		tl.anchor = now.Add(-pts)
+		tl.next = timelineKeyframe{pts: pts, anchor: tl.anchor}
+		tl.lastKeyframe = pts
+	}
+	// b-frames mean PTS only goes forward from one keyframe to the next
+	if !keyframe {
+		return
+	}
+	if pts < tl.lastKeyframe-SEGMENT_TIMELINE_SLACK {
+		// the source started over
+		tl.epoch += 1
+		tl.anchor = now.Add(-pts)
+	} else if drift := now.Sub(tl.anchor.Add(pts)); drift > SEGMENT_TIMELINE_MAX_DRIFT || drift < -SEGMENT_TIMELINE_MAX_DRIFT {
+		tl.anchor = now.Add(-pts)
+	}
+	tl.lastKeyframe = pts
+	tl.keyframes = append(tl.keyframes, timelineKeyframe{pts: pts, anchor: tl.anchor, epoch: tl.epoch})
+	if len(tl.keyframes) > SEGMENT_TIMELINE_KEYFRAMES {
+		tl.keyframes = tl.keyframes[len(tl.keyframes)-SEGMENT_TIMELINE_KEYFRAMES:]
+	}
+}
+
+// wall clock start and end of the next segment out of the segmenter, which
+// plays for dur
+func (tl *segmentTimeline) segment(dur time.Duration, now time.Time) (time.Time, time.Time) {
+	tl.mut.Lock()
+	defer tl.mut.Unlock()
+	if !tl.started {
+		return now.Add(-dur), now
+	}
+	start := tl.next
+	for _, kf := range tl.keyframes {
+		if kf.epoch < tl.next.epoch || (kf.epoch == tl.next.epoch && kf.pts < tl.next.pts-SEGMENT_TIMELINE_SLACK) {
+			continue
+		}
+		// segments start on a keyframe, so one well past where the last
+		// segment ended (or from after PTS started over) means the stream
+		// had a gap
+		if kf.epoch > tl.next.epoch || kf.pts > tl.next.pts+SEGMENT_TIMELINE_SLACK {
+			start = kf
+		} else {
+			start.anchor = kf.anchor
+		}
+		break
+	}
+	tl.next = timelineKeyframe{pts: start.pts + dur, anchor: start.anchor, epoch: start.epoch}
+	for len(tl.keyframes) > 0 {
+		kf := tl.keyframes[0]
+		if kf.epoch > tl.next.epoch || (kf.epoch == tl.next.epoch && kf.pts >= tl.next.pts-SEGMENT_TIMELINE_SLACK) {
+			break
+		}
+		tl.keyframes = tl.keyframes[1:]
+	}
+	// anchoring again can pull the timeline back, but segments still have to
+	// come one after another
+	wallStart := start.anchor.Add(start.pts)
+	if wallStart.Before(tl.lastEnd) {
+		wallStart = tl.lastEnd
+	}
+	tl.lastEnd = wallStart.Add(dur)
+	return wallStart, tl.lastEnd
+}
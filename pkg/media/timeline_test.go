@@ -0,0 +1,123 @@
+package media
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// feed the timeline 30fps real-time video with a keyframe every second, from
+// PTS start to end, with the first buffer arriving at now
+func feedTimeline(tl *segmentTimeline, start, end time.Duration, now time.Time) {
+	frame := time.Second / 30
+	for pts := start; pts < end; pts += frame {
+		tl.buffer(pts, (pts-start)%time.Second < frame, now.Add(pts-start))
+	}
+}
+
+func TestSegmentTimelineTiles(t *testing.T) {
+	tl := &segmentTimeline{}
+	anchor := time.UnixMilli(1_700_000_000_000)
+	// the source's PTS starts an hour in
+	feedTimeline(tl, time.Hour, time.Hour+10*time.Second, anchor)
+
+	var prevEnd time.Time
+	for i := 0; i < 4; i++ {
+		// signing happens whenever, it shouldn't matter
+		start, end := tl.segment(2*time.Second, anchor.Add(time.Minute))
+		if i == 0 {
+			require.Equal(t, anchor, start)
+		} else {
+			require.Equal(t, prevEnd, start, "segment %d should start where the last one ended", i)
+		}
+		require.Equal(t, 2*time.Second, end.Sub(start))
+		prevEnd = end
+	}
+}
+
+func TestSegmentTimelineJitter(t *testing.T) {
+	tl := &segmentTimeline{}
+	anchor := time.UnixMilli(1_700_000_000_000)
+	feedTimeline(tl, 0, 10*time.Second, anchor)
+
+	// muxed durations a little off the keyframe spacing still tile
+	_, end := tl.segment(2*time.Second-10*time.Millisecond, anchor)
+	start, _ := tl.segment(2*time.Second, anchor)
+	require.Equal(t, end, start)
+}
+
+func TestSegmentTimelineGap(t *testing.T) {
+	tl := &segmentTimeline{}
+	anchor := time.UnixMilli(1_700_000_000_000)
+	feedTimeline(tl, 0, 4*time.Second, anchor)
+	// the source stalls for five seconds
+	feedTimeline(tl, 9*time.Second, 13*time.Second, anchor.Add(9*time.Second))
+
+	_, end := tl.segment(2*time.Second, anchor)
+	require.Equal(t, anchor.Add(2*time.Second), end)
+	_, end = tl.segment(2*time.Second, anchor)
+	require.Equal(t, anchor.Add(4*time.Second), end)
+	start, end := tl.segment(2*time.Second, anchor)
+	require.Equal(t, anchor.Add(9*time.Second), start, "should pick up after the gap")
+	require.Equal(t, anchor.Add(11*time.Second), end)
+}
+
+func TestSegmentTimelineDrift(t *testing.T) {
+	tl := &segmentTimeline{}
+	anchor := time.UnixMilli(1_700_000_000_000)
+	feedTimeline(tl, 0, 4*time.Second, anchor)
+	// PTS carries on where it left off, but the buffers show up a minute
+	// late, eg the source's clock is way off or it was stuck somewhere
+	late := anchor.Add(time.Minute + 4*time.Second)
+	feedTimeline(tl, 4*time.Second, 8*time.Second, late)
+
+	_, end := tl.segment(2*time.Second, late)
+	require.Equal(t, anchor.Add(2*time.Second), end)
+	_, end = tl.segment(2*time.Second, late)
+	require.Equal(t, anchor.Add(4*time.Second), end)
+	start, end := tl.segment(2*time.Second, late)
+	require.Equal(t, late, start, "should be anchored to when the buffers showed up")
+	require.Equal(t, late.Add(2*time.Second), end)
+}
+
+func TestSegmentTimelineBackwards(t *testing.T) {
+	tl := &segmentTimeline{}
+	anchor := time.UnixMilli(1_700_000_000_000)
+	feedTimeline(tl, time.Hour, time.Hour+4*time.Second, anchor)
+	_, end := tl.segment(2*time.Second, anchor)
+	require.Equal(t, anchor.Add(2*time.Second), end)
+	_, end = tl.segment(2*time.Second, anchor)
+	require.Equal(t, anchor.Add(4*time.Second), end)
+
+	// the source restarts with PTS from zero, a bit after it left off
+	restart := anchor.Add(5 * time.Second)
+	feedTimeline(tl, 0, 4*time.Second, restart)
+	start, end := tl.segment(2*time.Second, restart)
+	require.Equal(t, restart, start)
+	require.Equal(t, restart.Add(2*time.Second), end)
+}
+
+func TestSegmentTimelineNoOverlap(t *testing.T) {
+	tl := &segmentTimeline{}
+	anchor := time.UnixMilli(1_700_000_000_000)
+	feedTimeline(tl, 0, 4*time.Second, anchor)
+	_, end := tl.segment(2*time.Second, anchor)
+	require.Equal(t, anchor.Add(2*time.Second), end)
+	// then buffers start arriving early, so anchoring again would put the
+	// next segment before the last one ended
+	early := anchor.Add(-10 * time.Second)
+	feedTimeline(tl, 4*time.Second, 8*time.Second, early)
+	_, end = tl.segment(2*time.Second, early)
+	require.Equal(t, anchor.Add(4*time.Second), end)
+	start, _ := tl.segment(2*time.Second, early)
+	require.Equal(t, anchor.Add(4*time.Second), start)
+}
+
+func TestSegmentTimelineNoBuffers(t *testing.T) {
+	tl := &segmentTimeline{}
+	now := time.UnixMilli(1_700_000_000_000)
+	start, end := tl.segment(2*time.Second, now)
+	require.Equal(t, now.Add(-2*time.Second), start)
+	require.Equal(t, now, end)
+}
@@ -0,0 +1,100 @@
+package media
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"aquareum.tv/aquareum/pkg/model"
+)
+
+// reasons ValidateMP4 turns down a segment. these get wrapped with details, so
+// check for them with errors.Is.
+var (
+	// not a signed mp4 we can make sense of
+	ErrSegmentInvalid = errors.New("invalid segment")
+	// signed by someone who isn't in cli.AllowedStreams or the AllowedStream table
+	ErrStreamerNotAllowed = errors.New("streamer is not allowed")
+	// EndTime is before StartTime
+	ErrSegmentInvalidRange = errors.New("segment ends before it starts")
+	// StartTime is too far in the future, or too far in the past for a fresh segment
+	ErrSegmentClockSkew = errors.New("segment start time is outside the allowed clock skew")
+	// we already have a segment with exactly these bytes
+	ErrSegmentDuplicate = errors.New("duplicate segment")
+	// a fresh segment that doesn't start after the streamer's latest one
+	ErrSegmentOutOfOrder = errors.New("segment starts before the latest segment")
+	// covers time that we already have a different segment for
+	ErrSegmentOverlap = errors.New("segment overlaps an existing segment")
+	// a replicated segment that plays for longer than segment-max-duration
+	ErrSegmentTooLong = errors.New("segment is longer than segment-max-duration")
+)
+
+// check a segment's timing and content against what we already have. segments
+// we signed ourselves must be current and in order; replicated segments may be
+// old (eg backfill) but can't overlap anything we already have.
+func (mm *MediaManager) checkSegment(user string, meta *SegmentMetadata, hash string, source model.SegmentSource, now time.Time) error {
+	// anything but the canonical format would sort wrong against what's in
+	// the database, as well as being unparseable
+	start, err := meta.StartTime.Parse()
+	if err != nil {
+		return fmt.Errorf("%w: bad start time: %w", ErrSegmentInvalid, err)
+	}
+	end, err := meta.EndTime.Parse()
+	if err != nil {
+		return fmt.Errorf("%w: bad end time: %w", ErrSegmentInvalid, err)
+	}
+	if end.Before(start) {
+		return fmt.Errorf("%w: start=%s end=%s", ErrSegmentInvalidRange, meta.StartTime, meta.EndTime)
+	}
+	// the segmenter does what it can to keep our own segments short, and
+	// turning them down would just take the stream off the air
+	maxDur := mm.cli.SegmentMaxDuration
+	if source == model.SegmentSourceReplicated && maxDur > 0 && meta.Duration > maxDur {
+		return fmt.Errorf("%w: duration=%s max=%s, is the encoder's keyframe interval too long?", ErrSegmentTooLong, meta.Duration, maxDur)
+	}
+	skew := mm.cli.SegmentClockSkew
+	if start.After(now.Add(skew)) {
+		return fmt.Errorf("%w: start=%s is in the future", ErrSegmentClockSkew, meta.StartTime)
+	}
+	if source == model.SegmentSourceLocal && start.Before(now.Add(-skew)) {
+		return fmt.Errorf("%w: start=%s is too far in the past", ErrSegmentClockSkew, meta.StartTime)
+	}
+	if source == model.SegmentSourceReplicated {
+		// no point accepting something retention would delete right away
+		maxAge := mm.cli.SegmentMaxAge
+		if userAge, ok := mm.cli.SegmentMaxAgeByUser[user]; ok {
+			maxAge = userAge
+		}
+		if maxAge > 0 && end.Before(now.Add(-maxAge)) {
+			return fmt.Errorf("%w: end=%s is older than segment-max-age", ErrSegmentClockSkew, meta.EndTime)
+		}
+	}
+
+	dup, err := mm.model.GetSegmentByHash(hash)
+	if err != nil {
+		return err
+	}
+	if dup != nil {
+		return fmt.Errorf("%w: same content as segment %s", ErrSegmentDuplicate, dup.ID)
+	}
+
+	if source == model.SegmentSourceLocal {
+		latest, err := mm.model.LatestSegment(user)
+		if err != nil {
+			return err
+		}
+		if latest != nil && meta.StartTime <= latest.StartTime {
+			return fmt.Errorf("%w: start=%s latest=%s", ErrSegmentOutOfOrder, meta.StartTime, latest.StartTime)
+		}
+		return nil
+	}
+
+	existing, err := mm.model.ListSegments(user, meta.StartTime, meta.EndTime)
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return fmt.Errorf("%w: start=%s end=%s existing=%s", ErrSegmentOverlap, meta.StartTime, meta.EndTime, existing[0].ID)
+	}
+	return nil
+}
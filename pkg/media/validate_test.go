@@ -0,0 +1,101 @@
+package media
+
+import (
+	"testing"
+	"time"
+
+	"aquareum.tv/aquareum/pkg/aqtime"
+	"aquareum.tv/aquareum/pkg/config"
+	"aquareum.tv/aquareum/pkg/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckSegment(t *testing.T) {
+	mod, err := model.MakeDB(":memory:")
+	require.NoError(t, err)
+	mm := &MediaManager{
+		cli:   &config.CLI{SegmentClockSkew: time.Minute, SegmentMaxAge: 24 * time.Hour},
+		model: mod,
+	}
+	now := time.Now()
+	at := func(d time.Duration) aqtime.AQTime {
+		return aqtime.FromMillis(now.Add(d).UnixMilli())
+	}
+	err = mod.CreateSegment(&model.Segment{
+		ID:        "existing",
+		User:      "0xalice",
+		StartTime: at(-10 * time.Second),
+		EndTime:   at(-8 * time.Second),
+		Hash:      "existinghash",
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		start  time.Duration
+		end    time.Duration
+		hash   string
+		source model.SegmentSource
+		err    error
+	}{
+		{"next local segment", -2 * time.Second, 0, "a", model.SegmentSourceLocal, nil},
+		{"ends before it starts", -2 * time.Second, -3 * time.Second, "a", model.SegmentSourceLocal, ErrSegmentInvalidRange},
+		{"from the future", time.Hour, time.Hour + time.Second, "a", model.SegmentSourceLocal, ErrSegmentClockSkew},
+		{"stale local segment", -time.Hour, -time.Hour + time.Second, "a", model.SegmentSourceLocal, ErrSegmentClockSkew},
+		{"old replicated segment", -time.Hour, -time.Hour + time.Second, "a", model.SegmentSourceReplicated, nil},
+		{"past retention", -48 * time.Hour, -48*time.Hour + time.Second, "a", model.SegmentSourceReplicated, ErrSegmentClockSkew},
+		{"same bytes", -2 * time.Second, 0, "existinghash", model.SegmentSourceLocal, ErrSegmentDuplicate},
+		{"local out of order", -30 * time.Second, -29 * time.Second, "a", model.SegmentSourceLocal, ErrSegmentOutOfOrder},
+		{"replicated overlap", -9 * time.Second, -7 * time.Second, "a", model.SegmentSourceReplicated, ErrSegmentOverlap},
+		{"replicated backfill", -30 * time.Second, -29 * time.Second, "a", model.SegmentSourceReplicated, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			meta := &SegmentMetadata{StartTime: at(tt.start), EndTime: at(tt.end)}
+			err := mm.checkSegment("0xalice", meta, tt.hash, tt.source, now)
+			if tt.err == nil {
+				require.NoError(t, err)
+			} else {
+				require.ErrorIs(t, err, tt.err)
+			}
+		})
+	}
+}
+
+func TestCheckSegmentDuration(t *testing.T) {
+	mod, err := model.MakeDB(":memory:")
+	require.NoError(t, err)
+	mm := &MediaManager{
+		cli:   &config.CLI{SegmentClockSkew: time.Minute, SegmentMaxDuration: 10 * time.Second},
+		model: mod,
+	}
+	now := time.Now()
+	meta := &SegmentMetadata{
+		StartTime: aqtime.FromMillis(now.Add(-12 * time.Second).UnixMilli()),
+		EndTime:   aqtime.FromMillis(now.UnixMilli()),
+		Duration:  12 * time.Second,
+	}
+	err = mm.checkSegment("0xalice", meta, "a", model.SegmentSourceReplicated, now)
+	require.ErrorIs(t, err, ErrSegmentTooLong)
+
+	// our own stream stays on the air, the segmenter deals with it
+	require.NoError(t, mm.checkSegment("0xalice", meta, "a", model.SegmentSourceLocal, now))
+
+	// segments from before we recorded durations get a pass
+	meta.Duration = 0
+	require.NoError(t, mm.checkSegment("0xalice", meta, "a", model.SegmentSourceReplicated, now))
+
+	mm.cli.SegmentMaxDuration = 0
+	meta.Duration = time.Hour
+	require.NoError(t, mm.checkSegment("0xalice", meta, "a", model.SegmentSourceReplicated, now))
+}
+
+func TestCheckSegmentFileSafeTime(t *testing.T) {
+	mm := &MediaManager{cli: &config.CLI{SegmentClockSkew: time.Minute}}
+	now := time.Now()
+	start, err := aqtime.FromString(aqtime.FromMillis(now.UnixMilli()).FileSafeString())
+	require.NoError(t, err)
+	meta := &SegmentMetadata{StartTime: start, EndTime: aqtime.FromMillis(now.UnixMilli())}
+	err = mm.checkSegment("0xalice", meta, "a", model.SegmentSourceLocal, now)
+	require.ErrorIs(t, err, ErrSegmentInvalid)
+}
@@ -0,0 +1,67 @@
+package media
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"strings"
+
+	"aquareum.tv/aquareum/pkg/log"
+	"github.com/go-gst/go-gst/gst"
+	"github.com/go-gst/go-gst/gst/app"
+	"github.com/pion/webrtc/v4"
+)
+
+// payload types we rewrite incoming RTP to, whatever the publisher negotiated
+const WEBRTC_H264_PAYLOAD_TYPE = 96
+const WEBRTC_OPUS_PAYLOAD_TYPE = 111
+
+// segment and sign the H.264 and Opus tracks of a WebRTC publisher, eg from
+// WHIP. opus gets transcoded to aac because that's what our segments carry.
+func (mm *MediaManager) IngestWebRTC(ctx context.Context, video, audio *webrtc.TrackRemote, ms *MediaSigner) error {
+	pipelineSlice := []string{
+		fmt.Sprintf(`appsrc name=videosrc format=time is-live=true do-timestamp=true caps="application/x-rtp,media=video,encoding-name=H264,clock-rate=90000,payload=%d"`, WEBRTC_H264_PAYLOAD_TYPE),
+		"videosrc. ! rtpjitterbuffer ! rtph264depay ! h264parse name=parse config-interval=-1",
+		fmt.Sprintf(`appsrc name=audiosrc format=time is-live=true do-timestamp=true caps="application/x-rtp,media=audio,encoding-name=OPUS,clock-rate=48000,payload=%d"`, WEBRTC_OPUS_PAYLOAD_TYPE),
+		"audiosrc. ! rtpjitterbuffer ! rtpopusdepay ! opusdec ! audioconvert ! audioresample ! fdkaacenc ! queue ! aacparse name=audioparse",
+	}
+	pipeline, err := gst.NewPipelineFromString(strings.Join(pipelineSlice, "\n"))
+	if err != nil {
+		return fmt.Errorf("error creating IngestWebRTC pipeline: %w", err)
+	}
+	defer runtime.KeepAlive(pipeline)
+	videoele, err := pipeline.GetElementByName("videosrc")
+	if err != nil {
+		return err
+	}
+	audioele, err := pipeline.GetElementByName("audiosrc")
+	if err != nil {
+		return err
+	}
+	go pushRTP(ctx, video, app.SrcFromElement(videoele), WEBRTC_H264_PAYLOAD_TYPE)
+	go pushRTP(ctx, audio, app.SrcFromElement(audioele), WEBRTC_OPUS_PAYLOAD_TYPE)
+	return mm.runSigningPipeline(ctx, pipeline, ms)
+}
+
+// copy packets from a track into an appsrc until the track ends
+func pushRTP(ctx context.Context, track *webrtc.TrackRemote, src *app.Source, payloadType uint8) {
+	defer src.EndStream()
+	for {
+		pkt, _, err := track.ReadRTP()
+		if err != nil {
+			log.Debug(ctx, "webrtc track ended", "kind", track.Kind().String(), "error", err)
+			return
+		}
+		pkt.PayloadType = payloadType
+		bs, err := pkt.Marshal()
+		if err != nil {
+			log.Error(ctx, "error marshalling rtp packet", "error", err)
+			return
+		}
+		ret := src.PushBuffer(gst.NewBufferFromBytes(bs))
+		if ret != gst.FlowOK {
+			log.Debug(ctx, "pipeline stopped accepting rtp", "kind", track.Kind().String(), "flow", ret)
+			return
+		}
+	}
+}
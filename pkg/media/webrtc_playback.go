@@ -0,0 +1,310 @@
+package media
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"aquareum.tv/aquareum/pkg/log"
+	"github.com/go-gst/go-glib/glib"
+	"github.com/go-gst/go-gst/gst"
+	"github.com/go-gst/go-gst/gst/app"
+	"github.com/livepeer/lpms/ffmpeg"
+	"github.com/pion/webrtc/v4"
+	pionmedia "github.com/pion/webrtc/v4/pkg/media"
+	"golang.org/x/sync/errgroup"
+)
+
+// the H.264 profile we offer WebRTC viewers when we don't know what the
+// stream's sending yet: constrained baseline, level 3.1
+const WEBRTC_H264_PROFILE_LEVEL_DEFAULT = "42e01f"
+
+// how many WebRTC viewers we'll play out to at once, across every stream
+const WEBRTC_PLAYBACK_MAX_VIEWERS = 256
+
+var ErrWebRTCCodecUnsupported = errors.New("video codec can't be played over WebRTC")
+var ErrWebRTCPlaybackFull = errors.New("too many WebRTC viewers")
+
+// fmtp line for an H.264 WebRTC track with the given profile-level-id
+func WebRTCH264Fmtp(profileLevelID string) string {
+	return fmt.Sprintf("level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=%s", profileLevelID)
+}
+
+// the H.264 profile-level-id to negotiate for a stream, from its RFC 6381
+// codec string, eg avc1.64002a. video passes straight through, so anything
+// browsers can't decode as H.264 constrained baseline, main or high is no good.
+// offers only get matched on profile, so the constraint flags are what
+// browsers ask for rather than whatever the encoder set.
+func webrtcProfileLevelID(codec string) (string, error) {
+	if codec == "" {
+		return WEBRTC_H264_PROFILE_LEVEL_DEFAULT, nil
+	}
+	entry, params, _ := strings.Cut(codec, ".")
+	if (entry != "avc1" && entry != "avc3") || len(params) != 6 {
+		return "", fmt.Errorf("%w: %s", ErrWebRTCCodecUnsupported, codec)
+	}
+	profile, level := params[0:2], params[4:6]
+	switch profile {
+	case "42":
+		return "42e0" + level, nil
+	case "4d", "64":
+		return profile + "00" + level, nil
+	}
+	return "", fmt.Errorf("%w: %s", ErrWebRTCCodecUnsupported, codec)
+}
+
+// one playout of a user's stream to WebRTC tracks, shared between everyone
+// watching it. pion sends whatever's written to a track to every peer
+// connection it's been added to, so viewers only need their own connection.
+type WebRTCPlayback struct {
+	Video *webrtc.TrackLocalStaticSample
+	Audio *webrtc.TrackLocalStaticSample
+	// what we're sending, for registering with a viewer's media engine
+	ProfileLevelID string
+	key            string
+	user           string
+	ctx            context.Context
+	cancel         context.CancelFunc
+	start          sync.Once
+	done           chan struct{}
+	// must hold mm.sharedMut
+	viewers int
+}
+
+// closed once the playout's over, whether the stream ended or it failed
+func (p *WebRTCPlayback) Done() <-chan struct{} {
+	return p.done
+}
+
+// join the playout of a user's stream, setting one up if need be. call
+// PlayWebRTC once the viewer's connected and LeaveWebRTCPlayback once they're
+// gone.
+func (mm *MediaManager) JoinWebRTCPlayback(ctx context.Context, user string) (*WebRTCPlayback, error) {
+	plid, err := webrtcProfileLevelID(mm.hlsSource(ctx, user).video)
+	if err != nil {
+		return nil, err
+	}
+	mm.sharedMut.Lock()
+	defer mm.sharedMut.Unlock()
+	if mm.webrtcViewers >= WEBRTC_PLAYBACK_MAX_VIEWERS {
+		return nil, ErrWebRTCPlaybackFull
+	}
+	key := fmt.Sprintf("%s/%s", user, plid)
+	p, ok := mm.webrtcShared[key]
+	if !ok {
+		video, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{
+			MimeType:    webrtc.MimeTypeH264,
+			ClockRate:   90000,
+			SDPFmtpLine: WebRTCH264Fmtp(plid),
+		}, "video", "aquareum")
+		if err != nil {
+			return nil, err
+		}
+		audio, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{
+			MimeType:  webrtc.MimeTypeOpus,
+			ClockRate: 48000,
+			Channels:  2,
+		}, "audio", "aquareum")
+		if err != nil {
+			return nil, err
+		}
+		// the playout outlives whichever viewer happened to start it
+		ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		p = &WebRTCPlayback{
+			Video:          video,
+			Audio:          audio,
+			ProfileLevelID: plid,
+			key:            key,
+			user:           user,
+			ctx:            log.WithLogValues(ctx, "user", user, "format", "webrtc"),
+			cancel:         cancel,
+			done:           make(chan struct{}),
+		}
+		mm.webrtcShared[key] = p
+	}
+	p.viewers += 1
+	mm.webrtcViewers += 1
+	return p, nil
+}
+
+// start the playout if nobody has yet. samples written before anyone's
+// connected are lost, and with them the keyframe the stream starts on, so we
+// wait for the first viewer; later ones pick up at the next keyframe.
+func (mm *MediaManager) PlayWebRTC(p *WebRTCPlayback) {
+	p.start.Do(func() {
+		go func() {
+			log.Log(p.ctx, "started webrtc playback")
+			err := mm.PlaybackWebRTC(p.ctx, p.user, p.Video, p.Audio)
+			if err != nil {
+				log.Log(p.ctx, "webrtc playback error", "error", err)
+			}
+			log.Log(p.ctx, "webrtc playback ended")
+			mm.sharedMut.Lock()
+			if mm.webrtcShared[p.key] == p {
+				delete(mm.webrtcShared, p.key)
+			}
+			mm.sharedMut.Unlock()
+			p.cancel()
+			close(p.done)
+		}()
+	})
+}
+
+// drop a viewer, tearing down the playout if they were the last
+func (mm *MediaManager) LeaveWebRTCPlayback(p *WebRTCPlayback) {
+	mm.sharedMut.Lock()
+	defer mm.sharedMut.Unlock()
+	p.viewers -= 1
+	mm.webrtcViewers -= 1
+	if p.viewers > 0 {
+		return
+	}
+	p.cancel()
+	if mm.webrtcShared[p.key] == p {
+		delete(mm.webrtcShared, p.key)
+	}
+}
+
+// play a user's livestream out to WebRTC tracks, eg for WHEP. H.264 video
+// passes straight through and the aac audio gets transcoded to opus.
+func (mm *MediaManager) PlaybackWebRTC(ctx context.Context, user string, video, audio *webrtc.TrackLocalStaticSample) error {
+	muxer := ffmpeg.ComponentOptions{
+		Name: "matroska",
+	}
+	pr, pw := io.Pipe()
+	g, ctx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		err := mm.SegmentToStream(ctx, user, muxer, pw)
+		pw.CloseWithError(err)
+		return err
+	})
+	g.Go(func() error {
+		// unblocks the transmux if the viewer goes away first
+		defer pr.Close()
+		return MKVToWebRTC(ctx, pr, video, audio)
+	})
+	return g.Wait()
+}
+
+// demux a live mkv stream into samples on WebRTC tracks, paced by the clock so
+// a whole segment arriving at once doesn't go out in one burst
+func MKVToWebRTC(ctx context.Context, input io.Reader, video, audio *webrtc.TrackLocalStaticSample) error {
+	mainLoop := glib.NewMainLoop(glib.MainContextDefault(), false)
+
+	pipelineSlice := []string{
+		"appsrc name=appsrc ! matroskademux name=demux",
+		"demux.video_0 ! queue ! h264parse config-interval=-1 ! video/x-h264,stream-format=byte-stream,alignment=au ! appsink name=videosink sync=true",
+		"demux.audio_0 ! queue ! fdkaacdec ! audioconvert ! audioresample ! opusenc inband-fec=true perfect-timestamp=true bitrate=128000 ! appsink name=audiosink sync=true",
+	}
+
+	pipeline, err := gst.NewPipelineFromString(strings.Join(pipelineSlice, "\n"))
+	if err != nil {
+		return fmt.Errorf("error creating MKVToWebRTC pipeline: %w", err)
+	}
+
+	appsrc, err := pipeline.GetElementByName("appsrc")
+	if err != nil {
+		return err
+	}
+	src := app.SrcFromElement(appsrc)
+	src.SetCallbacks(&app.SourceCallbacks{
+		NeedDataFunc: readerNeedData(ctx, input),
+	})
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for name, track := range map[string]*webrtc.TrackLocalStaticSample{"videosink": video, "audiosink": audio} {
+		ele, err := pipeline.GetElementByName(name)
+		if err != nil {
+			return err
+		}
+		sink := app.SinkFromElement(ele)
+		sink.SetCallbacks(&app.SinkCallbacks{
+			NewSampleFunc: trackNewSample(ctx, track),
+			EOSFunc: func(sink *app.Sink) {
+				cancel()
+			},
+		})
+	}
+
+	go func() {
+		<-ctx.Done()
+		pipeline.BlockSetState(gst.StateNull)
+		mainLoop.Quit()
+	}()
+
+	var pipelineErr error
+	pipeline.GetPipelineBus().AddWatch(func(msg *gst.Message) bool {
+		switch msg.Type() {
+		case gst.MessageEOS:
+			log.Debug(ctx, "got EOS")
+			cancel()
+		case gst.MessageError:
+			err := msg.ParseError()
+			log.Error(ctx, "gstreamer error", "error", err.Error())
+			if debug := err.DebugString(); debug != "" {
+				log.Log(ctx, "gstreamer debug", "message", debug)
+			}
+			pipelineErr = err
+			cancel()
+		default:
+			log.Debug(ctx, msg.String())
+		}
+		return true
+	})
+
+	pipeline.SetState(gst.StatePlaying)
+
+	mainLoop.Run()
+	return pipelineErr
+}
+
+// write each sample out of an appsink to a WebRTC track
+func trackNewSample(ctx context.Context, track *webrtc.TrackLocalStaticSample) func(sink *app.Sink) gst.FlowReturn {
+	clock := &sampleClock{}
+	return func(sink *app.Sink) gst.FlowReturn {
+		sample := sink.PullSample()
+		if sample == nil {
+			return gst.FlowOK
+		}
+		buffer := sample.GetBuffer()
+		if buffer == nil {
+			return gst.FlowOK
+		}
+		dur := clock.duration(buffer.PresentationTimestamp().AsDuration(), buffer.Duration().AsDuration())
+		err := track.WriteSample(pionmedia.Sample{Data: buffer.Bytes(), Duration: dur})
+		if err != nil {
+			log.Debug(ctx, "error writing webrtc sample", "kind", track.Kind().String(), "error", err)
+			return gst.FlowError
+		}
+		return gst.FlowOK
+	}
+}
+
+// works out how long each sample on a track plays for, which is how far pion
+// moves the RTP clock on after it. buffers don't always say, so we fall back
+// on the gap since the last one.
+type sampleClock struct {
+	last    time.Duration
+	started bool
+}
+
+func (c *sampleClock) duration(pts, dur *time.Duration) time.Duration {
+	var gap time.Duration
+	if pts != nil {
+		if c.started && *pts > c.last {
+			gap = *pts - c.last
+		}
+		c.last = *pts
+		c.started = true
+	}
+	if dur != nil && *dur > 0 {
+		return *dur
+	}
+	return gap
+}
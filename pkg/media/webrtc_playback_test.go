@@ -0,0 +1,74 @@
+package media
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"aquareum.tv/aquareum/pkg/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSampleClock(t *testing.T) {
+	c := &sampleClock{}
+	at := func(d time.Duration) *time.Duration { return &d }
+	frame := time.Second / 30
+
+	// buffers that know their duration get it
+	require.Equal(t, frame, c.duration(at(0), at(frame)))
+	// otherwise it's the gap since the last one
+	require.Equal(t, frame, c.duration(at(frame), nil))
+	require.Equal(t, 2*frame, c.duration(at(3*frame), nil))
+	// nothing to go on
+	require.Equal(t, time.Duration(0), c.duration(nil, nil))
+	require.Equal(t, time.Duration(0), c.duration(at(frame), nil), "timestamps going backwards")
+}
+
+func TestWebRTCProfileLevelID(t *testing.T) {
+	for codec, expected := range map[string]string{
+		"":            WEBRTC_H264_PROFILE_LEVEL_DEFAULT,
+		"avc1.64002a": "64002a",
+		"avc1.640c1f": "64001f",
+		"avc3.4d401f": "4d001f",
+		"avc1.42c01e": "42e01e",
+	} {
+		plid, err := webrtcProfileLevelID(codec)
+		require.NoError(t, err, codec)
+		require.Equal(t, expected, plid, codec)
+	}
+	for _, codec := range []string{"hvc1.1.6.L93.90", "av01.0.08M.08", "avc1.6e0028", "avc1"} {
+		_, err := webrtcProfileLevelID(codec)
+		require.ErrorIs(t, err, ErrWebRTCCodecUnsupported, codec)
+	}
+}
+
+func TestWebRTCPlaybackShared(t *testing.T) {
+	mod, err := model.MakeDB(":memory:")
+	require.NoError(t, err)
+	mm := &MediaManager{model: mod, webrtcShared: map[string]*WebRTCPlayback{}}
+	ctx := context.Background()
+
+	a, err := mm.JoinWebRTCPlayback(ctx, "alice")
+	require.NoError(t, err)
+	b, err := mm.JoinWebRTCPlayback(ctx, "alice")
+	require.NoError(t, err)
+	require.Same(t, a, b, "viewers of one stream share a playout")
+	c, err := mm.JoinWebRTCPlayback(ctx, "bob")
+	require.NoError(t, err)
+	require.NotSame(t, a, c)
+	require.Equal(t, 3, mm.webrtcViewers)
+
+	mm.LeaveWebRTCPlayback(a)
+	require.NoError(t, a.ctx.Err(), "still has a viewer")
+	mm.LeaveWebRTCPlayback(b)
+	require.Error(t, a.ctx.Err(), "torn down with the last viewer")
+	require.NotContains(t, mm.webrtcShared, a.key)
+	mm.LeaveWebRTCPlayback(c)
+	require.Empty(t, mm.webrtcShared)
+	require.Equal(t, 0, mm.webrtcViewers)
+
+	// viewers are capped across every stream
+	mm.webrtcViewers = WEBRTC_PLAYBACK_MAX_VIEWERS
+	_, err = mm.JoinWebRTCPlayback(ctx, "alice")
+	require.ErrorIs(t, err, ErrWebRTCPlaybackFull)
+}
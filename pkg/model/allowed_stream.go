@@ -0,0 +1,55 @@
+package model
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm/clause"
+)
+
+// a streamer that this node accepts segments from, in addition to the
+// allowed-streams flag. removed streamers stay in the table with Allowed=false
+// so that we remember when it happened.
+type AllowedStream struct {
+	Address string `gorm:"primarykey"`
+	Allowed bool
+	// time on the admin's signed update, so old updates can't be replayed over newer ones
+	SignedTime int64
+	UpdatedBy  string
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+// apply an update if it's newer than the last one for that address. returns
+// false if a newer update has already been applied.
+func (m *DBModel) UpdateAllowedStream(stream *AllowedStream) (bool, error) {
+	res := m.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "address"}},
+		DoUpdates: clause.AssignmentColumns([]string{"allowed", "signed_time", "updated_by", "updated_at"}),
+		Where: clause.Where{Exprs: []clause.Expression{
+			clause.Expr{SQL: "allowed_streams.signed_time < excluded.signed_time"},
+		}},
+	}).Create(stream)
+	if res.Error != nil {
+		return false, fmt.Errorf("error updating allowed stream: %w", res.Error)
+	}
+	return res.RowsAffected > 0, nil
+}
+
+func (m *DBModel) ListAllowedStreams() ([]AllowedStream, error) {
+	streams := []AllowedStream{}
+	err := m.DB.Where("allowed = ?", true).Order("address ASC").Find(&streams).Error
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving allowed streams: %w", err)
+	}
+	return streams, nil
+}
+
+func (m *DBModel) IsAllowedStream(address string) (bool, error) {
+	var count int64
+	err := m.DB.Model(AllowedStream{}).Where("address = ? AND allowed = ?", address, true).Count(&count).Error
+	if err != nil {
+		return false, fmt.Errorf("error checking allowed streams: %w", err)
+	}
+	return count > 0, nil
+}
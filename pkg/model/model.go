@@ -8,6 +8,7 @@ import (
 	"strings"
 	"time"
 
+	"aquareum.tv/aquareum/pkg/aqtime"
 	"aquareum.tv/aquareum/pkg/log"
 	"github.com/lmittmann/tint"
 	slogGorm "github.com/orandin/slog-gorm"
@@ -27,6 +28,35 @@ type Model interface {
 	ListPlayerEvents(playerId string) ([]PlayerEvent, error)
 	PlayerReport(playerId string) (map[string]float64, error)
 	ClearPlayerEvents() error
+
+	CreateSegment(seg *Segment) error
+	ListSegments(user string, start, end aqtime.AQTime) ([]Segment, error)
+	ListSegmentsEndingBefore(user string, before aqtime.AQTime) ([]Segment, error)
+	ListSegmentsByLastAccessed(limit int) ([]Segment, error)
+	ListSegmentUsers() ([]string, error)
+	TotalSegmentSize() (int64, error)
+	TouchSegment(user string, start aqtime.AQTime) error
+	GetSegment(id string) (*Segment, error)
+	GetSegmentByHash(hash string) (*Segment, error)
+	LatestSegment(user string) (*Segment, error)
+	DeleteSegment(id string) error
+
+	CreateReplicationTask(task *ReplicationTask) error
+	ListReplicationTasks(peer string, limit int) ([]ReplicationTask, error)
+	ReplicationBacklog(peer string) (int64, time.Time, error)
+	FailReplicationTask(id string, reason string) error
+	DeleteReplicationTask(id string) error
+	DeleteReplicationTasksExcept(peers []string) (int64, error)
+
+	UpdateAllowedStream(stream *AllowedStream) (bool, error)
+	ListAllowedStreams() ([]AllowedStream, error)
+	IsAllowedStream(address string) (bool, error)
+
+	CreateStreamSession(sess *StreamSession) error
+	UpdateStreamSession(sess *StreamSession) error
+	LatestStreamSession(user string) (*StreamSession, error)
+	ListStreamSessions(user string, limit int) ([]StreamSession, error)
+	EndOpenStreamSessions() (int64, error)
 }
 
 func MakeDB(dbURL string) (Model, error) {
@@ -54,7 +84,7 @@ func MakeDB(dbURL string) (Model, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error starting database: %w", err)
 	}
-	for _, model := range []any{Notification{}, PlayerEvent{}} {
+	for _, model := range []any{Notification{}, PlayerEvent{}, Segment{}, ReplicationTask{}, AllowedStream{}, StreamSession{}} {
 		err = db.AutoMigrate(model)
 		if err != nil {
 			return nil, err
@@ -1 +1,92 @@
 package model
+
+import (
+	"testing"
+	"time"
+
+	"aquareum.tv/aquareum/pkg/aqtime"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListSegments(t *testing.T) {
+	mod, err := MakeDB(":memory:")
+	require.NoError(t, err)
+	var base int64 = 1726251017090
+	for i, user := range []string{"0xalice", "0xalice", "0xalice", "0xbob"} {
+		start := base + int64(i)*1000
+		err := mod.CreateSegment(&Segment{
+			ID:        aqtime.FromMillis(start).String() + user,
+			User:      user,
+			StartTime: aqtime.FromMillis(start),
+			EndTime:   aqtime.FromMillis(start + 1000),
+			Size:      1234,
+			Source:    SegmentSourceLocal,
+		})
+		require.NoError(t, err)
+	}
+
+	segs, err := mod.ListSegments("0xalice", aqtime.FromMillis(base), aqtime.FromMillis(base+3000))
+	require.NoError(t, err)
+	require.Len(t, segs, 3)
+	require.Equal(t, aqtime.FromMillis(base), segs[0].StartTime)
+	require.Equal(t, aqtime.FromMillis(base+2000), segs[2].StartTime)
+
+	segs, err = mod.ListSegments("0xalice", aqtime.FromMillis(base+1500), aqtime.FromMillis(base+2500))
+	require.NoError(t, err)
+	require.Len(t, segs, 2)
+
+	segs, err = mod.ListSegments("0xbob", aqtime.FromMillis(base), aqtime.FromMillis(base+1000))
+	require.NoError(t, err)
+	require.Len(t, segs, 0)
+}
+
+func TestUpdateAllowedStream(t *testing.T) {
+	mod, err := MakeDB(":memory:")
+	require.NoError(t, err)
+	addr := "0x6fbe6863cf1efc713899455e526a13239d371175"
+
+	applied, err := mod.UpdateAllowedStream(&AllowedStream{Address: addr, Allowed: true, SignedTime: 100})
+	require.NoError(t, err)
+	require.True(t, applied)
+	allowed, err := mod.IsAllowedStream(addr)
+	require.NoError(t, err)
+	require.True(t, allowed)
+
+	applied, err = mod.UpdateAllowedStream(&AllowedStream{Address: addr, Allowed: false, SignedTime: 200})
+	require.NoError(t, err)
+	require.True(t, applied)
+	allowed, err = mod.IsAllowedStream(addr)
+	require.NoError(t, err)
+	require.False(t, allowed)
+
+	// replaying the original add doesn't undo the removal
+	applied, err = mod.UpdateAllowedStream(&AllowedStream{Address: addr, Allowed: true, SignedTime: 100})
+	require.NoError(t, err)
+	require.False(t, applied)
+	streams, err := mod.ListAllowedStreams()
+	require.NoError(t, err)
+	require.Len(t, streams, 0)
+}
+
+func TestEndOpenStreamSessions(t *testing.T) {
+	mod, err := MakeDB(":memory:")
+	require.NoError(t, err)
+	start := time.Now().Add(-time.Hour)
+	last := start.Add(10 * time.Minute)
+	err = mod.CreateStreamSession(&StreamSession{ID: "open", User: "0xalice", StartTime: start, LastSegment: last, Segments: 300})
+	require.NoError(t, err)
+	end := start.Add(time.Minute)
+	err = mod.CreateStreamSession(&StreamSession{ID: "closed", User: "0xbob", StartTime: start, EndTime: &end, LastSegment: end, Segments: 30})
+	require.NoError(t, err)
+
+	ended, err := mod.EndOpenStreamSessions()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), ended)
+	sess, err := mod.LatestStreamSession("0xalice")
+	require.NoError(t, err)
+	require.NotNil(t, sess.EndTime)
+	require.True(t, last.Equal(*sess.EndTime))
+	sess, err = mod.LatestStreamSession("0xbob")
+	require.NoError(t, err)
+	require.True(t, end.Equal(*sess.EndTime))
+}
@@ -0,0 +1,92 @@
+package model
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm/clause"
+)
+
+// a segment waiting to be pushed to a peer
+type ReplicationTask struct {
+	ID   string `gorm:"primarykey"`
+	Peer string `gorm:"uniqueIndex:idx_replication_peer_hash,priority:1;index:idx_replication_peer_created,priority:1"`
+	// sha256 of the segment, so the same segment is only queued once per peer
+	Hash        string `gorm:"uniqueIndex:idx_replication_peer_hash,priority:2"`
+	SegmentPath string
+	Size        int64
+	Attempts    int
+	LastError   string
+	CreatedAt   time.Time `gorm:"index:idx_replication_peer_created,priority:2"`
+}
+
+// queue a task, silently ignoring segments that are already queued for that peer
+func (m *DBModel) CreateReplicationTask(task *ReplicationTask) error {
+	err := m.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(task).Error
+	if err != nil {
+		return fmt.Errorf("error queueing replication task: %w", err)
+	}
+	return nil
+}
+
+// a peer's pending tasks, oldest first
+func (m *DBModel) ListReplicationTasks(peer string, limit int) ([]ReplicationTask, error) {
+	tasks := []ReplicationTask{}
+	err := m.DB.
+		Where("peer = ?", peer).
+		Order("created_at ASC").
+		Limit(limit).
+		Find(&tasks).Error
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving replication tasks: %w", err)
+	}
+	return tasks, nil
+}
+
+// how many tasks a peer has pending and when the oldest one was queued
+// (zero if there aren't any)
+func (m *DBModel) ReplicationBacklog(peer string) (int64, time.Time, error) {
+	var count int64
+	err := m.DB.Model(ReplicationTask{}).Where("peer = ?", peer).Count(&count).Error
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("error counting replication tasks: %w", err)
+	}
+	if count == 0 {
+		return 0, time.Time{}, nil
+	}
+	oldest := ReplicationTask{}
+	err = m.DB.Where("peer = ?", peer).Order("created_at ASC").First(&oldest).Error
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("error retrieving oldest replication task: %w", err)
+	}
+	return count, oldest.CreatedAt, nil
+}
+
+func (m *DBModel) FailReplicationTask(id string, reason string) error {
+	return m.DB.Model(ReplicationTask{}).
+		Where("id = ?", id).
+		Updates(map[string]any{
+			"attempts":   clause.Expr{SQL: "attempts + 1"},
+			"last_error": reason,
+		}).Error
+}
+
+func (m *DBModel) DeleteReplicationTask(id string) error {
+	return m.DB.Where("id = ?", id).Delete(&ReplicationTask{}).Error
+}
+
+// drop tasks queued for anyone who isn't one of peers any more, since nothing
+// will ever send them
+func (m *DBModel) DeleteReplicationTasksExcept(peers []string) (int64, error) {
+	query := m.DB.Model(ReplicationTask{})
+	if len(peers) > 0 {
+		query = query.Where("peer NOT IN ?", peers)
+	} else {
+		query = query.Where("1 = 1")
+	}
+	res := query.Delete(&ReplicationTask{})
+	if res.Error != nil {
+		return 0, fmt.Errorf("error pruning replication tasks: %w", res.Error)
+	}
+	return res.RowsAffected, nil
+}
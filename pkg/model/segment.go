@@ -0,0 +1,150 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"aquareum.tv/aquareum/pkg/aqtime"
+	"gorm.io/gorm"
+)
+
+type SegmentSource string
+
+// segment was signed by this node
+const SegmentSourceLocal SegmentSource = "local"
+
+// segment was pushed to us by another node
+const SegmentSourceReplicated SegmentSource = "replicated"
+
+type Segment struct {
+	ID                string        `gorm:"primarykey"`
+	User              string        `gorm:"index:idx_segment_user_start,priority:1"`
+	StartTime         aqtime.AQTime `gorm:"index:idx_segment_user_start,priority:2"`
+	EndTime           aqtime.AQTime
+	Size              int64
+	Hash              string `gorm:"index"`
+	Path              string
+	SignerFingerprint string
+	Source            SegmentSource
+	EncodingFormat    string
+	Duration          time.Duration
+	CreatedAt         time.Time
+	LastAccessed      time.Time `gorm:"index"`
+}
+
+func (m *DBModel) CreateSegment(seg *Segment) error {
+	if seg.LastAccessed.IsZero() {
+		seg.LastAccessed = time.Now()
+	}
+	err := m.DB.Model(Segment{}).Create(seg).Error
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// list a user's segments that overlap the provided time range, oldest first
+func (m *DBModel) ListSegments(user string, start, end aqtime.AQTime) ([]Segment, error) {
+	segs := []Segment{}
+	// AQTime strings are fixed-width, so they compare lexically
+	err := m.DB.
+		Where("user = ? AND start_time < ? AND end_time > ?", user, end, start).
+		Order("start_time ASC").
+		Find(&segs).Error
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving segments: %w", err)
+	}
+	return segs, nil
+}
+
+// list a user's segments that ended before the provided time, oldest first
+func (m *DBModel) ListSegmentsEndingBefore(user string, before aqtime.AQTime) ([]Segment, error) {
+	segs := []Segment{}
+	err := m.DB.
+		Where("user = ? AND end_time <= ?", user, before).
+		Order("start_time ASC").
+		Find(&segs).Error
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving segments: %w", err)
+	}
+	return segs, nil
+}
+
+// list segments across all users, least recently accessed first
+func (m *DBModel) ListSegmentsByLastAccessed(limit int) ([]Segment, error) {
+	segs := []Segment{}
+	err := m.DB.Order("last_accessed ASC").Limit(limit).Find(&segs).Error
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving segments: %w", err)
+	}
+	return segs, nil
+}
+
+// every user that has at least one segment stored
+func (m *DBModel) ListSegmentUsers() ([]string, error) {
+	users := []string{}
+	err := m.DB.Model(Segment{}).Distinct().Pluck("user", &users).Error
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving segment users: %w", err)
+	}
+	return users, nil
+}
+
+func (m *DBModel) TotalSegmentSize() (int64, error) {
+	var total int64
+	err := m.DB.Model(Segment{}).Select("COALESCE(SUM(size), 0)").Scan(&total).Error
+	if err != nil {
+		return 0, fmt.Errorf("error summing segment sizes: %w", err)
+	}
+	return total, nil
+}
+
+// mark a segment as recently used so LRU eviction leaves it alone
+func (m *DBModel) TouchSegment(user string, start aqtime.AQTime) error {
+	return m.DB.Model(Segment{}).
+		Where("user = ? AND start_time = ?", user, start).
+		Update("last_accessed", time.Now()).Error
+}
+
+func (m *DBModel) GetSegment(id string) (*Segment, error) {
+	seg := Segment{}
+	err := m.DB.Where("id = ?", id).First(&seg).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving segment: %w", err)
+	}
+	return &seg, nil
+}
+
+// a segment with exactly this content, if we have one
+func (m *DBModel) GetSegmentByHash(hash string) (*Segment, error) {
+	seg := Segment{}
+	err := m.DB.Where("hash = ?", hash).First(&seg).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving segment: %w", err)
+	}
+	return &seg, nil
+}
+
+// a user's segment with the latest start time, if they have any
+func (m *DBModel) LatestSegment(user string) (*Segment, error) {
+	seg := Segment{}
+	err := m.DB.Where("user = ?", user).Order("start_time DESC").First(&seg).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving segment: %w", err)
+	}
+	return &seg, nil
+}
+
+func (m *DBModel) DeleteSegment(id string) error {
+	return m.DB.Where("id = ?", id).Delete(&Segment{}).Error
+}
@@ -0,0 +1,77 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// one unbroken run of a user streaming, from their first segment until they
+// stopped. EndTime is nil while it's still going.
+type StreamSession struct {
+	ID          string    `gorm:"primarykey"`
+	User        string    `gorm:"index:idx_stream_session_user_start,priority:1"`
+	StartTime   time.Time `gorm:"index:idx_stream_session_user_start,priority:2"`
+	EndTime     *time.Time
+	LastSegment time.Time
+	Segments    int
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+func (m *DBModel) CreateStreamSession(sess *StreamSession) error {
+	err := m.DB.Create(sess).Error
+	if err != nil {
+		return fmt.Errorf("error creating stream session: %w", err)
+	}
+	return nil
+}
+
+func (m *DBModel) UpdateStreamSession(sess *StreamSession) error {
+	err := m.DB.Save(sess).Error
+	if err != nil {
+		return fmt.Errorf("error updating stream session: %w", err)
+	}
+	return nil
+}
+
+// a user's most recent stream session, if they have any
+func (m *DBModel) LatestStreamSession(user string) (*StreamSession, error) {
+	sess := StreamSession{}
+	err := m.DB.Where("user = ?", user).Order("start_time DESC").First(&sess).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving stream session: %w", err)
+	}
+	return &sess, nil
+}
+
+// a user's stream sessions, newest first
+func (m *DBModel) ListStreamSessions(user string, limit int) ([]StreamSession, error) {
+	sessions := []StreamSession{}
+	err := m.DB.
+		Where("user = ?", user).
+		Order("start_time DESC").
+		Limit(limit).
+		Find(&sessions).Error
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving stream sessions: %w", err)
+	}
+	return sessions, nil
+}
+
+// end any sessions still open from before a restart at their last segment,
+// since nobody's around to end them otherwise
+func (m *DBModel) EndOpenStreamSessions() (int64, error) {
+	res := m.DB.Model(StreamSession{}).
+		Where("end_time IS NULL").
+		Update("end_time", gorm.Expr("last_segment"))
+	if res.Error != nil {
+		return 0, fmt.Errorf("error ending open stream sessions: %w", res.Error)
+	}
+	return res.RowsAffected, nil
+}
@@ -1,47 +1,321 @@
 package boring
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"sync"
+	"time"
 
 	"aquareum.tv/aquareum/pkg/aqhttp"
 	"aquareum.tv/aquareum/pkg/log"
+	"aquareum.tv/aquareum/pkg/model"
+	"aquareum.tv/aquareum/pkg/replication"
+	"aquareum.tv/aquareum/pkg/storage"
+	"github.com/google/uuid"
 )
 
-// boring HTTP replication mechanism
+// how many of a peer's tasks to look at per pass
+const REPLICATION_BATCH = 20
+
+// how often we check the queue when nothing else wakes us up
+const POLL_INTERVAL = time.Second
+
+// backoff for a peer that's failing, doubling from MIN to MAX
+const MIN_BACKOFF = time.Second
+const MAX_BACKOFF = 30 * time.Second
+
+const DEFAULT_MAX_IN_FLIGHT = 4
+
+// boring HTTP replication mechanism. segments are queued in the database per
+// peer and retried with backoff until the peer accepts them.
 type BoringReplicator struct {
-	Peers []string
+	Peers       []string
+	Model       model.Model
+	Store       storage.SegmentStore
+	MaxInFlight int
+	// signs the header peers use to authenticate us
+	Signer replication.MessageSigner
+
+	peers    map[string]*peerState
+	inFlight map[string]bool
+	sem      chan struct{}
+	wake     chan struct{}
+	mu       sync.Mutex
+	initOnce sync.Once
+}
+
+type peerState struct {
+	failures    int
+	retryAt     time.Time
+	lastSuccess time.Time
+	lastError   string
+	inFlight    int
+}
+
+// peer turned the segment down in a way that retrying won't fix
+type rejectedError struct {
+	error
+}
+
+func (rep *BoringReplicator) init() {
+	rep.initOnce.Do(func() {
+		max := rep.MaxInFlight
+		if max <= 0 {
+			max = DEFAULT_MAX_IN_FLIGHT
+		}
+		rep.peers = map[string]*peerState{}
+		for _, peer := range rep.Peers {
+			rep.peers[peer] = &peerState{}
+		}
+		rep.inFlight = map[string]bool{}
+		rep.sem = make(chan struct{}, max)
+		rep.wake = make(chan struct{}, 1)
+	})
+}
+
+func (rep *BoringReplicator) NewSegment(ctx context.Context, key string, bs []byte) {
+	if len(rep.Peers) == 0 {
+		return
+	}
+	rep.init()
+	hash := replication.SegmentHash(bs)
+	for _, peer := range rep.Peers {
+		uu, err := uuid.NewV7()
+		if err != nil {
+			log.Error(ctx, "error generating replication task id", "error", err)
+			return
+		}
+		err = rep.Model.CreateReplicationTask(&model.ReplicationTask{
+			ID:          uu.String(),
+			Peer:        peer,
+			Hash:        hash,
+			SegmentPath: key,
+			Size:        int64(len(bs)),
+		})
+		if err != nil {
+			log.Error(ctx, "error queueing segment for replication", "peer", peer, "key", key, "error", err)
+		}
+	}
+	rep.poke()
+}
+
+func (rep *BoringReplicator) poke() {
+	select {
+	case rep.wake <- struct{}{}:
+	default:
+	}
+}
+
+// work through the replication queue until the context is cancelled
+func (rep *BoringReplicator) Run(ctx context.Context) error {
+	rep.init()
+	// the peer list only changes across restarts, so anything queued for a
+	// peer we've since dropped would otherwise sit there forever
+	pruned, err := rep.Model.DeleteReplicationTasksExcept(rep.Peers)
+	if err != nil {
+		return err
+	}
+	if pruned > 0 {
+		log.Log(ctx, "dropped replication tasks for removed peers", "count", pruned)
+	}
+	ticker := time.NewTicker(POLL_INTERVAL)
+	defer ticker.Stop()
+	for {
+		rep.dispatch(ctx)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-rep.wake:
+		case <-ticker.C:
+		}
+	}
 }
 
-func (rep *BoringReplicator) NewSegment(ctx context.Context, bs []byte) {
-	for _, p := range rep.Peers {
-		go func(peer string) {
-			ctx := log.WithLogValues(ctx, "peer", peer)
-			err := sendSegment(ctx, peer, bs)
-			if err != nil {
-				log.Log(ctx, "error replicating segment", "error", err)
+// start sending whatever is due, up to MaxInFlight at a time. each peer gets
+// a fair share of those, so one with a big backlog can't starve the rest.
+func (rep *BoringReplicator) dispatch(ctx context.Context) {
+	if len(rep.Peers) == 0 {
+		return
+	}
+	now := time.Now()
+	share := (cap(rep.sem) + len(rep.Peers) - 1) / len(rep.Peers)
+	for _, peer := range rep.Peers {
+		rep.mu.Lock()
+		state := rep.peers[peer]
+		backingOff := now.Before(state.retryAt)
+		rep.mu.Unlock()
+		if backingOff {
+			continue
+		}
+		tasks, err := rep.Model.ListReplicationTasks(peer, REPLICATION_BATCH)
+		if err != nil {
+			log.Error(ctx, "error listing replication tasks", "peer", peer, "error", err)
+			continue
+		}
+		for _, task := range tasks {
+			rep.mu.Lock()
+			busy := rep.inFlight[task.ID]
+			full := state.inFlight >= share
+			rep.mu.Unlock()
+			if full {
+				break
+			}
+			if busy {
+				continue
+			}
+			acquired := false
+			select {
+			case rep.sem <- struct{}{}:
+				acquired = true
+			default:
 			}
-		}(p)
+			if !acquired {
+				// maybe there's room once something finishes; on to the next peer
+				break
+			}
+			rep.mu.Lock()
+			rep.inFlight[task.ID] = true
+			state.inFlight += 1
+			rep.mu.Unlock()
+			go func(task model.ReplicationTask) {
+				err := rep.sendTask(ctx, task)
+				rep.finish(ctx, task, err)
+				rep.mu.Lock()
+				delete(rep.inFlight, task.ID)
+				state.inFlight -= 1
+				rep.mu.Unlock()
+				<-rep.sem
+				rep.poke()
+			}(task)
+		}
+	}
+}
+
+func (rep *BoringReplicator) finish(ctx context.Context, task model.ReplicationTask, sendErr error) {
+	ctx = log.WithLogValues(ctx, "peer", task.Peer, "key", task.SegmentPath)
+	rep.mu.Lock()
+	state := rep.peers[task.Peer]
+	if sendErr == nil {
+		state.failures = 0
+		state.retryAt = time.Time{}
+		state.lastSuccess = time.Now()
+	} else {
+		state.lastError = sendErr.Error()
+	}
+	var rejected rejectedError
+	retry := sendErr != nil && !errors.As(sendErr, &rejected)
+	if retry {
+		state.failures += 1
+		state.retryAt = time.Now().Add(backoff(state.failures))
+	}
+	rep.mu.Unlock()
+
+	if retry {
+		log.Log(ctx, "error replicating segment, will retry", "attempt", task.Attempts+1, "error", sendErr)
+		err := rep.Model.FailReplicationTask(task.ID, sendErr.Error())
+		if err != nil {
+			log.Error(ctx, "error updating replication task", "error", err)
+		}
+		return
+	}
+	if sendErr != nil {
+		log.Log(ctx, "segment rejected by peer, giving up", "error", sendErr)
+	}
+	err := rep.Model.DeleteReplicationTask(task.ID)
+	if err != nil {
+		log.Error(ctx, "error deleting replication task", "error", err)
+	}
+}
+
+func backoff(failures int) time.Duration {
+	d := MIN_BACKOFF
+	for i := 1; i < failures && d < MAX_BACKOFF; i++ {
+		d *= 2
+	}
+	if d > MAX_BACKOFF {
+		d = MAX_BACKOFF
 	}
+	return d
 }
 
-func sendSegment(ctx context.Context, peer string, bs []byte) error {
-	r := bytes.NewReader(bs)
+func (rep *BoringReplicator) sendTask(ctx context.Context, task model.ReplicationTask) error {
+	r, err := rep.Store.Get(ctx, task.SegmentPath)
+	if errors.Is(err, storage.ErrNotFound) {
+		// probably cleaned up by retention before we got to it
+		return rejectedError{err}
+	}
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return sendSegment(ctx, rep.Signer, task.Peer, r, task.Size, task.Hash)
+}
+
+func sendSegment(ctx context.Context, signer replication.MessageSigner, peer string, r io.Reader, size int64, hash string) error {
 	peerURL := fmt.Sprintf("%s/api/segment", peer)
 	req, err := http.NewRequestWithContext(ctx, "POST", peerURL, r)
 	if err != nil {
 		return err
 	}
+	req.ContentLength = size
+	if signer != nil {
+		auth, err := replication.PeerAuthHeader(signer, req.Method, req.URL.Path, hash)
+		if err != nil {
+			return err
+		}
+		req.Header.Set(replication.PEER_AUTH_HEADER, auth)
+	}
 	res, err := aqhttp.Client.Do(req)
 	if err != nil {
 		return err
 	}
-	if res.StatusCode != 204 {
-		body, _ := io.ReadAll(res.Body)
-		return fmt.Errorf("unexpected http code %d body=%s", res.StatusCode, body)
+	defer res.Body.Close()
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return nil
+	}
+	body, _ := io.ReadAll(res.Body)
+	err = fmt.Errorf("unexpected http code %d body=%s", res.StatusCode, body)
+	switch res.StatusCode {
+	// auth problems are usually config that someone will fix, so keep trying
+	case 401, 408, 429:
+		return err
+	}
+	if res.StatusCode >= 400 && res.StatusCode < 500 {
+		return rejectedError{err}
+	}
+	return err
+}
+
+func (rep *BoringReplicator) Stats() ([]replication.PeerStats, error) {
+	rep.init()
+	stats := []replication.PeerStats{}
+	now := time.Now()
+	for _, peer := range rep.Peers {
+		pending, oldest, err := rep.Model.ReplicationBacklog(peer)
+		if err != nil {
+			return nil, err
+		}
+		stat := replication.PeerStats{Peer: peer, Pending: pending}
+		if pending > 0 {
+			stat.Lag = now.Sub(oldest)
+		}
+		rep.mu.Lock()
+		state := rep.peers[peer]
+		stat.ConsecutiveFailures = state.failures
+		stat.LastError = state.lastError
+		if !state.lastSuccess.IsZero() {
+			t := state.lastSuccess
+			stat.LastSuccess = &t
+		}
+		if now.Before(state.retryAt) {
+			t := state.retryAt
+			stat.RetryAt = &t
+		}
+		rep.mu.Unlock()
+		stats = append(stats, stat)
 	}
-	return nil
+	return stats, nil
 }
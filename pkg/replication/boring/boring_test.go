@@ -0,0 +1,194 @@
+package boring
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"aquareum.tv/aquareum/pkg/model"
+	"aquareum.tv/aquareum/pkg/storage"
+	"github.com/stretchr/testify/require"
+)
+
+// peer that fails a few times before coming back
+type flakyPeer struct {
+	failures int
+	received [][]byte
+	mu       sync.Mutex
+}
+
+func (p *flakyPeer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.failures > 0 {
+		p.failures -= 1
+		w.WriteHeader(503)
+		return
+	}
+	bs, _ := io.ReadAll(r.Body)
+	p.received = append(p.received, bs)
+	// what HandleSegment actually returns
+	w.WriteHeader(200)
+}
+
+func (p *flakyPeer) count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.received)
+}
+
+func TestRetryUntilDelivered(t *testing.T) {
+	peer := &flakyPeer{failures: 1}
+	server := httptest.NewServer(peer)
+	defer server.Close()
+	mod, err := model.MakeDB(":memory:")
+	require.NoError(t, err)
+	store := &storage.LocalStore{Root: t.TempDir()}
+	rep := &BoringReplicator{Peers: []string{server.URL}, Model: mod, Store: store}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go rep.Run(ctx)
+
+	content := []byte("segment one")
+	err = store.Put(ctx, "0xalice/one.mp4", bytes.NewReader(content), int64(len(content)))
+	require.NoError(t, err)
+	rep.NewSegment(ctx, "0xalice/one.mp4", content)
+	// same bytes again shouldn't be sent twice
+	rep.NewSegment(ctx, "0xalice/one.mp4", content)
+
+	require.Eventually(t, func() bool { return peer.count() == 1 }, 5*time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool {
+		stats, err := rep.Stats()
+		require.NoError(t, err)
+		return stats[0].Pending == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, content, peer.received[0])
+	stats, err := rep.Stats()
+	require.NoError(t, err)
+	require.Equal(t, 0, stats[0].ConsecutiveFailures)
+	require.NotNil(t, stats[0].LastSuccess)
+	// give any duplicate a chance to show up
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, 1, peer.count())
+}
+
+func TestBacklogSurvivesRestart(t *testing.T) {
+	peer := &flakyPeer{}
+	server := httptest.NewServer(peer)
+	defer server.Close()
+	mod, err := model.MakeDB(":memory:")
+	require.NoError(t, err)
+	store := &storage.LocalStore{Root: t.TempDir()}
+	ctx := context.Background()
+
+	// queued while nothing was running, eg before a crash
+	first := &BoringReplicator{Peers: []string{server.URL}, Model: mod, Store: store}
+	for _, key := range []string{"0xalice/one.mp4", "0xalice/two.mp4"} {
+		content := []byte(key)
+		err = store.Put(ctx, key, bytes.NewReader(content), int64(len(content)))
+		require.NoError(t, err)
+		first.NewSegment(ctx, key, content)
+	}
+	stats, err := first.Stats()
+	require.NoError(t, err)
+	require.Equal(t, int64(2), stats[0].Pending)
+	require.Greater(t, stats[0].Lag, time.Duration(0))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	second := &BoringReplicator{Peers: []string{server.URL}, Model: mod, Store: store}
+	go second.Run(ctx)
+	require.Eventually(t, func() bool { return peer.count() == 2 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestPruneRemovedPeers(t *testing.T) {
+	peer := &flakyPeer{}
+	server := httptest.NewServer(peer)
+	defer server.Close()
+	mod, err := model.MakeDB(":memory:")
+	require.NoError(t, err)
+	store := &storage.LocalStore{Root: t.TempDir()}
+	ctx := context.Background()
+
+	// queued back when there was another peer
+	first := &BoringReplicator{Peers: []string{server.URL, "http://gone.example"}, Model: mod, Store: store}
+	content := []byte("segment")
+	err = store.Put(ctx, "0xalice/one.mp4", bytes.NewReader(content), int64(len(content)))
+	require.NoError(t, err)
+	first.NewSegment(ctx, "0xalice/one.mp4", content)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	second := &BoringReplicator{Peers: []string{server.URL}, Model: mod, Store: store}
+	go second.Run(ctx)
+	require.Eventually(t, func() bool { return peer.count() == 1 }, 5*time.Second, 10*time.Millisecond)
+	pending, _, err := mod.ReplicationBacklog("http://gone.example")
+	require.NoError(t, err)
+	require.Equal(t, int64(0), pending)
+}
+
+// peer that holds on to every request until released
+type stuckPeer struct {
+	release chan struct{}
+}
+
+func (p *stuckPeer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-p.release:
+	case <-r.Context().Done():
+	}
+	w.WriteHeader(503)
+}
+
+func TestBacklogDoesNotStarvePeers(t *testing.T) {
+	stuck := &stuckPeer{release: make(chan struct{})}
+	stuckServer := httptest.NewServer(stuck)
+	defer stuckServer.Close()
+	defer close(stuck.release)
+	peer := &flakyPeer{}
+	server := httptest.NewServer(peer)
+	defer server.Close()
+	mod, err := model.MakeDB(":memory:")
+	require.NoError(t, err)
+	store := &storage.LocalStore{Root: t.TempDir()}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the first peer has a big backlog, and isn't getting through it
+	for i := 0; i < REPLICATION_BATCH; i++ {
+		key := fmt.Sprintf("0xalice/%d.mp4", i)
+		content := []byte(key)
+		err = store.Put(ctx, key, bytes.NewReader(content), int64(len(content)))
+		require.NoError(t, err)
+		err = mod.CreateReplicationTask(&model.ReplicationTask{
+			ID:          key,
+			Peer:        stuckServer.URL,
+			Hash:        key,
+			SegmentPath: key,
+			Size:        int64(len(content)),
+		})
+		require.NoError(t, err)
+	}
+	rep := &BoringReplicator{Peers: []string{stuckServer.URL, server.URL}, Model: mod, Store: store, MaxInFlight: 2}
+	go rep.Run(ctx)
+
+	content := []byte("segment one")
+	err = store.Put(ctx, "0xbob/one.mp4", bytes.NewReader(content), int64(len(content)))
+	require.NoError(t, err)
+	err = mod.CreateReplicationTask(&model.ReplicationTask{
+		ID:          "0xbob/one.mp4",
+		Peer:        server.URL,
+		Hash:        "0xbob/one.mp4",
+		SegmentPath: "0xbob/one.mp4",
+		Size:        int64(len(content)),
+	})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return peer.count() == 1 }, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,202 @@
+package pull
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"aquareum.tv/aquareum/pkg/aqhttp"
+	"aquareum.tv/aquareum/pkg/aqtime"
+	"aquareum.tv/aquareum/pkg/config"
+	"aquareum.tv/aquareum/pkg/log"
+	"aquareum.tv/aquareum/pkg/model"
+	"aquareum.tv/aquareum/pkg/replication"
+	"aquareum.tv/aquareum/pkg/storage"
+)
+
+// how much of an error response we'll read, in case a peer sends us a lot
+const ERROR_BODY_LIMIT = 4096
+
+var ErrSegmentSize = errors.New("segment from peer is the wrong size")
+
+// pull-based replication: periodically compare our segments for each allowed
+// stream against each of cli.PullPeers and fetch anything we're missing. works
+// for nodes that can't accept inbound connections.
+type PullReplicator struct {
+	CLI      *config.CLI
+	Model    model.Model
+	Ingester replication.Ingester
+}
+
+func (p *PullReplicator) Run(ctx context.Context) error {
+	if len(p.CLI.PullPeers) == 0 {
+		<-ctx.Done()
+		return nil
+	}
+	if p.CLI.PullInterval <= 0 {
+		return fmt.Errorf("pull-interval must be positive, got %s", p.CLI.PullInterval)
+	}
+	ticker := time.NewTicker(p.CLI.PullInterval)
+	defer ticker.Stop()
+	for {
+		p.Reconcile(ctx)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// one pass over every peer and stream. failures are logged and retried next time.
+func (p *PullReplicator) Reconcile(ctx context.Context) {
+	now := time.Now()
+	start := aqtime.FromMillis(0)
+	if p.CLI.PullWindow > 0 {
+		start = aqtime.FromMillis(now.Add(-p.CLI.PullWindow).UnixMilli())
+	}
+	end := aqtime.FromMillis(now.UnixMilli())
+	users, err := p.users()
+	if err != nil {
+		log.Error(ctx, "error listing allowed streams", "error", err)
+		return
+	}
+	for _, peer := range p.CLI.PullPeers {
+		for _, user := range users {
+			ctx := log.WithLogValues(ctx, "peer", peer, "user", user)
+			count, err := p.reconcileUser(ctx, peer, user, start, end)
+			if err != nil {
+				log.Log(ctx, "error pulling segments from peer", "error", err)
+			}
+			if count > 0 {
+				log.Log(ctx, "pulled missing segments from peer", "count", count)
+			}
+		}
+	}
+}
+
+// everyone from the allowed-streams flag plus the AllowedStream table
+func (p *PullReplicator) users() ([]string, error) {
+	users := []string{}
+	seen := map[string]bool{}
+	for _, pub := range p.CLI.AllowedStreams {
+		users = append(users, pub.String())
+		seen[pub.String()] = true
+	}
+	streams, err := p.Model.ListAllowedStreams()
+	if err != nil {
+		return nil, err
+	}
+	for _, stream := range streams {
+		if !seen[stream.Address] {
+			users = append(users, stream.Address)
+		}
+	}
+	return users, nil
+}
+
+func (p *PullReplicator) reconcileUser(ctx context.Context, peer, user string, start, end aqtime.AQTime) (int, error) {
+	theirs, err := FetchInventory(ctx, peer, user, start, end)
+	if err != nil {
+		return 0, err
+	}
+	ours, err := p.Model.ListSegments(user, start, end)
+	if err != nil {
+		return 0, err
+	}
+	have := map[string]bool{}
+	for _, seg := range ours {
+		have[seg.Hash] = true
+		have[string(seg.StartTime)] = true
+	}
+	count := 0
+	for _, item := range theirs {
+		if have[item.Hash] || have[string(item.StartTime)] {
+			continue
+		}
+		err := p.fetchSegment(ctx, peer, item)
+		if errors.Is(err, storage.ErrExists) {
+			continue
+		}
+		if err != nil {
+			// might just be this one segment that's bad, keep going
+			log.Log(ctx, "error pulling segment", "id", item.ID, "start", item.StartTime, "error", err)
+			continue
+		}
+		count += 1
+	}
+	return count, nil
+}
+
+// a peer's segments for a user that overlap the provided time range
+func FetchInventory(ctx context.Context, peer, user string, start, end aqtime.AQTime) ([]replication.InventoryItem, error) {
+	q := url.Values{}
+	q.Set("start", start.String())
+	q.Set("end", end.String())
+	u := fmt.Sprintf("%s/api/segments/%s?%s", peer, user, q.Encode())
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := aqhttp.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, unexpectedResponse(res)
+	}
+	items := []replication.InventoryItem{}
+	err = json.NewDecoder(res.Body).Decode(&items)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding inventory: %w", err)
+	}
+	return items, nil
+}
+
+func (p *PullReplicator) fetchSegment(ctx context.Context, peer string, item replication.InventoryItem) error {
+	if item.Size <= 0 || item.Size > replication.MAX_SEGMENT_SIZE {
+		return fmt.Errorf("%w: inventory says %d bytes", ErrSegmentSize, item.Size)
+	}
+	u := fmt.Sprintf("%s/api/segment/%s", peer, url.PathEscape(item.ID))
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+	res, err := aqhttp.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return unexpectedResponse(res)
+	}
+	// read no more than they said we'd get, so a broken peer can't run us out
+	// of memory before anything's checked
+	bs, err := io.ReadAll(io.LimitReader(res.Body, item.Size+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(bs)) != item.Size {
+		return fmt.Errorf("%w: expected %d bytes, got %d", ErrSegmentSize, item.Size, len(bs))
+	}
+	// ValidateMP4 checks the signature and that the streamer is allowed, so we
+	// don't have to trust the peer
+	return p.Ingester.ValidateMP4(ctx, bytes.NewReader(bs), model.SegmentSourceReplicated)
+}
+
+// error for a response we weren't expecting, with as much of the body as we're
+// willing to read in case it says why
+func unexpectedResponse(res *http.Response) error {
+	body, err := io.ReadAll(io.LimitReader(res.Body, ERROR_BODY_LIMIT))
+	if err != nil {
+		return fmt.Errorf("unexpected http code %d, error reading body: %w", res.StatusCode, err)
+	}
+	return fmt.Errorf("unexpected http code %d body=%s", res.StatusCode, body)
+}
@@ -0,0 +1,132 @@
+package pull
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"aquareum.tv/aquareum/pkg/aqtime"
+	"aquareum.tv/aquareum/pkg/config"
+	"aquareum.tv/aquareum/pkg/crypto/aqpub"
+	"aquareum.tv/aquareum/pkg/model"
+	"aquareum.tv/aquareum/pkg/replication"
+	"github.com/stretchr/testify/require"
+)
+
+var testUser = "0x6fbe6863cf1efc713899455e526a13239d371175"
+
+// records what it's given instead of checking signatures
+type fakeIngester struct {
+	mod      model.Model
+	ingested []string
+}
+
+func (f *fakeIngester) ValidateMP4(ctx context.Context, input io.Reader, source model.SegmentSource) error {
+	bs, err := io.ReadAll(input)
+	if err != nil {
+		return err
+	}
+	// the fake segment's content is its start time
+	start := aqtime.AQTime(bs)
+	f.ingested = append(f.ingested, string(bs))
+	return f.mod.CreateSegment(&model.Segment{
+		ID:        "pulled-" + string(bs),
+		User:      testUser,
+		StartTime: start,
+		EndTime:   start,
+		Hash:      replication.SegmentHash(bs),
+		Source:    source,
+	})
+}
+
+func TestReconcile(t *testing.T) {
+	now := time.Now()
+	items := []replication.InventoryItem{}
+	for i := 3; i > 0; i-- {
+		start := aqtime.FromMillis(now.Add(-time.Duration(i) * time.Minute).UnixMilli())
+		items = append(items, replication.InventoryItem{
+			ID:        "theirs-" + string(start),
+			User:      testUser,
+			StartTime: start,
+			EndTime:   aqtime.FromMillis(now.Add(-time.Duration(i)*time.Minute + time.Second).UnixMilli()),
+			Hash:      replication.SegmentHash([]byte(start)),
+			Size:      int64(len(start)),
+		})
+	}
+	fetches := 0
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/segments/"+testUser {
+			require.NotEmpty(t, r.URL.Query().Get("start"))
+			json.NewEncoder(w).Encode(items)
+			return
+		}
+		id, ok := strings.CutPrefix(r.URL.Path, "/api/segment/theirs-")
+		require.True(t, ok)
+		fetches += 1
+		w.Write([]byte(id))
+	}))
+	defer peer.Close()
+
+	mod, err := model.MakeDB(":memory:")
+	require.NoError(t, err)
+	// we already have the middle one
+	err = mod.CreateSegment(&model.Segment{
+		ID:        "ours",
+		User:      testUser,
+		StartTime: items[1].StartTime,
+		EndTime:   items[1].EndTime,
+		Hash:      items[1].Hash,
+	})
+	require.NoError(t, err)
+
+	pub, err := aqpub.FromHexString(testUser)
+	require.NoError(t, err)
+	ingester := &fakeIngester{mod: mod}
+	p := &PullReplicator{
+		CLI: &config.CLI{
+			PullPeers:      []string{peer.URL},
+			PullWindow:     time.Hour,
+			AllowedStreams: []aqpub.Pub{pub},
+		},
+		Model:    mod,
+		Ingester: ingester,
+	}
+	p.Reconcile(context.Background())
+	require.Equal(t, []string{string(items[0].StartTime), string(items[2].StartTime)}, ingester.ingested)
+	require.Equal(t, 2, fetches)
+
+	// nothing left to fetch the second time around
+	p.Reconcile(context.Background())
+	require.Equal(t, 2, fetches)
+}
+
+func TestFetchSegmentSize(t *testing.T) {
+	start := aqtime.FromMillis(time.Now().UnixMilli())
+	body := []byte(start)
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer peer.Close()
+	mod, err := model.MakeDB(":memory:")
+	require.NoError(t, err)
+	ingester := &fakeIngester{mod: mod}
+	p := &PullReplicator{CLI: &config.CLI{}, Model: mod, Ingester: ingester}
+	item := replication.InventoryItem{ID: "theirs", User: testUser, StartTime: start, EndTime: start}
+
+	for _, size := range []int64{0, int64(len(body)) - 1, int64(len(body)) + 1, replication.MAX_SEGMENT_SIZE + 1} {
+		item.Size = size
+		err = p.fetchSegment(context.Background(), peer.URL, item)
+		require.ErrorIs(t, err, ErrSegmentSize, "size %d", size)
+	}
+	require.Empty(t, ingester.ingested)
+
+	item.Size = int64(len(body))
+	err = p.fetchSegment(context.Background(), peer.URL, item)
+	require.NoError(t, err)
+	require.Equal(t, []string{string(body)}, ingester.ingested)
+}
@@ -1,7 +1,76 @@
 package replication
 
-import "context"
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"time"
+
+	"aquareum.tv/aquareum/pkg/aqtime"
+	"aquareum.tv/aquareum/pkg/model"
+	v0 "aquareum.tv/aquareum/pkg/schema/v0"
+)
+
+// header carrying a base64-encoded, EIP-712 signed v0.SegmentUpload
+const PEER_AUTH_HEADER = "X-Aquareum-Peer-Auth"
+
+// biggest segment we'll take from a peer. a couple of seconds of video is a
+// few megabytes at most.
+const MAX_SEGMENT_SIZE = 64 * 1024 * 1024
+
+// ie eip712.EIP712Signer
+type MessageSigner interface {
+	SignMessage(something any) ([]byte, error)
+}
+
+// sign a PEER_AUTH_HEADER value vouching for the segment with the provided
+// hash, for a request with the provided method and path
+func PeerAuthHeader(signer MessageSigner, method, path, hash string) (string, error) {
+	bs, err := signer.SignMessage(v0.SegmentUpload{Method: method, Path: path, Hash: hash})
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(bs), nil
+}
 
 type Replicator interface {
-	NewSegment(context.Context, []byte)
+	// queue a newly-stored segment for delivery to our peers
+	NewSegment(ctx context.Context, key string, bs []byte)
+	Stats() ([]PeerStats, error)
+}
+
+// something that can verify and store a segment we got from elsewhere, ie MediaManager
+type Ingester interface {
+	ValidateMP4(ctx context.Context, input io.Reader, source model.SegmentSource) error
+}
+
+// how far behind a peer is
+type PeerStats struct {
+	Peer string `json:"peer"`
+	// segments queued but not yet delivered
+	Pending int64 `json:"pending"`
+	// age of the oldest undelivered segment
+	Lag                 time.Duration `json:"lag"`
+	ConsecutiveFailures int           `json:"consecutiveFailures"`
+	LastError           string        `json:"lastError,omitempty"`
+	LastSuccess         *time.Time    `json:"lastSuccess,omitempty"`
+	RetryAt             *time.Time    `json:"retryAt,omitempty"`
+}
+
+// one entry in a node's segment inventory, as served by /api/segments/:user
+type InventoryItem struct {
+	ID        string        `json:"id"`
+	User      string        `json:"user"`
+	StartTime aqtime.AQTime `json:"startTime"`
+	EndTime   aqtime.AQTime `json:"endTime"`
+	Hash      string        `json:"hash"`
+	Size      int64         `json:"size"`
+}
+
+// hex sha256 of a segment, used to tell whether two nodes have the same one
+func SegmentHash(bs []byte) string {
+	sum := sha256.Sum256(bs)
+	return hex.EncodeToString(sum[:])
 }
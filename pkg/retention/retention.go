@@ -0,0 +1,138 @@
+package retention
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"aquareum.tv/aquareum/pkg/aqtime"
+	"aquareum.tv/aquareum/pkg/config"
+	"aquareum.tv/aquareum/pkg/log"
+	"aquareum.tv/aquareum/pkg/model"
+	"aquareum.tv/aquareum/pkg/storage"
+)
+
+// how many segments to consider at once when evicting for space
+const EVICTION_BATCH = 100
+
+// anything that has transient stream output to clean up, eg HLS temp dirs
+type StreamCleaner interface {
+	CleanupHLS(ctx context.Context)
+}
+
+// deletes old segments according to the retention flags in config.CLI
+type Retention struct {
+	CLI     *config.CLI
+	Model   model.Model
+	Store   storage.SegmentStore
+	Cleaner StreamCleaner
+}
+
+// retention-interval is checked when flags are parsed, since an error here
+// would take the whole node down
+func (r *Retention) Run(ctx context.Context) error {
+	ticker := time.NewTicker(r.CLI.RetentionInterval)
+	defer ticker.Stop()
+	for {
+		err := r.Sweep(ctx)
+		if err != nil {
+			log.Error(ctx, "error enforcing segment retention", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// enforce max age, then max bytes, then clean up ended streams. each step runs
+// even if the one before it failed.
+func (r *Retention) Sweep(ctx context.Context) error {
+	expireErr := r.expireSegments(ctx)
+	evictErr := r.evictSegments(ctx)
+	if r.Cleaner != nil {
+		r.Cleaner.CleanupHLS(ctx)
+	}
+	return errors.Join(expireErr, evictErr)
+}
+
+func (r *Retention) maxAge(user string) time.Duration {
+	age, ok := r.CLI.SegmentMaxAgeByUser[user]
+	if ok {
+		return age
+	}
+	return r.CLI.SegmentMaxAge
+}
+
+func (r *Retention) expireSegments(ctx context.Context) error {
+	users, err := r.Model.ListSegmentUsers()
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		age := r.maxAge(user)
+		if age <= 0 {
+			continue
+		}
+		before := aqtime.FromMillis(time.Now().Add(-age).UnixMilli())
+		segs, err := r.Model.ListSegmentsEndingBefore(user, before)
+		if err != nil {
+			return err
+		}
+		for _, seg := range segs {
+			err := r.deleteSegment(ctx, seg)
+			if err != nil {
+				return err
+			}
+		}
+		if len(segs) > 0 {
+			log.Log(ctx, "expired old segments", "user", user, "count", len(segs), "maxAge", age)
+		}
+	}
+	return nil
+}
+
+func (r *Retention) evictSegments(ctx context.Context) error {
+	if r.CLI.SegmentMaxBytes <= 0 {
+		return nil
+	}
+	total, err := r.Model.TotalSegmentSize()
+	if err != nil {
+		return err
+	}
+	count := 0
+	for total > r.CLI.SegmentMaxBytes {
+		segs, err := r.Model.ListSegmentsByLastAccessed(EVICTION_BATCH)
+		if err != nil {
+			return err
+		}
+		if len(segs) == 0 {
+			break
+		}
+		for _, seg := range segs {
+			err := r.deleteSegment(ctx, seg)
+			if err != nil {
+				return err
+			}
+			total -= seg.Size
+			count += 1
+			if total <= r.CLI.SegmentMaxBytes {
+				break
+			}
+		}
+	}
+	if count > 0 {
+		log.Log(ctx, "evicted least recently used segments", "count", count, "totalBytes", total, "maxBytes", r.CLI.SegmentMaxBytes)
+	}
+	return nil
+}
+
+func (r *Retention) deleteSegment(ctx context.Context, seg model.Segment) error {
+	err := r.Store.Delete(ctx, seg.Path)
+	if err != nil {
+		return fmt.Errorf("error removing segment %s: %w", seg.Path, err)
+	}
+	return r.Model.DeleteSegment(seg.ID)
+}
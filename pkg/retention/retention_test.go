@@ -0,0 +1,131 @@
+package retention
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path"
+	"testing"
+	"time"
+
+	"aquareum.tv/aquareum/pkg/aqtime"
+	"aquareum.tv/aquareum/pkg/config"
+	ct "aquareum.tv/aquareum/pkg/config/configtesting"
+	"aquareum.tv/aquareum/pkg/model"
+	"aquareum.tv/aquareum/pkg/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func writeSegment(t *testing.T, store storage.SegmentStore, mod model.Model, user string, start time.Time, size int) model.Segment {
+	aqt := aqtime.FromMillis(start.UnixMilli())
+	key := storage.SegmentKey(user, aqt)
+	err := store.Put(context.Background(), key, bytes.NewReader(make([]byte, size)), int64(size))
+	require.NoError(t, err)
+	seg := model.Segment{
+		ID:           aqt.String() + user,
+		User:         user,
+		StartTime:    aqt,
+		EndTime:      aqtime.FromMillis(start.Add(time.Second).UnixMilli()),
+		Size:         int64(size),
+		Path:         key,
+		LastAccessed: start,
+	}
+	err = mod.CreateSegment(&seg)
+	require.NoError(t, err)
+	return seg
+}
+
+func segmentExists(t *testing.T, store storage.SegmentStore, seg model.Segment) bool {
+	r, err := store.Get(context.Background(), seg.Path)
+	if errors.Is(err, storage.ErrNotFound) {
+		return false
+	}
+	require.NoError(t, err)
+	r.Close()
+	return true
+}
+
+func TestMaxAge(t *testing.T) {
+	cli := ct.CLI(t, &config.CLI{
+		SegmentMaxAge:       time.Hour,
+		SegmentMaxAgeByUser: map[string]time.Duration{"0xbob": 48 * time.Hour},
+	})
+	mod, err := model.MakeDB(":memory:")
+	require.NoError(t, err)
+	store := &storage.LocalStore{Root: t.TempDir()}
+	now := time.Now()
+	oldAlice := writeSegment(t, store, mod, "0xalice", now.Add(-2*time.Hour), 10)
+	newAlice := writeSegment(t, store, mod, "0xalice", now.Add(-time.Minute), 10)
+	oldBob := writeSegment(t, store, mod, "0xbob", now.Add(-2*time.Hour), 10)
+
+	r := &Retention{CLI: cli, Model: mod, Store: store}
+	err = r.Sweep(context.Background())
+	require.NoError(t, err)
+
+	require.False(t, segmentExists(t, store, oldAlice))
+	require.True(t, segmentExists(t, store, newAlice))
+	require.True(t, segmentExists(t, store, oldBob))
+
+	segs, err := mod.ListSegments("0xalice", aqtime.FromMillis(0), aqtime.FromMillis(now.UnixMilli()))
+	require.NoError(t, err)
+	require.Len(t, segs, 1)
+	require.Equal(t, newAlice.ID, segs[0].ID)
+}
+
+func TestMaxBytes(t *testing.T) {
+	cli := ct.CLI(t, &config.CLI{SegmentMaxBytes: 25})
+	mod, err := model.MakeDB(":memory:")
+	require.NoError(t, err)
+	store := &storage.LocalStore{Root: t.TempDir()}
+	now := time.Now()
+	first := writeSegment(t, store, mod, "0xalice", now.Add(-3*time.Minute), 10)
+	second := writeSegment(t, store, mod, "0xalice", now.Add(-2*time.Minute), 10)
+	third := writeSegment(t, store, mod, "0xalice", now.Add(-1*time.Minute), 10)
+	// reading the first segment makes the second one the eviction candidate.
+	// readers only have the filename to go on, same as the playback route.
+	_, aqt, err := storage.SegmentFileKey("0xalice", path.Base(first.Path))
+	require.NoError(t, err)
+	err = mod.TouchSegment("0xalice", aqt)
+	require.NoError(t, err)
+
+	r := &Retention{CLI: cli, Model: mod, Store: store}
+	err = r.Sweep(context.Background())
+	require.NoError(t, err)
+
+	total, err := mod.TotalSegmentSize()
+	require.NoError(t, err)
+	require.Equal(t, int64(20), total)
+	require.False(t, segmentExists(t, store, second))
+	require.True(t, segmentExists(t, store, first))
+	require.True(t, segmentExists(t, store, third))
+}
+
+type failingStore struct {
+	storage.LocalStore
+}
+
+func (s *failingStore) Delete(ctx context.Context, key string) error {
+	return errors.New("delete failed")
+}
+
+type countingCleaner struct {
+	calls int
+}
+
+func (c *countingCleaner) CleanupHLS(ctx context.Context) {
+	c.calls += 1
+}
+
+func TestSweepCleansUpAfterErrors(t *testing.T) {
+	cli := ct.CLI(t, &config.CLI{SegmentMaxAge: time.Hour})
+	mod, err := model.MakeDB(":memory:")
+	require.NoError(t, err)
+	store := &failingStore{storage.LocalStore{Root: t.TempDir()}}
+	writeSegment(t, store, mod, "0xalice", time.Now().Add(-2*time.Hour), 10)
+
+	cleaner := &countingCleaner{}
+	r := &Retention{CLI: cli, Model: mod, Store: store, Cleaner: cleaner}
+	err = r.Sweep(context.Background())
+	require.Error(t, err)
+	require.Equal(t, 1, cleaner.calls)
+}
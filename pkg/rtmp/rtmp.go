@@ -0,0 +1,190 @@
+package rtmp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"aquareum.tv/aquareum/pkg/log"
+	"github.com/yutopp/go-flv"
+	flvtag "github.com/yutopp/go-flv/tag"
+	gortmp "github.com/yutopp/go-rtmp"
+	rtmpmsg "github.com/yutopp/go-rtmp/message"
+)
+
+// consumes an incoming stream, remuxed to FLV, until it ends
+type IngestFunc func(ctx context.Context, flv io.Reader) error
+
+// RTMP listener for OBS and friends. publishers put their stream key in the
+// URL, eg rtmp://aquareum.example/live/<key>.
+type Server struct {
+	Addr string
+	// checks a stream key, returning what should consume the stream. an error
+	// rejects the publish.
+	OnPublish func(ctx context.Context, key string) (IngestFunc, error)
+}
+
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	ln, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ctx, ln)
+}
+
+func (s *Server) Serve(ctx context.Context, ln net.Listener) error {
+	log.Log(ctx, "rtmp server starting", "addr", ln.Addr().String())
+	srv := gortmp.NewServer(&gortmp.ServerConfig{
+		OnConnect: func(conn net.Conn) (io.ReadWriteCloser, *gortmp.ConnConfig) {
+			ctx := log.WithLogValues(ctx, "remote", conn.RemoteAddr().String())
+			return conn, &gortmp.ConnConfig{
+				Handler: &handler{ctx: ctx, server: s},
+				ControlState: gortmp.StreamControlStateConfig{
+					DefaultBandwidthWindowSize: 6 * 1024 * 1024 / 8,
+				},
+			}
+		},
+	})
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	err := srv.Serve(ln)
+	if errors.Is(err, gortmp.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// the stream key, minus anything OBS or the user tacked on the end
+func streamKey(publishingName string) string {
+	key, _, _ := strings.Cut(publishingName, "?")
+	return key
+}
+
+// one RTMP connection. audio and video tags are written as FLV to a pipe that
+// the IngestFunc reads from.
+type handler struct {
+	gortmp.DefaultHandler
+	ctx    context.Context
+	server *Server
+	conn   *gortmp.Conn
+	pw     *io.PipeWriter
+	enc    *flv.Encoder
+}
+
+func (h *handler) OnServe(conn *gortmp.Conn) {
+	h.conn = conn
+}
+
+func (h *handler) OnPublish(_ *gortmp.StreamContext, timestamp uint32, cmd *rtmpmsg.NetStreamPublish) error {
+	if h.pw != nil {
+		return fmt.Errorf("already publishing on this connection")
+	}
+	key := streamKey(cmd.PublishingName)
+	if key == "" {
+		return fmt.Errorf("stream key required")
+	}
+	ingest, err := h.server.OnPublish(h.ctx, key)
+	if err != nil {
+		log.Log(h.ctx, "rejecting rtmp publish", "error", err)
+		return err
+	}
+	pr, pw := io.Pipe()
+	ctx, cancel := context.WithCancel(h.ctx)
+	// the pipe is unbuffered, so start reading before the encoder writes the header
+	go func() {
+		defer cancel()
+		log.Log(ctx, "rtmp stream start")
+		err := ingest(ctx, pr)
+		if err != nil {
+			log.Log(ctx, "rtmp stream error", "error", err)
+		} else {
+			log.Log(ctx, "rtmp stream success")
+		}
+		// unblock any pending writes and hang up on the publisher
+		pr.CloseWithError(io.ErrClosedPipe)
+		h.conn.Close()
+	}()
+	enc, err := flv.NewEncoder(pw, flv.FlagsAudio|flv.FlagsVideo)
+	if err != nil {
+		pw.CloseWithError(err)
+		return err
+	}
+	h.pw = pw
+	h.enc = enc
+	return nil
+}
+
+func (h *handler) OnSetDataFrame(timestamp uint32, data *rtmpmsg.NetStreamSetDataFrame) error {
+	if h.enc == nil {
+		return nil
+	}
+	var script flvtag.ScriptData
+	err := flvtag.DecodeScriptData(bytes.NewReader(data.Payload), &script)
+	if err != nil {
+		// just metadata, not worth dropping the stream over
+		log.Debug(h.ctx, "error decoding rtmp script data", "error", err)
+		return nil
+	}
+	return h.enc.Encode(&flvtag.FlvTag{
+		TagType:   flvtag.TagTypeScriptData,
+		Timestamp: timestamp,
+		Data:      &script,
+	})
+}
+
+func (h *handler) OnAudio(timestamp uint32, payload io.Reader) error {
+	if h.enc == nil {
+		return fmt.Errorf("got audio before publish")
+	}
+	var audio flvtag.AudioData
+	err := flvtag.DecodeAudioData(payload, &audio)
+	if err != nil {
+		return err
+	}
+	body := new(bytes.Buffer)
+	_, err = io.Copy(body, audio.Data)
+	if err != nil {
+		return err
+	}
+	audio.Data = body
+	return h.enc.Encode(&flvtag.FlvTag{
+		TagType:   flvtag.TagTypeAudio,
+		Timestamp: timestamp,
+		Data:      &audio,
+	})
+}
+
+func (h *handler) OnVideo(timestamp uint32, payload io.Reader) error {
+	if h.enc == nil {
+		return fmt.Errorf("got video before publish")
+	}
+	var video flvtag.VideoData
+	err := flvtag.DecodeVideoData(payload, &video)
+	if err != nil {
+		return err
+	}
+	body := new(bytes.Buffer)
+	_, err = io.Copy(body, video.Data)
+	if err != nil {
+		return err
+	}
+	video.Data = body
+	return h.enc.Encode(&flvtag.FlvTag{
+		TagType:   flvtag.TagTypeVideo,
+		Timestamp: timestamp,
+		Data:      &video,
+	})
+}
+
+func (h *handler) OnClose() {
+	if h.pw != nil {
+		// EOF lets the pipeline flush the last segment
+		h.pw.Close()
+	}
+}
@@ -0,0 +1,95 @@
+package rtmp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	gortmp "github.com/yutopp/go-rtmp"
+	rtmpmsg "github.com/yutopp/go-rtmp/message"
+)
+
+func startServer(t *testing.T, onPublish func(ctx context.Context, key string) (IngestFunc, error)) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Server{OnPublish: onPublish}
+	done := make(chan error)
+	go func() {
+		done <- s.Serve(ctx, ln)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		require.NoError(t, <-done)
+	})
+	return ln.Addr().String()
+}
+
+func publish(t *testing.T, addr, name string) (*gortmp.ClientConn, *gortmp.Stream) {
+	client, err := gortmp.Dial("rtmp", addr, &gortmp.ConnConfig{})
+	require.NoError(t, err)
+	require.NoError(t, client.Connect(nil))
+	stream, err := client.CreateStream(nil, 128)
+	require.NoError(t, err)
+	err = stream.Publish(&rtmpmsg.NetStreamPublish{PublishingName: name, PublishingType: "live"})
+	require.NoError(t, err)
+	return client, stream
+}
+
+func TestRTMPIngest(t *testing.T) {
+	type result struct {
+		key string
+		flv []byte
+	}
+	results := make(chan result, 1)
+	addr := startServer(t, func(ctx context.Context, key string) (IngestFunc, error) {
+		return func(ctx context.Context, flv io.Reader) error {
+			bs, err := io.ReadAll(flv)
+			results <- result{key: key, flv: bs}
+			return err
+		}, nil
+	})
+
+	client, stream := publish(t, addr, "my-stream-key?bandwidthtest=true")
+	// keyframe, AVC NALU, zero composition time
+	video := append([]byte{0x17, 0x01, 0x00, 0x00, 0x00}, []byte("pretend h264")...)
+	err := stream.Write(6, 0, &rtmpmsg.VideoMessage{Payload: bytes.NewReader(video)})
+	require.NoError(t, err)
+	// AAC 44.1kHz 16-bit stereo, raw frame
+	audio := append([]byte{0xaf, 0x01}, []byte("pretend aac")...)
+	err = stream.Write(4, 10, &rtmpmsg.AudioMessage{Payload: bytes.NewReader(audio)})
+	require.NoError(t, err)
+	client.Close()
+
+	select {
+	case res := <-results:
+		require.Equal(t, "my-stream-key", res.key)
+		require.True(t, bytes.HasPrefix(res.flv, []byte("FLV")), "should be an flv stream")
+		require.Contains(t, string(res.flv), "pretend h264")
+		require.Contains(t, string(res.flv), "pretend aac")
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for ingest")
+	}
+}
+
+func TestRTMPRejectedKey(t *testing.T) {
+	keys := make(chan string, 1)
+	addr := startServer(t, func(ctx context.Context, key string) (IngestFunc, error) {
+		keys <- key
+		return nil, fmt.Errorf("bad key %s", key)
+	})
+
+	client, stream := publish(t, addr, "bad-key")
+	defer client.Close()
+	// the server hangs up, so writes start failing
+	require.Eventually(t, func() bool {
+		err := stream.Write(6, 0, &rtmpmsg.VideoMessage{Payload: bytes.NewReader([]byte{0x17, 0x01, 0x00, 0x00, 0x00})})
+		return err != nil
+	}, 5*time.Second, 50*time.Millisecond)
+	require.Equal(t, "bad-key", <-keys)
+}
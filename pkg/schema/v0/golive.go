@@ -6,18 +6,42 @@ var Name = "Aquareum"
 var Version = "0.0.1"
 
 type V0Schema struct {
-	GoLive    GoLive
-	StreamKey StreamKey
+	GoLive              GoLive
+	StreamKey           StreamKey
+	SegmentUpload       SegmentUpload
+	AllowedStreamUpdate AllowedStreamUpdate
 }
 type GoLive struct {
 	Streamer string `json:"streamer"`
 	Title    string `json:"title"`
 }
 
+// a user letting a node stream on their behalf
 type StreamKey struct {
+	// media signing address of the node that may sign segments for the user
 	Authorized string `json:"authorized"`
 }
 
+// a node vouching for a segment it's pushing to a peer. the request it's for is
+// part of what's signed so the header can't be replayed against another
+// endpoint, and the message time bounds how long it can be replayed at all.
+type SegmentUpload struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	// hex sha256 of the segment
+	Hash string `json:"hash"`
+}
+
+const ALLOWED_STREAM_ADD = "add"
+const ALLOWED_STREAM_REMOVE = "remove"
+
+// an admin adding or removing a streamer that nodes will accept segments from
+type AllowedStreamUpdate struct {
+	Address string `json:"address"`
+	// ALLOWED_STREAM_ADD or ALLOWED_STREAM_REMOVE
+	Action string `json:"action"`
+}
+
 func MakeV0Schema() (schema.Schema, error) {
 	return schema.MakeSchema(Name, Version, V0Schema{})
 }
@@ -0,0 +1,129 @@
+package srt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"aquareum.tv/aquareum/pkg/log"
+	gosrt "github.com/datarhei/gosrt"
+)
+
+// consumes an incoming MPEG-TS stream until it ends
+type IngestFunc func(ctx context.Context, ts io.Reader) error
+
+// SRT listener for contribution over lossy networks. publishers put their
+// stream key in the streamid, either bare or as the resource of the SRT
+// access control syntax, eg #!::r=<key>,m=publish
+type Server struct {
+	Addr string
+	// checks a stream key, returning what should consume the stream. an error
+	// rejects the connection.
+	OnPublish func(ctx context.Context, key string) (IngestFunc, error)
+}
+
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	ln, err := gosrt.Listen("srt", s.Addr, gosrt.DefaultConfig())
+	if err != nil {
+		return err
+	}
+	return s.Serve(ctx, ln)
+}
+
+func (s *Server) Serve(ctx context.Context, ln gosrt.Listener) error {
+	log.Log(ctx, "srt server starting", "addr", ln.Addr().String())
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	for {
+		req, err := ln.Accept2()
+		if errors.Is(err, gosrt.ErrListenerClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// OnPublish can be slow (database, etc) and one publisher mustn't hold
+		// up everyone else's handshakes
+		go s.handleRequest(ctx, req)
+	}
+}
+
+func (s *Server) handleRequest(ctx context.Context, req gosrt.ConnRequest) {
+	ctx = log.WithLogValues(ctx, "remote", req.RemoteAddr().String())
+	key, err := streamKey(req.StreamId())
+	if err != nil {
+		log.Log(ctx, "rejecting srt connection", "error", err)
+		req.Reject(gosrt.REJX_BAD_REQUEST)
+		return
+	}
+	if req.IsEncrypted() {
+		log.Log(ctx, "rejecting encrypted srt connection, we don't have a passphrase")
+		req.Reject(gosrt.REJ_UNSECURE)
+		return
+	}
+	ingest, err := s.OnPublish(ctx, key)
+	if err != nil {
+		log.Log(ctx, "rejecting srt publish", "error", err)
+		req.Reject(gosrt.REJX_UNAUTHORIZED)
+		return
+	}
+	conn, err := req.Accept()
+	if err != nil {
+		log.Log(ctx, "error accepting srt connection", "error", err)
+		return
+	}
+	defer conn.Close()
+	log.Log(ctx, "srt stream start")
+	err = ingest(ctx, &eofReader{ctx: ctx, r: conn})
+	if err != nil {
+		log.Log(ctx, "srt stream error", "error", err)
+		return
+	}
+	log.Log(ctx, "srt stream success")
+}
+
+// pull the stream key out of a streamid. we only take publishers.
+func streamKey(streamid string) (string, error) {
+	if !strings.HasPrefix(streamid, "#!::") {
+		if streamid == "" {
+			return "", fmt.Errorf("streamid required")
+		}
+		return streamid, nil
+	}
+	var key string
+	for _, pair := range strings.Split(strings.TrimPrefix(streamid, "#!::"), ",") {
+		k, v, _ := strings.Cut(pair, "=")
+		switch k {
+		case "r":
+			key = v
+		case "m":
+			if v != "publish" {
+				return "", fmt.Errorf("unsupported mode m=%s", v)
+			}
+		}
+	}
+	if key == "" {
+		return "", fmt.Errorf("streamid has no r= resource")
+	}
+	return key, nil
+}
+
+// a publisher dropping off (timeout, shutdown, etc) is the normal way for an
+// SRT stream to end, so the pipeline should see it as EOF and flush
+type eofReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (e *eofReader) Read(bs []byte) (int, error) {
+	n, err := e.r.Read(bs)
+	if err != nil && !errors.Is(err, io.EOF) {
+		log.Debug(e.ctx, "srt connection ended", "error", err)
+		return n, io.EOF
+	}
+	return n, err
+}
@@ -0,0 +1,152 @@
+package srt
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	gosrt "github.com/datarhei/gosrt"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamKey(t *testing.T) {
+	tests := []struct {
+		streamid string
+		key      string
+		err      bool
+	}{
+		{streamid: "my-key", key: "my-key"},
+		{streamid: "#!::r=my-key,m=publish", key: "my-key"},
+		{streamid: "#!::m=publish,r=my-key", key: "my-key"},
+		{streamid: "#!::r=my-key", key: "my-key"},
+		{streamid: "#!::r=my-key,m=request", err: true},
+		{streamid: "#!::m=publish", err: true},
+		{streamid: "", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.streamid, func(t *testing.T) {
+			key, err := streamKey(tt.streamid)
+			if tt.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.key, key)
+		})
+	}
+}
+
+func startServer(t *testing.T, onPublish func(ctx context.Context, key string) (IngestFunc, error)) string {
+	ln, err := gosrt.Listen("srt", "127.0.0.1:0", gosrt.DefaultConfig())
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Server{OnPublish: onPublish}
+	done := make(chan error)
+	go func() {
+		done <- s.Serve(ctx, ln)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		require.NoError(t, <-done)
+	})
+	return ln.Addr().String()
+}
+
+func dial(addr, streamid string) (gosrt.Conn, error) {
+	config := gosrt.DefaultConfig()
+	config.StreamId = streamid
+	return gosrt.Dial("srt", addr, config)
+}
+
+func TestSRTIngest(t *testing.T) {
+	type result struct {
+		key string
+		ts  []byte
+	}
+	// a few MPEG-TS packets worth of data
+	payload := bytes.Repeat([]byte{0x47}, 188*7)
+	results := make(chan result, 1)
+	ended := make(chan error, 1)
+	addr := startServer(t, func(ctx context.Context, key string) (IngestFunc, error) {
+		return func(ctx context.Context, ts io.Reader) error {
+			bs := make([]byte, len(payload))
+			_, err := io.ReadFull(ts, bs)
+			results <- result{key: key, ts: bs}
+			if err != nil {
+				return err
+			}
+			// then hanging up should look like the end of the stream
+			_, err = io.Copy(io.Discard, ts)
+			ended <- err
+			return err
+		}, nil
+	})
+
+	conn, err := dial(addr, "#!::r=my-stream-key,m=publish")
+	require.NoError(t, err)
+	_, err = conn.Write(payload)
+	require.NoError(t, err)
+
+	select {
+	case res := <-results:
+		require.Equal(t, "my-stream-key", res.key)
+		require.Equal(t, payload, res.ts)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for ingest")
+	}
+	conn.Close()
+	select {
+	case err := <-ended:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the stream to end")
+	}
+}
+
+func TestSRTSlowPublish(t *testing.T) {
+	release := make(chan struct{})
+	addr := startServer(t, func(ctx context.Context, key string) (IngestFunc, error) {
+		if key == "slow-key" {
+			<-release
+		}
+		return func(ctx context.Context, ts io.Reader) error {
+			_, err := io.Copy(io.Discard, ts)
+			return err
+		}, nil
+	})
+	defer close(release)
+
+	slow := make(chan error, 1)
+	go func() {
+		conn, err := dial(addr, "slow-key")
+		if err == nil {
+			conn.Close()
+		}
+		slow <- err
+	}()
+	// the slow publisher is still stuck in OnPublish, which shouldn't stop
+	// this one getting through
+	conn, err := dial(addr, "fast-key")
+	require.NoError(t, err)
+	conn.Close()
+	select {
+	case err := <-slow:
+		t.Fatalf("slow publish finished first: %v", err)
+	default:
+	}
+}
+
+func TestSRTRejectedKey(t *testing.T) {
+	keys := make(chan string, 1)
+	addr := startServer(t, func(ctx context.Context, key string) (IngestFunc, error) {
+		keys <- key
+		return nil, fmt.Errorf("bad key %s", key)
+	})
+
+	_, err := dial(addr, "bad-key")
+	require.Error(t, err)
+	require.Equal(t, "bad-key", <-keys)
+}
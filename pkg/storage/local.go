@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// SegmentStore backed by a directory on local disk
+type LocalStore struct {
+	Root string
+}
+
+func (s *LocalStore) path(key string) (string, error) {
+	if !fs.ValidPath(key) {
+		return "", fmt.Errorf("invalid segment key: %s", key)
+	}
+	return filepath.Join(s.Root, filepath.FromSlash(key)), nil
+}
+
+func (s *LocalStore) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	fpath, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(fpath), os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("error creating subdirectories for %s: %w", fpath, err)
+	}
+	fd, err := os.OpenFile(fpath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("%w: %s", ErrExists, key)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fd, r)
+	if err != nil {
+		fd.Close()
+		os.Remove(fpath)
+		return err
+	}
+	return fd.Close()
+}
+
+func (s *LocalStore) Get(ctx context.Context, key string) (io.ReadSeekCloser, error) {
+	fpath, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := os.Open(fpath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return fd, nil
+}
+
+func (s *LocalStore) Stat(ctx context.Context, key string) (int64, error) {
+	fpath, err := s.path(key)
+	if err != nil {
+		return 0, err
+	}
+	info, err := os.Stat(fpath)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (s *LocalStore) List(ctx context.Context, prefix string) ([]string, error) {
+	keys := []string{}
+	// only walk the deepest directory that could contain the prefix
+	dir := prefix
+	if !strings.HasSuffix(dir, "/") {
+		dir = path.Dir(dir)
+	}
+	dir = strings.TrimSuffix(dir, "/")
+	if dir == "" {
+		dir = "."
+	}
+	start, err := s.path(dir)
+	if err != nil {
+		return nil, err
+	}
+	err = filepath.WalkDir(start, func(fpath string, d fs.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(s.Root, fpath)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (s *LocalStore) Delete(ctx context.Context, key string) error {
+	fpath, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(fpath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	s.removeEmptyDirs(filepath.Dir(fpath))
+	return nil
+}
+
+// walk up from dir removing empty directories, stopping at the root
+func (s *LocalStore) removeEmptyDirs(dir string) {
+	for {
+		rel, err := filepath.Rel(s.Root, dir)
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			return
+		}
+		// fails if the directory isn't empty, which is our cue to stop
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+type S3StoreOptions struct {
+	// host:port, or a full http(s):// URL
+	Endpoint        string
+	Bucket          string
+	Prefix          string
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+	Insecure        bool
+}
+
+// SegmentStore backed by any S3-compatible object storage
+type S3Store struct {
+	Client *minio.Client
+	Bucket string
+	Prefix string
+}
+
+func MakeS3Store(ctx context.Context, opts *S3StoreOptions) (*S3Store, error) {
+	if opts.Endpoint == "" {
+		return nil, fmt.Errorf("s3-endpoint is required for s3 segment storage")
+	}
+	if opts.Bucket == "" {
+		return nil, fmt.Errorf("s3-bucket is required for s3 segment storage")
+	}
+	endpoint := opts.Endpoint
+	secure := !opts.Insecure
+	if strings.Contains(endpoint, "://") {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing s3-endpoint: %w", err)
+		}
+		endpoint = u.Host
+		secure = u.Scheme == "https"
+	}
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(opts.AccessKeyID, opts.SecretAccessKey, ""),
+		Secure: secure,
+		Region: opts.Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating s3 client: %w", err)
+	}
+	return &S3Store{
+		Client: client,
+		Bucket: opts.Bucket,
+		Prefix: strings.Trim(opts.Prefix, "/"),
+	}, nil
+}
+
+func (s *S3Store) objectName(key string) string {
+	if s.Prefix == "" {
+		return key
+	}
+	return path.Join(s.Prefix, key)
+}
+
+func isNotFound(err error) bool {
+	code := minio.ToErrorResponse(err).Code
+	return code == "NoSuchKey" || code == "NotFound"
+}
+
+func (s *S3Store) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	name := s.objectName(key)
+	// S3 has no create-only PUT, so this is best effort
+	_, err := s.Client.StatObject(ctx, s.Bucket, name, minio.StatObjectOptions{})
+	if err == nil {
+		return fmt.Errorf("%w: %s", ErrExists, key)
+	}
+	if !isNotFound(err) {
+		return err
+	}
+	_, err = s.Client.PutObject(ctx, s.Bucket, name, r, size, minio.PutObjectOptions{
+		ContentType: "video/mp4",
+	})
+	return err
+}
+
+func (s *S3Store) Get(ctx context.Context, key string) (io.ReadSeekCloser, error) {
+	obj, err := s.Client.GetObject(ctx, s.Bucket, s.objectName(key), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// GetObject is lazy; stat to find out whether the object actually exists
+	_, err = obj.Stat()
+	if err != nil {
+		obj.Close()
+		if isNotFound(err) {
+			return nil, fmt.Errorf("%w: %s", ErrNotFound, key)
+		}
+		return nil, err
+	}
+	return obj, nil
+}
+
+func (s *S3Store) Stat(ctx context.Context, key string) (int64, error) {
+	info, err := s.Client.StatObject(ctx, s.Bucket, s.objectName(key), minio.StatObjectOptions{})
+	if isNotFound(err) {
+		return 0, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.Size, nil
+}
+
+func (s *S3Store) List(ctx context.Context, prefix string) ([]string, error) {
+	keys := []string{}
+	// not path.Join, which would eat trailing slashes that are significant in a prefix
+	full := prefix
+	if s.Prefix != "" {
+		full = s.Prefix + "/" + prefix
+	}
+	for obj := range s.Client.ListObjects(ctx, s.Bucket, minio.ListObjectsOptions{Prefix: full, Recursive: true}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		key := obj.Key
+		if s.Prefix != "" {
+			key = strings.TrimPrefix(key, s.Prefix+"/")
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	return s.Client.RemoveObject(ctx, s.Bucket, s.objectName(key), minio.RemoveObjectOptions{})
+}
@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"aquareum.tv/aquareum/pkg/aqtime"
+	"aquareum.tv/aquareum/pkg/config"
+)
+
+const STORE_LOCAL = "local"
+const STORE_S3 = "s3"
+
+var ErrNotFound = errors.New("segment not found")
+var ErrExists = errors.New("segment already exists")
+
+// somewhere to keep segment files. keys are slash-separated paths like
+// 0xabc.../2024/09/13/18/10/2024-09-13T18-10-17-090Z.mp4
+type SegmentStore interface {
+	// store a new segment, returning ErrExists rather than overwriting
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	// fetch a segment, returning ErrNotFound if it's not there. don't forget to close it!
+	Get(ctx context.Context, key string) (io.ReadSeekCloser, error)
+	// size of a segment, returning ErrNotFound if it's not there
+	Stat(ctx context.Context, key string) (int64, error)
+	// all keys starting with the provided prefix
+	List(ctx context.Context, prefix string) ([]string, error)
+	// remove a segment. deleting something that's not there is not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+func MakeSegmentStore(ctx context.Context, cli *config.CLI) (SegmentStore, error) {
+	switch cli.SegmentStore {
+	case "", STORE_LOCAL:
+		return &LocalStore{Root: filepath.Join(cli.DataDir, config.SEGMENTS_DIR)}, nil
+	case STORE_S3:
+		return MakeS3Store(ctx, &S3StoreOptions{
+			Endpoint:        cli.S3Endpoint,
+			Bucket:          cli.S3Bucket,
+			Prefix:          cli.S3Prefix,
+			Region:          cli.S3Region,
+			AccessKeyID:     cli.S3AccessKeyID,
+			SecretAccessKey: cli.S3SecretAccessKey,
+			Insecure:        cli.S3Insecure,
+		})
+	default:
+		return nil, fmt.Errorf("unknown segment-store '%s', expected one of [%s, %s]", cli.SegmentStore, STORE_LOCAL, STORE_S3)
+	}
+}
+
+// key for a user's segment starting at the provided time
+func SegmentKey(user string, aqt aqtime.AQTime) string {
+	fname := fmt.Sprintf("%s.mp4", aqt.FileSafeString())
+	yr, mon, day, hr, min, _, _ := aqt.Parts()
+	return path.Join(user, yr, mon, day, hr, min, fname)
+}
+
+// parse a segment filename like 2024-09-13T18-10-17-090Z.mp4 into its key and start time
+func SegmentFileKey(user, file string) (string, aqtime.AQTime, error) {
+	ext := path.Ext(file)
+	if ext != ".mp4" {
+		return "", "", fmt.Errorf("expected mp4 ext, got %s", ext)
+	}
+	aqt, err := aqtime.FromString(strings.TrimSuffix(file, ext))
+	if err != nil {
+		return "", "", err
+	}
+	// back to the canonical form that's in the database
+	yr, mon, day, hr, min, sec, ms := aqt.Parts()
+	aqt = aqtime.AQTime(fmt.Sprintf("%s-%s-%sT%s:%s:%s.%sZ", yr, mon, day, hr, min, sec, ms))
+	return SegmentKey(user, aqt), aqt, nil
+}
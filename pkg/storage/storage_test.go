@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"aquareum.tv/aquareum/pkg/aqtime"
+	"aquareum.tv/aquareum/pkg/storage/storagetesting"
+	"github.com/stretchr/testify/require"
+)
+
+func testStore(t *testing.T, store SegmentStore) {
+	ctx := context.Background()
+	key := SegmentKey("0xalice", aqtime.FromMillis(1726251017090))
+	require.Equal(t, "0xalice/2024/09/13/18/10/2024-09-13T18-10-17-090Z.mp4", key)
+	other := SegmentKey("0xbob", aqtime.FromMillis(1726251017090))
+	content := []byte("not really an mp4")
+
+	_, err := store.Get(ctx, key)
+	require.ErrorIs(t, err, ErrNotFound)
+	_, err = store.Stat(ctx, key)
+	require.ErrorIs(t, err, ErrNotFound)
+
+	err = store.Put(ctx, key, bytes.NewReader(content), int64(len(content)))
+	require.NoError(t, err)
+	err = store.Put(ctx, key, bytes.NewReader(content), int64(len(content)))
+	require.ErrorIs(t, err, ErrExists)
+	err = store.Put(ctx, other, bytes.NewReader(content), int64(len(content)))
+	require.NoError(t, err)
+
+	r, err := store.Get(ctx, key)
+	require.NoError(t, err)
+	bs, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, content, bs)
+	r.Close()
+	size, err := store.Stat(ctx, key)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(content)), size)
+
+	keys, err := store.List(ctx, "0xalice/")
+	require.NoError(t, err)
+	require.Equal(t, []string{key}, keys)
+	keys, err = store.List(ctx, "")
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+
+	err = store.Delete(ctx, key)
+	require.NoError(t, err)
+	err = store.Delete(ctx, key)
+	require.NoError(t, err)
+	_, err = store.Get(ctx, key)
+	require.ErrorIs(t, err, ErrNotFound)
+	keys, err = store.List(ctx, "0xalice/")
+	require.NoError(t, err)
+	require.Len(t, keys, 0)
+}
+
+func TestLocalStore(t *testing.T) {
+	testStore(t, &LocalStore{Root: t.TempDir()})
+}
+
+func TestS3Store(t *testing.T) {
+	fake, addr := storagetesting.StartFakeS3(t, "segments")
+	store, err := MakeS3Store(context.Background(), &S3StoreOptions{
+		Endpoint:        addr,
+		Bucket:          "segments",
+		Prefix:          "aquareum",
+		Region:          "us-east-1",
+		AccessKeyID:     "minioadmin",
+		SecretAccessKey: "minioadmin",
+	})
+	require.NoError(t, err)
+	testStore(t, store)
+	require.Equal(t, []string{"aquareum/0xbob/2024/09/13/18/10/2024-09-13T18-10-17-090Z.mp4"}, fake.Keys())
+}
+
+func TestSegmentFileKey(t *testing.T) {
+	key, aqt, err := SegmentFileKey("0xalice", "2024-09-13T18-10-17-090Z.mp4")
+	require.NoError(t, err)
+	require.Equal(t, aqtime.FromMillis(1726251017090), aqt)
+	require.Equal(t, "0xalice/2024/09/13/18/10/2024-09-13T18-10-17-090Z.mp4", key)
+	_, _, err = SegmentFileKey("0xalice", "2024-09-13T18-10-17-090Z.ts")
+	require.Error(t, err)
+}
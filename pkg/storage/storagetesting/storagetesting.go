@@ -0,0 +1,163 @@
+package storagetesting
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// in-memory stand-in for an S3-compatible server like MinIO. only supports
+// the handful of path-style calls that storage.S3Store makes.
+type FakeS3 struct {
+	Bucket  string
+	objects map[string][]byte
+	mu      sync.Mutex
+}
+
+// start a FakeS3 server for the duration of the test, returning its address
+func StartFakeS3(t *testing.T, bucket string) (*FakeS3, string) {
+	fake := &FakeS3{Bucket: bucket, objects: map[string][]byte{}}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, server.URL
+}
+
+// names of all stored objects, sorted
+func (f *FakeS3) Keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := []string{}
+	for k := range f.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type listBucketResult struct {
+	XMLName     xml.Name       `xml:"ListBucketResult"`
+	Name        string         `xml:"Name"`
+	Prefix      string         `xml:"Prefix"`
+	KeyCount    int            `xml:"KeyCount"`
+	MaxKeys     int            `xml:"MaxKeys"`
+	IsTruncated bool           `xml:"IsTruncated"`
+	Contents    []listContents `xml:"Contents"`
+}
+
+type listContents struct {
+	Key          string    `xml:"Key"`
+	Size         int64     `xml:"Size"`
+	LastModified time.Time `xml:"LastModified"`
+	ETag         string    `xml:"ETag"`
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func etag(bs []byte) string {
+	sum := md5.Sum(bs)
+	return fmt.Sprintf(`"%s"`, hex.EncodeToString(sum[:]))
+}
+
+// undo the aws-chunked encoding used for streaming signatures on plain http
+func decodeChunked(r io.Reader) ([]byte, error) {
+	br := bufio.NewReader(r)
+	out := bytes.Buffer{}
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		sizeStr, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(sizeStr, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return out.Bytes(), nil
+		}
+		_, err = io.CopyN(&out, br, size)
+		if err != nil {
+			return nil, err
+		}
+		_, err = br.Discard(2)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (f *FakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != f.Bucket {
+		writeError(w, 404, "NoSuchBucket")
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if key == "" {
+		if r.URL.Query().Has("location") {
+			w.Header().Set("Content-Type", "application/xml")
+			fmt.Fprintf(w, `<LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/"></LocationConstraint>`)
+			return
+		}
+		prefix := r.URL.Query().Get("prefix")
+		res := listBucketResult{Name: f.Bucket, Prefix: prefix, MaxKeys: 1000}
+		for k, v := range f.objects {
+			if strings.HasPrefix(k, prefix) {
+				res.Contents = append(res.Contents, listContents{Key: k, Size: int64(len(v)), LastModified: time.Now().UTC(), ETag: etag(v)})
+			}
+		}
+		sort.Slice(res.Contents, func(i, j int) bool { return res.Contents[i].Key < res.Contents[j].Key })
+		res.KeyCount = len(res.Contents)
+		w.Header().Set("Content-Type", "application/xml")
+		xml.NewEncoder(w).Encode(res)
+		return
+	}
+	switch r.Method {
+	case "PUT":
+		var bs []byte
+		var err error
+		if strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+			bs, err = decodeChunked(r.Body)
+		} else {
+			bs, err = io.ReadAll(r.Body)
+		}
+		if err != nil {
+			writeError(w, 400, "IncompleteBody")
+			return
+		}
+		f.objects[key] = bs
+		w.Header().Set("ETag", etag(bs))
+		w.WriteHeader(200)
+	case "GET", "HEAD":
+		bs, ok := f.objects[key]
+		if !ok {
+			writeError(w, 404, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", etag(bs))
+		w.Header().Set("Content-Type", "video/mp4")
+		http.ServeContent(w, r, key, time.Now(), bytes.NewReader(bs))
+	case "DELETE":
+		delete(f.objects, key)
+		w.WriteHeader(204)
+	default:
+		writeError(w, 405, "MethodNotAllowed")
+	}
+}